@@ -0,0 +1,164 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bf
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/venicegeo/geojson-go/geojson"
+	"github.com/venicegeo/pzsvc-lib"
+)
+
+// Algorithm describes a shoreline detection service that bf-handle knows
+// how to drive through pzsvc-exec.  Each one is registered under the
+// algoType string that clients use to ask for it.
+type Algorithm interface {
+	// Bands lists the image bands the algorithm expects, in the order
+	// it expects them.  It is used when the request does not name any.
+	Bands() []string
+	// Command builds the command line to run, given the local names
+	// of the input images and the properties to attach to the output.
+	Command(imgNames []string, attMap map[string]string) string
+	// Outputs lists the geojson files the command produces.  The first
+	// of these is taken as the shoreline result.
+	Outputs() []string
+	// FeatureMeta reports whether the algorithm attaches the metadata
+	// to each output feature itself, rather than needing us to do it.
+	FeatureMeta() bool
+}
+
+// localAlgorithm is an Algorithm that runs inside bf-handle rather than
+// through pzsvc-exec.  Its Command is never used.
+type localAlgorithm interface {
+	Algorithm
+	// detect finds the shorelines in the given images, which come in
+	// the same order as Bands.
+	detect(images []*geoRaster, params map[string]string) (*geojson.FeatureCollection, error)
+}
+
+type algoDesc struct {
+	AlgoType    string   `json:"algoType"`
+	Bands       []string `json:"bands"`
+	Outputs     []string `json:"outputs"`
+	FeatureMeta bool     `json:"featureMeta"`
+	Local       bool     `json:"local"`
+}
+
+var algoMapSem sync.RWMutex
+var algoMap = make(map[string]Algorithm)
+
+func init() {
+	RegisterAlgorithm("pzsvc-ossim", ossimAlgo{})
+	RegisterAlgorithm("ndwi", ndwiAlgo{})
+}
+
+// RegisterAlgorithm makes the given algorithm available under the given
+// algoType.  Registering a second algorithm under the same name replaces
+// the first.
+func RegisterAlgorithm(algoType string, algo Algorithm) {
+	algoMapSem.Lock()
+	algoMap[algoType] = algo
+	algoMapSem.Unlock()
+}
+
+func getAlgorithm(algoType string) (Algorithm, error) {
+	algoMapSem.RLock()
+	algo, ok := algoMap[algoType]
+	algoMapSem.RUnlock()
+	if !ok {
+		return nil, pzsvc.ErrWithTrace(`bf-handle error: algorithm type "` + algoType + `" not defined`)
+	}
+	return algo, nil
+}
+
+// algoBands works out which bands to hand the given algorithm.  If the
+// request named its own bands, they must be as many as the algorithm needs.
+func algoBands(algo Algorithm, reqBands []string) ([]string, error) {
+	if len(reqBands) == 0 {
+		return algo.Bands(), nil
+	}
+	if len(reqBands) != len(algo.Bands()) {
+		return nil, pzsvc.ErrWithTrace(fmt.Sprintf("Algorithm requires %d bands (%s).  Received %d.",
+			len(algo.Bands()), strings.Join(algo.Bands(), ","), len(reqBands)))
+	}
+	return reqBands, nil
+}
+
+// Algorithms responds with the list of registered algorithms and the
+// bands that each of them requires.
+func Algorithms(w http.ResponseWriter, r *http.Request) {
+	var outpObj struct {
+		Algorithms []algoDesc `json:"algorithms"`
+	}
+	outpObj.Algorithms = make([]algoDesc, 0)
+
+	algoMapSem.RLock()
+	for algoType, algo := range algoMap {
+		_, local := algo.(localAlgorithm)
+		outpObj.Algorithms = append(outpObj.Algorithms, algoDesc{
+			AlgoType:    algoType,
+			Bands:       algo.Bands(),
+			Outputs:     algo.Outputs(),
+			FeatureMeta: algo.FeatureMeta(),
+			Local:       local})
+	}
+	algoMapSem.RUnlock()
+	sort.Sort(byAlgoType(outpObj.Algorithms))
+
+	b, err := json.Marshal(outpObj)
+	if err != nil {
+		pzsvc.HTTPOut(w, `{"error":"Marshalling error: `+jsonEscString(err.Error())+`."}`, http.StatusInternalServerError)
+		return
+	}
+	pzsvc.HTTPOut(w, string(b), http.StatusOK)
+}
+
+type byAlgoType []algoDesc
+
+func (a byAlgoType) Len() int           { return len(a) }
+func (a byAlgoType) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byAlgoType) Less(i, j int) bool { return a[i].AlgoType < a[j].AlgoType }
+
+// ossimAlgo runs the "shoreline" command of pzsvc-ossim.
+type ossimAlgo struct{}
+
+func (ossimAlgo) Bands() []string {
+	return []string{"coastal", "swir1"}
+}
+
+func (ossimAlgo) Command(imgNames []string, attMap map[string]string) string {
+	funcStr := `shoreline --image ` + strings.Join(imgNames, ",") + ` --projection geo-scaled `
+	for key, val := range attMap {
+		fmt.Println("adding props to shoreline call: key: " + key + "value: " + val)
+		funcStr = funcStr + fmt.Sprintf(`--prop %s:%s `, key, val)
+	}
+	return funcStr + `shoreline.geojson`
+}
+
+func (ossimAlgo) Outputs() []string {
+	return []string{`shoreline.geojson`}
+}
+
+// the version of OSSIM we are currently capable of using does not have feature-level
+// metadata.  Until/unless that's fixed, we need to treat it the same way we do
+// everyone else.
+func (ossimAlgo) FeatureMeta() bool {
+	return false
+}
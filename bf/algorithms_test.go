@@ -0,0 +1,58 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bf
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/venicegeo/pzsvc-lib"
+)
+
+func TestAlgorithms(t *testing.T) {
+	w, outStr, outInt := pzsvc.GetMockResponseWriter()
+	r := http.Request{}
+	r.Method = "GET"
+	Algorithms(w, &r)
+	if *outInt != http.StatusOK {
+		t.Error(`TestAlgorithms: failed on what should have been a good run.  Error: ` + *outStr)
+	}
+	if !strings.Contains(*outStr, `"algoType":"pzsvc-ossim"`) {
+		t.Error(`TestAlgorithms: pzsvc-ossim missing from output: ` + *outStr)
+	}
+}
+
+func TestGetAlgorithm(t *testing.T) {
+	if _, err := getAlgorithm("not-an-algorithm"); err == nil {
+		t.Error(`TestGetAlgorithm: passed on what should have been an unknown algorithm.`)
+	}
+	algo, err := getAlgorithm("pzsvc-ossim")
+	if err != nil {
+		t.Error(`TestGetAlgorithm: failed to find pzsvc-ossim: ` + err.Error())
+		return
+	}
+	if _, err = algoBands(algo, []string{"coastal"}); err == nil {
+		t.Error(`TestGetAlgorithm: passed on what should have been a band count failure.`)
+	}
+	bands, err := algoBands(algo, nil)
+	if err != nil || len(bands) != 2 {
+		t.Error(`TestGetAlgorithm: did not fall back on default bands.`)
+	}
+	cmd := algo.Command([]string{"img1.TIF", "img2.TIF"}, map[string]string{"sensorName": "landsat"})
+	if !strings.HasPrefix(cmd, "shoreline --image img1.TIF,img2.TIF") || !strings.Contains(cmd, "--prop sensorName:landsat") {
+		t.Error(`TestGetAlgorithm: unexpected ossim command: ` + cmd)
+	}
+}
@@ -0,0 +1,362 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bf
+
+import (
+	"fmt"
+	"log"
+	"math"
+
+	"github.com/paulsmith/gogeos/geos"
+	"github.com/venicegeo/geojson-geos-go/geojsongeos"
+	"github.com/venicegeo/geojson-go/geojson"
+	"github.com/venicegeo/pzsvc-lib"
+)
+
+/*
+GEOS knows nothing of the antimeridian.  A polygon that crosses it, written
+with longitudes that jump from 179 to -179, looks to GEOS like a band around
+nearly the whole world, and the two halves of a polygon split at ±180 look
+like two things on opposite sides of the map.  So, geometry is worked on in
+a lonFrame: a 360 degree range of longitudes that is chosen to keep the
+baseline in one piece.  This is -180 to 180 almost everywhere, and 0 to 360
+in the Pacific.  Each part of each geometry is unwrapped on the way in, so
+that its longitudes run continuously, and everything is split back up at
+±180 on the way out, as RFC 7946 asks.
+
+Baselines that span more than 180 degrees of longitude, or that cross both
+the antimeridian and the prime meridian, are not handled.
+*/
+
+// lonFrame is the range of longitudes [west, west+360) that geometry is
+// worked on in.
+type lonFrame float64
+
+const (
+	standardFrame lonFrame = -180
+	pacificFrame  lonFrame = 0
+)
+
+// wrap returns the equivalent of the given longitude within the frame.
+func (frame lonFrame) wrap(lon float64) float64 {
+	return lon - 360*math.Floor((lon-float64(frame))/360)
+}
+
+// nearLon returns the equivalent of the given longitude that is closest to
+// the reference longitude.
+func nearLon(lon, ref float64) float64 {
+	return lon + 360*math.Floor((ref-lon)/360+0.5)
+}
+
+// frameFor returns the frame in which the given GeoJSON is most compact.
+func frameFor(input interface{}) lonFrame {
+	var lons []float64
+	eachLon(input, func(lon float64) { lons = append(lons, lon) })
+	if len(lons) == 0 || lonWidth(lons, pacificFrame) >= lonWidth(lons, standardFrame) {
+		return standardFrame
+	}
+	return pacificFrame
+}
+
+func lonWidth(lons []float64, frame lonFrame) float64 {
+	minLon, maxLon := math.Inf(1), math.Inf(-1)
+	for _, lon := range lons {
+		lon = frame.wrap(lon)
+		minLon = math.Min(minLon, lon)
+		maxLon = math.Max(maxLon, lon)
+	}
+	return maxLon - minLon
+}
+
+// eachLon calls the given function with every longitude in the given
+// GeoJSON.
+func eachLon(input interface{}, fn func(float64)) {
+	line := func(coords [][]float64) {
+		for _, coord := range coords {
+			if len(coord) >= 2 {
+				fn(coord[0])
+			}
+		}
+	}
+	switch it := input.(type) {
+	case map[string]interface{}:
+		eachLon(geojson.FromMap(it), fn)
+	case *geojson.FeatureCollection:
+		for _, feature := range it.Features {
+			eachLon(feature, fn)
+		}
+	case *geojson.Feature:
+		eachLon(it.Geometry, fn)
+	case *geojson.GeometryCollection:
+		for _, geometry := range it.Geometries {
+			eachLon(geometry, fn)
+		}
+	case *geojson.Point:
+		line([][]float64{it.Coordinates})
+	case *geojson.LineString:
+		line(it.Coordinates)
+	case *geojson.MultiPoint:
+		line(it.Coordinates)
+	case *geojson.Polygon:
+		for _, ring := range it.Coordinates {
+			line(ring)
+		}
+	case *geojson.MultiLineString:
+		for _, part := range it.Coordinates {
+			line(part)
+		}
+	case *geojson.MultiPolygon:
+		for _, polygon := range it.Coordinates {
+			for _, ring := range polygon {
+				line(ring)
+			}
+		}
+	}
+}
+
+// normalize returns a copy of the given GeoJSON with each part unwrapped
+// and placed within the frame.
+func (frame lonFrame) normalize(input interface{}) (interface{}, error) {
+	return normalizeGeoJSON(input, frame.wrap)
+}
+
+// normalizeNear returns a copy of the given GeoJSON with each part
+// unwrapped and placed as close as it can be to the reference longitude.
+func normalizeNear(input interface{}, ref float64) (interface{}, error) {
+	return normalizeGeoJSON(input, func(lon float64) float64 { return nearLon(lon, ref) })
+}
+
+// normalizeGeoJSON returns a copy of the given GeoJSON in which the
+// longitudes of each line, ring and point run continuously, without
+// jumps across the antimeridian.  The anchor decides where the first
+// longitude of each part goes, and the rest of the part follows it.
+func normalizeGeoJSON(input interface{}, anchor func(float64) float64) (interface{}, error) {
+	line := func(coords [][]float64, prev float64) [][]float64 {
+		result := make([][]float64, len(coords))
+		for inx, coord := range coords {
+			result[inx] = append([]float64(nil), coord...)
+			if len(coord) >= 2 {
+				result[inx][0] = nearLon(coord[0], prev)
+				prev = result[inx][0]
+			}
+		}
+		return result
+	}
+	firstLon := func(coords [][]float64) float64 {
+		if len(coords) == 0 || len(coords[0]) < 2 {
+			return 0
+		}
+		return anchor(coords[0][0])
+	}
+	polygon := func(coords [][][]float64) [][][]float64 {
+		result := make([][][]float64, len(coords))
+		if len(coords) == 0 {
+			return result
+		}
+		ref := firstLon(coords[0])
+		for inx, ring := range coords {
+			result[inx] = line(ring, ref)
+		}
+		return result
+	}
+	points := func(coords [][]float64) [][]float64 {
+		result := make([][]float64, len(coords))
+		for inx, coord := range coords {
+			result[inx] = line([][]float64{coord}, firstLon([][]float64{coord}))[0]
+		}
+		return result
+	}
+
+	switch it := input.(type) {
+	case map[string]interface{}:
+		return normalizeGeoJSON(geojson.FromMap(it), anchor)
+	case *geojson.FeatureCollection:
+		result := geojson.NewFeatureCollection(nil)
+		for _, feature := range it.Features {
+			normalized, err := normalizeGeoJSON(feature, anchor)
+			if err != nil {
+				return nil, err
+			}
+			result.Features = append(result.Features, normalized.(*geojson.Feature))
+		}
+		return result, nil
+	case *geojson.Feature:
+		result := *it
+		result.Bbox = nil
+		if it.Geometry != nil {
+			var err error
+			if result.Geometry, err = normalizeGeoJSON(it.Geometry, anchor); err != nil {
+				return nil, err
+			}
+		}
+		return &result, nil
+	case *geojson.GeometryCollection:
+		geometries := make([]interface{}, len(it.Geometries))
+		for inx, geometry := range it.Geometries {
+			var err error
+			if geometries[inx], err = normalizeGeoJSON(geometry, anchor); err != nil {
+				return nil, err
+			}
+		}
+		return geojson.NewGeometryCollection(geometries), nil
+	case *geojson.Point:
+		return geojson.NewPoint(points([][]float64{it.Coordinates})[0]), nil
+	case *geojson.MultiPoint:
+		return geojson.NewMultiPoint(points(it.Coordinates)), nil
+	case *geojson.LineString:
+		return geojson.NewLineString(line(it.Coordinates, firstLon(it.Coordinates))), nil
+	case *geojson.MultiLineString:
+		coords := make([][][]float64, len(it.Coordinates))
+		for inx, part := range it.Coordinates {
+			coords[inx] = line(part, firstLon(part))
+		}
+		return geojson.NewMultiLineString(coords), nil
+	case *geojson.Polygon:
+		return geojson.NewPolygon(polygon(it.Coordinates)), nil
+	case *geojson.MultiPolygon:
+		coords := make([][][][]float64, len(it.Coordinates))
+		for inx, part := range it.Coordinates {
+			coords[inx] = polygon(part)
+		}
+		return geojson.NewMultiPolygon(coords), nil
+	}
+	return nil, pzsvc.ErrWithTrace(fmt.Sprintf("Cannot normalize longitudes of %T.", input))
+}
+
+// splitGeoJSON splits the given GeoJSON geometry at ±180, and moves each
+// piece to within -180 to 180.  Geometries that are already within that
+// range are returned as they are.
+func splitGeoJSON(input interface{}) (interface{}, error) {
+	var (
+		err error
+		geometry,
+		box,
+		piece *geos.Geometry
+		empty   bool
+		gjPiece interface{}
+		pieces  []interface{}
+	)
+	minLon, maxLon := math.Inf(1), math.Inf(-1)
+	eachLon(input, func(lon float64) {
+		minLon = math.Min(minLon, lon)
+		maxLon = math.Max(maxLon, lon)
+	})
+	if minLon >= -180 && maxLon <= 180 {
+		return input, nil
+	}
+	if geometry, err = geojsongeos.GeosFromGeoJSON(input); err != nil {
+		return nil, pzsvc.TraceErr(err)
+	}
+	for west := 360*math.Floor((minLon+180)/360) - 180; west < maxLon; west += 360 {
+		shift := -180 - west
+		if box, err = geos.NewPolygon([]geos.Coord{
+			geos.NewCoord(west, -90), geos.NewCoord(west+360, -90), geos.NewCoord(west+360, 90),
+			geos.NewCoord(west, 90), geos.NewCoord(west, -90)}); err != nil {
+			return nil, pzsvc.TraceErr(err)
+		}
+		if piece, err = geometry.Intersection(box); err != nil {
+			return nil, pzsvc.TraceErr(err)
+		}
+		if empty, err = piece.IsEmpty(); err != nil {
+			return nil, pzsvc.TraceErr(err)
+		} else if empty {
+			continue
+		}
+		if gjPiece, err = geojsongeos.GeoJSONFromGeos(piece); err != nil {
+			return nil, pzsvc.TraceErr(err)
+		}
+		if gjPiece, err = transformGeoJSON(gjPiece, func(x, y float64) (float64, float64) { return x + shift, y }); err != nil {
+			return nil, err
+		}
+		pieces = append(pieces, gjPiece)
+	}
+	return mergeGeoJSON(pieces), nil
+}
+
+// mergeGeoJSON combines the given GeoJSON geometries into a single one,
+// as a multi-geometry where they are all of a kind, or as a collection.
+func mergeGeoJSON(parts []interface{}) interface{} {
+	var (
+		polygons [][][][]float64
+		lines    [][][]float64
+		points   [][]float64
+		others   []interface{}
+		flatten  func(part interface{})
+	)
+	flatten = func(part interface{}) {
+		switch it := part.(type) {
+		case *geojson.Polygon:
+			polygons = append(polygons, it.Coordinates)
+		case *geojson.MultiPolygon:
+			polygons = append(polygons, it.Coordinates...)
+		case *geojson.LineString:
+			lines = append(lines, it.Coordinates)
+		case *geojson.MultiLineString:
+			lines = append(lines, it.Coordinates...)
+		case *geojson.Point:
+			points = append(points, it.Coordinates)
+		case *geojson.MultiPoint:
+			points = append(points, it.Coordinates...)
+		case *geojson.GeometryCollection:
+			for _, geometry := range it.Geometries {
+				flatten(geometry)
+			}
+		default:
+			others = append(others, part)
+		}
+	}
+	for _, part := range parts {
+		flatten(part)
+	}
+	switch {
+	case len(others) == 0 && len(lines) == 0 && len(points) == 0 && len(polygons) == 1:
+		return geojson.NewPolygon(polygons[0])
+	case len(others) == 0 && len(lines) == 0 && len(points) == 0:
+		return geojson.NewMultiPolygon(polygons)
+	case len(others) == 0 && len(polygons) == 0 && len(points) == 0 && len(lines) == 1:
+		return geojson.NewLineString(lines[0])
+	case len(others) == 0 && len(polygons) == 0 && len(points) == 0:
+		return geojson.NewMultiLineString(lines)
+	case len(others) == 0 && len(polygons) == 0 && len(lines) == 0 && len(points) == 1:
+		return geojson.NewPoint(points[0])
+	case len(others) == 0 && len(polygons) == 0 && len(lines) == 0:
+		return geojson.NewMultiPoint(points)
+	}
+	if len(polygons) > 0 {
+		others = append(others, geojson.NewMultiPolygon(polygons))
+	}
+	if len(lines) > 0 {
+		others = append(others, geojson.NewMultiLineString(lines))
+	}
+	if len(points) > 0 {
+		others = append(others, geojson.NewMultiPoint(points))
+	}
+	return geojson.NewGeometryCollection(others)
+}
+
+// splitFeatures splits the geometry of each of the given features at ±180.
+func splitFeatures(features []*geojson.Feature) {
+	for _, feature := range features {
+		if feature.Geometry == nil {
+			continue
+		}
+		if geometry, err := splitGeoJSON(feature.Geometry); err == nil {
+			feature.Geometry = geometry
+			feature.Bbox = nil
+		} else {
+			log.Printf("Failed to split %v at the antimeridian: %v", feature.ID, err.Error())
+		}
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bf
+
+import (
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/venicegeo/geojson-go/geojson"
+)
+
+func TestLonFrame(t *testing.T) {
+	if lon := pacificFrame.wrap(-179); lon != 181 {
+		t.Errorf(`TestLonFrame: expected -179 to wrap to 181, got %v`, lon)
+	}
+	if lon := standardFrame.wrap(540); lon != -180 {
+		t.Errorf(`TestLonFrame: expected 540 to wrap to -180, got %v`, lon)
+	}
+	if lon := nearLon(-179, 170); lon != 181 {
+		t.Errorf(`TestLonFrame: expected -179 near 170 to be 181, got %v`, lon)
+	}
+	if utmZoneOf(181) != 1 || utmZoneOf(-181) != 60 {
+		t.Errorf(`TestLonFrame: bad zones %d, %d for 181, -181`, utmZoneOf(181), utmZoneOf(-181))
+	}
+	e1, n1 := latLonToUTM(-17, 181, 1, false)
+	e2, n2 := latLonToUTM(-17, -179, 1, false)
+	if math.Abs(e1-e2) > 1e-6 || math.Abs(n1-n2) > 1e-6 {
+		t.Errorf(`TestLonFrame: 181 and -179 projected differently.`)
+	}
+}
+
+func TestNormalizeGeoJSON(t *testing.T) {
+	// Fiji, written the way that wraps around the world
+	fiji := geojson.NewFeature(geojson.NewPolygon([][][]float64{{{179, -17}, {-179, -17}, {-179, -16}, {179, -16}, {179, -17}}}), "fiji", nil)
+	if frame := frameFor(fiji); frame != pacificFrame {
+		t.Errorf(`TestNormalizeGeoJSON: expected the Pacific frame for Fiji, got %v`, frame)
+	}
+	if frame := frameFor(geojson.NewPoint([]float64{-75, 35})); frame != standardFrame {
+		t.Errorf(`TestNormalizeGeoJSON: expected the standard frame for North Carolina, got %v`, frame)
+	}
+	normalized, err := pacificFrame.normalize(fiji)
+	if err != nil {
+		t.Fatal(`TestNormalizeGeoJSON: ` + err.Error())
+	}
+	expected := [][][]float64{{{179, -17}, {181, -17}, {181, -16}, {179, -16}, {179, -17}}}
+	if coords := normalized.(*geojson.Feature).Geometry.(*geojson.Polygon).Coordinates; !reflect.DeepEqual(coords, expected) {
+		t.Errorf(`TestNormalizeGeoJSON: expected %v, got %v`, expected, coords)
+	}
+	if fiji.Geometry.(*geojson.Polygon).Coordinates[0][1][0] != -179 {
+		t.Error(`TestNormalizeGeoJSON: the input was modified.`)
+	}
+
+	// The same thing, split as RFC 7946 would have it, comes back together
+	split := geojson.NewMultiPolygon([][][][]float64{
+		{{{179, -17}, {180, -17}, {180, -16}, {179, -16}, {179, -17}}},
+		{{{-180, -17}, {-179, -17}, {-179, -16}, {-180, -16}, {-180, -17}}}})
+	normalized, _ = normalizeGeoJSON(split, pacificFrame.wrap)
+	if west := normalized.(*geojson.MultiPolygon).Coordinates[1][0][0][0]; west != 180 {
+		t.Errorf(`TestNormalizeGeoJSON: expected the western half to start at 180, got %v`, west)
+	}
+
+	// Geometry that is already within -180 to 180 is not split
+	if unsplit, err := splitGeoJSON(split); err != nil || unsplit != interface{}(split) {
+		t.Errorf(`TestNormalizeGeoJSON: split geometry was changed: %v`, err)
+	}
+}
+
+func TestMergeGeoJSON(t *testing.T) {
+	a := geojson.NewPolygon([][][]float64{{{0, 0}, {1, 0}, {1, 1}, {0, 0}}})
+	b := geojson.NewMultiPolygon([][][][]float64{{{{2, 0}, {3, 0}, {3, 1}, {2, 0}}}})
+	if merged, ok := mergeGeoJSON([]interface{}{a, b}).(*geojson.MultiPolygon); !ok || len(merged.Coordinates) != 2 {
+		t.Errorf(`TestMergeGeoJSON: expected a MultiPolygon of 2, got %#v`, merged)
+	}
+	if merged, ok := mergeGeoJSON([]interface{}{a}).(*geojson.Polygon); !ok || !reflect.DeepEqual(merged.Coordinates, a.Coordinates) {
+		t.Errorf(`TestMergeGeoJSON: expected a Polygon, got %#v`, merged)
+	}
+	line := geojson.NewLineString([][]float64{{0, 0}, {1, 1}})
+	if merged, ok := mergeGeoJSON([]interface{}{line, line}).(*geojson.MultiLineString); !ok || len(merged.Coordinates) != 2 {
+		t.Errorf(`TestMergeGeoJSON: expected a MultiLineString of 2, got %#v`, merged)
+	}
+	if merged, ok := mergeGeoJSON([]interface{}{a, line}).(*geojson.GeometryCollection); !ok || len(merged.Geometries) != 2 {
+		t.Errorf(`TestMergeGeoJSON: expected a GeometryCollection of 2, got %#v`, merged)
+	}
+}
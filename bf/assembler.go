@@ -15,37 +15,48 @@
 package bf
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
 	"runtime/debug"
+	"sync"
 
 	"github.com/paulsmith/gogeos/geos"
 	"github.com/venicegeo/geojson-geos-go/geojsongeos"
 	"github.com/venicegeo/geojson-go/geojson"
-	"github.com/venicegeo/pzsvc-image-catalog/catalog"
 	"github.com/venicegeo/pzsvc-lib"
 )
 
 type asInpStruct struct {
-	AlgoType string `json:"algoType"` // API for the shoreline algorithm
-	AlgoURL  string `json:"svcURL"`   // URL for the shoreline algorithm
-	// BndMrgType string           `json:"bandMergeType,omitempty"` // API for the bandmerge/rgb algorithm (optional)
-	// BndMrgURL  string           `json:"bandMergeURL,omitempty"`  // URL for the bandmerge/rgb algorithm (optional)
-	Bands            []string                   `json:"bands"`                 // names of bands to feed into the shoreline algorithm
-	PzAuth           string                     `json:"pzAuthToken,omitempty"` // Auth string for this Pz instance
-	PzAddr           string                     `json:"pzAddr"`                // gateway URL for this Pz instance
-	DbAuth           string                     `json:"dbAuthToken,omitempty"` // Auth string for the initial image database
-	LGroupID         string                     `json:"lGroupId"`              // UUID string for the target geoserver layer group
-	JobName          string                     `json:"resultName"`            // Arbitrary user-defined string to aid in later reference
-	TidesAddr        string                     `json:"tidesAddr"`             // URL for Tide Prediction Service (optional)
-	Collections      *geojson.FeatureCollection `json:"collections"`           // Collection objects
-	Baseline         map[string]interface{}     `json:"baseline"`              // Baseline shoreline, as GeoJSON
-	FootprintsDataID string                     `json:"footprintsDataID"`      // Piazza ID of GeoJSON containing footprints
-	SkipDetection    bool                       `json:"skipDetection"`         // true: skip detection; go straight to assembly
-	ForceDetection   bool                       `json:"forceDetection"`        // true: ignore cache
+	AlgoType         string                     `json:"algoType"`                  // API for the shoreline algorithm
+	AlgoURL          string                     `json:"svcURL"`                    // URL for the shoreline algorithm
+	BndMrgType       string                     `json:"bandMergeType,omitempty"`   // API for the bandmerge/rgb algorithm (optional)
+	BndMrgURL        string                     `json:"bandMergeURL,omitempty"`    // URL for the bandmerge/rgb algorithm (optional)
+	Bands            []string                   `json:"bands"`                     // names of bands to feed into the shoreline algorithm
+	PzAuth           string                     `json:"pzAuthToken,omitempty"`     // Auth string for this Pz instance
+	PzAddr           string                     `json:"pzAddr"`                    // gateway URL for this Pz instance
+	DbAuth           string                     `json:"dbAuthToken,omitempty"`     // Auth string for the initial image database
+	LGroupID         string                     `json:"lGroupId"`                  // UUID string for the target geoserver layer group
+	JobName          string                     `json:"resultName"`                // Arbitrary user-defined string to aid in later reference
+	TidesAddr        string                     `json:"tidesAddr"`                 // URL for Tide Prediction Service (optional)
+	Collections      *geojson.FeatureCollection `json:"collections"`               // Collection objects
+	Baseline         map[string]interface{}     `json:"baseline"`                  // Baseline shoreline, as GeoJSON
+	FootprintsDataID string                     `json:"footprintsDataID"`          // Piazza ID of GeoJSON containing footprints
+	SkipDetection    bool                       `json:"skipDetection"`             // true: skip detection; go straight to assembly
+	ForceDetection   bool                       `json:"forceDetection"`            // true: ignore cache
+	AlgoParams       map[string]string          `json:"algoParams,omitempty"`      // Tuning parameters for in-process algorithms (optional)
+	Workers          int                        `json:"workers,omitempty"`         // Number of scenes to detect at once (optional)
+	Scoring          *scoringPolicy             `json:"scoring,omitempty"`         // How to rank candidate scenes (optional)
+	Selection        string                     `json:"selection,omitempty"`       // How to choose footprints: "cover" or "greedy" (optional)
+	BufferMeters     float64                    `json:"bufferMeters,omitempty"`    // How far the footprint region extends beyond the baseline (optional)
+	Stitch           bool                       `json:"stitch,omitempty"`          // true: join shorelines across footprint boundaries
+	StitchTolerance  float64                    `json:"stitchTolerance,omitempty"` // How close line ends must be to be joined, in meters (optional)
+	QA               bool                       `json:"qa,omitempty"`              // true: measure each shoreline against the baseline
+	QATolerance      float64                    `json:"qaTolerance,omitempty"`     // How close a shoreline must be to recover the baseline, in meters (optional)
 }
 
 // type ebOutStruct struct {
@@ -56,13 +67,13 @@ type asInpStruct struct {
 // }
 
 // AssembleShorelines creates a single dataset from some input or something
-func AssembleShorelines(w http.ResponseWriter, r *http.Request) {
+func AssembleShorelines(w http.ResponseWriter, r *http.Request, gw Gateway) {
 	var (
-		b          []byte
-		err        error
-		inpObj     asInpStruct
-		outpObj    gsOutpStruct
-		shorelines *geojson.FeatureCollection
+		b       []byte
+		err     error
+		inpObj  asInpStruct
+		outpObj gsOutpStruct
+		spool   *featureSpool
 	)
 
 	// clients to this function expect a JSON response
@@ -81,21 +92,20 @@ func AssembleShorelines(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if shorelines, err = assembleShorelines(inpObj); err != nil {
+	if spool, err = assembleShorelines(inpObj, gw); err != nil {
 		handleError(err.Error(), http.StatusBadRequest)
-	} else {
-		if b, err = geojson.Write(shorelines); err != nil {
-			errStr := pzsvc.TraceStr("Failed to write output GeoJSON object: " + err.Error())
-			handleError(errStr, http.StatusInternalServerError)
-			return
-		}
-		w.Write(b)
+		return
+	}
+	defer spool.close()
+	// Once the output has started there is no way left to report an error
+	if err = spool.writeTo(w); err != nil {
+		log.Print(pzsvc.TraceStr("Failed to write output GeoJSON object: " + err.Error()))
 	}
 }
 
 // ExecuteBatch executes a single shoreline detection
 // based on a GeoJSON object representing one or more geometries
-func ExecuteBatch(w http.ResponseWriter, r *http.Request) {
+func ExecuteBatch(w http.ResponseWriter, r *http.Request, gw Gateway) {
 	var (
 		b                []byte
 		err              error
@@ -103,6 +113,8 @@ func ExecuteBatch(w http.ResponseWriter, r *http.Request) {
 		footprints       *geojson.FeatureCollection
 		footprintsDataID string
 		footprintsDepl   *pzsvc.DeplStrct
+		coverage         *coverageReport
+		job              *batchJob
 	)
 
 	// clients to this function expect a JSON response
@@ -128,6 +140,14 @@ func ExecuteBatch(w http.ResponseWriter, r *http.Request) {
 	if inpObj.DbAuth == "" {
 		inpObj.DbAuth = os.Getenv("BFH_DB_AUTH")
 	}
+	if _, err = stitchTolerance(&inpObj); err != nil {
+		handleError(err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, err = qaTolerance(inpObj.QATolerance); err != nil {
+		handleError(err.Error(), http.StatusBadRequest)
+		return
+	}
 
 	if inpObj.FootprintsDataID == "" {
 		if inpObj.Baseline == nil {
@@ -135,21 +155,29 @@ func ExecuteBatch(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		if footprints, err = crawlFootprints(inpObj.Baseline, &inpObj); err != nil {
+		if _, err = footprintSelection(&inpObj); err != nil {
+			handleError(err.Error(), http.StatusBadRequest)
+			return
+		}
+		if _, err = footprintBuffer(&inpObj); err != nil {
+			handleError(err.Error(), http.StatusBadRequest)
+			return
+		}
+		if footprints, coverage, err = crawlFootprints(inpObj.Baseline, &inpObj); err != nil {
 			handleError(pzsvc.TraceStr("Error: failed to crawl footprints: "+err.Error()), http.StatusInternalServerError)
 			return
 		}
 
 		// Ingest the footprints, store the Piazza ID
-		if footprintsDataID, b, err = ingestFootprints(footprints, inpObj); err == nil {
-			if footprintsDepl, err = pzsvc.DeployToGeoServer(footprintsDataID, "", inpObj.PzAddr, inpObj.PzAuth); err == nil {
+		if footprintsDataID, b, err = ingestFootprints(footprints, inpObj, gw); err == nil {
+			if footprintsDepl, err = gw.DeployToGeoServer(r.Context(), footprintsDataID, "", inpObj.PzAddr, inpObj.PzAuth); err == nil {
 				fmt.Printf("Deployed footprints go GeoServer. DeplID: %v", footprintsDepl.DeplID)
 			} else {
 				log.Printf(pzsvc.TraceStr("Failed to deploy footprint GeoJSON to GeoServer: " + err.Error()))
 			}
 		}
 	} else {
-		if b, err = pzsvc.DownloadBytes(inpObj.FootprintsDataID, inpObj.PzAddr, inpObj.PzAuth); err == nil {
+		if b, err = gw.DownloadBytes(r.Context(), inpObj.FootprintsDataID, inpObj.PzAddr, inpObj.PzAuth); err == nil {
 			if footprints, err = geojson.FeatureCollectionFromBytes(b); err != nil {
 				errStr := pzsvc.TraceStr("Error: Failed to build FeatureCollection from contents of ID " + inpObj.FootprintsDataID + ": " + err.Error())
 				handleError(errStr, http.StatusBadRequest)
@@ -159,7 +187,7 @@ func ExecuteBatch(w http.ResponseWriter, r *http.Request) {
 			// on previous collection operations so re-retrieve from the catalog
 			var newFootprint *geojson.Feature
 			for inx, footprint := range footprints.Features {
-				if newFootprint, err = catalog.GetSceneMetadata(footprint.IDStr()); err == nil {
+				if newFootprint, err = sceneCatalog.GetSceneMetadata(footprint.IDStr()); err == nil {
 					footprints.Features[inx] = newFootprint
 				} else {
 					log.Printf("Failed to retrieve image %v from catalog.", footprint.ID)
@@ -177,78 +205,66 @@ func ExecuteBatch(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	go detectShorelines(inpObj, footprints)
-	w.Write([]byte(fmt.Sprintf("Starting shoreline assembly. Footprints ID: %v", footprintsDataID)))
+	if job, err = newBatchJob(inpObj, footprints, footprintsDataID, coverage); err != nil {
+		handleError(pzsvc.TraceStr("Error: failed to create batch job: "+err.Error()), http.StatusInternalServerError)
+		return
+	}
+
+	go detectShorelines(job, inpObj, footprints, gw)
+	writeBatchStarted(w, job.snapshot())
 }
 
-func detectShorelines(inpObj asInpStruct, footprints *geojson.FeatureCollection) {
+// detectShorelines runs shoreline detection on each of the given footprints
+// that does not already have a result, assembles the results, and ingests
+// them.  Progress is recorded on the given batch job as it goes.
+func detectShorelines(job *batchJob, inpObj asInpStruct, footprints *geojson.FeatureCollection, gw Gateway) {
 	var (
 		shoreDataID   string
 		shoreDeplID   string
-		gen           *geojson.Feature
 		err           error
-		shorelines    *geojson.FeatureCollection
+		spool         *featureSpool
 		shoreDepl     *pzsvc.DeplStrct
-		gsInpObj      gsInpStruct
 		eventType     pzsvc.EventType
 		eventResponse pzsvc.EventResponse
-		b             []byte
 		ingestError   string
 	)
+	defer job.lease.release()
+	results := detectFootprints(job, inpObj, footprints, gw)
+	if inpObj.QA {
+		fmt.Print("\nFinished shoreline generation. Measuring shorelines against the baseline.")
+		qaFootprints(job.lease.jobContext(), job, inpObj, results, gw)
+	}
 	inpObj.Collections = geojson.NewFeatureCollection(nil)
-
-	// Convert the asInpStruct to a gsInpStruct
-	b, _ = json.Marshal(inpObj)
-	json.Unmarshal(b, &gsInpObj)
-
-	for inx, footprint := range footprints.Features {
-		if shoreDataID = footprint.PropertyString("cache.shoreDataID"); inpObj.ForceDetection || shoreDataID == "" {
-			if !inpObj.SkipDetection {
-				fmt.Printf("Detecting scene %v (#%v of %v, score %v)\n", footprint.ID, inx+1, len(footprints.Features), sceneScore(footprint))
-
-				if gen, err = popShoreline(gsInpObj, footprint); err != nil {
-					log.Printf("Failed to detect scene %v: %v", footprint.ID, err.Error())
-					continue
-				}
-				inpObj.Collections.Features = append(inpObj.Collections.Features, gen)
-				shoreDataID = gen.PropertyString("shoreDataID")
-				shoreDeplID = gen.PropertyString("shoreDeplID")
-				fmt.Printf("Finished detecting feature %v. Data ID: %v", footprint.ID, shoreDataID)
-				go addCache(footprint.IDStr(), shoreDataID, shoreDeplID)
-				debug.FreeOSMemory()
-			}
-		} else {
-			fmt.Printf("Found Data ID %v for feature %v\n", shoreDataID, footprint.ID)
-			footprint.Properties["shoreDataID"] = shoreDataID
-			footprint.Properties["shoreDeplID"] = shoreDeplID
-			inpObj.Collections.Features = append(inpObj.Collections.Features, footprint)
+	for _, result := range results {
+		if result != nil {
+			inpObj.Collections.Features = append(inpObj.Collections.Features, result)
 		}
 	}
 
 	fmt.Print("\nFinished shoreline generation. Starting assembly.")
+	job.setStatus(batchAssembling)
 
-	if shorelines, err = assembleShorelines(inpObj); err != nil {
-		executeBatchFailed(err.Error(), inpObj)
+	if spool, err = assembleShorelines(inpObj, gw); err != nil {
+		job.fail(err.Error())
+		executeBatchFailed(err.Error(), inpObj, gw)
+		return
 	}
-
-	// Ingest the shorelines, store the Piazza ID in outpObj
-
-	// Working around annoying relational restrictions in Piazza
-	shorelines.FillProperties()
-
-	b, _ = geojson.Write(shorelines)
-	if shoreDataID, err = pzsvc.Ingest("shorelines.geojson", "geojson", inpObj.PzAddr, "bf-handle ExecuteBatch", "1.0", inpObj.PzAuth, b, nil); err == nil {
-		if shoreDepl, err = pzsvc.DeployToGeoServer(shoreDataID, "", inpObj.PzAddr, inpObj.PzAuth); err == nil {
+	defer spool.close()
+
+	// Ingest the shorelines, streaming them from the spool (which also
+	// works around annoying relational restrictions in Piazza)
+	reader := spool.reader()
+	shoreDataID, err = gw.IngestStream(context.Background(), "shorelines.geojson", "geojson", inpObj.PzAddr, "bf-handle ExecuteBatch", "1.0", inpObj.PzAuth, reader, nil)
+	reader.Close()
+	if err == nil {
+		if shoreDepl, err = gw.DeployToGeoServer(context.Background(), shoreDataID, "", inpObj.PzAddr, inpObj.PzAuth); err == nil {
 			shoreDeplID = shoreDepl.DeplID
 		} else {
 			ingestError = "Failed to deploy shorelines GeoJSON to GeoServer: " + err.Error()
 			log.Printf(pzsvc.TraceStr(ingestError))
 		}
 	} else {
-		ingestError = "Failed to ingest shorelines GeoJSON: " + err.Error()
-		for inx := 0; inx < 10 && inx < len(shorelines.Features); inx++ {
-			ingestError = ingestError + fmt.Sprintf("%#v", shorelines.Features[inx].Properties)
-		}
+		ingestError = fmt.Sprintf("Failed to ingest shorelines GeoJSON (%v features): %v", spool.count, err.Error())
 		log.Printf(pzsvc.TraceStr(ingestError))
 	}
 
@@ -260,14 +276,14 @@ func detectShorelines(inpObj asInpStruct, footprints *geojson.FeatureCollection)
 		etm["shoreDataID"] = "string"
 		etm["shoreDeplID"] = "string"
 
-		if eventType, err = pzsvc.GetEventType(":beachfront:executeBatch:completed", etm, inpObj.PzAddr, inpObj.PzAuth); err == nil {
+		if eventType, err = gw.GetEventType(context.Background(), ":beachfront:executeBatch:completed", etm, inpObj.PzAddr, inpObj.PzAuth); err == nil {
 			event := pzsvc.Event{
 				EventTypeID: eventType.EventTypeID,
 				Data:        make(map[string]interface{})}
 			event.Data["shoreDataID"] = shoreDataID
 			event.Data["shoreDeplID"] = shoreDeplID
 
-			if eventResponse, err = pzsvc.AddEvent(event, inpObj.PzAddr, inpObj.PzAuth); err == nil {
+			if eventResponse, err = gw.AddEvent(context.Background(), event, inpObj.PzAddr, inpObj.PzAuth); err == nil {
 				log.Printf("Completed batch process and added event: %#v", eventResponse)
 			} else {
 				log.Printf(pzsvc.TraceStr(fmt.Sprintf("Failed to post event %#v\n%v", event, err.Error())))
@@ -275,43 +291,168 @@ func detectShorelines(inpObj asInpStruct, footprints *geojson.FeatureCollection)
 		} else {
 			log.Printf(pzsvc.TraceStr("Failed to get event type: " + err.Error()))
 		}
+		job.succeed(shoreDataID, shoreDeplID)
 	} else {
-		executeBatchFailed(ingestError, inpObj)
+		job.fail(ingestError)
+		executeBatchFailed(ingestError, inpObj, gw)
+	}
+}
+
+// detectFootprints runs detection on the given footprints across a pool of
+// workers, and returns the resulting features in footprint order, with nil
+// for any footprint that produced nothing.  Workers take footprints in
+// order, so they start in the order that footprint selection left them.
+func detectFootprints(job *batchJob, inpObj asInpStruct, footprints *geojson.FeatureCollection, gw Gateway) []*geojson.Feature {
+	var (
+		gsInpObj gsInpStruct
+		wg       sync.WaitGroup
+		results  = make([]*geojson.Feature, len(footprints.Features))
+		inxChan  = make(chan int)
+		workers  = batchWorkerCount(inpObj.Workers, len(footprints.Features))
+	)
+
+	// Convert the asInpStruct to a gsInpStruct
+	b, _ := json.Marshal(inpObj)
+	json.Unmarshal(b, &gsInpObj)
+
+	for wInx := 0; wInx < workers; wInx++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for inx := range inxChan {
+				results[inx] = detectFootprint(job, inx, footprints, inpObj, gsInpObj, gw)
+			}
+		}()
+	}
+	for inx := range footprints.Features {
+		inxChan <- inx
+	}
+	close(inxChan)
+	wg.Wait()
+	return results
+}
+
+// detectFootprint handles the footprint at the given index: reusing its
+// cached result if there is one, and detecting its shoreline if not.
+func detectFootprint(job *batchJob, inx int, footprints *geojson.FeatureCollection, inpObj asInpStruct, gsInpObj gsInpStruct, gw Gateway) *geojson.Feature {
+	footprint := footprints.Features[inx]
+
+	// shorelines from before this job was resumed are kept whatever the
+	// settings
+	if fpStatus := job.footprint(inx); fpStatus.done() {
+		log.Printf("Keeping Data ID %v for feature %v", fpStatus.ShoreDataID, footprint.ID)
+		footprint.Properties["shoreDataID"] = fpStatus.ShoreDataID
+		footprint.Properties["shoreDeplID"] = fpStatus.ShoreDeplID
+		return footprint
 	}
+
+	shoreDataID := footprint.PropertyString("cache.shoreDataID")
+	if shoreDataID != "" && !inpObj.ForceDetection {
+		log.Printf("Found Data ID %v for feature %v", shoreDataID, footprint.ID)
+		shoreDeplID := footprint.PropertyString("cache.shoreDeplID")
+		footprint.Properties["shoreDataID"] = shoreDataID
+		footprint.Properties["shoreDeplID"] = shoreDeplID
+		job.setFootprint(inx, footprintCached, "", shoreDataID, shoreDeplID)
+		return footprint
+	}
+	if inpObj.SkipDetection {
+		job.setFootprint(inx, footprintSkipped, "skipDetection is set and there is no cached result.", "", "")
+		return nil
+	}
+
+	// the algorithm service is shared with every other batch, so hold
+	// a slot on it for the duration
+	sem := algoURLSemaphore(inpObj.AlgoURL)
+	sem.Lock()
+	defer sem.Unlock()
+
+	log.Printf("Detecting scene %v (#%v of %v, score %v)", footprint.ID, inx+1, len(footprints.Features), footprint.PropertyFloat("score"))
+	job.setFootprint(inx, footprintDetecting, "", "", "")
+	gen, err := popShoreline(context.Background(), gsInpObj, footprint, gw)
+	if err != nil {
+		log.Printf("Failed to detect scene %v: %v", footprint.ID, err.Error())
+		job.setFootprint(inx, footprintFailed, err.Error(), "", "")
+		return nil
+	}
+	shoreDataID = gen.PropertyString("shoreDataID")
+	shoreDeplID := gen.PropertyString("shoreDeplID")
+	job.setFootprint(inx, footprintDetected, "", shoreDataID, shoreDeplID)
+	log.Printf("Finished detecting feature %v. Data ID: %v", footprint.ID, shoreDataID)
+	go addCache(footprint.IDStr(), shoreDataID, shoreDeplID)
+	debug.FreeOSMemory()
+	return gen
 }
 
-func assembleShorelines(inpObj asInpStruct) (*geojson.FeatureCollection, error) {
+// assembleShorelines clips the detected shorelines of each collection to
+// the baseline and the collection's footprint, and returns the result in
+// a spool.  The caller must close the spool.  Shorelines are read from
+// Piazza a feature at a time and the result goes straight to disk, so
+// memory use does not grow with the size of the batch; stitching, which
+// needs every result feature at once, is the exception.
+func assembleShorelines(inpObj asInpStruct, gw Gateway) (*featureSpool, error) {
 	var (
 		gjIfc interface{}
 		baseline,
 		collGeom,
 		collGeomPart,
 		clippedGeom *geos.Geometry
-		b   []byte
-		err error
-		currFc,
-		fc *geojson.FeatureCollection
-		ok     bool
-		empty  bool
-		result *geojson.FeatureCollection
-		foundGeoms,
+		err          error
+		empty        bool
+		intersects   bool
+		count        int
+		found        int
+		shoreDataID  string
+		collection   *geojson.Feature
+		feature      *geojson.Feature
+		stream       io.ReadCloser
+		spool        *featureSpool
 		clippedGeoms []*geos.Geometry
-		count       int
-		shoreDataID string
+		shorelines   []*geojson.Feature
+		stitched     []*geojson.Feature
+		sceneIDs     []string
+		tolerance    float64
 	)
-	if baseline, err = geojsongeos.GeosFromGeoJSON(inpObj.Baseline); err != nil {
+	if inpObj.Stitch {
+		if tolerance, err = stitchTolerance(&inpObj); err != nil {
+			return nil, err
+		}
+	}
+	// Everything is unwrapped into the frame of the baseline, and split
+	// at the antimeridian again at the end (see antimeridian.go)
+	frame := frameFor(inpObj.Baseline)
+	if gjIfc, err = frame.normalize(inpObj.Baseline); err != nil {
+		return nil, err
+	}
+	if baseline, err = geojsongeos.GeosFromGeoJSON(gjIfc); err != nil {
 		return nil, pzsvc.ErrWithTrace("Could not convert GeoJSON object to GEOS geometry: " + err.Error())
 	}
+	preparedBaseline := geos.PrepareGeometry(baseline)
 
-	result = geojson.NewFeatureCollection(nil)
+	if spool, err = newFeatureSpool(); err != nil {
+		return nil, err
+	}
+	// emit sends a result feature on its way.  Stitched features have to
+	// wait until everything has been found.
+	emit := func(feature *geojson.Feature, sceneID string) error {
+		qaProperties(collection.Properties, feature.Properties)
+		if inpObj.Stitch {
+			stitched = append(stitched, feature)
+			sceneIDs = append(sceneIDs, sceneID)
+			return nil
+		}
+		splitFeatures([]*geojson.Feature{feature})
+		return spool.add(feature)
+	}
 
-	for _, collection := range inpObj.Collections.Features {
+	for _, rawCollection := range inpObj.Collections.Features {
 		clippedGeoms = nil
-		foundGeoms = nil
-		b = nil
-		debug.FreeOSMemory()
 
-		shoreDataID = collection.PropertyString("shoreDataID")
+		shoreDataID = rawCollection.PropertyString("shoreDataID")
+		if gjIfc, err = frame.normalize(rawCollection); err != nil {
+			log.Print(pzsvc.TraceStr("Could not normalize the geometry for " + shoreDataID + ": " + err.Error()))
+			continue
+		}
+		collection = gjIfc.(*geojson.Feature)
 		if collGeom, err = geojsongeos.GeosFromGeoJSON(collection.Geometry); err != nil {
 			log.Printf("%T", collection.Geometry)
 			log.Printf(pzsvc.TraceStr("Could not convert GeoJSON object to GEOS geometry: " + err.Error()))
@@ -329,6 +470,11 @@ func assembleShorelines(inpObj asInpStruct) (*geojson.FeatureCollection, error)
 		for inx := 0; inx < count; inx++ {
 			collGeomPart, _ = collGeom.Geometry(inx)
 
+			// Most parts are nowhere near most of the baseline, and the
+			// prepared test is far cheaper than an intersection.
+			if intersects, err = preparedBaseline.Intersects(collGeomPart); err == nil && !intersects {
+				continue
+			}
 			if clippedGeom, err = baseline.Intersection(collGeomPart); err != nil {
 				log.Printf(pzsvc.TraceStr("Could not clip the baseline geometry: " + err.Error()))
 				log.Printf("collGeomPart: %v", collGeomPart.String())
@@ -341,83 +487,164 @@ func assembleShorelines(inpObj asInpStruct) (*geojson.FeatureCollection, error)
 				continue
 			} else if empty {
 				area, _ := collGeomPart.Area()
-				fmt.Printf("Clipped geometry for %v is empty (size: %v). Continuing.", shoreDataID, area)
+				log.Printf("Clipped geometry for %v is empty (size: %v). Continuing.", shoreDataID, area)
 				// log.Printf("collGeomPart: %v", collGeomPart.String())
 				continue
 			}
 			clippedGeoms = append(clippedGeoms, clippedGeom)
 		}
-
-		if b, err = pzsvc.DownloadBytes(shoreDataID, inpObj.PzAddr, inpObj.PzAuth); err != nil {
-			log.Printf(pzsvc.TraceStr("Failed to download shoreline " + shoreDataID + ".\n" + err.Error()))
+		if len(clippedGeoms) == 0 {
 			continue
 		}
 
-		if gjIfc, err = geojson.Parse(b); err != nil {
-			log.Printf(pzsvc.TraceStr("Failed to parse GeoJSON from " + shoreDataID + ".\n" + err.Error()))
+		if stream, err = gw.DownloadStream(context.Background(), shoreDataID, inpObj.PzAddr, inpObj.PzAuth); err != nil {
+			log.Print(pzsvc.TraceStr("Failed to download shoreline " + shoreDataID + ".\n" + err.Error()))
 			continue
 		}
 
-		b = nil
-		debug.FreeOSMemory()
-
-		if fc, ok = gjIfc.(*geojson.FeatureCollection); ok {
-			for _, clippedGeom = range clippedGeoms {
-				if currFc = findBestMatches(fc, clippedGeom, collGeom); len(currFc.Features) == 0 {
-					fmt.Printf("Found no matching shorelines for %v.", shoreDataID)
-				} else {
-					result.Features = append(result.Features, currFc.Features...)
-					fmt.Printf("Found %v matching shorelines for %v.\n", len(currFc.Features), shoreDataID)
+		// shorelines are indexed a batch at a time (see matchShorelines)
+		scanner := newFeatureScanner(stream)
+		found = 0
+		shorelines = shorelines[:0]
+		for done := false; !done; {
+			if feature, err = scanner.next(); err == io.EOF {
+				done = true
+			} else if err != nil {
+				log.Print(pzsvc.TraceStr("Failed to read GeoJSON from " + shoreDataID + ".\n" + err.Error()))
+				done = true
+			} else if gjIfc, err = frame.normalize(feature); err != nil {
+				log.Print(pzsvc.TraceStr("Failed to normalize GeoJSON from " + shoreDataID + ".\n" + err.Error()))
+			} else {
+				shorelines = append(shorelines, gjIfc.(*geojson.Feature))
+			}
+			if len(shorelines) < shorelineIndexBatch && !done {
+				continue
+			}
+			for _, match := range matchShorelines(shorelines, clippedGeoms, collGeom) {
+				found++
+				if err = emit(match, collection.IDStr()); err != nil {
+					stream.Close()
+					spool.close()
+					return nil, err
 				}
 			}
-			debug.FreeOSMemory()
+			shorelines = shorelines[:0]
+		}
+		stream.Close()
+		if found == 0 {
+			log.Printf("Found no matching shorelines for %v.", shoreDataID)
 		} else {
-			log.Printf(pzsvc.TraceStr(fmt.Sprintf("Was expecting a *geojson.FeatureCollection, got a %T", gjIfc)))
+			log.Printf("Found %v matching shorelines for %v.", found, shoreDataID)
 		}
-		if gjIfc, err = geos.NewCollection(geos.GEOMETRYCOLLECTION, foundGeoms...); err != nil {
-			log.Printf(pzsvc.TraceStr("Failed to create new collection containing" + string(len(foundGeoms)) + " geometries\n" + err.Error()))
+	}
+	if inpObj.Stitch {
+		count = len(stitched)
+		stitched = stitchShorelines(stitched, sceneIDs, tolerance)
+		log.Printf("Stitched %v shorelines into %v.", count, len(stitched))
+		splitFeatures(stitched)
+		for _, feature = range stitched {
+			if err = spool.add(feature); err != nil {
+				spool.close()
+				return nil, err
+			}
 		}
 	}
-	return result, nil
+	return spool, nil
 }
 
+// findBestMatches returns the features of the collection that intersect
+// the comparison geometry, clipped to the clip geometry.
 func findBestMatches(fc *geojson.FeatureCollection, comparison, clip *geos.Geometry) *geojson.FeatureCollection {
+	return geojson.NewFeatureCollection(matchShorelines(fc.Features, []*geos.Geometry{comparison}, clip))
+}
+
+// shorelineIndexBatch is how many shoreline features are indexed at a
+// time.  Shorelines are read as a stream, and batching them keeps memory
+// use bounded however many a scene has.
+const shorelineIndexBatch = 4096
+
+// matchShorelines returns each of the shoreline features once for every
+// piece of the baseline that it intersects, clipped to the clip geometry,
+// in the order of the features.  The features go into an STR tree by their
+// envelopes, so that each piece is tested, as a prepared geometry, only
+// against the features near it, and each feature is converted to GEOS and
+// clipped at most once.
+func matchShorelines(features []*geojson.Feature, pieces []*geos.Geometry, clip *geos.Geometry) []*geojson.Feature {
 	var (
-		err         error
-		intersects  bool
-		gjIfc       interface{}
-		currFeature *geojson.Feature
-		currGeom,
+		envs          []envelope
+		items         []int // index into features of each item in the tree
+		gjIfc         interface{}
+		intersects    bool
+		err           error
 		intersectGeom *geos.Geometry
-		result *geojson.FeatureCollection
+		result        []*geojson.Feature
 	)
-	result = geojson.NewFeatureCollection(nil)
-	fmt.Printf("%v features to inspect. ", len(fc.Features))
-	for _, feature := range fc.Features {
-		if currGeom, err = geojsongeos.GeosFromGeoJSON(feature); err != nil {
-			log.Printf(pzsvc.TraceStr("Could not convert GeoJSON object to GEOS geometry: " + err.Error()))
+	for inx, feature := range features {
+		if env, ok := envelopeOf(feature.Geometry); ok {
+			envs = append(envs, env)
+			items = append(items, inx)
+		}
+	}
+	if len(envs) == 0 {
+		return nil
+	}
+	tree := newSTRTree(envs)
+	geoms := make([]*geos.Geometry, len(features))
+	failed := make([]bool, len(features))
+	hits := make([]int, len(features))
+	for _, piece := range pieces {
+		if gjIfc, err = geojsongeos.GeoJSONFromGeos(piece); err != nil {
+			log.Print(pzsvc.TraceStr("Failed to convert GEOS geometry to GeoJSON: " + err.Error()))
+			continue
+		}
+		env, ok := envelopeOf(gjIfc)
+		if !ok {
 			continue
 		}
-		// Need a better test here?
-		if intersects, err = currGeom.Intersects(comparison); err != nil {
-			log.Printf(pzsvc.TraceStr("Failed to test intersection: " + err.Error()))
+		candidates := tree.query(env)
+		if len(candidates) == 0 {
 			continue
-		} else if intersects {
-			// Need to clip each found geometry to its collection geometry
-			if intersectGeom, err = currGeom.Intersection(clip); err != nil {
-				log.Printf(pzsvc.TraceStr("Failed to clip the found geometry for %v " + feature.IDStr() + ": " + err.Error()))
-				// log.Printf("clip: %v", clip.String())
-				// log.Printf("currGeom: %v", currGeom.String())
+		}
+		prepared := geos.PrepareGeometry(piece)
+		for _, item := range candidates {
+			inx := items[item]
+			if failed[inx] {
 				continue
 			}
-
+			if geoms[inx] == nil {
+				if geoms[inx], err = geojsongeos.GeosFromGeoJSON(features[inx]); err != nil {
+					log.Print(pzsvc.TraceStr("Could not convert GeoJSON object to GEOS geometry: " + err.Error()))
+					failed[inx] = true
+					continue
+				}
+			}
+			// Need a better test here?
+			if intersects, err = prepared.Intersects(geoms[inx]); err != nil {
+				log.Print(pzsvc.TraceStr("Failed to test intersection: " + err.Error()))
+			} else if intersects {
+				hits[inx]++
+			}
+		}
+	}
+	for inx, count := range hits {
+		if count == 0 {
+			continue
+		}
+		// Need to clip each found geometry to its collection geometry
+		feature := features[inx]
+		if intersectGeom, err = geoms[inx].Intersection(clip); err != nil {
+			log.Print(pzsvc.TraceStr("Failed to clip the found geometry for " + feature.IDStr() + ": " + err.Error()))
+			continue
+		}
+		// each match gets a geometry of its own, since they may be split
+		// in place later on
+		for ; count > 0; count-- {
 			if gjIfc, err = geojsongeos.GeoJSONFromGeos(intersectGeom); err != nil {
-				log.Printf(pzsvc.TraceStr("Failed to convert GEOS geometry to GeoJSON: " + err.Error()))
+				log.Print(pzsvc.TraceStr("Failed to convert GEOS geometry to GeoJSON: " + err.Error()))
 				log.Printf("intersectGeom: %v", intersectGeom.String())
-				continue
+				break
 			}
-			currFeature = geojson.NewFeature(gjIfc, feature.ID, feature.Properties)
-			result.Features = append(result.Features, currFeature)
+			result = append(result, geojson.NewFeature(gjIfc, feature.ID, feature.Properties))
 		}
 	}
 	return result
@@ -429,20 +656,21 @@ func addCache(imageID, shoreDataID, shoreDeplID string) {
 		err     error
 	)
 	// Get a clean copy of the image metadata
-	if feature, err = catalog.GetSceneMetadata(imageID); err != nil {
+	if feature, err = sceneCatalog.GetSceneMetadata(imageID); err != nil {
 		log.Printf(pzsvc.TraceStr("Failed to retrieve image metadata so that we could cache results: " + err.Error()))
+		return
 	}
 
 	feature.Properties["cache.shoreDataID"] = shoreDataID
 	feature.Properties["cache.shoreDeplID"] = shoreDeplID
 
 	// re-store the feature
-	if _, err = catalog.StoreFeature(feature, true); err != nil {
+	if err = sceneCatalog.StoreFeature(feature); err != nil {
 		log.Printf(pzsvc.TraceStr("Failed to store image metadata with cached results: " + err.Error()))
 	}
 }
 
-func executeBatchFailed(message string, inpObj asInpStruct) {
+func executeBatchFailed(message string, inpObj asInpStruct, gw Gateway) {
 	var (
 		eventResponse pzsvc.EventResponse
 		eventType     pzsvc.EventType
@@ -451,13 +679,13 @@ func executeBatchFailed(message string, inpObj asInpStruct) {
 	etm := make(map[string]interface{})
 	etm["error"] = "string"
 
-	if eventType, err = pzsvc.GetEventType(":beachfront:executeBatch:failed", etm, inpObj.PzAddr, inpObj.PzAuth); err == nil {
+	if eventType, err = gw.GetEventType(context.Background(), ":beachfront:executeBatch:failed", etm, inpObj.PzAddr, inpObj.PzAuth); err == nil {
 		event := pzsvc.Event{
 			EventTypeID: eventType.EventTypeID,
 			Data:        make(map[string]interface{})}
 		event.Data["error"] = message
 
-		if eventResponse, err = pzsvc.AddEvent(event, inpObj.PzAddr, inpObj.PzAuth); err == nil {
+		if eventResponse, err = gw.AddEvent(context.Background(), event, inpObj.PzAddr, inpObj.PzAuth); err == nil {
 			fmt.Printf("Failed to execute batch process, but posted event %v.", eventResponse.Data.EventID)
 		} else {
 			log.Printf("Failed to execute batch process or post event.")
@@ -28,12 +28,12 @@ func TestAssembleShorelines(t *testing.T) {
 	r := http.Request{}
 	r.Method = "POST"
 	r.Body = pzsvc.GetMockReadCloser(`{"name":what?}`)
-	Execute(w, &r)
+	Execute(w, &r, PzGateway{})
 	*outStr = ""
 	*outInt = 200
-	AssembleShorelines(w, &r)
-	Execute(w, &r)
-	ExecuteBatch(w, &r)
+	AssembleShorelines(w, &r, PzGateway{})
+	Execute(w, &r, PzGateway{})
+	ExecuteBatch(w, &r, PzGateway{})
 	testBodyStr := `{"algoType":"pzsvc-ossim","svcURL":"https://pzsvc-ossim.stage.geointservices.io/execute","pzAuthToken":"","pzAddr":"https://pz-gateway.stage.geointservices.io","footprintsDataID":"1234","bandMergeType":"","bandMergeURL":"","tideURL":"https://bf-tideprediction.stage.geointservices.io/","dbAuthToken":"","bands":["coastal","swir1"],"metaDataJSON":{"type":"FeatureCollection","features":[{"type":"Feature","geometry":{"type":"Point","coordinates":[-80.87088507656375,35.21515162500578]},"properties":{"name":"ABBOTTNEIGHBORHOODPARK","address":"1300SPRUCEST"}},{"type":"Feature","geometry":{"type":"Point","coordinates":[-80.83775386582222,35.24980190252168]},"properties":{"name":"DOUBLEOAKSCENTER","address":"1326WOODWARDAV"}},{"type":"Feature","geometry":{"type":"Point","coordinates":[-80.83827000459532,35.25674709224663]},"properties":{"name":"DOUBLEOAKSNEIGHBORHOODPARK","address":"2605DOUBLEOAKSRD"}},{"type":"Feature","geometry":{"type":"Point","coordinates":[-80.83697759172735,35.25751734669229]},"properties":{"name":"DOUBLEOAKSPOOL","address":"1200NEWLANDRD"}},{"type":"Feature","geometry":{"type":"Point","coordinates":[-80.81647652154736,35.40148708491418]},"properties":{"name":"DAVIDB.WAYMERFLYINGREGIONALPARK","address":"15401HOLBROOKSRD"}},{"type":"Feature","geometry":{"type":"Point","coordinates":[-80.83556459443902,35.39917224760999]},"properties":{"name":"DAVIDB.WAYMERCOMMUNITYPARK","address":"302HOLBROOKSRD"}},{"type":"Feature","geometry":{"type":"Polygon","coordinates":[[[-80.72487831115721,35.26545403190955],[-80.72135925292969,35.26727607954368],[-80.71517944335938,35.26769654625573],[-80.7125186920166,35.27035945142482],[-80.70857048034668,35.268257165144064],[-80.70479393005371,35.268397319259996],[-80.70324897766113,35.26503355355979],[-80.71088790893555,35.2553619492954],[-80.71681022644043,35.2553619492954],[-80.7150936126709,35.26054831539319],[-80.71869850158691,35.26026797976481],[-80.72032928466797,35.26061839914875],[-80.72264671325684,35.26033806376283],[-80.72487831115721,35.26545403190955]]]},"properties":{"name":"PlazaRoadPark"}}]},"properties": {"acquiredDate": "2016-06-18T07:36:07.536703+00:00","bands": {"blue": "http://landsat_B2.TIF","cirrus": "http://landsat_B9.TIF","coastal": "http://landsat_B1.TIF","green": "http://landsat_B3.TIF","nir": "http://landsat_B5.TIF","panchromatic": "http://landsat_B8.TIF","red": "http://landsat_B4.TIF","swir1": "http://landsat_B6.TIF","swir2": "http://landsat_B7.TIF","tirs1": "http://landsat_B10.TIF","tirs2": "http://landsat_B11.TIF"},"cloudCover": 8.6,"path": "http://landsat.com/index.html","resolution": 30,"sensorName": "Landsat8","thumb_large": "http://landsat_thumb_large.jpg","thumb_small": "http://landsat_thumb_small.jpg"},"id": "landsat:LC81660752016170LGN00","bbox": [34.6366754134012, -22.719959598174, 36.814147099668, -20.6249573123582]}`
 
 	r.Body = pzsvc.GetMockReadCloser(testBodyStr)
@@ -47,8 +47,8 @@ func TestAssembleShorelines(t *testing.T) {
 	if err != nil {
 		t.Error(`TestExecute: failed to marshal dummy data.  What's wrong with you?`)
 	}
-	AssembleShorelines(w, &r)
-	Execute(w, &r)
+	AssembleShorelines(w, &r, PzGateway{})
+	Execute(w, &r, PzGateway{})
 	var mockMeta struct{ Data pzsvc.DataDesc }
 	mockDataType := pzsvc.DataType{Location: &pzsvc.FileLoc{FileSize: 500}}
 	mockResMeta := pzsvc.ResMeta{Metadata: map[string]string{"prop1": "1", "prop2": "2"}}
@@ -63,9 +63,9 @@ func TestAssembleShorelines(t *testing.T) {
 
 	pzsvc.SetMockClient(cliOuts, 200)
 
-	Execute(w, &r)
-	AssembleShorelines(w, &r)
-	ExecuteBatch(w, &r)
+	Execute(w, &r, PzGateway{})
+	AssembleShorelines(w, &r, PzGateway{})
+	ExecuteBatch(w, &r, PzGateway{})
 }
 func TestExecuteBatch(t *testing.T) {
 	var err error
@@ -74,7 +74,7 @@ func TestExecuteBatch(t *testing.T) {
 	r := http.Request{}
 	r.Method = "POST"
 	r.Body = pzsvc.GetMockReadCloser(`{"name":what?}`)
-	Execute(w, &r)
+	Execute(w, &r, PzGateway{})
 	if *outInt < 300 && *outInt >= 200 {
 		t.Error(`TestExecute: passed on what should have been a json failure.`)
 	}
@@ -82,20 +82,20 @@ func TestExecuteBatch(t *testing.T) {
 	*outInt = 200
 
 	mockFeatByts := []byte(`{"type":"FeatureCollection","features":[{"type":"Feature","geometry":{"type":"Point","coordinates":[-80.87088507656375,35.21515162500578]},"properties":{"name":"ABBOTTNEIGHBORHOODPARK","address":"1300SPRUCEST"}},{"type":"Feature","geometry":{"type":"Point","coordinates":[-80.83775386582222,35.24980190252168]},"properties":{"name":"DOUBLEOAKSCENTER","address":"1326WOODWARDAV"}},{"type":"Feature","geometry":{"type":"Point","coordinates":[-80.83827000459532,35.25674709224663]},"properties":{"name":"DOUBLEOAKSNEIGHBORHOODPARK","address":"2605DOUBLEOAKSRD"}},{"type":"Feature","geometry":{"type":"Point","coordinates":[-80.83697759172735,35.25751734669229]},"properties":{"name":"DOUBLEOAKSPOOL","address":"1200NEWLANDRD"}},{"type":"Feature","geometry":{"type":"Point","coordinates":[-80.81647652154736,35.40148708491418]},"properties":{"name":"DAVIDB.WAYMERFLYINGREGIONALPARK","address":"15401HOLBROOKSRD"}},{"type":"Feature","geometry":{"type":"Point","coordinates":[-80.83556459443902,35.39917224760999]},"properties":{"name":"DAVIDB.WAYMERCOMMUNITYPARK","address":"302HOLBROOKSRD"}},{"type":"Feature","geometry":{"type":"Polygon","coordinates":[[[-80.72487831115721,35.26545403190955],[-80.72135925292969,35.26727607954368],[-80.71517944335938,35.26769654625573],[-80.7125186920166,35.27035945142482],[-80.70857048034668,35.268257165144064],[-80.70479393005371,35.268397319259996],[-80.70324897766113,35.26503355355979],[-80.71088790893555,35.2553619492954],[-80.71681022644043,35.2553619492954],[-80.7150936126709,35.26054831539319],[-80.71869850158691,35.26026797976481],[-80.72032928466797,35.26061839914875],[-80.72264671325684,35.26033806376283],[-80.72487831115721,35.26545403190955]]]},"properties":{"name":"PlazaRoadPark"}}]}`)
-	Execute(w, &r)
-	ExecuteBatch(w, &r)
-	AssembleShorelines(w, &r)
+	Execute(w, &r, PzGateway{})
+	ExecuteBatch(w, &r, PzGateway{})
+	AssembleShorelines(w, &r, PzGateway{})
 	testBodyStr := `{"algoType":"pzsvc-ossim","svcURL":"https://pzsvc-ossim.stage.geointservices.io/execute","pzAuthToken":"","pzAddr":"https://pz-gateway.stage.geointservices.io","bandMergeType":"","bandMergeURL":"","tideURL":"https://bf-tideprediction.stage.geointservices.io/"}`
 
 	r.Body = pzsvc.GetMockReadCloser(testBodyStr)
 	// create and populate mock client here.
-	Execute(w, &r)
-	ExecuteBatch(w, &r)
-	AssembleShorelines(w, &r)
+	Execute(w, &r, PzGateway{})
+	ExecuteBatch(w, &r, PzGateway{})
+	AssembleShorelines(w, &r, PzGateway{})
 
 	testBodyStr1 := `{"algoType":"pzsvc-ossim","svcURL":"https://pzsvc-ossim.stage.geointservices.io/execute","pzAuthToken":"","baseline":{"type":"FeatureCollection","features":[{"type":"Feature","geometry":{"type":"Point","coordinates":[-80.87088507656375,35.21515162500578]},"properties":{"name":"ABBOTTNEIGHBORHOODPARK","address":"1300SPRUCEST"}},{"type":"Feature","geometry":{"type":"Point","coordinates":[-80.83775386582222,35.24980190252168]},"properties":{"name":"DOUBLEOAKSCENTER","address":"1326WOODWARDAV"}},{"type":"Feature","geometry":{"type":"Point","coordinates":[-80.83827000459532,35.25674709224663]},"properties":{"name":"DOUBLEOAKSNEIGHBORHOODPARK","address":"2605DOUBLEOAKSRD"}},{"type":"Feature","geometry":{"type":"Point","coordinates":[-80.83697759172735,35.25751734669229]},"properties":{"name":"DOUBLEOAKSPOOL","address":"1200NEWLANDRD"}},{"type":"Feature","geometry":{"type":"Point","coordinates":[-80.81647652154736,35.40148708491418]},"properties":{"name":"DAVIDB.WAYMERFLYINGREGIONALPARK","address":"15401HOLBROOKSRD"}},{"type":"Feature","geometry":{"type":"Point","coordinates":[-80.83556459443902,35.39917224760999]},"properties":{"name":"DAVIDB.WAYMERCOMMUNITYPARK","address":"302HOLBROOKSRD"}},{"type":"Feature","geometry":{"type":"Polygon","coordinates":[[[-80.72487831115721,35.26545403190955],[-80.72135925292969,35.26727607954368],[-80.71517944335938,35.26769654625573],[-80.7125186920166,35.27035945142482],[-80.70857048034668,35.268257165144064],[-80.70479393005371,35.268397319259996],[-80.70324897766113,35.26503355355979],[-80.71088790893555,35.2553619492954],[-80.71681022644043,35.2553619492954],[-80.7150936126709,35.26054831539319],[-80.71869850158691,35.26026797976481],[-80.72032928466797,35.26061839914875],[-80.72264671325684,35.26033806376283],[-80.72487831115721,35.26545403190955]]]},"properties":{"name":"PlazaRoadPark"}}]},"footprintsDataID":"123","pzAddr":"https://pz-gateway.stage.geointservices.io","bandMergeType":"","bandMergeURL":"","tideURL":"https://bf-tideprediction.stage.geointservices.io/","dbAuthToken":"","bands":["coastal","swir1"],"metaDataJSON":{"type": "Feature","geometry": {"type": "Polygon","coordinates": [[35.0552646979563, -20.6249573123582],[36.814147099668, -20.9863928375569],[36.4165176126861, -22.719959598174],[34.6366754134012, -22.3522722379786],[35.0552646979563, -20.6249573123582]]},"properties": {"acquiredDate": "2016-06-18T07:36:07.536703+00:00","bands": {"blue": "http://landsat_B2.TIF","cirrus": "http://landsat_B9.TIF","coastal": "http://landsat_B1.TIF","green": "http://landsat_B3.TIF","nir": "http://landsat_B5.TIF","panchromatic": "http://landsat_B8.TIF","red": "http://landsat_B4.TIF","swir1": "http://landsat_B6.TIF","swir2": "http://landsat_B7.TIF","tirs1": "http://landsat_B10.TIF","tirs2": "http://landsat_B11.TIF"},"cloudCover": 8.6,"path": "http://landsat.com/index.html","resolution": 30,"sensorName": "Landsat8","thumb_large": "http://landsat_thumb_large.jpg","thumb_small": "http://landsat_thumb_small.jpg"},"id": "landsat:LC81660752016170LGN00","bbox": [34.6366754134012, -22.719959598174, 36.814147099668, -20.6249573123582]}}`
 	r.Body = pzsvc.GetMockReadCloser(testBodyStr1)
-	ExecuteBatch(w, &r)
+	ExecuteBatch(w, &r, PzGateway{})
 	var mockMeta struct{ Data pzsvc.DataDesc }
 	mockDataType := pzsvc.DataType{Location: &pzsvc.FileLoc{FileSize: 500}}
 	mockResMeta := pzsvc.ResMeta{Metadata: map[string]string{"prop1": "1", "prop2": "2"}}
@@ -114,13 +114,13 @@ func TestExecuteBatch(t *testing.T) {
 		`{"data":{"status":"Success","result":{"deployment":{"deploymentId":"aaaa","dataId":"aaa"}}}}`}
 	pzsvc.SetMockClient(cliOuts, 200)
 
-	Execute(w, &r)
-	ExecuteBatch(w, &r)
-	AssembleShorelines(w, &r)
+	Execute(w, &r, PzGateway{})
+	ExecuteBatch(w, &r, PzGateway{})
+	AssembleShorelines(w, &r, PzGateway{})
 
 	testBodyStr2 := `{"algoType":"pzsvc-ossim","svcURL":"https://pzsvc-ossim.stage.geointservices.io/execute","pzAuthToken":"123","baseline":{"type":"FeatureCollection","features":[{"type":"Feature","geometry":{"type":"Point","coordinates":[-80.87088507656375,35.21515162500578]},"properties":{"name":"ABBOTTNEIGHBORHOODPARK","address":"1300SPRUCEST"}},{"type":"Feature","geometry":{"type":"Point","coordinates":[-80.83775386582222,35.24980190252168]},"properties":{"name":"DOUBLEOAKSCENTER","address":"1326WOODWARDAV"}},{"type":"Feature","geometry":{"type":"Point","coordinates":[-80.83827000459532,35.25674709224663]},"properties":{"name":"DOUBLEOAKSNEIGHBORHOODPARK","address":"2605DOUBLEOAKSRD"}},{"type":"Feature","geometry":{"type":"Point","coordinates":[-80.83697759172735,35.25751734669229]},"properties":{"name":"DOUBLEOAKSPOOL","address":"1200NEWLANDRD"}},{"type":"Feature","geometry":{"type":"Point","coordinates":[-80.81647652154736,35.40148708491418]},"properties":{"name":"DAVIDB.WAYMERFLYINGREGIONALPARK","address":"15401HOLBROOKSRD"}},{"type":"Feature","geometry":{"type":"Point","coordinates":[-80.83556459443902,35.39917224760999]},"properties":{"name":"DAVIDB.WAYMERCOMMUNITYPARK","address":"302HOLBROOKSRD"}},{"type":"Feature","geometry":{"type":"Polygon","coordinates":[[[-80.72487831115721,35.26545403190955],[-80.72135925292969,35.26727607954368],[-80.71517944335938,35.26769654625573],[-80.7125186920166,35.27035945142482],[-80.70857048034668,35.268257165144064],[-80.70479393005371,35.268397319259996],[-80.70324897766113,35.26503355355979],[-80.71088790893555,35.2553619492954],[-80.71681022644043,35.2553619492954],[-80.7150936126709,35.26054831539319],[-80.71869850158691,35.26026797976481],[-80.72032928466797,35.26061839914875],[-80.72264671325684,35.26033806376283],[-80.72487831115721,35.26545403190955]]]},"properties":{"name":"PlazaRoadPark"}}],"footprintsDataID":"123","pzAddr":"https://pz-gateway.stage.geointservices.io","bandMergeType":"","bandMergeURL":"","tideURL":"https://bf-tideprediction.stage.geointservices.io/","dbAuthToken":"","bands":["coastal","swir1"],"metaDataJSON":{"type": "Feature","geometry": {"type": "Polygon","coordinates": [[35.0552646979563, -20.6249573123582],[36.814147099668, -20.9863928375569],[36.4165176126861, -22.719959598174],[34.6366754134012, -22.3522722379786],[35.0552646979563, -20.6249573123582]]},"properties": {"acquiredDate": "2016-06-18T07:36:07.536703+00:00","bands": {"blue": "http://landsat_B2.TIF","cirrus": "http://landsat_B9.TIF","coastal": "http://landsat_B1.TIF","green": "http://landsat_B3.TIF","nir": "http://landsat_B5.TIF","panchromatic": "http://landsat_B8.TIF","red": "http://landsat_B4.TIF","swir1": "http://landsat_B6.TIF","swir2": "http://landsat_B7.TIF","tirs1": "http://landsat_B10.TIF","tirs2": "http://landsat_B11.TIF"},"cloudCover": 8.6,"path": "http://landsat.com/index.html","resolution": 30,"sensorName": "Landsat8","thumb_large": "http://landsat_thumb_large.jpg","thumb_small": "http://landsat_thumb_small.jpg"},"id": "landsat:LC81660752016170LGN00","bbox": [34.6366754134012, -22.719959598174, 36.814147099668, -20.6249573123582]}}}`
 	r.Body = pzsvc.GetMockReadCloser(testBodyStr2)
-	ExecuteBatch(w, &r)
+	ExecuteBatch(w, &r, PzGateway{})
 	mockDataType = pzsvc.DataType{Location: &pzsvc.FileLoc{FileSize: 500}}
 	mockResMeta = pzsvc.ResMeta{Metadata: map[string]string{"prop1": "1", "prop2": "2"}}
 	mockMeta.Data = pzsvc.DataDesc{DataID: "aaa", DataType: mockDataType, ResMeta: mockResMeta}
@@ -138,23 +138,23 @@ func TestExecuteBatch(t *testing.T) {
 		`{"data":{"status":"Success","result":{"deployment":{"deploymentId":"aaaa","dataId":"aaa"}}}}`}
 	pzsvc.SetMockClient(cliOuts, 200)
 
-	Execute(w, &r)
-	ExecuteBatch(w, &r)
-	AssembleShorelines(w, &r)
+	Execute(w, &r, PzGateway{})
+	ExecuteBatch(w, &r, PzGateway{})
+	AssembleShorelines(w, &r, PzGateway{})
 
 	testBodyStr3 := `{"algoType":"pzsvc-ossim","svcURL":"https://pzsvc-ossim.stage.geointservices.io/execute","pzAuthToken":"","baseline":{"type":"FeatureCollection","features":[{"type":"Feature","geometry":{"type":"Point","coordinates":[-80.87088507656375,35.21515162500578]},"properties":{"name":"ABBOTTNEIGHBORHOODPARK","address":"1300SPRUCEST"}},{"type":"Feature","geometry":{"type":"Point","coordinates":[-80.83775386582222,35.24980190252168]},"properties":{"name":"DOUBLEOAKSCENTER","address":"1326WOODWARDAV"}},{"type":"Feature","geometry":{"type":"Point","coordinates":[-80.83827000459532,35.25674709224663]},"properties":{"name":"DOUBLEOAKSNEIGHBORHOODPARK","address":"2605DOUBLEOAKSRD"}},{"type":"Feature","geometry":{"type":"Point","coordinates":[-80.83697759172735,35.25751734669229]},"properties":{"name":"DOUBLEOAKSPOOL","address":"1200NEWLANDRD"}},{"type":"Feature","geometry":{"type":"Point","coordinates":[-80.81647652154736,35.40148708491418]},"properties":{"name":"DAVIDB.WAYMERFLYINGREGIONALPARK","address":"15401HOLBROOKSRD"}},{"type":"Feature","geometry":{"type":"Point","coordinates":[-80.83556459443902,35.39917224760999]},"properties":{"name":"DAVIDB.WAYMERCOMMUNITYPARK","address":"302HOLBROOKSRD"}},{"type":"Feature","geometry":{"type":"Polygon","coordinates":[[[-80.72487831115721,35.26545403190955],[-80.72135925292969,35.26727607954368],[-80.71517944335938,35.26769654625573],[-80.7125186920166,35.27035945142482],[-80.70857048034668,35.268257165144064],[-80.70479393005371,35.268397319259996],[-80.70324897766113,35.26503355355979],[-80.71088790893555,35.2553619492954],[-80.71681022644043,35.2553619492954],[-80.7150936126709,35.26054831539319],[-80.71869850158691,35.26026797976481],[-80.72032928466797,35.26061839914875],[-80.72264671325684,35.26033806376283],[-80.72487831115721,35.26545403190955]]]},"properties":{"name":"PlazaRoadPark"}}]},"footprintsDataID":"123","pzAddr":"https://pz-gateway.stage.geointservices.io","bandMergeType":"","bandMergeURL":"","tideURL":"https://bf-tideprediction.stage.geointservices.io/","dbAuthToken":"","bands":["coastal","swir1"],"metaDataJSON":{"type": "Feature","geometry": {"type": "Polygon","coordinates": [[35.0552646979563, -20.6249573123582],[36.814147099668, -20.9863928375569],[36.4165176126861, -22.719959598174],[34.6366754134012, -22.3522722379786],[35.0552646979563, -20.6249573123582]]},"properties": {"acquiredDate": "2016-06-18T07:36:07.536703+00:00","bands": {"blue": "http://landsat_B2.TIF","cirrus": "http://landsat_B9.TIF","coastal": "http://landsat_B1.TIF","green": "http://landsat_B3.TIF","nir": "http://landsat_B5.TIF","panchromatic": "http://landsat_B8.TIF","red": "http://landsat_B4.TIF","swir1": "http://landsat_B6.TIF","swir2": "http://landsat_B7.TIF","tirs1": "http://landsat_B10.TIF","tirs2": "http://landsat_B11.TIF"},"cloudCover": 8.6,"path": "http://landsat.com/index.html","resolution": 30,"sensorName": "Landsat8","thumb_large": "http://landsat_thumb_large.jpg","thumb_small": "http://landsat_thumb_small.jpg"},"id": "landsat:LC81660752016170LGN00","bbox": [34.6366754134012, -22.719959598174, 36.814147099668, -20.6249573123582]}}`
 
 	r.Body = pzsvc.GetMockReadCloser(testBodyStr3)
-	Execute(w, &r)
-	ExecuteBatch(w, &r)
-	AssembleShorelines(w, &r)
+	Execute(w, &r, PzGateway{})
+	ExecuteBatch(w, &r, PzGateway{})
+	AssembleShorelines(w, &r, PzGateway{})
 
 	testBodyStr4 := `{"algoType":"pzsvc-ossim","svcURL":"https://pzsvc-ossim.stage.geointservices.io/execute","pzAuthToken":"123","Baseline":"","footprintsDataID":"","pzAddr":"https://pz-gateway.stage.geointservices.io","bandMergeType":"","bandMergeURL":"","tideURL":"https://bf-tideprediction.stage.geointservices.io/","dbAuthToken":"","bands":["coastal","swir1"],"metaDataJSON":{"type": "Feature","geometry": {"type": "Polygon","coordinates": [[35.0552646979563, -20.6249573123582],[36.814147099668, -20.9863928375569],[36.4165176126861, -22.719959598174],[34.6366754134012, -22.3522722379786],[35.0552646979563, -20.6249573123582]]},"properties": {"acquiredDate": "2016-06-18T07:36:07.536703+00:00","bands": {"blue": "http://landsat_B2.TIF","cirrus": "http://landsat_B9.TIF","coastal": "http://landsat_B1.TIF","green": "http://landsat_B3.TIF","nir": "http://landsat_B5.TIF","panchromatic": "http://landsat_B8.TIF","red": "http://landsat_B4.TIF","swir1": "http://landsat_B6.TIF","swir2": "http://landsat_B7.TIF","tirs1": "http://landsat_B10.TIF","tirs2": "http://landsat_B11.TIF"},"cloudCover": 8.6,"path": "http://landsat.com/index.html","resolution": 30,"sensorName": "Landsat8","thumb_large": "http://landsat_thumb_large.jpg","thumb_small": "http://landsat_thumb_small.jpg"},"id": "landsat:LC81660752016170LGN00","bbox": [34.6366754134012, -22.719959598174, 36.814147099668, -20.6249573123582]}}`
 
 	r.Body = pzsvc.GetMockReadCloser(testBodyStr4)
-	Execute(w, &r)
-	ExecuteBatch(w, &r)
-	AssembleShorelines(w, &r)
+	Execute(w, &r, PzGateway{})
+	ExecuteBatch(w, &r, PzGateway{})
+	AssembleShorelines(w, &r, PzGateway{})
 }
 
 func TestForassembleShorelines(t *testing.T) {
@@ -184,12 +184,14 @@ func TestForassembleShorelines(t *testing.T) {
 	asInpStrucHolder.PzAuth = ""
 	asInpStrucHolder.SkipDetection = false
 	asInpStrucHolder.TidesAddr = "https://bf-tideprediction.stage.geointservices.io"
-	assembleShorelines(asInpStrucHolder)
-	detectShorelines(asInpStrucHolder, geoCollectionHolder)
+	job, _ := newBatchJob(asInpStrucHolder, geoCollectionHolder, "1234", nil)
+	assembleShorelines(asInpStrucHolder, PzGateway{})
+	detectShorelines(job, asInpStrucHolder, geoCollectionHolder, PzGateway{})
 
 	asInpStrucHolder.SkipDetection = true
-	assembleShorelines(asInpStrucHolder)
-	detectShorelines(asInpStrucHolder, geoCollectionHolder)
+	job, _ = newBatchJob(asInpStrucHolder, geoCollectionHolder, "1234", nil)
+	assembleShorelines(asInpStrucHolder, PzGateway{})
+	detectShorelines(job, asInpStrucHolder, geoCollectionHolder, PzGateway{})
 
 }
 
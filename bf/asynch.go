@@ -15,6 +15,7 @@
 package bf
 
 import (
+	"context"
 	"encoding/json"
 	//	"errors"
 	"fmt"
@@ -22,9 +23,10 @@ import (
 	"log"
 	"net/http"
 	//	"os"
-	//	"strconv"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/venicegeo/pzsvc-image-catalog/catalog"
 	"github.com/venicegeo/pzsvc-lib"
@@ -49,21 +51,49 @@ Still to do:
 
 var taskChan chan string
 var redisCli *redis.Client
-var once sync.Once
+
+// asynchReady is set once prepAsynch has succeeded.  Until then, each call
+// to HandleAsynch tries again.
+var (
+	asynchReady bool
+	prepMutex   sync.Mutex
+)
+
+// redisConnectAttempts is how many times prepAsynch tries to reach redis
+// before giving up on the request at hand.
+const redisConnectAttempts = 3
 
 // HandleAsynch determines which of the asynch functions is appropriate for the given
 // call, and does a bit of work extracting information from the requests to simplify
-// things downstream and check for obvious errors.  On its first time through, it also
-// calls prepAsynch(), and blocks appropriately to make sure that prepAsynch is done
-// before anything else happens.  It is the only externally accessible function in
-// asynch.go.
-func HandleAsynch(w http.ResponseWriter, r *http.Request) {
-	once.Do(prepAsynch) // makes sure that all the prep work is done, once, before any other uses of asynch.
+// things downstream and check for obvious errors.  Until prepAsynch() has succeeded,
+// it also calls prepAsynch(), and blocks appropriately to make sure that prepAsynch is
+// done before anything else happens.  It is the only externally accessible function in
+// asynch.go.  Jobs are kept in the JobStore given to SetJobStore (see jobstore.go),
+// which defaults to redis.
+func HandleAsynch(w http.ResponseWriter, r *http.Request, gw Gateway) {
+	prepMutex.Lock()
+	if !asynchReady {
+		if err := prepAsynch(gw); err != nil {
+			prepMutex.Unlock()
+			pzsvc.HTTPOut(w, `{"error":"`+jsonEscString(err.Error())+`"}`, http.StatusServiceUnavailable)
+			return
+		}
+		asynchReady = true
+	}
+	prepMutex.Unlock()
 	pathStrs := strings.Split(r.URL.Path, "/")
 	if len(pathStrs) == 2 {
 		addAsynchJob(w, r)
 		return
 	}
+	if len(pathStrs) == 3 && r.Method == "DELETE" {
+		cancelAsynchJob(w, pathStrs[2])
+		return
+	}
+	if len(pathStrs) == 3 && pathStrs[2] == "deadLetters" {
+		getDeadLetters(w)
+		return
+	}
 	if len(pathStrs) != 4 {
 		pzsvc.HTTPOut(w, `{"Errors": "Incorrect path length for bf-handle asynch.",  "Given Path":"`+r.URL.Path+`"}`, http.StatusBadRequest)
 		return
@@ -73,6 +103,10 @@ func HandleAsynch(w http.ResponseWriter, r *http.Request) {
 		getAsynchStatus(w, pathStrs[3])
 	case "result":
 		getAsynchResults(w, pathStrs[3])
+	case "cancel":
+		cancelAsynchJob(w, pathStrs[3])
+	case "requeue":
+		requeueAsynchJob(w, pathStrs[3])
 	default:
 		pzsvc.HTTPOut(w, `{"Errors": "Not a valid path for bf-handle asynch.",  "Given Path":"`+r.URL.Path+`"}`, http.StatusBadRequest)
 	}
@@ -104,92 +138,280 @@ func addAsynchJob(w http.ResponseWriter, r *http.Request) {
 		pzsvc.HTTPOut(w, errStr, http.StatusInternalServerError)
 		return
 	}
+	if _, err = jobRetryPolicy(string(byts)); err != nil {
+		pzsvc.HTTPOut(w, `{"error":"bad retry policy", "details":"`+jsonEscString(err.Error())+`"}`, http.StatusBadRequest)
+		return
+	}
+
+	meta, err := jobMetaFor(string(byts))
+	if err != nil {
+		pzsvc.HTTPOut(w, `{"error":"bad scheduling options", "details":"`+jsonEscString(err.Error())+`"}`, http.StatusBadRequest)
+		return
+	}
 
-	err = redisAddJob(jobID, string(byts))
+	err = jobStore.AddJob(jobID, string(byts), meta)
 	if err != nil {
-		// failure on redis access
+		// failure on job store access
 		errStr := `{"error":"database access failure", "details":"` + err.Error() + `"}`
 		log.Print(pzsvc.TraceStr(errStr))
 		pzsvc.HTTPOut(w, errStr, http.StatusInternalServerError)
 		return
 	}
 
+	wakeWorker()
+	pzsvc.HTTPOut(w, `{"type":"job","data":{"jobId":"`+jobID+`"}}`, http.StatusOK)
+}
+
+// wakeWorker wakes up a worker thread, if any are waiting.
+func wakeWorker() {
 	select { // this is what a nonblocking unlock looks like in go.
 	case taskChan <- "":
 	default:
 	}
-	pzsvc.HTTPOut(w, `{"type":"job","data":{"jobId":"`+jobID+`"}}`, http.StatusOK)
 }
 
-// getAsynchStatus grabs the current status of the given job out of redis and
-// sends it to the writer
+// getAsynchStatus grabs the current status of the given job out of the job store and
+// sends it to the writer.  Jobs waiting their turn are given their place in the queue.
 // Acceptable statuses: Pending, Running, Success, Cancelled, Error, Fail
 func getAsynchStatus(w http.ResponseWriter, jobID string) {
-	statStr, err := redisGetStatus(jobID)
+	statStr, err := jobStore.Status(jobID)
+	if err == errJobNotFound || statStr == "Syntax error" {
+		pzsvc.HTTPOut(w, `{"status":"Error","result" : {"type": "error", "message": "Job not found: `+jobID+`"}}`, http.StatusBadRequest)
+		return
+	}
 	if err != nil {
 		errStr := `{"status":"Error","result" : {"type": "error","message": "Error while retrieving status","details": "Initial error: ` + err.Error() + `"}}`
 		pzsvc.HTTPOut(w, errStr, http.StatusInternalServerError)
 		return
 	}
-	if statStr == "Syntax error" {
-		pzsvc.HTTPOut(w, `{"status":"Error","result" : {"type": "error", "message": "Job not found: `+jobID+`"}}`, http.StatusBadRequest)
-		return
+	if status := parseJobStatus(statStr); status.Status == "Pending" && status.RetryAt == "" {
+		if status.Position, err = jobStore.QueuePosition(jobID); err == nil && status.Position > 0 {
+			statStr = status.String()
+		}
 	}
 	pzsvc.HTTPOut(w, statStr, http.StatusOK)
 }
 
-// getAsynchResults grabs the results of a completed job out of redis and
+// getAsynchResults grabs the results of a completed job out of the job store and
 // sends it to the writer
 // result format here shoudl be identical to the base bf-handle '/execute' call
 func getAsynchResults(w http.ResponseWriter, jobID string) {
-	outpStr, err := redisGetResults(jobID)
+	outpStr, err := jobStore.Results(jobID)
+	if err == errJobNotFound {
+		pzsvc.HTTPOut(w, `{"Errors":"No results for job: `+jobID+`" }`, http.StatusBadRequest)
+		return
+	}
 	if err != nil {
 		pzsvc.HTTPOut(w, `{"Errors":"`+err.Error()+`" }`, http.StatusInternalServerError)
+		return
 	}
 
 	pzsvc.HTTPOut(w, outpStr, http.StatusOK)
 
 }
 
+// cancelAsynchJob cancels a job that has not yet finished.  A pending job
+// simply comes off the queue.  A running job is stopped by its worker, at
+// once if the worker is in this instance of bf-handle, or else when that
+// worker next polls its status.
+func cancelAsynchJob(w http.ResponseWriter, jobID string) {
+	switch err := jobStore.CancelJob(jobID); err {
+	case nil:
+		cancelRunningJob(jobID)
+		pzsvc.HTTPOut(w, jobCancelled, http.StatusOK)
+	case errJobNotFound:
+		pzsvc.HTTPOut(w, `{"status":"Error","result" : {"type": "error", "message": "Job not found: `+jobID+`"}}`, http.StatusBadRequest)
+	case errJobFinished:
+		pzsvc.HTTPOut(w, `{"status":"Error","result" : {"type": "error", "message": "Job has already finished: `+jobID+`"}}`, http.StatusConflict)
+	default:
+		errStr := `{"error":"database access failure", "details":"` + jsonEscString(err.Error()) + `"}`
+		log.Print(pzsvc.TraceStr(errStr))
+		pzsvc.HTTPOut(w, errStr, http.StatusInternalServerError)
+	}
+}
+
+// getDeadLetters lists the jobs in the dead-letter list, along with their
+// statuses.
+func getDeadLetters(w http.ResponseWriter) {
+	type deadLetter struct {
+		JobID  string    `json:"jobId"`
+		Status jobStatus `json:"status"`
+	}
+	jobIDs, err := jobStore.DeadJobs()
+	if err != nil {
+		pzsvc.HTTPOut(w, `{"Errors":"`+jsonEscString(err.Error())+`" }`, http.StatusInternalServerError)
+		return
+	}
+	deadLetters := make([]deadLetter, len(jobIDs))
+	for inx, jobID := range jobIDs {
+		deadLetters[inx].JobID = jobID
+		if statStr, err := jobStore.Status(jobID); err == nil {
+			deadLetters[inx].Status = parseJobStatus(statStr)
+		}
+	}
+	byts, _ := json.Marshal(map[string]interface{}{"deadLetters": deadLetters})
+	pzsvc.HTTPOut(w, string(byts), http.StatusOK)
+}
+
+// requeueAsynchJob moves a job from the dead-letter list back onto the
+// queue, to be tried again from scratch.
+func requeueAsynchJob(w http.ResponseWriter, jobID string) {
+	err := jobStore.RequeueJob(jobID)
+	if err == errJobNotFound {
+		pzsvc.HTTPOut(w, `{"Errors":"Job is not in the dead-letter list: `+jobID+`" }`, http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		pzsvc.HTTPOut(w, `{"Errors":"`+jsonEscString(err.Error())+`" }`, http.StatusInternalServerError)
+		return
+	}
+	wakeWorker()
+	pzsvc.HTTPOut(w, jobPending, http.StatusOK)
+}
+
+// failAsynchJob records the failure of a job, and decides what comes of
+// it: another attempt, the dead-letter list, or nothing.  The owner is the
+// one that took the job, or empty if the job has been reclaimed.
+func failAsynchJob(jobID, owner, inpStr string, attempt int, policy retryPolicy, class, errStr string) {
+	var err error
+	switch {
+	case !policy.retries(class):
+		err = jobStore.ErrorJob(jobID, owner, errStr)
+	case attempt < policy.MaxAttempts:
+		delay := policy.delay(attempt)
+		log.Printf("Retrying job %v after attempt %v in %v (%v error)", jobID, attempt, delay, class)
+		err = jobStore.RetryJob(jobID, owner, inpStr, errStr, time.Now().Add(delay))
+		time.AfterFunc(delay, wakeWorker)
+	default:
+		log.Printf("Job %v failed on its last attempt (%v error)", jobID, class)
+		err = jobStore.DeadJob(jobID, owner, inpStr, errStr)
+	}
+	if err != nil {
+		log.Print(pzsvc.TraceStr(`{"error":"database access failure", "details":"` + err.Error() + `"}`))
+	}
+}
+
+// how often idle workers check for jobs that are due to be retried
+var asynchIdlePoll = time.Minute
+
+// how often a worker checks whether its job has been cancelled elsewhere
+var cancelPollInterval = 5 * time.Second
+
+var (
+	runningJobs      = make(map[string]context.CancelFunc)
+	runningJobsMutex sync.Mutex
+)
+
+// startJob gives a job a context that is cancelled when the job is, whether
+// through this instance of bf-handle or through the job store.  It also
+// keeps the lease that the given owner took the job under alive (see
+// lease.go), and cancels the job if the lease is lost.
+func startJob(jobID, owner string) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	runningJobsMutex.Lock()
+	runningJobs[jobID] = cancel
+	runningJobsMutex.Unlock()
+	store, interval, beatInterval, lease := jobStore, cancelPollInterval, heartbeatInterval, leaseDuration
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		heartbeat := time.NewTicker(beatInterval)
+		defer heartbeat.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if statStr, err := store.Status(jobID); err == nil && statStr == jobCancelled {
+					cancel()
+				}
+			case <-heartbeat.C:
+				err := store.Heartbeat(jobID, owner, time.Now().Add(lease))
+				if err == errLeaseLost {
+					log.Printf("Lost the lease on job %v.  Abandoning it.", jobID)
+					cancel()
+				} else if err != nil {
+					log.Print(pzsvc.TraceStr("Could not renew the lease on job " + jobID + ": " + err.Error()))
+				}
+			}
+		}
+	}()
+	return ctx, func() {
+		cancel()
+		runningJobsMutex.Lock()
+		delete(runningJobs, jobID)
+		runningJobsMutex.Unlock()
+	}
+}
+
+// cancelRunningJob cancels the given job if it is running in this instance
+// of bf-handle.
+func cancelRunningJob(jobID string) {
+	runningJobsMutex.Lock()
+	defer runningJobsMutex.Unlock()
+	if cancel, ok := runningJobs[jobID]; ok {
+		cancel()
+	}
+}
+
 //
 //
 //
-func asynchWorker(name string) {
+func asynchWorker(name string, gw Gateway) {
 	var (
 		jobID, inpStr, errStr string
+		attempt, httpStatus   int
 		err                   error
+		policy                retryPolicy
 		inpObj                *gsInpStruct
 		outpObj               *gsOutpStruct
 		outByts               []byte
 	)
+	// each worker takes its jobs under its own name, so that a run that
+	// has lost its lease cannot be mistaken for a later run of the same job
+	// by another worker in this instance
+	owner := instanceID + "/" + name
 	fmt.Println("worker " + name + " started")
 	for {
 		fmt.Println("worker " + name + " begin cycle")
-		jobID, inpStr, err = redisTakeJob()
+		jobID, inpStr, attempt, err = jobStore.TakeJob(owner, time.Now().Add(leaseDuration))
 		if jobID == "" {
 			fmt.Println("worker " + name + " no job.  Waiting for next job.")
-			if err != nil && err.Error() != "redis: nil" {
+			if err != nil {
 				errStr = `{"error":"database access failure", "details":"` + err.Error() + `"}`
 				log.Print(pzsvc.TraceStr(errStr))
 			}
-			<-taskChan
+			select {
+			case <-taskChan:
+			case <-time.After(asynchIdlePoll):
+			}
 			continue
 		}
-		fmt.Println("worker " + name + " grabs jobID " + jobID)
+		fmt.Printf("worker %v grabs jobID %v (attempt %v)\n", name, jobID, attempt)
 
 		inpObj = new(gsInpStruct)
 		err = json.Unmarshal([]byte(inpStr), inpObj)
+		if err == nil {
+			policy, err = jobRetryPolicy(inpStr)
+		}
 		if err != nil {
 			errStr = `{"error":"json unmarshaling error", "details":"` + err.Error() + `"}`
 			log.Print(pzsvc.TraceStr(errStr))
-			redisErrorJob(jobID, errStr)
+			jobStore.ErrorJob(jobID, owner, errStr)
+			continue
+		}
+		ctx, endJob := startJob(jobID, owner)
+		outpObj, httpStatus = processScene(ctx, inpObj, gw)
+		cancelled := ctx.Err() != nil
+		endJob()
+		if cancelled {
+			fmt.Println("worker " + name + " cancelled or lost jobID " + jobID)
 			continue
 		}
-		outpObj, _ = processScene(inpObj)
 		if outpObj.Error != "" {
 			errStr = pzsvc.TraceStr(`{"error":"scene processing error", "details":"` + outpObj.Error + `"}`)
 			log.Print(errStr)
-			redisErrorJob(jobID, errStr)
+			failAsynchJob(jobID, owner, inpStr, attempt, policy, errorClass(outpObj, httpStatus), errStr)
 			continue
 		}
 
@@ -197,37 +419,54 @@ func asynchWorker(name string) {
 		if err != nil {
 			errStr = `{"error":"json marshaling error", "details":"` + err.Error() + `"}`
 			log.Print(pzsvc.TraceStr(errStr))
-			redisErrorJob(jobID, errStr)
+			jobStore.ErrorJob(jobID, owner, errStr)
 			continue
 		}
 
-		redisDoneJob(jobID, string(outByts))
+		if err = jobStore.DoneJob(jobID, owner, string(outByts)); err != nil {
+			log.Print(pzsvc.TraceStr(`{"error":"database access failure", "details":"` + err.Error() + `"}`))
+		}
 	}
 }
 
 // PrepAsynch gets the asynch system up and running.  It checks to see if there are any
 // current jobs that were
-func prepAsynch() {
+//
+// If the jobs are kept in redis and redis cannot be reached, it gives up with an error
+// rather than quietly keeping them somewhere else: jobs are only kept in memory when
+// SetJobStore says so.
+func prepAsynch(gw Gateway) error {
 	var err error
 
-	if redisCli == nil {
-		redisCli, err = catalog.RedisClient()
+	if _, ok := jobStore.(RedisJobStore); ok && redisCli == nil {
+		for attempt := 1; attempt <= redisConnectAttempts; attempt++ {
+			if redisCli, err = catalog.RedisClient(); err == nil {
+				break
+			}
+			log.Printf("Could not reach redis for asynch jobs (attempt %d of %d): %v", attempt, redisConnectAttempts, pzsvc.TraceStr(err.Error()))
+			if attempt < redisConnectAttempts {
+				time.Sleep(time.Duration(attempt) * time.Second)
+			}
+		}
 		if err != nil {
-			log.Println("Failure in Redis call.  Error: " + pzsvc.TraceStr(err.Error()))
+			redisCli = nil
+			return pzsvc.ErrWithTrace("Asynch jobs are kept in redis, which could not be reached: " + err.Error() +
+				".  Set BFH_JOB_STORE to \"memory\" to keep them in memory instead.")
 		}
 	}
 
 	taskChan = make(chan string)
-	redisCloseDeadJobs()
+	go runReaper()
 
-	go asynchWorker("A")
-	go asynchWorker("B")
-	go asynchWorker("C")
+	go asynchWorker("A", gw)
+	go asynchWorker("B", gw)
+	go asynchWorker("C", gw)
 	// This is somewhat kludgy, and should be fixed later.  For the current system,
 	// three worker threads is about right.  While this does create goroutines that
 	// are not directly closable, this shouldn't be a leak issue - PrepAsynch is only
 	// meant to be called once, and the three routines are intended to last as long
 	// as the instance of bf-handle does.
+	return nil
 }
 
 const inpLoc = "bf-handle:asynchExecInp:"
@@ -235,6 +474,130 @@ const outpLoc = "bf-handle:asynchExecOutp:"
 const statusLoc = "bf-handle:asynchExecStatus:"
 const jobsLoc = "bf-handle:asynchJobsToDo:"
 const runningLoc = "bf-handle:asynchCurrentJobs:"
+const attemptsLoc = "bf-handle:asynchAttempts:"
+const retriesLoc = "bf-handle:asynchRetries:"
+const deadLoc = "bf-handle:asynchDeadLetters:"
+const metaLoc = "bf-handle:asynchJobMeta:"
+const schedLoc = "bf-handle:asynchSched:"
+
+// redisTakeScript moves a job from the pending queue to the running queue,
+// leases it, counts the attempt and marks it running, all at once, and
+// returns the attempt and the job's input.  It also moves the lane
+// scheduler on, from the state that the job was picked with.  If the job
+// is no longer pending, or the scheduler has moved on, because another
+// instance took a job first, it returns nil.  The status it writes is laid
+// out as jobStatus would be.
+// KEYS: pending queue, running queue, lease, attempts, status, input,
+// scheduler
+// ARGV: jobID, lease, owner, scheduler as read, scheduler after the pick
+const redisTakeScript = `
+if (redis.call("get", KEYS[7]) or "") ~= ARGV[4] then return false end
+if redis.call("lrem", KEYS[1], 1, ARGV[1]) == 0 then return false end
+redis.call("set", KEYS[7], ARGV[5])
+redis.call("lpush", KEYS[2], ARGV[1])
+redis.call("set", KEYS[3], ARGV[2])
+local attempt = redis.call("incr", KEYS[4])
+redis.call("set", KEYS[5], '{"status":"Running","attempt":' .. attempt .. ',"owner":' .. cjson.encode(ARGV[3]) .. '}')
+return {attempt, redis.call("get", KEYS[6]) or ""}`
+
+// redisFinishScript records the end of a run, unless the job has been
+// cancelled in the meantime, or the run has lost its lease (see lease.go),
+// in which case it returns -1 and leaves the job to whoever has it now.
+// The checks and the writes happen in one script, so a cancellation or a
+// new run cannot land between them and be overwritten.  A job with no
+// owner given has already been reclaimed, and has no lease to check.
+// KEYS: status, running queue, lease, input, meta, output
+// ARGV: jobID, cancelled status, new status, output ("" for none), owner
+const redisFinishScript = `
+if redis.call("get", KEYS[1]) == ARGV[2] then return 0 end
+if ARGV[5] ~= "" then
+	local lease = redis.call("get", KEYS[3])
+	if not lease or cjson.decode(lease).owner ~= ARGV[5] then return -1 end
+	redis.call("lrem", KEYS[2], 0, ARGV[1])
+	redis.call("del", KEYS[3])
+end
+redis.call("del", KEYS[4])
+redis.call("hdel", KEYS[5], ARGV[1])
+if ARGV[4] ~= "" then redis.call("set", KEYS[6], ARGV[4]) end
+redis.call("set", KEYS[1], ARGV[3])
+return 1`
+
+// redisRetryScript and redisDeadScript take a failed run off the running
+// queue, restore the job's input, and either schedule a retry or add the
+// job to the dead-letter list - again, unless it has been cancelled or the
+// run has lost its lease.
+// KEYS: status, running queue, lease, input, retries or dead letters
+// ARGV: jobID, cancelled status, new status, input, retry time, owner
+const (
+	redisRetryScript = `
+if redis.call("get", KEYS[1]) == ARGV[2] then return 0 end
+if ARGV[6] ~= "" then
+	local lease = redis.call("get", KEYS[3])
+	if not lease or cjson.decode(lease).owner ~= ARGV[6] then return -1 end
+	redis.call("lrem", KEYS[2], 0, ARGV[1])
+	redis.call("del", KEYS[3])
+end
+redis.call("set", KEYS[4], ARGV[4])
+redis.call("zadd", KEYS[5], ARGV[5], ARGV[1])
+redis.call("set", KEYS[1], ARGV[3])
+return 1`
+	redisDeadScript = `
+if redis.call("get", KEYS[1]) == ARGV[2] then return 0 end
+if ARGV[6] ~= "" then
+	local lease = redis.call("get", KEYS[3])
+	if not lease or cjson.decode(lease).owner ~= ARGV[6] then return -1 end
+	redis.call("lrem", KEYS[2], 0, ARGV[1])
+	redis.call("del", KEYS[3])
+end
+redis.call("set", KEYS[4], ARGV[4])
+redis.call("rpush", KEYS[5], ARGV[1])
+redis.call("set", KEYS[1], ARGV[3])
+return 1`
+)
+
+// redisCancelScript cancels a job that is pending, running or waiting to
+// be retried, taking it off every queue and marking it cancelled.  The
+// status is checked in the same script, so a job that finishes in the
+// meantime keeps its status.  It returns 1 once the job is cancelled, 0
+// if it already was, -1 if it has finished and -2 if there is no such job.
+// KEYS: status, pending queue, running queue, retries, input, lease, meta
+// ARGV: jobID, cancelled status
+const redisCancelScript = `
+local status = redis.call("get", KEYS[1])
+if not status or status == "" then return -2 end
+if status == ARGV[2] then return 0 end
+local state = cjson.decode(status).status
+if state ~= "Pending" and state ~= "Running" then return -1 end
+redis.call("lrem", KEYS[2], 0, ARGV[1])
+redis.call("lrem", KEYS[3], 0, ARGV[1])
+redis.call("zrem", KEYS[4], ARGV[1])
+redis.call("del", KEYS[5], KEYS[6])
+redis.call("hdel", KEYS[7], ARGV[1])
+redis.call("set", KEYS[1], ARGV[2])
+return 1`
+
+// redisRequeueScript moves a job from the dead-letter list back onto the
+// pending queue, with its attempts reset, returning 0 if it was not in the
+// dead-letter list.
+// KEYS: dead letters, pending queue, attempts, status
+// ARGV: jobID, pending status
+const redisRequeueScript = `
+if redis.call("lrem", KEYS[1], 0, ARGV[1]) == 0 then return 0 end
+redis.call("del", KEYS[3])
+redis.call("set", KEYS[4], ARGV[2])
+redis.call("lpush", KEYS[2], ARGV[1])
+return 1`
+
+// redisQueueScript reads everything that the scheduler needs at once: the
+// pending and running queues, the scheduling details of the jobs, and the
+// lane scheduler's state.
+// KEYS: pending queue, running queue, meta, scheduler
+const redisQueueScript = `
+return {redis.call("lrange", KEYS[1], 0, -1), redis.call("lrange", KEYS[2], 0, -1), redis.call("hgetall", KEYS[3]), redis.call("get", KEYS[4]) or ""}`
+
+// redisSchedMutex keeps this instance's workers from racing each other to
+// move the shared lane scheduler on.
+var redisSchedMutex sync.Mutex
 
 //
 //
@@ -250,26 +613,122 @@ func redisAddJob(jobID, inpObj string) error {
 		redisCli.Set(inpLoc+jobID, "", 0)
 		return idObj.Err()
 	}
-	redisCli.Set(statusLoc+jobID, `{"status":"Pending"}`, 0)
+	redisCli.Set(statusLoc+jobID, jobPending, 0)
 	return nil // failure to set status is not logic-breaking
 }
 
 // redisTakeJob handles the redis side of a worker thread picking
-// up a job from the queue.  It moves the jobID from the "Pending"
-// queue to the "Running" queue, grabs and then clears the input
-// data, and returns jobID and input data in that order to the
-// Callign function.  It will return the empty string and no error
-// if there are no jobs in the queue.
-func redisTakeJob() (string, string, error) {
-	jobObj := redisCli.RPopLPush(jobsLoc, runningLoc)
-	jobID := jobObj.Val()
-	fmt.Println("Job #" + jobID + " retrieved!")
-	if jobID == "" || jobObj.Err() != nil {
-		return "", "", jobObj.Err()
-	}
-	jobDataObj := redisCli.GetSet(inpLoc+jobID, "")
-	redisCli.Set(statusLoc+jobID, `{"status":"Running"}`, 0)
-	return jobID, jobDataObj.Val(), jobDataObj.Err()
+// up a job from the queue.  It asks the lane scheduler which pending
+// job is next, moves that jobID from the "Pending" queue to the
+// "Running" queue under a lease to the given owner, and returns jobID,
+// input data and attempt in that order to the Callign function.  The
+// input is kept until the job is done with, in case it has to be run
+// again.  It will return the empty string and no error if there are no
+// jobs in the queue.
+func redisTakeJob(owner string, until time.Time) (string, string, int, error) {
+	redisSchedMutex.Lock()
+	defer redisSchedMutex.Unlock()
+	for try := 0; try < 5; try++ {
+		pending, running, state, err := redisQueue()
+		if err != nil {
+			return "", "", 0, err
+		}
+		sched := parseLaneScheduler(state)
+		inx := sched.pick(pending, running)
+		if inx < 0 {
+			return "", "", 0, nil
+		}
+		jobID := pending[inx].jobID
+
+		// if another instance took a job first, this one gets nothing,
+		// and has to pick again.
+		keys := []string{jobsLoc, runningLoc, leaseLoc + jobID, attemptsLoc + jobID, statusLoc + jobID, inpLoc + jobID, schedLoc}
+		lease := jobLease{Owner: owner, Expires: until}.String()
+		res, err := redisCli.Eval(redisTakeScript, keys, []string{jobID, lease, owner, state, sched.String()}).Result()
+		if err != nil && err.Error() == "redis: nil" {
+			continue
+		}
+		if err != nil {
+			return "", "", 0, err
+		}
+		vals, ok := res.([]interface{})
+		if !ok || len(vals) != 2 {
+			return "", "", 0, pzsvc.ErrWithTrace(fmt.Sprintf("unexpected reply %v taking job %s", res, jobID))
+		}
+		attempt, _ := vals[0].(int64)
+		inp, _ := vals[1].(string)
+		fmt.Println("Job #" + jobID + " retrieved!")
+		return jobID, inp, int(attempt), nil
+	}
+	return "", "", 0, nil
+}
+
+// redisQueue reads the pending jobs, oldest first, the number of jobs
+// each submitter has running, and the lane scheduler's state, as one
+// snapshot, for the scheduler.
+func redisQueue() ([]queuedJob, map[string]int, string, error) {
+	keys := []string{jobsLoc, runningLoc, metaLoc, schedLoc}
+	res, err := redisCli.Eval(redisQueueScript, keys, nil).Result()
+	if err != nil {
+		return nil, nil, "", err
+	}
+	vals, ok := res.([]interface{})
+	if !ok || len(vals) != 4 {
+		return nil, nil, "", pzsvc.ErrWithTrace(fmt.Sprintf("unexpected reply %v reading the queue", res))
+	}
+	jobIDs, runningIDs, metaVals := redisStrings(vals[0]), redisStrings(vals[1]), redisStrings(vals[2])
+	state, _ := vals[3].(string)
+	metas := make(map[string]string)
+	for inx := 0; inx+1 < len(metaVals); inx += 2 {
+		metas[metaVals[inx]] = metaVals[inx+1]
+	}
+
+	// jobs are pushed on the left, so the list is newest first
+	pending := make([]queuedJob, len(jobIDs))
+	for inx, jobID := range jobIDs {
+		pending[len(jobIDs)-1-inx] = queuedJob{jobID: jobID, meta: redisParseMeta(metas[jobID])}
+	}
+	running := make(map[string]int)
+	for _, jobID := range runningIDs {
+		running[redisParseMeta(metas[jobID]).Submitter]++
+	}
+	return pending, running, state, nil
+}
+
+// redisStrings reads a list out of a script's reply.
+func redisStrings(val interface{}) []string {
+	items, _ := val.([]interface{})
+	strs := make([]string, 0, len(items))
+	for _, item := range items {
+		if str, ok := item.(string); ok {
+			strs = append(strs, str)
+		}
+	}
+	return strs
+}
+
+// redisSetMeta stores the scheduling details of a job.
+func redisSetMeta(jobID string, meta jobMeta) error {
+	byts, _ := json.Marshal(meta)
+	return redisCli.HSet(metaLoc, jobID, string(byts)).Err()
+}
+
+// redisParseMeta reads back the scheduling details of a job.  Jobs with
+// none, such as those queued before there were any, count as normal
+// priority.
+func redisParseMeta(metaStr string) jobMeta {
+	var meta jobMeta
+	json.Unmarshal([]byte(metaStr), &meta)
+	return meta
+}
+
+// redisQueuePosition works out where a job stands in the redis queue.
+func redisQueuePosition(jobID string) (int, error) {
+	pending, running, state, err := redisQueue()
+	if err != nil {
+		return 0, err
+	}
+	return parseLaneScheduler(state).queuePosition(jobID, pending, running), nil
 }
 
 //
@@ -277,21 +736,27 @@ func redisTakeJob() (string, string, error) {
 //
 // output is set before status to ensure that users who
 // receive a status of "Success" are guaranteed to receive
-// an output.
-func redisDoneJob(jobID, output string) error {
-	doneObj := redisCli.LRem(runningLoc, 0, jobID)
-	redisCli.Set(outpLoc+jobID, output, 0)
-	redisCli.Set(statusLoc+jobID, `{"status":"Success"}`, 0)
-	return doneObj.Err()
+// an output.  A job cancelled while it ran stays cancelled, and a run
+// that has lost its lease gets errLeaseLost.
+func redisDoneJob(jobID, owner, output string) error {
+	status := jobStatus{Status: "Success", Attempt: redisAttempts(jobID)}.String()
+	return redisFinishJob(jobID, owner, status, output)
 }
 
 // redisErrorJob is used to try to clean up after a processing error.
 // by its nature, it is an attempt to fail out.  As such, the ability
-// to respond meaningfully to further failures is limited.
-func redisErrorJob(jobID, errString string) {
-	errMsg := `{"status":"Error", "result" : {"type": "error","message": "process failure","details": "` + errString + `"}}`
-	redisCli.Set(statusLoc+jobID, errMsg, 0)
-	redisCli.LRem(runningLoc, 0, jobID)
+// to respond meaningfully to further failures is limited.  As with
+// redisDoneJob, a cancelled job stays cancelled, and a run that has lost
+// its lease gets errLeaseLost.
+func redisErrorJob(jobID, owner, errString string) error {
+	errMsg := jobErrorStatus("process failure", errString, redisAttempts(jobID)).String()
+	return redisFinishJob(jobID, owner, errMsg, "")
+}
+
+// redisFinishJob runs redisFinishScript for a job.
+func redisFinishJob(jobID, owner, status, output string) error {
+	keys := []string{statusLoc + jobID, runningLoc, leaseLoc + jobID, inpLoc + jobID, metaLoc, outpLoc + jobID}
+	return redisLeaseResult(redisCli.Eval(redisFinishScript, keys, []string{jobID, jobCancelled, status, output, owner}).Result())
 }
 
 //
@@ -323,13 +788,76 @@ func redisClearJob(jobID string) [2]error {
 	return [2]error{statResObj.Err(), outpResObj.Err()}
 }
 
-// redisCloseDeadJobs
-// Does not need to worry about thread-safety. This should only
-// ever be called on startup, when there are no other threads to interfere
-func redisCloseDeadJobs() {
-	errMsg := `{"status":"Error", "result" : {"type": "error","message": "crash-interrupt","details": "bf-handle crashed while processing and was rebooted."}}`
-	for jobID := redisCli.RPop(runningLoc).Val(); jobID != ""; jobID = redisCli.RPop(runningLoc).Val() {
-		redisCli.Set(statusLoc+jobID, errMsg, 0)
-		redisCli.Del(inpLoc + jobID)
+// redisAttempts returns the number of attempts made at a job so far.
+func redisAttempts(jobID string) int {
+	attempt, _ := redisCli.Get(attemptsLoc + jobID).Int64()
+	return int(attempt)
+}
+
+// redisRetryJob takes a failed job off the running queue, restores its
+// input, and schedules it to be retried.  Retries are kept in a sorted
+// set, by the time that they are due.  A cancelled job is left alone,
+// and a run that has lost its lease gets errLeaseLost.
+func redisRetryJob(jobID, owner, inp, errStr string, at time.Time) error {
+	status := jobRetryStatus(errStr, redisAttempts(jobID), at)
+	return redisFailJob(redisRetryScript, jobID, owner, status, inp, retriesLoc, strconv.FormatInt(at.Unix(), 10))
+}
+
+// redisPromoteRetries moves every retry that is due onto the pending
+// queue.  Removal from the sorted set is atomic, so each retry is only
+// promoted once, even with several instances of bf-handle at it.
+func redisPromoteRetries() {
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	for _, jobID := range redisCli.ZRangeByScore(retriesLoc, redis.ZRangeByScore{Min: "-inf", Max: now}).Val() {
+		if redisCli.ZRem(retriesLoc, jobID).Val() == 1 {
+			redisCli.LPush(jobsLoc, jobID)
+		}
+	}
+}
+
+// redisDeadJob takes a failed job off the running queue, restores its
+// input, and adds it to the dead-letter list.  A cancelled job is left
+// alone, and a run that has lost its lease gets errLeaseLost.
+func redisDeadJob(jobID, owner, inp, errStr string) error {
+	return redisFailJob(redisDeadScript, jobID, owner, jobDeadStatus(errStr, redisAttempts(jobID)), inp, deadLoc, "")
+}
+
+// redisFailJob runs redisRetryScript or redisDeadScript for a job.
+func redisFailJob(script, jobID, owner, status, inp, listLoc, at string) error {
+	keys := []string{statusLoc + jobID, runningLoc, leaseLoc + jobID, inpLoc + jobID, listLoc}
+	return redisLeaseResult(redisCli.Eval(script, keys, []string{jobID, jobCancelled, status, inp, at, owner}).Result())
+}
+
+func redisDeadJobs() ([]string, error) {
+	deadObj := redisCli.LRange(deadLoc, 0, -1)
+	return deadObj.Val(), deadObj.Err()
+}
+
+// redisRequeueJob runs redisRequeueScript for a job.
+func redisRequeueJob(jobID string) error {
+	keys := []string{deadLoc, jobsLoc, attemptsLoc + jobID, statusLoc + jobID}
+	res, err := redisCli.Eval(redisRequeueScript, keys, []string{jobID, jobPending}).Result()
+	if err != nil {
+		return err
+	}
+	if res != int64(1) {
+		return errJobNotFound
+	}
+	return nil
+}
+
+// redisCancelJob runs redisCancelScript for a job.
+func redisCancelJob(jobID string) error {
+	keys := []string{statusLoc + jobID, jobsLoc, runningLoc, retriesLoc, inpLoc + jobID, leaseLoc + jobID, metaLoc}
+	res, err := redisCli.Eval(redisCancelScript, keys, []string{jobID, jobCancelled}).Result()
+	if err != nil {
+		return err
+	}
+	switch res {
+	case int64(1), int64(0):
+		return nil
+	case int64(-1):
+		return errJobFinished
 	}
+	return errJobNotFound
 }
@@ -15,10 +15,18 @@
 package bf
 
 import (
-	"github.com/venicegeo/pzsvc-image-catalog/catalog"
-	"github.com/venicegeo/pzsvc-lib"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/venicegeo/pzsvc-image-catalog/catalog"
+	"github.com/venicegeo/pzsvc-lib"
 )
 
 /*
@@ -56,21 +64,30 @@ func TestAddAsynchJob(t *testing.T) {
 	catalog.SetMockConnCount(0)
 	outputs := []string{
 		catalog.RedisConvErrStr("Error: totally an error."),
-		catalog.RedisConvStatus("Pending"),
+		catalog.RedisConvInt(1),
+		catalog.RedisConvStatus("OK"),
 		catalog.RedisConvInt(5),
-		catalog.RedisConvStatus("Pending")}
+		catalog.RedisConvStatus("OK")}
 	redisCli = catalog.MakeMockRedisCli(outputs)
 	taskChan = make(chan string)
+	inpStr := `{"pzAuthToken":"aaaa","priority":"high"}`
 	w, outstr, outInt := pzsvc.GetMockResponseWriter()
 	r := http.Request{}
 	r.Method = "POST"
-	r.Body = pzsvc.GetMockReadCloser("string goes here\n")
 
+	r.Body = pzsvc.GetMockReadCloser("string goes here\n")
+	addAsynchJob(w, &r)
+	t.Log(*outstr)
+	if *outInt != http.StatusBadRequest {
+		t.Errorf(`TestAddAsynchJob: accepted a body that is not JSON, with status %d.`, *outInt)
+	}
+	r.Body = pzsvc.GetMockReadCloser(inpStr)
 	addAsynchJob(w, &r)
 	t.Log(*outstr)
 	if *outInt == http.StatusOK {
 		t.Error(`TestAddAsynchJob: passed on what should have been an error return.`)
 	}
+	r.Body = pzsvc.GetMockReadCloser(inpStr)
 	addAsynchJob(w, &r)
 	t.Log(*outstr)
 	if *outInt != http.StatusOK {
@@ -126,18 +143,18 @@ func TestRedisTakeJob(t *testing.T) {
 		catalog.RedisConvString("123"),
 		catalog.RedisConvStatus("Pending")}
 	redisCli = catalog.MakeMockRedisCli(outputs)
-	out1, out2, _ := redisTakeJob()
+	out1, out2, _, _ := redisTakeJob(instanceID, time.Now().Add(leaseDuration))
 	t.Log(out1)
 	t.Log(out2)
 }
 func TestRedisDoneJob(t *testing.T) {
 	catalog.SetMockConnCount(0)
-	_ = redisDoneJob("123", "test")
+	_ = redisDoneJob("123", instanceID, "test")
 }
 
 func TestRedisErrorJob(t *testing.T) {
 	catalog.SetMockConnCount(0)
-	redisErrorJob("123", "test")
+	redisErrorJob("123", instanceID, "test")
 }
 
 func TestRedisClearJob(t *testing.T) {
@@ -145,9 +162,255 @@ func TestRedisClearJob(t *testing.T) {
 	_ = redisClearJob("123")
 }
 
-func TestRedisCloseDeadJobs(t *testing.T) {
-	redisCloseDeadJobs()
-}
 func TestPrepAsynch(t *testing.T) {
-	prepAsynch()
+	prepAsynch(PzGateway{})
+}
+
+func TestMemoryJobStore(t *testing.T) {
+	store := NewMemoryJobStore()
+	if jobID, _, _, err := store.TakeJob(instanceID, time.Now().Add(leaseDuration)); jobID != "" || err != nil {
+		t.Error(`TestMemoryJobStore: took a job from an empty store.`)
+	}
+	store.AddJob("a", "inpA", jobMeta{})
+	store.AddJob("b", "inpB", jobMeta{})
+	if status, _ := store.Status("b"); status != jobPending {
+		t.Errorf(`TestMemoryJobStore: unexpected status %s.`, status)
+	}
+	jobID, inp, attempt, err := store.TakeJob(instanceID, time.Now().Add(leaseDuration))
+	if jobID != "a" || inp != "inpA" || attempt != 1 || err != nil {
+		t.Errorf(`TestMemoryJobStore: took %s/%s rather than the oldest job.`, jobID, inp)
+	}
+	if status, _ := store.Status("a"); parseJobStatus(status) != (jobStatus{Status: "Running", Attempt: 1, Owner: instanceID}) {
+		t.Errorf(`TestMemoryJobStore: unexpected status %s.`, status)
+	}
+	if _, err = store.Results("a"); err != errJobNotFound {
+		t.Error(`TestMemoryJobStore: got results for a running job.`)
+	}
+	store.DoneJob("a", instanceID, "outA")
+	if outp, err := store.Results("a"); outp != "outA" || err != nil {
+		t.Errorf(`TestMemoryJobStore: unexpected results %s.`, outp)
+	}
+	store.TakeJob(instanceID, time.Now().Add(leaseDuration))
+	store.ErrorJob("b", instanceID, "oops")
+	if status, _ := store.Status("b"); !strings.Contains(status, `"Error"`) || !strings.Contains(status, "oops") {
+		t.Errorf(`TestMemoryJobStore: unexpected status %s.`, status)
+	}
+	if _, err = store.Status("d"); err != errJobNotFound {
+		t.Error(`TestMemoryJobStore: found a job that was never added.`)
+	}
+}
+
+func TestMemoryJobStoreEviction(t *testing.T) {
+	store := NewMemoryJobStore()
+	store.AddJob("old", "inpOld", jobMeta{})
+	store.AddJob("recent", "inpRecent", jobMeta{})
+	store.TakeJob(instanceID, time.Now().Add(leaseDuration))
+	store.DoneJob("old", instanceID, "outOld")
+	store.CancelJob("recent")
+	store.finished["old"] = time.Now().Add(-2 * memoryJobTTL)
+	store.AddJob("new", "inpNew", jobMeta{})
+	if _, err := store.Status("old"); err != errJobNotFound {
+		t.Error(`TestMemoryJobStoreEviction: expired job was kept.`)
+	}
+	if _, err := store.Results("old"); err != errJobNotFound {
+		t.Error(`TestMemoryJobStoreEviction: results of an expired job were kept.`)
+	}
+	if status, _ := store.Status("recent"); status != jobCancelled {
+		t.Errorf(`TestMemoryJobStoreEviction: recent job has status %s.`, status)
+	}
+	if status, _ := store.Status("new"); status != jobPending {
+		t.Errorf(`TestMemoryJobStoreEviction: new job has status %s.`, status)
+	}
+}
+
+func TestAsynchMemoryStore(t *testing.T) {
+	defer SetJobStore(jobStore)
+	store := NewMemoryJobStore()
+	SetJobStore(store)
+	taskChan = make(chan string)
+
+	w, outStr, outInt := pzsvc.GetMockResponseWriter()
+	r := http.Request{Method: "POST", Body: pzsvc.GetMockReadCloser(`{"algoType":"ndwi"}`)}
+	addAsynchJob(w, &r)
+	var resp struct {
+		Data struct {
+			JobID string `json:"jobId"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal([]byte(*outStr), &resp); err != nil || *outInt != http.StatusOK {
+		t.Fatalf(`TestAsynchMemoryStore: could not add job: %s`, *outStr)
+	}
+	jobID := resp.Data.JobID
+
+	w, outStr, outInt = pzsvc.GetMockResponseWriter()
+	getAsynchStatus(w, jobID)
+	if *outInt != http.StatusOK || *outStr != (jobStatus{Status: "Pending", Position: 1}).String() {
+		t.Errorf(`TestAsynchMemoryStore: unexpected status %d %s.`, *outInt, *outStr)
+	}
+	w, _, outInt = pzsvc.GetMockResponseWriter()
+	getAsynchResults(w, jobID)
+	if *outInt != http.StatusBadRequest {
+		t.Errorf(`TestAsynchMemoryStore: got results for a pending job.`)
+	}
+	w, _, outInt = pzsvc.GetMockResponseWriter()
+	getAsynchStatus(w, "no-such-job")
+	if *outInt != http.StatusBadRequest {
+		t.Errorf(`TestAsynchMemoryStore: found a job that does not exist.`)
+	}
+
+	if taken, inp, _, _ := store.TakeJob(instanceID, time.Now().Add(leaseDuration)); taken != jobID || inp != `{"algoType":"ndwi"}` {
+		t.Errorf(`TestAsynchMemoryStore: job input was not stored.`)
+	}
+	store.DoneJob(jobID, instanceID, `{"shoreDataID":"x"}`)
+	w, outStr, outInt = pzsvc.GetMockResponseWriter()
+	getAsynchResults(w, jobID)
+	if *outInt != http.StatusOK || *outStr != `{"shoreDataID":"x"}` {
+		t.Errorf(`TestAsynchMemoryStore: unexpected results %d %s.`, *outInt, *outStr)
+	}
+}
+
+func TestCancelAsynchJob(t *testing.T) {
+	defer SetJobStore(jobStore)
+	store := NewMemoryJobStore()
+	SetJobStore(store)
+
+	store.AddJob("a", "inpA", jobMeta{})
+	store.AddJob("b", "inpB", jobMeta{})
+	w, outStr, outInt := pzsvc.GetMockResponseWriter()
+	cancelAsynchJob(w, "a")
+	if *outInt != http.StatusOK || *outStr != jobCancelled {
+		t.Errorf(`TestCancelAsynchJob: unexpected response %d %s.`, *outInt, *outStr)
+	}
+	if jobID, _, _, _ := store.TakeJob(instanceID, time.Now().Add(leaseDuration)); jobID != "b" {
+		t.Errorf(`TestCancelAsynchJob: cancelled job was still queued.`)
+	}
+
+	// b is now running in this instance
+	ctx, endJob := startJob("b", instanceID)
+	defer endJob()
+	w, _, outInt = pzsvc.GetMockResponseWriter()
+	cancelAsynchJob(w, "b")
+	if *outInt != http.StatusOK || ctx.Err() == nil {
+		t.Error(`TestCancelAsynchJob: running job was not cancelled.`)
+	}
+	store.DoneJob("b", instanceID, "outB")
+	if status, _ := store.Status("b"); status != jobCancelled {
+		t.Errorf(`TestCancelAsynchJob: cancelled job finished as %s.`, status)
+	}
+
+	store.AddJob("c", "inpC", jobMeta{})
+	store.TakeJob(instanceID, time.Now().Add(leaseDuration))
+	store.DoneJob("c", instanceID, "outC")
+	w, _, outInt = pzsvc.GetMockResponseWriter()
+	cancelAsynchJob(w, "c")
+	if *outInt != http.StatusConflict {
+		t.Errorf(`TestCancelAsynchJob: cancelled a finished job.`)
+	}
+	w, _, outInt = pzsvc.GetMockResponseWriter()
+	cancelAsynchJob(w, "d")
+	if *outInt != http.StatusBadRequest {
+		t.Errorf(`TestCancelAsynchJob: cancelled a job that does not exist.`)
+	}
+
+	// e is waiting to be retried
+	store.AddJob("e", "inpE", jobMeta{})
+	store.TakeJob(instanceID, time.Now().Add(leaseDuration))
+	store.RetryJob("e", instanceID, "inpE", "oops", time.Now())
+	for try := 0; try < 2; try++ {
+		w, _, outInt = pzsvc.GetMockResponseWriter()
+		cancelAsynchJob(w, "e")
+		if *outInt != http.StatusOK {
+			t.Errorf(`TestCancelAsynchJob: cancelling a job waiting to be retried returned %d.`, *outInt)
+		}
+	}
+	if jobID, _, _, _ := store.TakeJob(instanceID, time.Now().Add(leaseDuration)); jobID != "" {
+		t.Errorf(`TestCancelAsynchJob: took cancelled job %s.`, jobID)
+	}
+}
+
+func TestStartJobPolls(t *testing.T) {
+	defer SetJobStore(jobStore)
+	defer func(interval time.Duration) { cancelPollInterval = interval }(cancelPollInterval)
+	store := NewMemoryJobStore()
+	SetJobStore(store)
+	cancelPollInterval = time.Millisecond
+
+	// cancelled through the store, as another instance would
+	store.AddJob("a", "inpA", jobMeta{})
+	store.TakeJob(instanceID, time.Now().Add(leaseDuration))
+	ctx, endJob := startJob("a", instanceID)
+	defer endJob()
+	store.CancelJob("a")
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Error(`TestStartJobPolls: job was not cancelled through the store.`)
+	}
+}
+
+func TestAwaitCtx(t *testing.T) {
+	if err := awaitCtx(context.Background(), func() error { return errors.New("oops") }); err == nil || err.Error() != "oops" {
+		t.Error(`TestAwaitCtx: did not return the call's error.`)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	release := make(chan bool)
+	defer close(release)
+	go cancel()
+	if err := awaitCtx(ctx, func() error { <-release; return nil }); err != context.Canceled {
+		t.Errorf(`TestAwaitCtx: unexpected error %v from a cancelled call.`, err)
+	}
+	if err := awaitCtx(ctx, func() error { t.Error(`TestAwaitCtx: made a call after cancellation.`); return nil }); err != context.Canceled {
+		t.Errorf(`TestAwaitCtx: unexpected error %v.`, err)
+	}
+}
+
+func TestRequestKnownJSONCtx(t *testing.T) {
+	release := make(chan bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			<-release
+			return
+		}
+		w.Write([]byte(`{"currentTide":1.5}`))
+	}))
+	defer server.Close()
+	defer close(release)
+
+	var out tideOut
+	if _, err := requestKnownJSONCtx(context.Background(), "POST", `{}`, server.URL, "", &out); err != nil || out.CurrTide != 1.5 {
+		t.Errorf(`TestRequestKnownJSONCtx: got %v, %v.`, out, err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := (remoteTides{url: server.URL + "/slow"}).tide(ctx, tideIn{}); err == nil {
+		t.Error(`TestRequestKnownJSONCtx: a cancelled tide lookup succeeded.`)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Error(`TestRequestKnownJSONCtx: the tide lookup did not stop when cancelled.`)
+	}
+}
+
+// upstreamMock answers upstreamClient's requests with canned bodies, in
+// order, as pzsvc.SetMockClient does for pzsvc-lib's client.  Once they run
+// out, it answers with an empty object.
+type upstreamMock struct {
+	outs   []string
+	status int
+}
+
+func (mock *upstreamMock) RoundTrip(req *http.Request) (*http.Response, error) {
+	body := "{}"
+	if len(mock.outs) > 0 {
+		body, mock.outs = mock.outs[0], mock.outs[1:]
+	}
+	return &http.Response{StatusCode: mock.status, Header: http.Header{}, Body: ioutil.NopCloser(strings.NewReader(body)), Request: req}, nil
+}
+
+// setMockUpstream points upstreamClient at an upstreamMock, and returns a
+// function that puts the real client back.
+func setMockUpstream(outs []string, status int) func() {
+	realClient := upstreamClient
+	upstreamClient = &http.Client{Transport: &upstreamMock{outs: outs, status: status}}
+	return func() { upstreamClient = realClient }
 }
@@ -0,0 +1,452 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bf
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/venicegeo/geojson-go/geojson"
+	"github.com/venicegeo/pzsvc-lib"
+)
+
+/*
+This file keeps track of executeBatch jobs, so that callers can follow
+a batch along without having to listen for Piazza events.  Each batch gets
+a jobId when it starts, and keeps a state for each of its footprints as
+detection moves through them.  Running jobs live in memory, and are
+checkpointed as they go (see checkpoint.go) so that they can be reported
+on and resumed after a restart.
+*/
+
+// Batch job statuses
+const (
+	batchRunning     = "Running"
+	batchAssembling  = "Assembling"
+	batchSuccess     = "Success"
+	batchError       = "Error"
+	batchInterrupted = "Interrupted" // cut off by a crash or restart, and not yet resumed
+)
+
+// Footprint states within a batch job
+const (
+	footprintPending   = "pending"
+	footprintCached    = "cached"
+	footprintSkipped   = "skipped"
+	footprintDetecting = "detecting"
+	footprintDetected  = "detected"
+	footprintFailed    = "failed"
+)
+
+type footprintStatus struct {
+	SceneID     string    `json:"sceneId"`
+	State       string    `json:"state"`
+	Reason      string    `json:"reason,omitempty"`
+	ShoreDataID string    `json:"shoreDataID,omitempty"`
+	ShoreDeplID string    `json:"shoreDeplID,omitempty"`
+	QA          *qaReport `json:"qa,omitempty"`
+}
+
+type batchStatus struct {
+	JobID            string            `json:"jobId"`
+	Status           string            `json:"status"`
+	FootprintsDataID string            `json:"footprintsDataID,omitempty"`
+	ShoreDataID      string            `json:"shoreDataID,omitempty"`
+	ShoreDeplID      string            `json:"shoreDeplID,omitempty"`
+	Coverage         *coverageReport   `json:"coverage,omitempty"`
+	QA               *qaReport         `json:"qa,omitempty"`
+	Footprints       []footprintStatus `json:"footprints"`
+	CheckpointError  string            `json:"checkpointError,omitempty"` // why the job could not be checkpointed, if it could not
+	errMsg           string
+}
+
+type batchResult struct {
+	JobID            string `json:"jobId"`
+	FootprintsDataID string `json:"footprintsDataID,omitempty"`
+	ShoreDataID      string `json:"shoreDataID"`
+	ShoreDeplID      string `json:"shoreDeplID"`
+}
+
+// batchJob is the running record of a single executeBatch call.  It is
+// updated from the detection goroutine and read from status calls, and
+// so all access goes through its methods.
+type batchJob struct {
+	mutex    sync.Mutex
+	status   batchStatus
+	finished time.Time // when the job succeeded or failed, if it has
+	dirty    bool      // whether the status has changed since it was last checkpointed
+	saving   bool      // whether a checkpoint is being written
+	lease    *batchLease
+}
+
+var (
+	batchJobs      = make(map[string]*batchJob)
+	batchJobsMutex sync.Mutex
+)
+
+// batchJobTTL is how long a finished batch job is kept in memory.  After
+// that, its status and result come from its checkpoint.
+const batchJobTTL = time.Hour
+
+// evictBatchJobs drops finished jobs that have outlived batchJobTTL.  The
+// caller must hold batchJobsMutex.
+func evictBatchJobs() {
+	cutoff := time.Now().Add(-batchJobTTL)
+	for jobID, job := range batchJobs {
+		job.mutex.Lock()
+		expired := !job.finished.IsZero() && job.finished.Before(cutoff)
+		job.mutex.Unlock()
+		if expired {
+			delete(batchJobs, jobID)
+		}
+	}
+}
+
+// newBatchJob registers a new batch job for the given footprints, with
+// each footprint pending, and checkpoints it.  The coverage report is nil
+// when the footprints came from an earlier call.
+func newBatchJob(inpObj asInpStruct, footprints *geojson.FeatureCollection, footprintsDataID string, coverage *coverageReport) (*batchJob, error) {
+	jobID, err := pzsvc.PsuUUID()
+	if err != nil {
+		return nil, pzsvc.TraceErr(err)
+	}
+	// with redis down, the state checkpoints report the same error
+	if err = saveBatchInput(jobID, inpObj, footprints); err != nil && err != errCheckpointsInMemory {
+		return nil, err
+	}
+	job := &batchJob{status: batchStatus{
+		JobID:            jobID,
+		Status:           batchRunning,
+		FootprintsDataID: footprintsDataID,
+		Coverage:         coverage,
+		Footprints:       make([]footprintStatus, len(footprints.Features))}}
+	for inx, footprint := range footprints.Features {
+		job.status.Footprints[inx] = footprintStatus{SceneID: footprint.IDStr(), State: footprintPending}
+	}
+	var ok bool
+	if job.lease, ok = holdBatchLease(jobID); !ok {
+		return nil, pzsvc.ErrWithTrace("Could not take the lease on new job " + jobID + ".")
+	}
+
+	batchJobsMutex.Lock()
+	evictBatchJobs()
+	batchJobs[jobID] = job
+	batchJobsMutex.Unlock()
+	job.update(func() {})
+	return job, nil
+}
+
+// resumedBatchJob registers a batch job to carry on from the given
+// checkpointed status.  Footprints that already have a shoreline keep it,
+// and all others go back to pending.  If the job is still running, here or
+// on another instance, it is left alone and nil is returned.
+func resumedBatchJob(status batchStatus) *batchJob {
+	lease, ok := holdBatchLease(status.JobID)
+	if !ok {
+		return nil
+	}
+	batchJobsMutex.Lock()
+	if current := batchJobs[status.JobID]; current != nil {
+		if state := current.snapshot().Status; state == batchRunning || state == batchAssembling {
+			batchJobsMutex.Unlock()
+			lease.release()
+			return nil
+		}
+	}
+
+	job := &batchJob{status: status, lease: lease}
+	job.status.Status = batchRunning
+	job.status.errMsg = ""
+	job.status.ShoreDataID = ""
+	job.status.ShoreDeplID = ""
+	for inx, fpStatus := range job.status.Footprints {
+		if !fpStatus.done() {
+			job.status.Footprints[inx] = footprintStatus{SceneID: fpStatus.SceneID, State: footprintPending}
+		}
+	}
+	evictBatchJobs()
+	batchJobs[status.JobID] = job
+	batchJobsMutex.Unlock()
+	job.update(func() {})
+	return job
+}
+
+// done reports whether the footprint has a shoreline.
+func (fpStatus footprintStatus) done() bool {
+	return (fpStatus.State == footprintDetected || fpStatus.State == footprintCached) && fpStatus.ShoreDataID != ""
+}
+
+// getBatchJob returns the batch job with the given ID, or nil if there
+// is none.
+func getBatchJob(jobID string) *batchJob {
+	batchJobsMutex.Lock()
+	defer batchJobsMutex.Unlock()
+	return batchJobs[jobID]
+}
+
+func (job *batchJob) id() string {
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+	return job.status.JobID
+}
+
+// update makes a change to the job under its lock, and then checkpoints
+// the job outside of it, so that workers are not held up by redis.  Only
+// one goroutine writes checkpoints at a time.  Changes made while it is
+// writing are left for it to pick up, so that checkpoints go out in order
+// and the last one is always current.
+func (job *batchJob) update(change func()) {
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+	change()
+	job.dirty = true
+	if job.saving {
+		return
+	}
+	job.saving = true
+	for job.dirty {
+		job.dirty = false
+		status := job.copyStatus()
+		job.mutex.Unlock()
+		err := saveBatchState(status)
+		job.mutex.Lock()
+		job.status.CheckpointError = ""
+		if err != nil {
+			job.status.CheckpointError = err.Error()
+		}
+	}
+	job.saving = false
+}
+
+// setFootprint updates the state of the footprint at the given index.
+func (job *batchJob) setFootprint(inx int, state, reason, shoreDataID, shoreDeplID string) {
+	job.update(func() {
+		fpStatus := &job.status.Footprints[inx]
+		fpStatus.State = state
+		fpStatus.Reason = reason
+		fpStatus.ShoreDataID = shoreDataID
+		fpStatus.ShoreDeplID = shoreDeplID
+	})
+}
+
+// footprint returns the current status of the footprint at the given
+// index.
+func (job *batchJob) footprint(inx int) footprintStatus {
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+	return job.status.Footprints[inx]
+}
+
+// setFootprintQA records the QA report of the footprint at the given
+// index.
+func (job *batchJob) setFootprintQA(inx int, report *qaReport) {
+	job.update(func() { job.status.Footprints[inx].QA = report })
+}
+
+// setQA records the QA summary of the whole batch.
+func (job *batchJob) setQA(report *qaReport) {
+	job.update(func() { job.status.QA = report })
+}
+
+func (job *batchJob) setStatus(status string) {
+	job.update(func() { job.status.Status = status })
+}
+
+func (job *batchJob) fail(errMsg string) {
+	job.update(func() {
+		job.status.Status = batchError
+		job.status.errMsg = errMsg
+		job.finished = time.Now()
+	})
+}
+
+func (job *batchJob) succeed(shoreDataID, shoreDeplID string) {
+	job.update(func() {
+		job.status.Status = batchSuccess
+		job.status.ShoreDataID = shoreDataID
+		job.status.ShoreDeplID = shoreDeplID
+		job.finished = time.Now()
+	})
+}
+
+// snapshot returns a copy of the job status that is safe to read at
+// leisure.
+func (job *batchJob) snapshot() batchStatus {
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+	return job.copyStatus()
+}
+
+// copyStatus copies the job status.  The caller must hold the lock.
+func (job *batchJob) copyStatus() batchStatus {
+	result := job.status
+	result.Footprints = append([]footprintStatus(nil), job.status.Footprints...)
+	return result
+}
+
+// writeBatchStarted responds to a call that starts a batch job running.
+func writeBatchStarted(w http.ResponseWriter, status batchStatus) {
+	data := struct {
+		JobID            string          `json:"jobId"`
+		FootprintsDataID string          `json:"footprintsDataID"`
+		Coverage         *coverageReport `json:"coverage,omitempty"`
+	}{status.JobID, status.FootprintsDataID, status.Coverage}
+	byts, err := json.Marshal(data)
+	if err != nil {
+		pzsvc.HTTPOut(w, `{"Errors": "`+pzsvc.TraceStr(err.Error())+`"}`, http.StatusInternalServerError)
+		return
+	}
+	pzsvc.HTTPOut(w, `{"type":"job","data":`+string(byts)+`}`, http.StatusOK)
+}
+
+// HandleBatch determines which of the executeBatch functions is appropriate
+// for the given call: starting a new batch, reporting on the status or
+// results of an existing one, or resuming one that was interrupted.
+func HandleBatch(w http.ResponseWriter, r *http.Request, gw Gateway) {
+	batchRecoverOnce.Do(recoverBatchJobs)
+	pathStrs := strings.Split(r.URL.Path, "/")
+	if len(pathStrs) == 2 {
+		ExecuteBatch(w, r, gw)
+		return
+	}
+	if len(pathStrs) != 4 {
+		pzsvc.HTTPOut(w, `{"Errors": "Incorrect path length for bf-handle executeBatch.",  "Given Path":"`+r.URL.Path+`"}`, http.StatusBadRequest)
+		return
+	}
+	switch pathStrs[2] {
+	case "status":
+		getBatchStatus(w, pathStrs[3])
+	case "result":
+		getBatchResult(w, pathStrs[3])
+	case "resume":
+		resumeBatch(w, r, pathStrs[3], gw)
+	default:
+		pzsvc.HTTPOut(w, `{"Errors": "Not a valid path for bf-handle executeBatch.",  "Given Path":"`+r.URL.Path+`"}`, http.StatusBadRequest)
+	}
+}
+
+// getBatchStatus reports on the overall status of the given batch job and
+// on the state of each of its footprints.  Jobs from before a restart are
+// reported as of their last checkpoint.
+func getBatchStatus(w http.ResponseWriter, jobID string) {
+	status, err := batchJobStatus(jobID)
+	if err != nil {
+		handleOut(w, err.Error(), batchStatus{JobID: jobID}, http.StatusInternalServerError)
+		return
+	}
+	if status == nil {
+		handleOut(w, "Job not found: "+jobID, batchStatus{JobID: jobID}, http.StatusNotFound)
+		return
+	}
+	handleOut(w, status.errMsg, status, http.StatusOK)
+}
+
+// batchJobStatus returns the status of the given job, from memory if it
+// is there and from its checkpoint if not, or nil if there is no such job.
+// A checkpointed job that is not running anywhere is interrupted.
+func batchJobStatus(jobID string) (*batchStatus, error) {
+	if job := getBatchJob(jobID); job != nil {
+		status := job.snapshot()
+		return &status, nil
+	}
+	status, err := loadBatchState(jobID)
+	if status != nil {
+		markInterrupted(status)
+	}
+	return status, err
+}
+
+// getBatchResult reports the shoreline dataId and deploymentId of the given
+// batch job, once it has finished successfully.
+func getBatchResult(w http.ResponseWriter, jobID string) {
+	status, err := batchJobStatus(jobID)
+	if err != nil {
+		handleOut(w, err.Error(), batchResult{JobID: jobID}, http.StatusInternalServerError)
+		return
+	}
+	if status == nil {
+		handleOut(w, "Job not found: "+jobID, batchResult{JobID: jobID}, http.StatusNotFound)
+		return
+	}
+	result := batchResult{
+		JobID:            status.JobID,
+		FootprintsDataID: status.FootprintsDataID,
+		ShoreDataID:      status.ShoreDataID,
+		ShoreDeplID:      status.ShoreDeplID}
+	switch status.Status {
+	case batchSuccess:
+		handleOut(w, "", result, http.StatusOK)
+	case batchError:
+		handleOut(w, status.errMsg, result, http.StatusInternalServerError)
+	default:
+		handleOut(w, "Job "+jobID+" has not finished.  Status: "+status.Status, result, http.StatusConflict)
+	}
+}
+
+// Defaults for batch detection concurrency, overridable through
+// BFH_BATCH_WORKERS, BFH_MAX_BATCH_WORKERS and BFH_ALGO_URL_LIMIT.
+const (
+	defaultBatchWorkers    = 4
+	defaultMaxBatchWorkers = 16
+	defaultAlgoURLLimit    = 2
+)
+
+var (
+	algoURLSems      = make(map[string]pzsvc.Semaphore)
+	algoURLSemsMutex sync.Mutex
+)
+
+// envInt returns the positive integer value of the given environment
+// variable, or the default if it is unset or invalid.
+func envInt(name string, dflt int) int {
+	if val, err := strconv.Atoi(os.Getenv(name)); err == nil && val > 0 {
+		return val
+	}
+	return dflt
+}
+
+// batchWorkerCount decides how many footprints a batch detects at once:
+// the number requested if any, else BFH_BATCH_WORKERS, but never more than
+// BFH_MAX_BATCH_WORKERS, nor more than there are footprints.
+func batchWorkerCount(requested, footprintCount int) int {
+	result := requested
+	if result <= 0 {
+		result = envInt("BFH_BATCH_WORKERS", defaultBatchWorkers)
+	}
+	if maxWorkers := envInt("BFH_MAX_BATCH_WORKERS", defaultMaxBatchWorkers); result > maxWorkers {
+		result = maxWorkers
+	}
+	if result > footprintCount {
+		result = footprintCount
+	}
+	return result
+}
+
+// algoURLSemaphore returns the semaphore that limits how many detections
+// may run against the given algorithm URL at once, across all batches.
+// In-process algorithms have no URL, and share the limit for "".
+func algoURLSemaphore(algoURL string) pzsvc.Semaphore {
+	algoURLSemsMutex.Lock()
+	defer algoURLSemsMutex.Unlock()
+	if algoURLSems[algoURL] == nil {
+		algoURLSems[algoURL] = make(pzsvc.Semaphore, envInt("BFH_ALGO_URL_LIMIT", defaultAlgoURLLimit))
+	}
+	return algoURLSems[algoURL]
+}
@@ -0,0 +1,155 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bf
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/venicegeo/geojson-go/geojson"
+	"github.com/venicegeo/pzsvc-lib"
+)
+
+func TestBatchJob(t *testing.T) {
+	footprints := geojson.NewFeatureCollection([]*geojson.Feature{
+		geojson.NewFeature(nil, "landsat:A", nil),
+		geojson.NewFeature(nil, "landsat:B", nil)})
+	job, err := newBatchJob(asInpStruct{}, footprints, "fpData", nil)
+	if err != nil {
+		t.Fatal(`TestBatchJob: failed to create job: ` + err.Error())
+	}
+	if getBatchJob(job.id()) != job {
+		t.Fatal(`TestBatchJob: could not find the new job.`)
+	}
+
+	getPath := func(path string) (string, int) {
+		w, outStr, outInt := pzsvc.GetMockResponseWriter()
+		r := http.Request{Method: "GET", URL: &url.URL{Path: path}}
+		HandleBatch(w, &r, PzGateway{})
+		return *outStr, *outInt
+	}
+
+	job.setFootprint(0, footprintCached, "", "shore1", "depl1")
+	job.setFootprint(1, footprintFailed, "no such band", "", "")
+	outStr, outInt := getPath("/executeBatch/status/" + job.id())
+	if outInt != http.StatusOK {
+		t.Fatalf(`TestBatchJob: status failed with %d: %s`, outInt, outStr)
+	}
+	var status batchStatus
+	if err = json.Unmarshal([]byte(outStr), &status); err != nil {
+		t.Fatal(`TestBatchJob: could not read status: ` + err.Error())
+	}
+	if status.Status != batchRunning || len(status.Footprints) != 2 ||
+		status.Footprints[0].State != footprintCached || status.Footprints[0].ShoreDataID != "shore1" ||
+		status.Footprints[1].State != footprintFailed || status.Footprints[1].Reason != "no such band" {
+		t.Errorf(`TestBatchJob: unexpected status %s`, outStr)
+	}
+
+	if _, outInt = getPath("/executeBatch/result/" + job.id()); outInt != http.StatusConflict {
+		t.Errorf(`TestBatchJob: result of an unfinished job returned %d.`, outInt)
+	}
+	job.succeed("shoreAll", "deplAll")
+	outStr, outInt = getPath("/executeBatch/result/" + job.id())
+	var result batchResult
+	if err = json.Unmarshal([]byte(outStr), &result); err != nil || outInt != http.StatusOK {
+		t.Fatalf(`TestBatchJob: result failed with %d: %s`, outInt, outStr)
+	}
+	if result.ShoreDataID != "shoreAll" || result.ShoreDeplID != "deplAll" || result.FootprintsDataID != "fpData" {
+		t.Errorf(`TestBatchJob: unexpected result %s`, outStr)
+	}
+
+	if _, outInt = getPath("/executeBatch/status/nonesuch"); outInt != http.StatusNotFound {
+		t.Errorf(`TestBatchJob: unknown job returned %d.`, outInt)
+	}
+	if _, outInt = getPath("/executeBatch/bogus/" + job.id()); outInt != http.StatusBadRequest {
+		t.Errorf(`TestBatchJob: bad path returned %d.`, outInt)
+	}
+}
+
+func TestDetectFootprints(t *testing.T) {
+	var features []*geojson.Feature
+	for inx := 0; inx < 10; inx++ {
+		props := map[string]interface{}{}
+		if inx%3 != 0 {
+			props["cache.shoreDataID"] = fmt.Sprintf("shore%d", inx)
+			props["cache.shoreDeplID"] = fmt.Sprintf("depl%d", inx)
+		}
+		features = append(features, geojson.NewFeature(nil, fmt.Sprintf("landsat:%d", inx), props))
+	}
+	footprints := geojson.NewFeatureCollection(features)
+	inpObj := asInpStruct{SkipDetection: true, Workers: 3}
+	job, err := newBatchJob(inpObj, footprints, "", nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	results := detectFootprints(job, inpObj, footprints, PzGateway{})
+	if len(results) != len(features) {
+		t.Fatalf(`TestDetectFootprints: expected %d results, got %d.`, len(features), len(results))
+	}
+	status := job.snapshot()
+	for inx, result := range results {
+		if inx%3 == 0 {
+			if result != nil || status.Footprints[inx].State != footprintSkipped {
+				t.Errorf(`TestDetectFootprints: footprint %d should have been skipped.`, inx)
+			}
+			continue
+		}
+		if result != features[inx] || result.PropertyString("shoreDataID") != fmt.Sprintf("shore%d", inx) {
+			t.Errorf(`TestDetectFootprints: result %d is out of order.`, inx)
+		}
+		if status.Footprints[inx].State != footprintCached || status.Footprints[inx].ShoreDeplID != fmt.Sprintf("depl%d", inx) {
+			t.Errorf(`TestDetectFootprints: footprint %d has status %#v.`, inx, status.Footprints[inx])
+		}
+	}
+}
+
+func TestBatchWorkerCount(t *testing.T) {
+	if count := batchWorkerCount(0, 100); count != defaultBatchWorkers {
+		t.Errorf(`TestBatchWorkerCount: default came out as %d.`, count)
+	}
+	if count := batchWorkerCount(8, 100); count != 8 {
+		t.Errorf(`TestBatchWorkerCount: requested 8, got %d.`, count)
+	}
+	if count := batchWorkerCount(100000, 100000); count != defaultMaxBatchWorkers {
+		t.Errorf(`TestBatchWorkerCount: expected no more than %d workers, got %d.`, defaultMaxBatchWorkers, count)
+	}
+	if count := batchWorkerCount(8, 2); count != 2 {
+		t.Errorf(`TestBatchWorkerCount: expected no more workers than footprints, got %d.`, count)
+	}
+	if sem := algoURLSemaphore("http://algo"); cap(sem) != defaultAlgoURLLimit || algoURLSemaphore("http://algo") != sem {
+		t.Error(`TestBatchWorkerCount: algorithm URL semaphore is not shared, or has the wrong limit.`)
+	}
+}
+
+func TestEvictBatchJobs(t *testing.T) {
+	old := &batchJob{status: batchStatus{JobID: "evict-old", Status: batchSuccess}, finished: time.Now().Add(-2 * batchJobTTL)}
+	recent := &batchJob{status: batchStatus{JobID: "evict-recent", Status: batchError}, finished: time.Now()}
+	running := &batchJob{status: batchStatus{JobID: "evict-running", Status: batchRunning}}
+	batchJobsMutex.Lock()
+	batchJobs["evict-old"], batchJobs["evict-recent"], batchJobs["evict-running"] = old, recent, running
+	evictBatchJobs()
+	batchJobsMutex.Unlock()
+	if getBatchJob("evict-old") != nil {
+		t.Error(`TestEvictBatchJobs: expired job was kept.`)
+	}
+	if getBatchJob("evict-recent") != recent || getBatchJob("evict-running") != running {
+		t.Error(`TestEvictBatchJobs: live jobs were evicted.`)
+	}
+}
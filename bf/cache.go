@@ -15,6 +15,7 @@
 package bf
 
 import (
+	"context"
 	"encoding/json"
 	"log"
 	"net/http"
@@ -40,23 +41,23 @@ func cacheInit() {
 	cacheMapSem = make(pzsvc.Semaphore, 1)
 }
 
-func cachedProcessScene(key string, shouldReadCache bool, inpObj *gsInpStruct) (*gsOutpStruct, int) {
+func cachedProcessScene(ctx context.Context, key string, shouldReadCache bool, inpObj *gsInpStruct, gw Gateway) (*gsOutpStruct, int) {
 
 	cacheMapSem.Lock()
 	if cacheMap[key] == nil {
 		cacheMap[key] = &cacheHolder{}
 		cacheMap[key].sem.Lock()
 		cacheMapSem.Unlock()
-		cacheMap[key].outp, cacheMap[key].httpStat = processScene(inpObj)
+		cacheMap[key].outp, cacheMap[key].httpStat = processScene(ctx, inpObj, gw)
 		cacheMap[key].sem.Unlock()
 		return cacheMap[key].outp, cacheMap[key].httpStat
 	}
 	if !shouldReadCache {
-		return processScene(inpObj)
+		return processScene(ctx, inpObj, gw)
 	}
 	cacheMap[key].sem.Lock()
 	if cacheMap[key].outp == nil {
-		cacheMap[key].outp, cacheMap[key].httpStat = processScene(inpObj)
+		cacheMap[key].outp, cacheMap[key].httpStat = processScene(ctx, inpObj, gw)
 	}
 	cacheMap[key].sem.Unlock()
 	return cacheMap[key].outp, cacheMap[key].httpStat
@@ -68,7 +69,7 @@ func cachedProcessScene(key string, shouldReadCache bool, inpObj *gsInpStruct) (
 // if any of them succeeds, all accept that success and return with it.  If you
 // do not understand how multithreaded programmign works, much of this will
 // be confusing to you.
-func cachedProcessSceneRedis(key string, shouldReadCache bool, inpObj *gsInpStruct) (*gsOutpStruct, int) {
+func cachedProcessSceneRedis(ctx context.Context, key string, shouldReadCache bool, inpObj *gsInpStruct, gw Gateway) (*gsOutpStruct, int) {
 	var (
 		inWait    bool
 		err       error
@@ -111,7 +112,7 @@ func cachedProcessSceneRedis(key string, shouldReadCache bool, inpObj *gsInpStru
 		inWait, err = inWaitTime(timeLockObj)
 		if err != nil {
 			log.Println("cachedProcessSceneRedis: Failure in inWaitTime call #1.  Error: " + err.Error())
-			return processScene(inpObj)
+			return processScene(ctx, inpObj, gw)
 		}
 		if !inWait {
 			// this plays around with race conditions a bit, but GetSet is atomic,
@@ -124,7 +125,7 @@ func cachedProcessSceneRedis(key string, shouldReadCache bool, inpObj *gsInpStru
 			inWait, err = inWaitTime(timeLockObj)
 			if err != nil {
 				log.Println("cachedProcessSceneRedis: Failure in inWaitTime call #2.  Error: " + err.Error())
-				return processScene(inpObj)
+				return processScene(ctx, inpObj, gw)
 			}
 			if !inWait {
 				break
@@ -137,7 +138,7 @@ func cachedProcessSceneRedis(key string, shouldReadCache bool, inpObj *gsInpStru
 			outpRed := redisCli.Get(outputKey)
 			if outpRed.Err() != nil {
 				log.Println("cachedProcessSceneRedis: Failure in redisCli Get call.  Error: " + err.Error())
-				return processScene(inpObj)
+				return processScene(ctx, inpObj, gw)
 			}
 			// get from output.  If output exists, respond with status 200
 			if outpRed.Val() != "" {
@@ -148,7 +149,7 @@ func cachedProcessSceneRedis(key string, shouldReadCache bool, inpObj *gsInpStru
 						err.Error() +
 						".  Original bytes: " +
 						outpRed.Val())
-					return processScene(inpObj)
+					return processScene(ctx, inpObj, gw)
 				}
 				return &outpObj, http.StatusOK
 			}
@@ -156,13 +157,13 @@ func cachedProcessSceneRedis(key string, shouldReadCache bool, inpObj *gsInpStru
 			inWait, err = inWaitTime(timeLockObj)
 			if err != nil {
 				log.Println("cachedProcessSceneRedis: Failure in inWaitTime call #3.  Error: " + err.Error())
-				return processScene(inpObj)
+				return processScene(ctx, inpObj, gw)
 			}
 		}
 	}
 	timeStr = time.Now().Format(timeFmt)
 	redisCli.Set(timeKey, timeStr, 2*time.Hour)
-	outpObj, status = processScene(inpObj)
+	outpObj, status = processScene(ctx, inpObj, gw)
 	outpJSON, err = json.Marshal(outpObj)
 	redisCli.Set(outputKey, outpJSON, 2*time.Hour)
 
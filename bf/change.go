@@ -0,0 +1,540 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bf
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/paulsmith/gogeos/geos"
+	"github.com/venicegeo/geojson-geos-go/geojsongeos"
+	"github.com/venicegeo/geojson-go/geojson"
+	"github.com/venicegeo/pzsvc-lib"
+)
+
+// Defaults for shoreline change analysis, in meters.  Anything that moves
+// less than half a Landsat pixel is called stable.
+const (
+	defaultTransectSpacing = 50
+	defaultTransectLength  = 1000
+	defaultStableThreshold = 15
+	maxTransects           = 100000
+)
+
+// Transect classifications
+const (
+	changeErosion   = "erosion"
+	changeAccretion = "accretion"
+	changeStable    = "stable"
+	changeUnknown   = "unknown" // one shoreline or the other was not crossed
+)
+
+type scInpStruct struct {
+	PzAddr          string                 `json:"pzAddr"`                    // gateway URL for this Pz instance
+	PzAuth          string                 `json:"pzAuthToken,omitempty"`     // Auth string for this Pz instance
+	Baseline        map[string]interface{} `json:"baseline"`                  // Baseline along which to cast transects, as GeoJSON
+	BeforeDataID    string                 `json:"beforeDataID,omitempty"`    // Piazza ID of the earlier shorelines
+	AfterDataID     string                 `json:"afterDataID,omitempty"`     // Piazza ID of the later shorelines
+	Before          map[string]interface{} `json:"before,omitempty"`          // Earlier shorelines as GeoJSON, instead of beforeDataID
+	After           map[string]interface{} `json:"after,omitempty"`           // Later shorelines as GeoJSON, instead of afterDataID
+	BeforeDate      string                 `json:"beforeDate,omitempty"`      // Date of the earlier shorelines (optional)
+	AfterDate       string                 `json:"afterDate,omitempty"`       // Date of the later shorelines (optional)
+	Spacing         float64                `json:"transectSpacing,omitempty"` // Distance between transects, in meters (optional)
+	Length          float64                `json:"transectLength,omitempty"`  // Length of each transect, in meters (optional)
+	Seaward         string                 `json:"seaward,omitempty"`         // "left" or "right" of the baseline's direction (optional)
+	StableThreshold float64                `json:"stableThreshold,omitempty"` // Least movement that counts as change, in meters (optional)
+}
+
+// transect is a line across the baseline, in UTM coordinates.  Normal is
+// the unit vector from the origin toward the sea.
+type transect struct {
+	origin []float64
+	normal []float64
+}
+
+// ShorelineChange compares two sets of shorelines along transects cast
+// from a baseline, and returns the transects as GeoJSON with the net
+// shoreline movement and end point rate of each.
+func ShorelineChange(w http.ResponseWriter, r *http.Request, gw Gateway) {
+	var (
+		b             []byte
+		err           error
+		inpObj        scInpStruct
+		before, after []*geojson.Feature
+		transects     *geojson.FeatureCollection
+	)
+
+	// clients to this function expect a JSON response
+	// containing the error message
+	handleError := func(errmsg string, status int) {
+		log.Print(errmsg)
+		outpErr := pzsvc.Error{Message: errmsg}
+		b, err = json.Marshal(outpErr)
+		if err != nil {
+			b = []byte(`{"error":"json.Marshal error: ` + err.Error() + `", "baseError":"` + errmsg + `"}`)
+		}
+		http.Error(w, string(b), status)
+	}
+
+	if b, err = pzsvc.ReadBodyJSON(&inpObj, r.Body); err != nil {
+		handleError(pzsvc.TraceStr("Error: pzsvc.ReadBodyJSON: "+err.Error()+".\nInput String: "+string(b)), http.StatusBadRequest)
+		return
+	}
+	if inpObj.PzAuth == "" {
+		inpObj.PzAuth = os.Getenv("BFH_PZ_AUTH")
+	}
+	if inpObj.Baseline == nil {
+		handleError(pzsvc.TraceStr("Input must contain a baseline."), http.StatusBadRequest)
+		return
+	}
+	if err = checkChangeInput(&inpObj); err != nil {
+		handleError(err.Error(), http.StatusBadRequest)
+		return
+	}
+	if before, err = changeShorelines(r.Context(), inpObj.BeforeDataID, inpObj.Before, inpObj, gw); err != nil {
+		handleError(pzsvc.TraceStr("Could not read the earlier shorelines: "+err.Error()), http.StatusBadRequest)
+		return
+	}
+	if after, err = changeShorelines(r.Context(), inpObj.AfterDataID, inpObj.After, inpObj, gw); err != nil {
+		handleError(pzsvc.TraceStr("Could not read the later shorelines: "+err.Error()), http.StatusBadRequest)
+		return
+	}
+	if transects, err = shorelineChange(inpObj, before, after); err != nil {
+		handleError(err.Error(), http.StatusBadRequest)
+		return
+	}
+	if b, err = geojson.Write(transects); err != nil {
+		handleError(pzsvc.TraceStr("Failed to write output GeoJSON object: "+err.Error()), http.StatusInternalServerError)
+		return
+	}
+	w.Write(b)
+}
+
+// checkChangeInput fills in the defaults of the given input, and returns
+// an error for anything it cannot accept.
+func checkChangeInput(inpObj *scInpStruct) error {
+	switch {
+	case inpObj.Spacing < 0:
+		return pzsvc.ErrWithTrace(fmt.Sprintf("transectSpacing must be positive, not %v.", inpObj.Spacing))
+	case inpObj.Length < 0:
+		return pzsvc.ErrWithTrace(fmt.Sprintf("transectLength must be positive, not %v.", inpObj.Length))
+	case inpObj.StableThreshold < 0:
+		return pzsvc.ErrWithTrace(fmt.Sprintf("stableThreshold must not be negative, not %v.", inpObj.StableThreshold))
+	}
+	if inpObj.Spacing == 0 {
+		inpObj.Spacing = defaultTransectSpacing
+	}
+	if inpObj.Length == 0 {
+		inpObj.Length = defaultTransectLength
+	}
+	if inpObj.StableThreshold == 0 {
+		inpObj.StableThreshold = defaultStableThreshold
+	}
+	switch inpObj.Seaward {
+	case "":
+		inpObj.Seaward = "left"
+	case "left", "right":
+	default:
+		return pzsvc.ErrWithTrace(`seaward must be "left" or "right", not "` + inpObj.Seaward + `".`)
+	}
+	for _, date := range []string{inpObj.BeforeDate, inpObj.AfterDate} {
+		if date == "" {
+			continue
+		}
+		if _, err := time.Parse(time.RFC3339, date); err != nil {
+			return pzsvc.ErrWithTrace("Dates must be in RFC 3339 format: " + err.Error())
+		}
+	}
+	return nil
+}
+
+// changeShorelines returns the shoreline features from the given Piazza
+// data item, or else from the given GeoJSON.
+func changeShorelines(ctx context.Context, dataID string, gjMap map[string]interface{}, inpObj scInpStruct, gw Gateway) ([]*geojson.Feature, error) {
+	var (
+		result  []*geojson.Feature
+		feature *geojson.Feature
+		stream  io.ReadCloser
+		err     error
+	)
+	if dataID != "" {
+		if stream, err = gw.DownloadStream(ctx, dataID, inpObj.PzAddr, inpObj.PzAuth); err != nil {
+			return nil, err
+		}
+		defer stream.Close()
+		scanner := newFeatureScanner(stream)
+		for {
+			if feature, err = scanner.next(); err == io.EOF {
+				return result, nil
+			} else if err != nil {
+				return nil, err
+			}
+			result = append(result, feature)
+		}
+	}
+	if gjMap == nil {
+		return nil, pzsvc.ErrWithTrace("Input must contain a data ID or GeoJSON for each set of shorelines.")
+	}
+	switch it := geojson.FromMap(gjMap).(type) {
+	case *geojson.FeatureCollection:
+		return it.Features, nil
+	case *geojson.Feature:
+		return []*geojson.Feature{it}, nil
+	case nil:
+		return nil, pzsvc.ErrWithTrace("Could not read the GeoJSON.")
+	default:
+		return []*geojson.Feature{geojson.NewFeature(it, nil, nil)}, nil
+	}
+}
+
+// shorelineChange casts transects along the baseline and measures the
+// shorelines against them.  Each line of the baseline is worked in the UTM
+// zone of its middle.
+func shorelineChange(inpObj scInpStruct, before, after []*geojson.Feature) (*geojson.FeatureCollection, error) {
+	var (
+		gjIfc      interface{}
+		err        error
+		count      int
+		side       = 1.0
+		transects  [][]transect
+		beforeSet  *transectShorelines
+		afterSet   *transectShorelines
+		zone, prev int
+		north      bool
+	)
+	if inpObj.Seaward == "right" {
+		side = -1
+	}
+	frame := frameFor(inpObj.Baseline)
+	if gjIfc, err = frame.normalize(inpObj.Baseline); err != nil {
+		return nil, err
+	}
+	lines := geoJSONLines(gjIfc)
+	if len(lines) == 0 {
+		return nil, pzsvc.ErrWithTrace("The baseline has no lines.")
+	}
+	if before, err = normalizeFeatures(before, frame); err != nil {
+		return nil, err
+	}
+	if after, err = normalizeFeatures(after, frame); err != nil {
+		return nil, err
+	}
+
+	// Cast everything first, so that a baseline that would make too many
+	// transects is turned away before any real work is done
+	for inx, line := range lines {
+		zone, north = lineZone(line)
+		projected := make([][]float64, len(line))
+		for cInx, coord := range line {
+			projected[cInx] = []float64{0, 0}
+			projected[cInx][0], projected[cInx][1] = latLonToUTM(coord[1], coord[0], zone, north)
+		}
+		transects = append(transects, castTransects(projected, inpObj.Spacing, side))
+		if count += len(transects[inx]); count > maxTransects {
+			return nil, pzsvc.ErrWithTrace(fmt.Sprintf("The baseline would need more than %v transects at a spacing of %v meters.", maxTransects, inpObj.Spacing))
+		}
+	}
+
+	result := geojson.NewFeatureCollection(nil)
+	id := 0
+	for inx, line := range lines {
+		middle := line[len(line)/2]
+		zone, north = lineZone(line)
+		if beforeSet == nil || zone != prev || north != beforeSet.north {
+			beforeSet = newTransectShorelines(before, zone, north)
+			afterSet = newTransectShorelines(after, zone, north)
+			prev = zone
+		}
+		unproject := fromUTM(zone, north)
+		for _, tr := range transects[inx] {
+			change := measureTransect(tr, inpObj, beforeSet, afterSet)
+			half := inpObj.Length / 2
+			coords := [][]float64{
+				{tr.origin[0] - tr.normal[0]*half, tr.origin[1] - tr.normal[1]*half},
+				{tr.origin[0] + tr.normal[0]*half, tr.origin[1] + tr.normal[1]*half}}
+			for _, coord := range coords {
+				coord[0], coord[1] = unproject(coord[0], coord[1])
+				coord[0] = nearLon(coord[0], middle[0])
+			}
+			result.Features = append(result.Features, geojson.NewFeature(geojson.NewLineString(coords), fmt.Sprintf("transect.%d", id), change))
+			id++
+		}
+	}
+	splitFeatures(result.Features)
+	return result, nil
+}
+
+// lineZone returns the UTM zone and hemisphere of the middle of the line.
+func lineZone(line [][]float64) (int, bool) {
+	middle := line[len(line)/2]
+	return utmZoneOf(middle[0]), middle[1] >= 0
+}
+
+// measureTransect returns the properties of the given transect: where it
+// crosses each set of shorelines, and the change between them.
+func measureTransect(tr transect, inpObj scInpStruct, beforeSet, afterSet *transectShorelines) map[string]interface{} {
+	props := map[string]interface{}{"change": changeUnknown}
+	beforeDist, beforeDate, beforeOK := beforeSet.crossing(tr, inpObj.Length)
+	afterDist, afterDate, afterOK := afterSet.crossing(tr, inpObj.Length)
+	if inpObj.BeforeDate != "" {
+		beforeDate = inpObj.BeforeDate
+	}
+	if inpObj.AfterDate != "" {
+		afterDate = inpObj.AfterDate
+	}
+	if beforeOK {
+		props["beforeDistance"] = beforeDist
+		props["beforeDate"] = beforeDate
+	}
+	if afterOK {
+		props["afterDistance"] = afterDist
+		props["afterDate"] = afterDate
+	}
+	if !beforeOK || !afterOK {
+		return props
+	}
+	nsm := afterDist - beforeDist
+	props["nsm"] = nsm
+	props["change"] = classifyChange(nsm, inpObj.StableThreshold)
+	if epr, ok := endPointRate(nsm, beforeDate, afterDate); ok {
+		props["epr"] = epr
+	}
+	return props
+}
+
+// classifyChange names a net shoreline movement, in meters seaward.
+func classifyChange(nsm, threshold float64) string {
+	switch {
+	case nsm >= threshold && nsm > 0:
+		return changeAccretion
+	case nsm <= -threshold && nsm < 0:
+		return changeErosion
+	}
+	return changeStable
+}
+
+// endPointRate returns the net shoreline movement per year between the
+// given dates, and false if they are missing or out of order.
+func endPointRate(nsm float64, beforeDate, afterDate string) (float64, bool) {
+	before, err := time.Parse(time.RFC3339, beforeDate)
+	if err != nil {
+		return 0, false
+	}
+	after, err := time.Parse(time.RFC3339, afterDate)
+	if err != nil {
+		return 0, false
+	}
+	years := after.Sub(before).Hours() / (24 * 365.25)
+	if years <= 0 {
+		return 0, false
+	}
+	return nsm / years, true
+}
+
+// castTransects returns transects at every spacing meters along the given
+// line, starting at its first point.  side is 1 if the sea is to the left
+// of the line and -1 if it is to the right.
+func castTransects(line [][]float64, spacing, side float64) []transect {
+	var (
+		result []transect
+		next   float64 // distance along the line of the next transect
+		start  float64 // distance along the line of the current segment
+	)
+	for inx := 0; inx+1 < len(line); inx++ {
+		from, to := line[inx], line[inx+1]
+		dx, dy := to[0]-from[0], to[1]-from[1]
+		length := math.Hypot(dx, dy)
+		if length == 0 {
+			continue
+		}
+		normal := []float64{-dy / length * side, dx / length * side}
+		for ; next < start+length; next += spacing {
+			frac := (next - start) / length
+			result = append(result, transect{
+				origin: []float64{from[0] + dx*frac, from[1] + dy*frac},
+				normal: normal})
+		}
+		start += length
+	}
+	return result
+}
+
+// crossingDistance returns the distance seaward from the transect's origin
+// of the nearest of the given points.
+func crossingDistance(points [][]float64, tr transect) (float64, bool) {
+	best, found := 0.0, false
+	for _, point := range points {
+		if len(point) < 2 {
+			continue
+		}
+		dist := (point[0]-tr.origin[0])*tr.normal[0] + (point[1]-tr.origin[1])*tr.normal[1]
+		if !found || math.Abs(dist) < math.Abs(best) {
+			best, found = dist, true
+		}
+	}
+	return best, found
+}
+
+// geoJSONPoints returns every coordinate of the given GeoJSON geometry.
+func geoJSONPoints(input interface{}) [][]float64 {
+	var result [][]float64
+	switch it := input.(type) {
+	case *geojson.Point:
+		result = append(result, it.Coordinates)
+	case *geojson.MultiPoint:
+		result = append(result, it.Coordinates...)
+	case *geojson.LineString:
+		result = append(result, it.Coordinates...)
+	case *geojson.MultiLineString:
+		for _, line := range it.Coordinates {
+			result = append(result, line...)
+		}
+	case *geojson.GeometryCollection:
+		for _, geometry := range it.Geometries {
+			result = append(result, geoJSONPoints(geometry)...)
+		}
+	}
+	return result
+}
+
+// geoJSONLines returns the lines of every feature or geometry in the given
+// GeoJSON.
+func geoJSONLines(input interface{}) [][][]float64 {
+	var result [][][]float64
+	switch it := input.(type) {
+	case *geojson.FeatureCollection:
+		for _, feature := range it.Features {
+			result = append(result, geoJSONLines(feature)...)
+		}
+	case *geojson.Feature:
+		result = featureLines(it.Geometry)
+	default:
+		result = featureLines(input)
+	}
+	// a line needs two points to have a direction
+	lines := result[:0]
+	for _, line := range result {
+		if len(line) >= 2 {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// normalizeFeatures returns copies of the features in the given frame.
+func normalizeFeatures(features []*geojson.Feature, frame lonFrame) ([]*geojson.Feature, error) {
+	result := make([]*geojson.Feature, 0, len(features))
+	for _, feature := range features {
+		gjIfc, err := frame.normalize(feature)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, gjIfc.(*geojson.Feature))
+	}
+	return result, nil
+}
+
+// transectShorelines holds a set of shorelines projected into a UTM zone,
+// in an STR tree by their envelopes.
+type transectShorelines struct {
+	north    bool
+	features []*geojson.Feature
+	items    []int // index into features of each item in the tree
+	tree     *strTree
+	geoms    map[int]*geos.Geometry
+}
+
+func newTransectShorelines(features []*geojson.Feature, zone int, north bool) *transectShorelines {
+	var envs []envelope
+	result := transectShorelines{north: north, geoms: make(map[int]*geos.Geometry)}
+	project := toUTM(zone, north)
+	for _, feature := range features {
+		if feature.Geometry == nil {
+			continue
+		}
+		geometry, err := transformGeoJSON(feature.Geometry, project)
+		if err != nil {
+			log.Print(pzsvc.TraceStr("Could not project shoreline " + feature.IDStr() + ": " + err.Error()))
+			continue
+		}
+		projected := geojson.NewFeature(geometry, feature.ID, feature.Properties)
+		if env, ok := envelopeOf(geometry); ok {
+			envs = append(envs, env)
+			result.items = append(result.items, len(result.features))
+			result.features = append(result.features, projected)
+		}
+	}
+	result.tree = newSTRTree(envs)
+	return &result
+}
+
+// crossing returns the distance seaward along the transect to the nearest
+// shoreline that crosses it, and that shoreline's collection date.
+func (set *transectShorelines) crossing(tr transect, length float64) (float64, string, bool) {
+	var (
+		err   error
+		ok    bool
+		gjIfc interface{}
+		geom,
+		trGeom,
+		intersection *geos.Geometry
+		best  float64
+		date  string
+		found bool
+	)
+	half := length / 2
+	from := []float64{tr.origin[0] - tr.normal[0]*half, tr.origin[1] - tr.normal[1]*half}
+	to := []float64{tr.origin[0] + tr.normal[0]*half, tr.origin[1] + tr.normal[1]*half}
+	env := envelope{math.Min(from[0], to[0]), math.Min(from[1], to[1]), math.Max(from[0], to[0]), math.Max(from[1], to[1])}
+	candidates := set.tree.query(env)
+	if len(candidates) == 0 {
+		return 0, "", false
+	}
+	if trGeom, err = geojsongeos.GeosFromGeoJSON(geojson.NewLineString([][]float64{from, to})); err != nil {
+		log.Print(pzsvc.TraceStr("Could not convert transect to GEOS geometry: " + err.Error()))
+		return 0, "", false
+	}
+	for _, item := range candidates {
+		feature := set.features[set.items[item]]
+		if geom, ok = set.geoms[item]; !ok {
+			if geom, err = geojsongeos.GeosFromGeoJSON(feature.Geometry); err != nil {
+				log.Print(pzsvc.TraceStr("Could not convert GeoJSON object to GEOS geometry: " + err.Error()))
+			}
+			set.geoms[item] = geom
+		}
+		if geom == nil {
+			continue
+		}
+		if intersection, err = geom.Intersection(trGeom); err != nil {
+			log.Print(pzsvc.TraceStr("Failed to intersect transect with " + feature.IDStr() + ": " + err.Error()))
+			continue
+		}
+		if gjIfc, err = geojsongeos.GeoJSONFromGeos(intersection); err != nil {
+			log.Print(pzsvc.TraceStr("Failed to convert GEOS geometry to GeoJSON: " + err.Error()))
+			continue
+		}
+		if dist, ok := crossingDistance(geoJSONPoints(gjIfc), tr); ok && (!found || math.Abs(dist) < math.Abs(best)) {
+			best, date, found = dist, feature.PropertyString("dateTimeCollect"), true
+		}
+	}
+	return best, date, found
+}
@@ -0,0 +1,108 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bf
+
+import (
+	"math"
+	"testing"
+
+	"github.com/venicegeo/geojson-go/geojson"
+)
+
+func TestCastTransects(t *testing.T) {
+	// an L, 150 m east and then 100 m north, with the sea to the left
+	line := [][]float64{{0, 0}, {150, 0}, {150, 100}}
+	transects := castTransects(line, 50, 1)
+	if len(transects) != 5 {
+		t.Fatalf(`TestCastTransects: expected 5 transects, got %d`, len(transects))
+	}
+	expected := []transect{
+		{[]float64{0, 0}, []float64{0, 1}},
+		{[]float64{50, 0}, []float64{0, 1}},
+		{[]float64{100, 0}, []float64{0, 1}},
+		{[]float64{150, 0}, []float64{-1, 0}},
+		{[]float64{150, 50}, []float64{-1, 0}}}
+	for inx, tr := range transects {
+		for c := 0; c < 2; c++ {
+			if math.Abs(tr.origin[c]-expected[inx].origin[c]) > 1e-9 || math.Abs(tr.normal[c]-expected[inx].normal[c]) > 1e-9 {
+				t.Errorf(`TestCastTransects: transect %d: expected %v, got %v`, inx, expected[inx], tr)
+				break
+			}
+		}
+	}
+	if right := castTransects(line, 50, -1); right[0].normal[1] != -1 {
+		t.Errorf(`TestCastTransects: expected the normal to point right, got %v`, right[0].normal)
+	}
+}
+
+func TestCrossingDistance(t *testing.T) {
+	tr := transect{origin: []float64{10, 10}, normal: []float64{0, 1}}
+	if dist, ok := crossingDistance([][]float64{{10, 40}, {10, -5}, {10, 100}}, tr); !ok || dist != -15 {
+		t.Errorf(`TestCrossingDistance: expected -15, got %v %v`, dist, ok)
+	}
+	if _, ok := crossingDistance(nil, tr); ok {
+		t.Error(`TestCrossingDistance: found a crossing with no points.`)
+	}
+}
+
+func TestShorelineChangeMeasures(t *testing.T) {
+	cases := []struct {
+		nsm      float64
+		expected string
+	}{{20, changeAccretion}, {-20, changeErosion}, {14, changeStable}, {-15, changeErosion}, {0, changeStable}}
+	for _, c := range cases {
+		if actual := classifyChange(c.nsm, 15); actual != c.expected {
+			t.Errorf(`TestShorelineChangeMeasures: expected %v for %v, got %v`, c.expected, c.nsm, actual)
+		}
+	}
+	if actual := classifyChange(0, 0); actual != changeStable {
+		t.Errorf(`TestShorelineChangeMeasures: expected no movement to be stable, got %v`, actual)
+	}
+
+	if epr, ok := endPointRate(-30, "2015-01-01T00:00:00Z", "2017-01-01T00:00:00Z"); !ok || math.Abs(epr+15) > 0.02 {
+		t.Errorf(`TestShorelineChangeMeasures: expected an EPR of about -15, got %v %v`, epr, ok)
+	}
+	if _, ok := endPointRate(-30, "", "2017-01-01T00:00:00Z"); ok {
+		t.Error(`TestShorelineChangeMeasures: got an EPR without a date.`)
+	}
+	if _, ok := endPointRate(-30, "2017-01-01T00:00:00Z", "2015-01-01T00:00:00Z"); ok {
+		t.Error(`TestShorelineChangeMeasures: got an EPR with the dates reversed.`)
+	}
+}
+
+func TestCheckChangeInput(t *testing.T) {
+	inpObj := scInpStruct{}
+	if err := checkChangeInput(&inpObj); err != nil {
+		t.Fatalf(`TestCheckChangeInput: %v`, err.Error())
+	}
+	if inpObj.Spacing != defaultTransectSpacing || inpObj.Length != defaultTransectLength || inpObj.Seaward != "left" {
+		t.Errorf(`TestCheckChangeInput: defaults were not filled in: %#v`, inpObj)
+	}
+	for _, bad := range []scInpStruct{{Spacing: -1}, {Seaward: "up"}, {BeforeDate: "last year"}} {
+		if err := checkChangeInput(&bad); err == nil {
+			t.Errorf(`TestCheckChangeInput: accepted %#v`, bad)
+		}
+	}
+}
+
+func TestGeoJSONLines(t *testing.T) {
+	fc := geojson.NewFeatureCollection([]*geojson.Feature{
+		geojson.NewFeature(geojson.NewLineString([][]float64{{0, 0}, {1, 1}}), "a", nil),
+		geojson.NewFeature(geojson.NewMultiLineString([][][]float64{{{2, 2}, {3, 3}}, {{4, 4}}}), "b", nil),
+		geojson.NewFeature(geojson.NewPoint([]float64{5, 5}), "c", nil)})
+	if lines := geoJSONLines(fc); len(lines) != 2 || lines[1][0][0] != 2 {
+		t.Errorf(`TestGeoJSONLines: expected two lines, got %v`, lines)
+	}
+}
@@ -0,0 +1,398 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bf
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/venicegeo/geojson-go/geojson"
+	"github.com/venicegeo/pzsvc-image-catalog/catalog"
+	"github.com/venicegeo/pzsvc-lib"
+	"gopkg.in/redis.v3"
+)
+
+/*
+Batch checkpoints let an executeBatch job pick up where it left off after
+a failure or a restart.  Each job stores its input and footprints once, when
+it starts, and its status again every time a footprint changes state.  The
+checkpoints go to redis when it is available, and to memory when it is not,
+in which case they last only as long as this instance of bf-handle, and the
+job's status says so.
+
+A running job also holds a lease in redis, which the instance running it
+renews as it goes.  A job whose checkpoint says that it is running, but
+whose lease has lapsed, was cut off by a crash or a restart, and is
+reported as interrupted, ready to be resumed.
+
+Resuming a job reuses every shoreline it already has, and detects the rest:
+scenes that failed, that were skipped, or that were cut off partway through.
+Auth tokens are never checkpointed, so a resumed job runs with the tokens
+of whoever resumed it.
+*/
+
+const batchInputLoc = "bf-handle:batchInput:"
+const batchStateLoc = "bf-handle:batchState:"
+const batchLeaseLoc = "bf-handle:batchLease:"
+const batchesRunningLoc = "bf-handle:batchesRunning"
+
+// how long checkpoints are kept after their last update
+const batchCheckpointTTL = 7 * 24 * time.Hour
+
+type batchInput struct {
+	Input      asInpStruct                `json:"input"`
+	Footprints *geojson.FeatureCollection `json:"footprints"`
+}
+
+type batchCheckpoint struct {
+	Status batchStatus `json:"status"`
+	Error  string      `json:"error,omitempty"`
+}
+
+// batchCredentials are the auth tokens given to resume a job
+type batchCredentials struct {
+	PzAuth string `json:"pzAuthToken"`
+	DbAuth string `json:"dbAuthToken"`
+}
+
+// memCheckpoint is a checkpoint kept in memory, which expires as it would
+// have in redis
+type memCheckpoint struct {
+	value   string
+	expires time.Time
+}
+
+var (
+	checkpointOnce   sync.Once
+	checkpointCli    *redis.Client
+	checkpointMem    = make(map[string]memCheckpoint)
+	checkpointsMutex sync.Mutex
+	batchRecoverOnce sync.Once
+)
+
+// errCheckpointsInMemory is the checkpoint error of every job while redis
+// is not available.
+var errCheckpointsInMemory = errors.New("redis is not available, so checkpoints are kept in memory, and will not survive a restart")
+
+// batchLeaseRenew extends a batch lease, and batchLeaseRelease drops it,
+// but only if the given instance still holds it.
+const (
+	batchLeaseRenew   = `if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("pexpire", KEYS[1], ARGV[2]) end return 0`
+	batchLeaseRelease = `if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("del", KEYS[1]) end return 0`
+)
+
+// checkpointClient returns the redis client for checkpoints, or nil if
+// redis is not available.
+func checkpointClient() *redis.Client {
+	checkpointOnce.Do(func() {
+		var err error
+		if checkpointCli, err = catalog.RedisClient(); err != nil {
+			log.Println("Batch checkpoints will be kept in memory.  Redis error: " + pzsvc.TraceStr(err.Error()))
+			checkpointCli = nil
+		}
+	})
+	return checkpointCli
+}
+
+// storeCheckpoint writes the given value to redis, falling back on memory
+// if redis is not available or fails.  Falling back is reported as an
+// error, since the checkpoint will not outlast this instance.
+func storeCheckpoint(key, value string) error {
+	err := errCheckpointsInMemory
+	if cli := checkpointClient(); cli != nil {
+		if err = cli.Set(key, value, batchCheckpointTTL).Err(); err == nil {
+			return nil
+		}
+		log.Println(pzsvc.TraceStr("Failed to store checkpoint " + key + " in redis: " + err.Error()))
+	}
+	checkpointsMutex.Lock()
+	evictCheckpoints()
+	checkpointMem[key] = memCheckpoint{value: value, expires: time.Now().Add(batchCheckpointTTL)}
+	checkpointsMutex.Unlock()
+	return err
+}
+
+// evictCheckpoints drops memory checkpoints that have outlived
+// batchCheckpointTTL.  The caller must hold checkpointsMutex.
+func evictCheckpoints() {
+	now := time.Now()
+	for key, checkpoint := range checkpointMem {
+		if checkpoint.expires.Before(now) {
+			delete(checkpointMem, key)
+		}
+	}
+}
+
+// fetchCheckpoint reads the given value back, returning "" if there is
+// none.
+func fetchCheckpoint(key string) string {
+	if cli := checkpointClient(); cli != nil {
+		cmd := cli.Get(key)
+		if err := cmd.Err(); err == nil && cmd.Val() != "" {
+			return cmd.Val()
+		} else if err != nil && err.Error() != "redis: nil" {
+			log.Println(pzsvc.TraceStr("Failed to fetch checkpoint " + key + " from redis: " + err.Error()))
+		}
+	}
+	checkpointsMutex.Lock()
+	defer checkpointsMutex.Unlock()
+	if checkpoint, ok := checkpointMem[key]; ok && checkpoint.expires.After(time.Now()) {
+		return checkpoint.value
+	}
+	return ""
+}
+
+// saveBatchInput checkpoints what a batch job needs in order to be run
+// again.  The footprints are stored as they are before detection begins.
+// The auth tokens are left out, so that they are not kept at rest, and so
+// that nobody can run with them just by knowing the jobID.
+func saveBatchInput(jobID string, inpObj asInpStruct, footprints *geojson.FeatureCollection) error {
+	inpObj.PzAuth, inpObj.DbAuth = "", ""
+	byts, err := json.Marshal(batchInput{Input: inpObj, Footprints: footprints})
+	if err != nil {
+		return pzsvc.TraceErr(err)
+	}
+	return storeCheckpoint(batchInputLoc+jobID, string(byts))
+}
+
+// saveBatchState checkpoints the current status of a batch job.
+func saveBatchState(status batchStatus) error {
+	byts, err := json.Marshal(batchCheckpoint{Status: status, Error: status.errMsg})
+	if err != nil {
+		return pzsvc.TraceErr(err)
+	}
+	return storeCheckpoint(batchStateLoc+status.JobID, string(byts))
+}
+
+// loadBatchState reads back the last checkpointed status of a batch job.
+// It returns nil if there is none.
+func loadBatchState(jobID string) (*batchStatus, error) {
+	var checkpoint batchCheckpoint
+	str := fetchCheckpoint(batchStateLoc + jobID)
+	if str == "" {
+		return nil, nil
+	}
+	if err := json.Unmarshal([]byte(str), &checkpoint); err != nil {
+		return nil, pzsvc.TraceErr(err)
+	}
+	checkpoint.Status.errMsg = checkpoint.Error
+	return &checkpoint.Status, nil
+}
+
+// batchLease is a running job's claim on it.  While redis is not
+// available, leases are empty, and it is up to batchJobs to say what is
+// running.
+type batchLease struct {
+	jobID  string
+	stop   chan struct{}
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// holdBatchLease takes the lease on a job, and keeps renewing it until it
+// is released.  It reports false if some instance already holds it.
+func holdBatchLease(jobID string) (*batchLease, bool) {
+	cli := checkpointClient()
+	if cli == nil {
+		return &batchLease{}, true
+	}
+	taken := cli.SetNX(batchLeaseLoc+jobID, instanceID, leaseDuration)
+	if taken.Err() != nil {
+		log.Println(pzsvc.TraceStr("Failed to take lease on batch " + jobID + ": " + taken.Err().Error()))
+		return nil, false
+	}
+	if !taken.Val() {
+		return nil, false
+	}
+	cli.SAdd(batchesRunningLoc, jobID)
+
+	lease := &batchLease{jobID: jobID, stop: make(chan struct{})}
+	lease.ctx, lease.cancel = context.WithCancel(context.Background())
+	interval, duration := heartbeatInterval, leaseDuration
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-lease.stop:
+				return
+			case <-ticker.C:
+				ttl := strconv.FormatInt(int64(duration/time.Millisecond), 10)
+				renewed, err := cli.Eval(batchLeaseRenew, []string{batchLeaseLoc + jobID}, []string{instanceID, ttl}).Result()
+				if err != nil || renewed != int64(1) {
+					log.Println(pzsvc.TraceStr(fmt.Sprintf("Failed to renew lease on batch %s: %v", jobID, err)))
+				}
+				if err == nil && renewed == int64(0) {
+					// some other instance has the job now
+					lease.cancel()
+				}
+			}
+		}
+	}()
+	return lease, true
+}
+
+// release gives up the lease, once the job has finished.
+func (lease *batchLease) release() {
+	if lease == nil || lease.stop == nil {
+		return
+	}
+	close(lease.stop)
+	lease.cancel()
+	if cli := checkpointClient(); cli != nil {
+		cli.Eval(batchLeaseRelease, []string{batchLeaseLoc + lease.jobID}, []string{instanceID})
+		cli.SRem(batchesRunningLoc, lease.jobID)
+	}
+}
+
+// jobContext gives the context that work done under the lease should run
+// in.  It is cancelled once the lease is lost or released.
+func (lease *batchLease) jobContext() context.Context {
+	if lease == nil || lease.ctx == nil {
+		return context.Background()
+	}
+	return lease.ctx
+}
+
+// batchLeased reports whether some instance holds the lease on a job.
+// Without redis, there are no leases to hold.
+func batchLeased(jobID string) bool {
+	cli := checkpointClient()
+	if cli == nil {
+		return false
+	}
+	err := cli.Get(batchLeaseLoc + jobID).Err()
+	if err != nil && err.Error() != "redis: nil" {
+		// better to report a job as running than as interrupted
+		log.Println(pzsvc.TraceStr("Failed to read lease on batch " + jobID + ": " + err.Error()))
+		return true
+	}
+	return err == nil
+}
+
+// markInterrupted reports a job that is checkpointed as running, but is
+// not running anywhere, as interrupted.
+func markInterrupted(status *batchStatus) {
+	if status.Status != batchRunning && status.Status != batchAssembling {
+		return
+	}
+	if getBatchJob(status.JobID) == nil && !batchLeased(status.JobID) {
+		status.Status = batchInterrupted
+		status.errMsg = "Job " + status.JobID + " was cut off partway through, and can be resumed."
+	}
+}
+
+// recoverBatchJobs runs once, on the first executeBatch call.  It checks
+// the jobs that redis has as running, and rewrites the checkpoints of any
+// whose leases have lapsed, so that they show as interrupted from then on.
+func recoverBatchJobs() {
+	cli := checkpointClient()
+	if cli == nil {
+		return
+	}
+	for _, jobID := range cli.SMembers(batchesRunningLoc).Val() {
+		if batchLeased(jobID) {
+			continue
+		}
+		if status, err := loadBatchState(jobID); err == nil && status != nil {
+			markInterrupted(status)
+			if status.Status == batchInterrupted {
+				if err = saveBatchState(*status); err != nil {
+					log.Println(pzsvc.TraceStr("Failed to mark batch " + jobID + " interrupted: " + err.Error()))
+					continue
+				}
+			}
+		}
+		cli.SRem(batchesRunningLoc, jobID)
+	}
+}
+
+// loadBatchInput reads back the input and footprints of a batch job.
+func loadBatchInput(jobID string) (*batchInput, error) {
+	var input batchInput
+	str := fetchCheckpoint(batchInputLoc + jobID)
+	if str == "" {
+		return nil, pzsvc.ErrWithTrace("No input was checkpointed for job " + jobID + ".")
+	}
+	if err := json.Unmarshal([]byte(str), &input); err != nil {
+		return nil, pzsvc.TraceErr(err)
+	}
+	if input.Footprints == nil {
+		return nil, pzsvc.ErrWithTrace("No footprints were checkpointed for job " + jobID + ".")
+	}
+	return &input, nil
+}
+
+// resumeBatch restarts the given batch job from its last checkpoint.
+// Shorelines that the job already has are kept, and everything else is
+// detected again.  Jobs that are still running cannot be resumed.  The job
+// runs with the auth tokens in the request, which default to the server's
+// own, as they do for a new job.
+func resumeBatch(w http.ResponseWriter, r *http.Request, jobID string, gw Gateway) {
+	var creds batchCredentials
+	if r.Body != nil {
+		byts, err := ioutil.ReadAll(r.Body)
+		if err == nil && len(byts) > 0 {
+			err = json.Unmarshal(byts, &creds)
+		}
+		if err != nil {
+			handleOut(w, "Could not read auth tokens: "+err.Error(), batchStatus{JobID: jobID}, http.StatusBadRequest)
+			return
+		}
+	}
+	if creds.PzAuth == "" {
+		creds.PzAuth = os.Getenv("BFH_PZ_AUTH")
+	}
+	if creds.DbAuth == "" {
+		creds.DbAuth = os.Getenv("BFH_DB_AUTH")
+	}
+
+	status, err := loadBatchState(jobID)
+	if err != nil {
+		handleOut(w, "Could not read checkpoint for job "+jobID+": "+err.Error(), batchStatus{JobID: jobID}, http.StatusInternalServerError)
+		return
+	}
+	if status == nil {
+		handleOut(w, "Job not found: "+jobID, batchStatus{JobID: jobID}, http.StatusNotFound)
+		return
+	}
+	input, err := loadBatchInput(jobID)
+	if err != nil {
+		handleOut(w, err.Error(), batchStatus{JobID: jobID}, http.StatusInternalServerError)
+		return
+	}
+	if len(status.Footprints) != len(input.Footprints.Features) {
+		handleOut(w, "Checkpoint for job "+jobID+" does not match its footprints.", batchStatus{JobID: jobID}, http.StatusInternalServerError)
+		return
+	}
+
+	job := resumedBatchJob(*status)
+	if job == nil {
+		handleOut(w, "Job "+jobID+" is still running.", batchStatus{JobID: jobID}, http.StatusConflict)
+		return
+	}
+	input.Input.PzAuth, input.Input.DbAuth = creds.PzAuth, creds.DbAuth
+	go detectShorelines(job, input.Input, input.Footprints, gw)
+	writeBatchStarted(w, job.snapshot())
+}
@@ -0,0 +1,154 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bf
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/venicegeo/geojson-go/geojson"
+	"github.com/venicegeo/pzsvc-lib"
+)
+
+func TestBatchCheckpoint(t *testing.T) {
+	footprints := geojson.NewFeatureCollection([]*geojson.Feature{
+		geojson.NewFeature(nil, "landsat:A", map[string]interface{}{}),
+		geojson.NewFeature(nil, "landsat:B", map[string]interface{}{}),
+		geojson.NewFeature(nil, "landsat:C", map[string]interface{}{})})
+	inpObj := asInpStruct{AlgoType: "ndwi", SkipDetection: true, Workers: 2, PzAuth: "pzSecret", DbAuth: "dbSecret"}
+	job, err := newBatchJob(inpObj, footprints, "fpData", nil)
+	if err != nil {
+		t.Fatal(`TestBatchCheckpoint: failed to create job: ` + err.Error())
+	}
+	jobID := job.id()
+	if checkpointErr := job.snapshot().CheckpointError; checkpointErr != errCheckpointsInMemory.Error() {
+		t.Errorf(`TestBatchCheckpoint: memory checkpoints not reported, got %q.`, checkpointErr)
+	}
+	job.setFootprint(0, footprintDetected, "", "shoreA", "deplA")
+	job.setFootprint(1, footprintFailed, "out of cheese", "", "")
+	job.setFootprint(2, footprintDetecting, "", "", "")
+
+	resume := func() int {
+		w, _, outInt := pzsvc.GetMockResponseWriter()
+		r := http.Request{Method: "POST", URL: &url.URL{Path: "/executeBatch/resume/" + jobID}}
+		HandleBatch(w, &r, PzGateway{})
+		return *outInt
+	}
+	if outInt := resume(); outInt != http.StatusConflict {
+		t.Errorf(`TestBatchCheckpoint: resumed a running job, with status %d.`, outInt)
+	}
+
+	// lose the job from memory, as if bf-handle had restarted
+	batchJobsMutex.Lock()
+	delete(batchJobs, jobID)
+	batchJobsMutex.Unlock()
+
+	status, err := batchJobStatus(jobID)
+	if err != nil || status == nil {
+		t.Fatalf(`TestBatchCheckpoint: could not read checkpoint: %v`, err)
+	}
+	if status.FootprintsDataID != "fpData" || status.Footprints[1].Reason != "out of cheese" || status.Footprints[2].State != footprintDetecting {
+		t.Errorf(`TestBatchCheckpoint: unexpected checkpoint %#v`, status)
+	}
+	if status.Status != batchInterrupted {
+		t.Errorf(`TestBatchCheckpoint: job cut off while running came back as %s.`, status.Status)
+	}
+	input, err := loadBatchInput(jobID)
+	if err != nil {
+		t.Fatal(`TestBatchCheckpoint: could not read input: ` + err.Error())
+	}
+	if input.Input.AlgoType != "ndwi" || len(input.Footprints.Features) != 3 {
+		t.Errorf(`TestBatchCheckpoint: unexpected input %#v`, input)
+	}
+	if input.Input.PzAuth != "" || input.Input.DbAuth != "" {
+		t.Error(`TestBatchCheckpoint: auth tokens were checkpointed.`)
+	}
+
+	resumed := resumedBatchJob(*status)
+	if resumed == nil {
+		t.Fatal(`TestBatchCheckpoint: could not resume job.`)
+	}
+	results := detectFootprints(resumed, input.Input, input.Footprints, PzGateway{})
+	if results[0] == nil || results[0].PropertyString("shoreDataID") != "shoreA" {
+		t.Error(`TestBatchCheckpoint: resumed job did not keep its earlier shoreline.`)
+	}
+	resumedStatus := resumed.snapshot()
+	if resumedStatus.Footprints[0].State != footprintDetected {
+		t.Errorf(`TestBatchCheckpoint: detected footprint came back as %v.`, resumedStatus.Footprints[0].State)
+	}
+	for inx := 1; inx < 3; inx++ {
+		if results[inx] != nil || resumedStatus.Footprints[inx].State != footprintSkipped || resumedStatus.Footprints[inx].Reason == "out of cheese" {
+			t.Errorf(`TestBatchCheckpoint: footprint %d was not retried: %#v`, inx, resumedStatus.Footprints[inx])
+		}
+	}
+
+	if loaded, _ := loadBatchState("nonesuch"); loaded != nil {
+		t.Error(`TestBatchCheckpoint: found a checkpoint for a job that does not exist.`)
+	}
+}
+
+func TestBatchCheckpointConcurrent(t *testing.T) {
+	var features []*geojson.Feature
+	for inx := 0; inx < 50; inx++ {
+		features = append(features, geojson.NewFeature(nil, "landsat:"+strconv.Itoa(inx), nil))
+	}
+	job, err := newBatchJob(asInpStruct{}, geojson.NewFeatureCollection(features), "", nil)
+	if err != nil {
+		t.Fatal(`TestBatchCheckpointConcurrent: failed to create job: ` + err.Error())
+	}
+	var wg sync.WaitGroup
+	for inx := range features {
+		wg.Add(1)
+		go func(inx int) {
+			defer wg.Done()
+			job.setFootprint(inx, footprintDetected, "", "shore"+strconv.Itoa(inx), "")
+		}(inx)
+	}
+	wg.Wait()
+
+	// the last checkpoint written has every change in it
+	status, err := loadBatchState(job.id())
+	if err != nil || status == nil {
+		t.Fatalf(`TestBatchCheckpointConcurrent: could not read checkpoint: %v`, err)
+	}
+	for inx, fpStatus := range status.Footprints {
+		if fpStatus.State != footprintDetected || fpStatus.ShoreDataID != "shore"+strconv.Itoa(inx) {
+			t.Errorf(`TestBatchCheckpointConcurrent: footprint %d checkpointed as %#v.`, inx, fpStatus)
+		}
+	}
+}
+
+func TestMemoryCheckpointExpiry(t *testing.T) {
+	checkpointsMutex.Lock()
+	checkpointMem["stale"] = memCheckpoint{value: "old", expires: time.Now().Add(-time.Second)}
+	checkpointsMutex.Unlock()
+	if value := fetchCheckpoint("stale"); value != "" {
+		t.Errorf(`TestMemoryCheckpointExpiry: fetched an expired checkpoint %q.`, value)
+	}
+	storeCheckpoint("fresh", "new")
+	checkpointsMutex.Lock()
+	_, stale := checkpointMem["stale"]
+	checkpointsMutex.Unlock()
+	if stale {
+		t.Error(`TestMemoryCheckpointExpiry: expired checkpoint was not evicted.`)
+	}
+	if value := fetchCheckpoint("fresh"); value != "new" {
+		t.Errorf(`TestMemoryCheckpointExpiry: fetched %q rather than the new checkpoint.`, value)
+	}
+}
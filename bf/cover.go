@@ -0,0 +1,497 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bf
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/paulsmith/gogeos/geos"
+	"github.com/venicegeo/geojson-geos-go/geojsongeos"
+	"github.com/venicegeo/geojson-go/geojson"
+	"github.com/venicegeo/pzsvc-lib"
+)
+
+/*
+Footprint selection decides which scenes cover the footprint region.  There
+are two ways of going about it:
+
+- "greedy" (the default) walks the point cloud of the region, and takes the
+  best scene for each point that is not yet covered.  It is quick, but tends
+  to pick up redundant scenes, and whichever scene is best at one point may
+  be a poor choice for its neighbors.
+- "cover" gathers every candidate scene for every point, and
+  treats the choice as a weighted set cover of the points: cover them all,
+  with as few scenes as possible, and with scenes that score as well as
+  possible.  Each scene costs 1, plus 1 for every point of score by which
+  it falls short of a perfect scene (a score of 1).  For up to
+  exactCoverLimit candidates, the cheapest cover is searched for outright;
+  beyond that, or if the search runs too long, the standard greedy
+  approximation is used, with redundant scenes pruned afterward.  The
+  candidates are searched for a cell of the point cloud at a time, and
+  their tides looked up all together, rather than point by point.
+
+Either way, the result is reported on in a coverageReport, including how much
+of the region was left uncovered, and why (see gaps.go).
+*/
+
+// Footprint selection modes
+const (
+	selectCover  = "cover"
+	selectGreedy = "greedy"
+)
+
+const (
+	exactCoverLimit     = 24      // most candidates to search for an exact cover
+	exactCoverNodeLimit = 1000000 // most branches to try in that search
+	coverSearchCell     = 1.0     // size, in degrees, of the cells that candidates are searched for in
+)
+
+// coverageAreaUnits labels the areas in a coverageReport, which are
+// measured in longitude and latitude.
+const coverageAreaUnits = "square degrees"
+
+// coverageReport describes how well a set of footprints covers the
+// footprint region.  Areas are in square degrees, as AreaUnits says.
+type coverageReport struct {
+	Selection      string                     `json:"selection"`
+	AreaUnits      string                     `json:"areaUnits"`
+	SceneCount     int                        `json:"sceneCount"`
+	TotalScore     float64                    `json:"totalScore"`
+	RegionArea     float64                    `json:"regionArea"`
+	UncoveredArea  float64                    `json:"uncoveredArea"`
+	CoveredPercent float64                    `json:"coveredPercent"`
+	Gaps           *geojson.FeatureCollection `json:"gaps"`
+}
+
+// footprintSelection returns the selection mode of the given input, or
+// an error if it is not one we know.
+func footprintSelection(inpObj *asInpStruct) (string, error) {
+	if inpObj == nil || inpObj.Selection == "" {
+		return selectGreedy, nil
+	}
+	switch inpObj.Selection {
+	case selectCover, selectGreedy:
+		return inpObj.Selection, nil
+	}
+	return "", pzsvc.ErrWithTrace(`selection must be "` + selectCover + `" or "` + selectGreedy + `".  Received "` + inpObj.Selection + `".`)
+}
+
+// greedyFootprints takes the best scene for each point in the cloud that
+// the scenes taken so far do not cover.
+func greedyFootprints(points *geos.Geometry, inpObj *asInpStruct) ([]*geojson.Feature, error) {
+	var (
+		err error
+		currentGeometry,
+		captured, // The area currently covered by selected images
+		point *geos.Geometry
+		pointCount int
+		contains   bool
+		bestImage  *geojson.Feature
+		result     []*geojson.Feature
+	)
+	if captured, err = geos.EmptyPolygon(); err != nil {
+		return nil, pzsvc.TraceErr(err)
+	}
+	if pointCount, err = points.NGeometry(); err != nil {
+		return nil, pzsvc.TraceErr(err)
+	}
+	for inx := 0; inx < pointCount; inx++ {
+		if point, err = points.Geometry(inx); err != nil {
+			return nil, pzsvc.TraceErr(err)
+		}
+		if contains, err = captured.Contains(point); err != nil {
+			return nil, pzsvc.TraceErr(err)
+		} else if contains {
+			continue
+		}
+		if bestImage = getBestScene(point, inpObj); bestImage == nil {
+			log.Printf("Didn't get a candidate image for point %v.", point.String())
+		} else {
+			result = append(result, bestImage)
+			if currentGeometry, err = geojsongeos.GeosFromGeoJSON(bestImage.Geometry); err != nil {
+				return nil, pzsvc.TraceErr(err)
+			}
+			if captured, err = captured.Union(currentGeometry); err != nil {
+				return nil, pzsvc.TraceErr(err)
+			}
+		}
+	}
+	return result, nil
+}
+
+// coverFootprints chooses the set of scenes that covers the points in the
+// cloud most cheaply, as described above.
+func coverFootprints(points *geos.Geometry, inpObj *asInpStruct) ([]*geojson.Feature, error) {
+	var (
+		err        error
+		pointCount int
+		point      *geos.Geometry
+		pointList  []*geos.Geometry
+		candidates []scoredScene
+		contains   bool
+	)
+	policy := scoringPolicyOf(inpObj)
+	if pointCount, err = points.NGeometry(); err != nil {
+		return nil, pzsvc.TraceErr(err)
+	}
+	for inx := 0; inx < pointCount; inx++ {
+		if point, err = points.Geometry(inx); err != nil {
+			return nil, pzsvc.TraceErr(err)
+		}
+		pointList = append(pointList, point)
+	}
+	if candidates, err = getCoverCandidates(pointList, inpObj, policy, time.Now()); err != nil {
+		return nil, err
+	}
+
+	sets := make([]coverSet, len(candidates))
+	costs := make([]float64, len(candidates))
+	for cinx, candidate := range candidates {
+		sets[cinx] = newCoverSet(len(pointList))
+		costs[cinx] = coverCost(candidate.score)
+		geometry, err := geojsongeos.GeosFromGeoJSON(candidate.scene.Geometry)
+		if err != nil {
+			log.Printf("Not considering scene %v: %v", candidate.scene.ID, err.Error())
+			continue
+		}
+		prepared := geos.PrepareGeometry(geometry)
+		for pinx, point := range pointList {
+			if contains, err = prepared.Contains(point); err == nil && contains {
+				sets[cinx].add(pinx)
+			}
+		}
+	}
+
+	chosen := chooseCover(sets, costs)
+	result := make([]*geojson.Feature, 0, len(chosen))
+	for _, cinx := range chosen {
+		candidate := candidates[cinx]
+		setScore(candidate.scene, policy, candidate.score, candidate.breakdown)
+		result = append(result, candidate.scene)
+	}
+	return result, nil
+}
+
+// getCoverCandidates finds every scene that covers any of the given
+// points, and scores it.  The points are grouped into cells of
+// coverSearchCell degrees, in the standard frame so that no cell crosses
+// the antimeridian, and each cell takes one catalog search.  Tides are
+// then looked up once, for all of the scenes together.
+func getCoverCandidates(points []*geos.Geometry, inpObj *asInpStruct, policy *scoringPolicy, now time.Time) ([]scoredScene, error) {
+	type searchCell struct {
+		coords [][]float64
+		lon    float64 // where the cell lies in the frame of the points
+	}
+	var (
+		cellKeys []string
+		cells    = make(map[string]*searchCell)
+		known    = make(map[string]bool)
+		scenes   = geojson.NewFeatureCollection(nil)
+		result   []scoredScene
+	)
+	for _, point := range points {
+		lon, err := point.X()
+		if err != nil {
+			return nil, pzsvc.TraceErr(err)
+		}
+		lat, err := point.Y()
+		if err != nil {
+			return nil, pzsvc.TraceErr(err)
+		}
+		stdLon := standardFrame.wrap(lon)
+		key := fmt.Sprintf("%v,%v", math.Floor(stdLon/coverSearchCell), math.Floor(lat/coverSearchCell))
+		if cells[key] == nil {
+			cells[key] = &searchCell{lon: lon}
+			cellKeys = append(cellKeys, key)
+		}
+		cells[key].coords = append(cells[key].coords, []float64{stdLon, lat})
+	}
+
+	for _, key := range cellKeys {
+		cell := cells[key]
+		found, err := searchSceneGeometry(geojson.NewMultiPoint(cell.coords))
+		if err != nil {
+			log.Printf("Failed to get scenes from image catalog: %v", err.Error())
+			continue
+		}
+		if len(found.Features) == 0 {
+			log.Printf("Didn't get a candidate image for the %d points in cell %v.", len(cell.coords), key)
+		}
+		for _, scene := range found.Features {
+			if id := scene.IDStr(); known[id] {
+				continue
+			} else {
+				known[id] = true
+			}
+			if scene.Geometry, err = normalizeNear(scene.Geometry, cell.lon); err != nil {
+				log.Printf("Not considering scene %v: %v", scene.ID, err.Error())
+				continue
+			}
+			scenes.Features = append(scenes.Features, scene)
+		}
+	}
+	if len(scenes.Features) == 0 {
+		return nil, nil
+	}
+	addSceneTides(scenes, inpObj)
+
+	for _, scene := range scenes.Features {
+		score, breakdown, err := policy.score(scene, now)
+		if err != nil {
+			log.Printf("Not considering scene %v: %v", scene.ID, err.Error())
+			continue
+		}
+		result = append(result, scoredScene{scene: scene, score: score, breakdown: breakdown})
+	}
+	return result, nil
+}
+
+// coverCost is what a scene with the given score costs toward a cover.
+func coverCost(score float64) float64 {
+	if score >= 1 {
+		return 1
+	}
+	return 2 - score
+}
+
+// chooseCover returns the indexes of the sets that together cover every
+// element that any of them covers, at the least total cost that it can
+// find.
+func chooseCover(sets []coverSet, costs []float64) []int {
+	if len(sets) == 0 {
+		return nil
+	}
+	universe := newCoverSet(0)
+	for _, set := range sets {
+		universe = universe.union(set)
+	}
+	chosen := pruneCover(greedyCover(sets, costs, universe), sets, costs, universe)
+	if len(sets) <= exactCoverLimit {
+		chosen = exactCover(sets, costs, universe, chosen)
+	}
+	sort.Ints(chosen)
+	return chosen
+}
+
+// greedyCover repeatedly takes the set that covers the most new elements
+// for its cost.
+func greedyCover(sets []coverSet, costs []float64, universe coverSet) []int {
+	var chosen []int
+	covered := newCoverSet(0)
+	for !covered.covers(universe) {
+		best, bestRatio := -1, 0.0
+		for inx, set := range sets {
+			if ratio := float64(set.countNotIn(covered)) / costs[inx]; ratio > bestRatio {
+				best, bestRatio = inx, ratio
+			}
+		}
+		if best < 0 {
+			break
+		}
+		chosen = append(chosen, best)
+		covered = covered.union(sets[best])
+	}
+	return chosen
+}
+
+// pruneCover drops whichever of the chosen sets the others make redundant,
+// most expensive first.
+func pruneCover(chosen []int, sets []coverSet, costs []float64, universe coverSet) []int {
+	sort.Stable(byCoverCost{chosen, costs})
+	for inx := 0; inx < len(chosen); {
+		others := newCoverSet(0)
+		for oinx, other := range chosen {
+			if oinx != inx {
+				others = others.union(sets[other])
+			}
+		}
+		if others.covers(universe) {
+			chosen = append(chosen[:inx], chosen[inx+1:]...)
+		} else {
+			inx++
+		}
+	}
+	return chosen
+}
+
+// byCoverCost sorts set indexes from most to least expensive.
+type byCoverCost struct {
+	indexes []int
+	costs   []float64
+}
+
+func (a byCoverCost) Len() int {
+	return len(a.indexes)
+}
+func (a byCoverCost) Swap(i, j int) {
+	a.indexes[i], a.indexes[j] = a.indexes[j], a.indexes[i]
+}
+func (a byCoverCost) Less(i, j int) bool {
+	return a.costs[a.indexes[i]] > a.costs[a.indexes[j]]
+}
+
+// exactCover searches for a cheaper cover than the one given, branching
+// on the element with the fewest sets that cover it.  If the search runs
+// past exactCoverNodeLimit, the best cover found so far is returned.
+func exactCover(sets []coverSet, costs []float64, universe coverSet, initial []int) []int {
+	best := append([]int(nil), initial...)
+	bestCost := 0.0
+	minCost := costs[0]
+	for _, inx := range initial {
+		bestCost += costs[inx]
+	}
+	for _, cost := range costs {
+		if cost < minCost {
+			minCost = cost
+		}
+	}
+	nodes := 0
+	var search func(covered coverSet, chosen []int, cost float64)
+	search = func(covered coverSet, chosen []int, cost float64) {
+		if nodes++; nodes > exactCoverNodeLimit {
+			return
+		}
+		elem, fewest := -1, 0
+		for _, candidate := range universe.elements() {
+			if covered.has(candidate) {
+				continue
+			}
+			count := 0
+			for _, set := range sets {
+				if set.has(candidate) {
+					count++
+				}
+			}
+			if elem < 0 || count < fewest {
+				elem, fewest = candidate, count
+			}
+		}
+		if elem < 0 {
+			if cost < bestCost-1e-9 {
+				best, bestCost = append([]int(nil), chosen...), cost
+			}
+			return
+		}
+		if cost+minCost >= bestCost-1e-9 {
+			return
+		}
+		for inx, set := range sets {
+			if set.has(elem) {
+				search(covered.union(set), append(chosen, inx), cost+costs[inx])
+			}
+		}
+	}
+	search(newCoverSet(0), nil, 0)
+	return best
+}
+
+// coverSet is a set of point indexes, as a bitmap.
+type coverSet []uint64
+
+func newCoverSet(size int) coverSet {
+	return make(coverSet, (size+63)/64)
+}
+
+func (set coverSet) add(elem int) {
+	set[elem/64] |= 1 << uint(elem%64)
+}
+
+func (set coverSet) has(elem int) bool {
+	return elem/64 < len(set) && set[elem/64]&(1<<uint(elem%64)) != 0
+}
+
+func (set coverSet) union(other coverSet) coverSet {
+	if len(other) > len(set) {
+		set, other = other, set
+	}
+	result := append(coverSet(nil), set...)
+	for inx, word := range other {
+		result[inx] |= word
+	}
+	return result
+}
+
+// covers reports whether every element of other is in the set.
+func (set coverSet) covers(other coverSet) bool {
+	return other.countNotIn(set) == 0
+}
+
+// countNotIn counts the elements of the set that are not in other.
+func (set coverSet) countNotIn(other coverSet) int {
+	count := 0
+	for inx, word := range set {
+		if inx < len(other) {
+			word &^= other[inx]
+		}
+		for ; word != 0; word &= word - 1 {
+			count++
+		}
+	}
+	return count
+}
+
+func (set coverSet) elements() []int {
+	var result []int
+	for inx := 0; inx < len(set)*64; inx++ {
+		if set.has(inx) {
+			result = append(result, inx)
+		}
+	}
+	return result
+}
+
+// coverageOf reports on how well the given footprints cover the region.
+func coverageOf(features []*geojson.Feature, region *geos.Geometry, selection string, inpObj *asInpStruct) (*coverageReport, error) {
+	var (
+		err error
+		covered,
+		geometry,
+		uncovered *geos.Geometry
+		result = coverageReport{Selection: selection, AreaUnits: coverageAreaUnits, SceneCount: len(features)}
+	)
+	if covered, err = geos.EmptyPolygon(); err != nil {
+		return nil, pzsvc.TraceErr(err)
+	}
+	for _, feature := range features {
+		result.TotalScore += feature.PropertyFloat("score")
+		if geometry, err = geojsongeos.GeosFromGeoJSON(feature.Geometry); err != nil {
+			return nil, pzsvc.TraceErr(err)
+		}
+		if covered, err = covered.Union(geometry); err != nil {
+			return nil, pzsvc.TraceErr(err)
+		}
+	}
+	if uncovered, err = region.Difference(covered); err != nil {
+		return nil, pzsvc.TraceErr(err)
+	}
+	if result.RegionArea, err = region.Area(); err != nil {
+		return nil, pzsvc.TraceErr(err)
+	}
+	if result.UncoveredArea, err = uncovered.Area(); err != nil {
+		return nil, pzsvc.TraceErr(err)
+	}
+	result.CoveredPercent = 100
+	if result.RegionArea > 0 {
+		result.CoveredPercent = 100 * (1 - result.UncoveredArea/result.RegionArea)
+	}
+	if result.Gaps, err = coverageGaps(uncovered, inpObj); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
@@ -0,0 +1,108 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bf
+
+import (
+	"reflect"
+	"testing"
+)
+
+func makeCoverSet(size int, elems ...int) coverSet {
+	result := newCoverSet(size)
+	for _, elem := range elems {
+		result.add(elem)
+	}
+	return result
+}
+
+// columns returns the elements of both rows of a two-row grid, 14 wide,
+// from column start up to column end.
+func columns(start, end int) []int {
+	var result []int
+	for col := start; col < end; col++ {
+		result = append(result, col, 14+col)
+	}
+	return result
+}
+
+func TestChooseCover(t *testing.T) {
+	// The classic case where greedy selection goes wrong: two rows cover
+	// the grid, but greedy takes the widest block of columns each time.
+	sets := []coverSet{
+		makeCoverSet(28, columns(0, 2)...),
+		makeCoverSet(28, columns(2, 6)...),
+		makeCoverSet(28, columns(6, 14)...),
+		makeCoverSet(28, 0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13),
+		makeCoverSet(28, 14, 15, 16, 17, 18, 19, 20, 21, 22, 23, 24, 25, 26, 27)}
+	costs := []float64{1, 1, 1, 1, 1}
+	universe := makeCoverSet(28)
+	for _, set := range sets {
+		universe = universe.union(set)
+	}
+	if greedy := greedyCover(sets, costs, universe); len(greedy) != 3 {
+		t.Errorf(`TestChooseCover: expected greedy cover of 3 sets, got %v`, greedy)
+	}
+	if chosen := chooseCover(sets, costs); !reflect.DeepEqual(chosen, []int{3, 4}) {
+		t.Errorf(`TestChooseCover: expected rows to be chosen, got %v`, chosen)
+	}
+
+	// Cost decides between covers of the same size.
+	costs = []float64{1, 1, 1, 3, 3}
+	if chosen := chooseCover(sets, costs); !reflect.DeepEqual(chosen, []int{0, 1, 2}) {
+		t.Errorf(`TestChooseCover: expected cheap columns to be chosen, got %v`, chosen)
+	}
+
+	// Redundant sets are pruned, and elements nothing covers are ignored.
+	sets = []coverSet{makeCoverSet(5, 0, 1), makeCoverSet(5, 1, 2), makeCoverSet(5, 0, 1, 2)}
+	if chosen := chooseCover(sets, []float64{1, 1, 1.5}); !reflect.DeepEqual(chosen, []int{2}) {
+		t.Errorf(`TestChooseCover: expected a single set, got %v`, chosen)
+	}
+	if chosen := chooseCover(nil, nil); len(chosen) != 0 {
+		t.Errorf(`TestChooseCover: chose %v from nothing`, chosen)
+	}
+}
+
+func TestCoverSet(t *testing.T) {
+	set := makeCoverSet(100, 3, 64, 99)
+	other := makeCoverSet(70, 3, 65)
+	if !set.has(64) || set.has(65) || other.has(99) {
+		t.Error(`TestCoverSet: membership is wrong.`)
+	}
+	if count := set.countNotIn(other); count != 2 {
+		t.Errorf(`TestCoverSet: expected 2 elements not in other, got %d`, count)
+	}
+	union := other.union(set)
+	if !reflect.DeepEqual(union.elements(), []int{3, 64, 65, 99}) || !union.covers(set) || set.covers(union) {
+		t.Errorf(`TestCoverSet: bad union %v`, union.elements())
+	}
+}
+
+func TestFootprintSelection(t *testing.T) {
+	if selection, err := footprintSelection(nil); err != nil || selection != selectGreedy {
+		t.Errorf(`TestFootprintSelection: default was %s, %v`, selection, err)
+	}
+	if selection, err := footprintSelection(&asInpStruct{Selection: selectGreedy}); err != nil || selection != selectGreedy {
+		t.Errorf(`TestFootprintSelection: greedy was %s, %v`, selection, err)
+	}
+	if selection, err := footprintSelection(&asInpStruct{Selection: selectCover}); err != nil || selection != selectCover {
+		t.Errorf(`TestFootprintSelection: cover was %s, %v`, selection, err)
+	}
+	if _, err := footprintSelection(&asInpStruct{Selection: "random"}); err == nil {
+		t.Error(`TestFootprintSelection: accepted an unknown selection.`)
+	}
+	if coverCost(1) != 1 || coverCost(0) != 2 || coverCost(-0.5) != 2.5 {
+		t.Error(`TestFootprintSelection: unexpected cover costs.`)
+	}
+}
@@ -15,10 +15,11 @@
 package bf
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
-	"math"
 	"net/http"
 	"sort"
 	"time"
@@ -33,12 +34,21 @@ import (
 // PrepareFootprints takes an input GeoJSON and creates a set of image features.
 // Those features contain image metadata suitable for passing into a
 // shoreline detection process. The geometries are footprints of the required
-// regions. The output is also GeoJSON.
+// regions. The output is also GeoJSON, with a "coverage" report alongside the
+// features.  The input may also be an object with the GeoJSON as its
+// "baseline", alongside "scoring", "selection" and "tidesAddr" as for
+// executeBatch.
 func PrepareFootprints(writer http.ResponseWriter, request *http.Request) {
 	var (
-		bytes []byte
-		err   error
-		gjIfc interface{}
+		bytes      []byte
+		err        error
+		gjIfc      interface{}
+		footprints *geojson.FeatureCollection
+		coverage   *coverageReport
+		asInpObj   *asInpStruct
+		wrapper    struct {
+			Baseline json.RawMessage `json:"baseline"`
+		}
 	)
 
 	switch request.Method {
@@ -48,12 +58,20 @@ func PrepareFootprints(writer http.ResponseWriter, request *http.Request) {
 			http.Error(writer, err.Error(), http.StatusBadRequest)
 			break
 		}
+		if json.Unmarshal(bytes, &wrapper) == nil && len(wrapper.Baseline) > 0 {
+			asInpObj = new(asInpStruct)
+			if err = json.Unmarshal(bytes, asInpObj); err != nil {
+				http.Error(writer, err.Error(), http.StatusBadRequest)
+				break
+			}
+			bytes = wrapper.Baseline
+		}
 		if gjIfc, err = geojson.Parse(bytes); err != nil {
 			http.Error(writer, err.Error(), http.StatusBadRequest)
 			break
 		}
-		if gjIfc, err = crawlFootprints(gjIfc, nil); err == nil {
-			if bytes, err = geojson.Write(gjIfc); err != nil {
+		if footprints, coverage, err = crawlFootprints(gjIfc, asInpObj); err == nil {
+			if bytes, err = footprintsWithCoverage(footprints, coverage); err != nil {
 				http.Error(writer, err.Error(), http.StatusBadRequest)
 				break
 			}
@@ -70,63 +88,104 @@ func PrepareFootprints(writer http.ResponseWriter, request *http.Request) {
 	}
 }
 
-func crawlFootprints(gjIfc interface{}, asInpObj *asInpStruct) (*geojson.FeatureCollection, error) {
+// footprintsWithCoverage writes the footprints as GeoJSON, with the coverage
+// report as a "coverage" member of the FeatureCollection.
+func footprintsWithCoverage(footprints *geojson.FeatureCollection, coverage *coverageReport) ([]byte, error) {
+	var members map[string]json.RawMessage
+	byts, err := geojson.Write(footprints)
+	if err != nil {
+		return nil, pzsvc.TraceErr(err)
+	}
+	if err = json.Unmarshal(byts, &members); err != nil {
+		return nil, pzsvc.TraceErr(err)
+	}
+	if members["coverage"], err = json.Marshal(coverage); err != nil {
+		return nil, pzsvc.TraceErr(err)
+	}
+	return json.Marshal(members)
+}
+
+// crawlFootprints selects the scenes that cover the footprint region of the
+// given GeoJSON, clipped to that region, and reports on how well they cover
+// it.
+func crawlFootprints(gjIfc interface{}, asInpObj *asInpStruct) (*geojson.FeatureCollection, *coverageReport, error) {
 	var (
 		err error
-		currentGeometry,
 		footprintRegion,
-		captured, // The area currently covered by selected images
-		points,
-		point *geos.Geometry
-		pointCount int
-		contains   bool
-		bestImage  *geojson.Feature
+		points *geos.Geometry
+		selection  string
+		buffer     float64
+		features   []*geojson.Feature
 		bestImages *geojson.FeatureCollection
+		coverage   *coverageReport
 	)
 
-	bestImages = geojson.NewFeatureCollection(nil)
-	if captured, err = geos.EmptyPolygon(); err != nil {
-		return nil, pzsvc.TraceErr(err)
+	if selection, err = footprintSelection(asInpObj); err != nil {
+		return nil, nil, err
+	}
+	if buffer, err = footprintBuffer(asInpObj); err != nil {
+		return nil, nil, err
+	}
+	if gjIfc, err = frameFor(gjIfc).normalize(gjIfc); err != nil {
+		return nil, nil, err
 	}
 	fmt.Print("\nProducing footprint region.")
-	if footprintRegion, err = getFootprintRegion(gjIfc, 0.25); err != nil {
-		return nil, err
+	if footprintRegion, err = getFootprintRegion(gjIfc, buffer); err != nil {
+		return nil, nil, err
 	}
 	if points, err = geojsongeos.PointCloud(footprintRegion); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	if pointCount, err = points.NGeometry(); err != nil {
-		return nil, pzsvc.TraceErr(err)
+	if selection == selectGreedy {
+		features, err = greedyFootprints(points, asInpObj)
+	} else {
+		features, err = coverFootprints(points, asInpObj)
 	}
-	for inx := 0; inx < pointCount; inx++ {
-		if point, err = points.Geometry(inx); err != nil {
-			return nil, pzsvc.TraceErr(err)
-		}
-		if contains, err = captured.Contains(point); err != nil {
-			return nil, pzsvc.TraceErr(err)
-		} else if contains {
-			continue
-		}
-		if bestImage = getBestScene(point, asInpObj); bestImage == nil {
-			log.Printf("Didn't get a candidate image for point %v.", point.String())
-		} else {
-			bestImages.Features = append(bestImages.Features, bestImage)
-			if currentGeometry, err = geojsongeos.GeosFromGeoJSON(bestImage.Geometry); err != nil {
-				return nil, pzsvc.TraceErr(err)
-			}
-			if captured, err = captured.Union(currentGeometry); err != nil {
-				return nil, pzsvc.TraceErr(err)
-			}
-		}
+	if err != nil {
+		return nil, nil, err
 	}
-	sort.Sort(ByScore(bestImages.Features))
+	bestImages = geojson.NewFeatureCollection(features)
+	sort.Sort(ByScore{Features: bestImages.Features, policy: scoringPolicyOf(asInpObj), now: time.Now()})
 	fmt.Print("\nClipping footprints.")
 	bestImages.Features = selfClip(bestImages.Features)
 	bestImages.Features = clipFootprints(bestImages.Features, footprintRegion)
+	if coverage, err = coverageOf(bestImages.Features, footprintRegion, selection, asInpObj); err != nil {
+		return nil, nil, err
+	}
+	log.Printf("Footprints cover %.1f%% of the footprint region with %d scenes.", coverage.CoveredPercent, coverage.SceneCount)
+	splitFeatures(bestImages.Features)
+	splitFeatures(coverage.Gaps.Features)
+
+	return bestImages, coverage, nil
+}
+
+// defaultFootprintBuffer is how far, in meters, the footprint region
+// extends beyond the baseline if the input does not say: about a quarter of
+// a degree of latitude.
+const defaultFootprintBuffer = 27750
 
-	return bestImages, nil
+// Buffered regions with less area than smallRegionFactor times the square
+// of the buffer distance are replaced by their bounding boxes.  For a
+// quarter-degree buffer, this is half a square degree.
+const smallRegionFactor = 8
+
+// footprintBuffer returns the buffer distance, in meters, of the given
+// input, or an error if it is negative.
+func footprintBuffer(inpObj *asInpStruct) (float64, error) {
+	if inpObj == nil || inpObj.BufferMeters == 0 {
+		return defaultFootprintBuffer, nil
+	}
+	if inpObj.BufferMeters < 0 {
+		return 0, pzsvc.ErrWithTrace(fmt.Sprintf("bufferMeters must not be negative.  Received %v.", inpObj.BufferMeters))
+	}
+	return inpObj.BufferMeters, nil
 }
 
+// getFootprintRegion buffers the given GeoJSON or GEOS geometry by the
+// given number of meters, to produce the region for which footprints are
+// needed.  Buffering is done in the local UTM zone of each geometry, or
+// of each piece of a geometry that spans several zones, so that the
+// distance means the same thing at any latitude.
 func getFootprintRegion(input interface{}, buffer float64) (*geos.Geometry, error) {
 	var (
 		geometries []*geos.Geometry
@@ -158,57 +217,41 @@ func getFootprintRegion(input interface{}, buffer float64) (*geos.Geometry, erro
 		return getFootprintRegion(geom, buffer)
 	case *geos.Geometry:
 		var (
-			area float64
-			gt   geos.GeometryType
+			gt    geos.GeometryType
+			count int
+			part  *geos.Geometry
 		)
-		if geom, err = it.Buffer(buffer); err != nil {
-			return nil, pzsvc.TraceErr(err)
-		}
-		// If we have too small a polygon, just buffer its envelope
-		// so we don't waste time with a zillion points
-		if gt, err = geom.Type(); err != nil {
+		if gt, err = it.Type(); err != nil {
 			return nil, pzsvc.TraceErr(err)
 		}
 		switch gt {
-		case geos.POLYGON:
-			if area, err = geom.Area(); err != nil {
-				return nil, pzsvc.TraceErr(err)
-			}
-			if area < buffer*2.0 {
-				// log.Print("Found a small geometry. Converting to Bounding Box.")
-				if result, err = geom.Envelope(); err != nil {
-					return nil, pzsvc.TraceErr(err)
-				}
-			} else {
-				result = geom
-				// log.Print("Found a large geometry. Simplifying.")
-				// if result, err = geom.Simplify(0.1); err != nil {
-				// 	return nil, pzsvc.TraceErr(err)
-				// }
-			}
-		case geos.MULTIPOLYGON:
-			var (
-				count int
-				geoms []*geos.Geometry
-				curr  *geos.Geometry
-			)
-			if count, err = geom.NGeometry(); err != nil {
+		case geos.MULTIPOINT, geos.MULTILINESTRING, geos.MULTIPOLYGON, geos.GEOMETRYCOLLECTION:
+			// Each part is buffered in its own UTM zone, since the parts
+			// may be far apart
+			if count, err = it.NGeometry(); err != nil {
 				return nil, pzsvc.TraceErr(err)
 			}
 			for inx := 0; inx < count; inx++ {
-				if curr, err = geom.Geometry(inx); err != nil {
+				if part, err = it.Geometry(inx); err != nil {
 					return nil, pzsvc.TraceErr(err)
 				}
-				if curr, err = getFootprintRegion(curr, 0); err != nil {
-					return nil, pzsvc.TraceErr(err)
+				if geom, err = getFootprintRegion(part, buffer); err != nil {
+					return nil, err
 				}
-				geoms = append(geoms, curr)
+				geometries = append(geometries, geom)
+			}
+			if collection, err = geos.NewCollection(geos.GEOMETRYCOLLECTION, geometries...); err != nil {
+				return nil, pzsvc.TraceErr(err)
 			}
-			if result, err = geos.NewCollection(geos.MULTIPOLYGON, geoms...); err != nil {
+			if result, err = collection.Buffer(0); err != nil {
 				return nil, pzsvc.TraceErr(err)
 			}
 		default:
-			return nil, pzsvc.TraceErr(fmt.Errorf("Unexpected geometry type: %v", gt))
+			// If we have too small a polygon, just buffer its envelope
+			// so we don't waste time with a zillion points
+			if result, err = bufferMeters(it, buffer, smallRegionFactor*buffer*buffer); err != nil {
+				return nil, err
+			}
 		}
 	default:
 		return nil, pzsvc.ErrWithTrace(fmt.Sprintf("Cannot create point cloud from %T.", input))
@@ -295,116 +338,143 @@ func selfClip(features []*geojson.Feature) []*geojson.Feature {
 	return features
 }
 
-// ByScore allows for sorting of features by their scores
-type ByScore []*geojson.Feature
-
-func (a ByScore) Len() int {
-	return len(a)
-}
-func (a ByScore) Swap(i, j int) {
-	a[i], a[j] = a[j], a[i]
-}
-func (a ByScore) Less(i, j int) bool {
-	return sceneScore(a[i]) < sceneScore(a[j])
+// scoredScene is a candidate scene, with its score under some policy.
+type scoredScene struct {
+	scene     *geojson.Feature
+	score     float64
+	breakdown map[string]float64
 }
 
+// getBestScene returns the best scene at the given point under the
+// input's scoring policy, with its score recorded, or nil if there is none.
 func getBestScene(point *geos.Geometry, inpObj *asInpStruct) *geojson.Feature {
-	var (
-		options catalog.SearchOptions
-		feature,
-		currentScene,
-		bestScene *geojson.Feature
-		geometry interface{}
-		currentScore,
-		bestScore float64
-		err              error
-		tidesInObj       *tidesIn
-		tidesOutObj      *tidesOut
-		sceneDescriptors catalog.SceneDescriptors
-	)
-	options.NoCache = true
-	options.Rigorous = true
-	geometry, _ = geojsongeos.GeoJSONFromGeos(point)
-	feature = geojson.NewFeature(geometry, "", nil)
-	feature.Bbox = feature.ForceBbox()
-	if sceneDescriptors, _, err = catalog.GetScenes(feature, options); err != nil {
+	var best *scoredScene
+	policy := scoringPolicyOf(inpObj)
+	candidates := getCandidateScenes(point, inpObj, policy, time.Now())
+	for inx, candidate := range candidates {
+		if best == nil || candidate.score > best.score {
+			best = &candidates[inx]
+		}
+	}
+	if best == nil {
+		return nil
+	}
+	setScore(best.scene, policy, best.score, best.breakdown)
+	return best.scene
+}
+
+// getCandidateScenes returns every scene at the given point that the
+// policy will consider, along with its score.
+func getCandidateScenes(point *geos.Geometry, inpObj *asInpStruct, policy *scoringPolicy, now time.Time) []scoredScene {
+	var result []scoredScene
+	scenes, err := searchScenes(point)
+	if err != nil {
 		log.Printf("Failed to get scenes from image catalog: %v", err.Error())
 		return nil
 	}
-	if len(sceneDescriptors.Scenes.Features) == 0 {
-		log.Printf("Found no images in catalog search. %v %#v", feature.String(), options)
+	if len(scenes.Features) == 0 {
+		log.Printf("Found no images in catalog search at %v.", point.String())
 		return nil
 	}
+	addSceneTides(scenes, inpObj)
 
-	// Incorporate Tide Prediction
-	if inpObj != nil && inpObj.TidesAddr != "" {
-		if tidesInObj = toTidesIn(sceneDescriptors.Scenes.Features); tidesInObj != nil {
-			fmt.Print("\nLoading tide information.")
-
-			if _, err = pzsvc.ReqByObjJSON("POST", inpObj.TidesAddr, "", tidesInObj, tidesOutObj); err == nil {
-				// Loop 1: Add the tide information to each image
-				for _, tideObj := range tidesOutObj.Locations {
-					currentScene = tidesInObj.Map[tideObj.Dtg]
-					currentScene.Properties["CurrentTide"] = tideObj.Results.CurrTide
-					currentScene.Properties["24hrMinTide"] = tideObj.Results.MinTide
-					currentScene.Properties["24hrMaxTide"] = tideObj.Results.MaxTide
-					updateSceneTide(currentScene, tideObj.Results)
-				}
-				// } else {
-				// 	log.Printf("Failed to get tide prediction information: %v", err.Error())
-			}
+	// Scenes that cross the antimeridian need to be unwrapped, and all
+	// of them need to be in the same frame as the point.
+	lon, err := point.X()
+	if err != nil {
+		log.Printf("Failed to read point %v: %v", point.String(), err.Error())
+		return nil
+	}
+	for _, currentScene := range scenes.Features {
+		if currentScene.Geometry, err = normalizeNear(currentScene.Geometry, lon); err != nil {
+			log.Printf("Not considering scene %v: %v", currentScene.ID, err.Error())
+			currentScene.Geometry = nil
 		}
 	}
 
-	// Loop 2: Check their scores
-	for _, currentScene = range sceneDescriptors.Scenes.Features {
-		currentScore = sceneScore(currentScene)
-		if currentScore > bestScore {
-			bestScene = currentScene
-			bestScene.Properties["score"] = currentScore
-			bestScore = currentScore
+	for _, currentScene := range scenes.Features {
+		if currentScene.Geometry == nil {
+			continue
+		}
+		score, breakdown, err := policy.score(currentScene, now)
+		if err != nil {
+			log.Printf("Not considering scene %v: %v", currentScene.ID, err.Error())
+			continue
 		}
+		result = append(result, scoredScene{scene: currentScene, score: score, breakdown: breakdown})
 	}
-	return bestScene
+	return result
+}
+
+// searchScenes returns the scenes in the catalog at the given point.
+// The point may be in any frame (see antimeridian.go).
+func searchScenes(point *geos.Geometry) (*geojson.FeatureCollection, error) {
+	geometry, err := geojsongeos.GeoJSONFromGeos(point)
+	if err != nil {
+		return nil, pzsvc.TraceErr(err)
+	}
+	return searchSceneGeometry(geometry)
 }
 
-var date2015 = time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC).Unix()
+// searchSceneGeometry finds the scenes that intersect the given GeoJSON
+// geometry.
+func searchSceneGeometry(geometry interface{}) (*geojson.FeatureCollection, error) {
+	var (
+		err     error
+		options catalog.SearchOptions
+	)
+	options.NoCache = true
+	options.Rigorous = true
+	if geometry, err = standardFrame.normalize(geometry); err != nil {
+		return nil, err
+	}
+	feature := geojson.NewFeature(geometry, "", nil)
+	feature.Bbox = feature.ForceBbox()
+	return sceneCatalog.GetScenes(feature, options)
+}
 
-func sceneScore(scene *geojson.Feature) float64 {
+// addSceneTides adds tide information to each of the given scenes, if the
+// input names a tide service.
+func addSceneTides(scenes *geojson.FeatureCollection, inpObj *asInpStruct) {
 	var (
-		result       = 1.0
-		acquiredDate time.Time
 		err          error
+		currentScene *geojson.Feature
+		tides        tideProvider
+		tidesInObj   *tidesIn
+		tidesOutObj  *tidesOut
 	)
-	cloudCover := scene.PropertyFloat("cloudCover")
-	currTide := scene.PropertyFloat("CurrentTide")
-	minTide := scene.PropertyFloat("24hrMinTide")
-	maxTide := scene.PropertyFloat("24hrMaxTide")
-	acquiredDateString := scene.PropertyString("acquiredDate")
-	if acquiredDate, err = time.Parse(time.RFC3339, acquiredDateString); err != nil {
-		log.Printf("Received invalid date of %v: ", acquiredDateString)
-		return 0.0
-	}
-	// Landsat images older than 2015 are unlikely to be in the S3 archive
-	// unless they happen to have very good cloud cover so discourage them
-	acquiredDateUnix := acquiredDate.Unix()
-	if acquiredDateUnix < date2015 {
-		result = 0.5
-	}
-	now := time.Now().Unix()
-	result -= math.Sqrt(cloudCover / 100.0)
-	result -= float64(acquiredDateUnix-now) / (60.0 * 60.0 * 24.0 * 365.0 * 10.0)
-	if math.IsNaN(currTide) {
-		// If no tide is available for some reason, assume low tide
-		// log.Printf("No tide available for %v", scene.ID)
-		result -= math.Sqrt(0.1)
-	} else {
-		result -= math.Sqrt(0.1) * (maxTide - currTide) / (maxTide - minTide)
+	if inpObj == nil || inpObj.TidesAddr == "" {
+		return
 	}
-	return result
+	if tides, err = getTideProvider(inpObj.TidesAddr); err != nil {
+		log.Printf("Failed to set up tide prediction: %v", err.Error())
+	} else if tidesInObj = toTidesIn(scenes.Features); tidesInObj != nil {
+		fmt.Print("\nLoading tide information.")
+
+		if tidesOutObj, err = tides.tides(context.Background(), tidesInObj); err == nil {
+			for _, tideObj := range tidesOutObj.Locations {
+				currentScene = tidesInObj.Map[tideObj.Dtg]
+				currentScene.Properties["CurrentTide"] = tideObj.Results.CurrTide
+				currentScene.Properties["24hrMinTide"] = tideObj.Results.MinTide
+				currentScene.Properties["24hrMaxTide"] = tideObj.Results.MaxTide
+				updateSceneTide(currentScene, tideObj.Results)
+			}
+		} else {
+			log.Printf("Failed to get tide prediction information: %v", err.Error())
+		}
+	}
+}
+
+// scoringPolicyOf returns the scoring policy of the given input, or the
+// default if it has none.
+func scoringPolicyOf(inpObj *asInpStruct) *scoringPolicy {
+	if inpObj == nil {
+		return scoringPolicyOrDefault(nil)
+	}
+	return scoringPolicyOrDefault(inpObj.Scoring)
 }
 
-func ingestFootprints(footprints *geojson.FeatureCollection, inpObj asInpStruct) (string, []byte, error) {
+func ingestFootprints(footprints *geojson.FeatureCollection, inpObj asInpStruct, gw Gateway) (string, []byte, error) {
 	var (
 		b      []byte
 		result string
@@ -416,15 +486,15 @@ func ingestFootprints(footprints *geojson.FeatureCollection, inpObj asInpStruct)
 
 	// Ingest the footprints, get back the Piazza ID
 	b, _ = geojson.Write(footprints)
-	if result, err = pzsvc.Ingest("footprints.geojson", "geojson", inpObj.PzAddr, "bf-handle footprints", "1.0", inpObj.PzAuth, b, nil); err == nil {
-		go ingestFootprintsSucceeded(result, inpObj)
+	if result, err = gw.Ingest(context.Background(), "footprints.geojson", "geojson", inpObj.PzAddr, "bf-handle footprints", "1.0", inpObj.PzAuth, b, nil); err == nil {
+		go ingestFootprintsSucceeded(result, inpObj, gw)
 	} else {
-		go ingestFootprintsFailed(string(b), inpObj)
+		go ingestFootprintsFailed(string(b), inpObj, gw)
 	}
 	return result, b, err
 }
 
-func ingestFootprintsSucceeded(footprintsID string, inpObj asInpStruct) {
+func ingestFootprintsSucceeded(footprintsID string, inpObj asInpStruct, gw Gateway) {
 	var (
 		err       error
 		eventType pzsvc.EventType
@@ -432,20 +502,20 @@ func ingestFootprintsSucceeded(footprintsID string, inpObj asInpStruct) {
 	etm := make(map[string]interface{})
 	etm["footprintsDataID"] = "string"
 
-	if eventType, err = pzsvc.GetEventType(":beachfront:executeBatch:footprintsIngested", etm, inpObj.PzAddr, inpObj.PzAuth); err == nil {
+	if eventType, err = gw.GetEventType(context.Background(), ":beachfront:executeBatch:footprintsIngested", etm, inpObj.PzAddr, inpObj.PzAuth); err == nil {
 		event := pzsvc.Event{
 			EventTypeID: eventType.EventTypeID,
 			Data:        make(map[string]interface{})}
 		event.Data["footprintsDataID"] = footprintsID
 
-		if _, err = pzsvc.AddEvent(event, inpObj.PzAddr, inpObj.PzAuth); err == nil {
+		if _, err = gw.AddEvent(context.Background(), event, inpObj.PzAddr, inpObj.PzAuth); err == nil {
 			fmt.Printf("Ingested footprints to Piazza, received ID %v.", footprintsID)
 		} else {
 			log.Printf("Failed to post event %#v\n%v", event, err.Error())
 		}
 	}
 }
-func ingestFootprintsFailed(footprints string, inpObj asInpStruct) {
+func ingestFootprintsFailed(footprints string, inpObj asInpStruct, gw Gateway) {
 	var (
 		err           error
 		eventType     pzsvc.EventType
@@ -454,13 +524,13 @@ func ingestFootprintsFailed(footprints string, inpObj asInpStruct) {
 	etm := make(map[string]interface{})
 	etm["footprints"] = "string"
 
-	if eventType, err = pzsvc.GetEventType(":beachfront:executeBatch:footprintsCalculated", etm, inpObj.PzAddr, inpObj.PzAuth); err == nil {
+	if eventType, err = gw.GetEventType(context.Background(), ":beachfront:executeBatch:footprintsCalculated", etm, inpObj.PzAddr, inpObj.PzAuth); err == nil {
 		event := pzsvc.Event{
 			EventTypeID: eventType.EventTypeID,
 			Data:        make(map[string]interface{})}
 		event.Data["footprints"] = footprints
 
-		if eventResponse, err = pzsvc.AddEvent(event, inpObj.PzAddr, inpObj.PzAuth); err == nil {
+		if eventResponse, err = gw.AddEvent(context.Background(), event, inpObj.PzAddr, inpObj.PzAuth); err == nil {
 			fmt.Printf("Failed to ingest footprints to Piazza, but posted event %v.", eventResponse.Data.EventID)
 		} else {
 			log.Printf("Failed to ingest footprints to Piazza or post event %#v\n%v", event, err.Error())
@@ -48,3 +48,15 @@ func TestSceneScore(t *testing.T) {
 	json.Unmarshal([]byte(`{ "type": "Feature", "geometry": { "type": "Polygon", "coordinates": [ [ [ -80.72487831115721, 35.26545403190955 ], [ -80.72135925292969, 35.26727607954368 ], [ -80.71517944335938, 35.26769654625573 ], [ -80.7125186920166, 35.27035945142482 ], [ -80.70857048034668, 35.268257165144064 ], [ -80.70479393005371, 35.268397319259996 ], [ -80.70324897766113, 35.26503355355979 ], [ -80.71088790893555, 35.2553619492954 ], [ -80.71681022644043, 35.2553619492954 ], [ -80.7150936126709, 35.26054831539319 ], [ -80.71869850158691, 35.26026797976481 ], [ -80.72032928466797, 35.26061839914875 ], [ -80.72264671325684, 35.26033806376283 ], [ -80.72487831115721, 35.26545403190955 ] ] ] }, "properties": { "name": "Plaza Road Park" } }`), gj)
 
 }
+
+func TestFootprintBuffer(t *testing.T) {
+	if _, err := footprintBuffer(&asInpStruct{BufferMeters: -1}); err == nil {
+		t.Error(`TestFootprintBuffer: accepted a negative buffer.`)
+	}
+	if buffer, _ := footprintBuffer(nil); buffer != defaultFootprintBuffer {
+		t.Errorf(`TestFootprintBuffer: default buffer was %v`, buffer)
+	}
+	if buffer, err := footprintBuffer(&asInpStruct{BufferMeters: 250}); err != nil || buffer != 250 {
+		t.Errorf(`TestFootprintBuffer: expected 250, got %v, %v`, buffer, err)
+	}
+}
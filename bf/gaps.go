@@ -0,0 +1,194 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bf
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/paulsmith/gogeos/geos"
+	"github.com/venicegeo/geojson-geos-go/geojsongeos"
+	"github.com/venicegeo/geojson-go/geojson"
+	"github.com/venicegeo/pzsvc-lib"
+)
+
+/*
+Gaps are the parts of the footprint region that no footprint covers.  Each
+gap is reported as a polygon, with a reason found by looking through the
+scenes that the catalog has inside of it:
+
+- noScenes: the catalog has no scenes there at all
+- tooCloudy: every scene there has more than maxCloudCover
+- outsideDateWindow: every scene there is outside of the preferred dates
+  (only when dateWindowRequired is set)
+- invalidMetadata: no scene there has usable metadata
+- noEligibleScenes: every scene there was ruled out, for a mix of reasons
+- notSelected: some scene there could have been used, but footprint
+  selection passed it over.  This is usually a sliver between the points
+  of the point cloud, and is most common with "greedy" selection.
+- catalogError: the catalog could not be searched
+- notDiagnosed: there were more than maxDiagnosedGaps gaps, and this was
+  one of the smallest
+*/
+
+// Gap reasons, beyond the reject constants
+const (
+	gapNoScenes      = "noScenes"
+	gapNoEligible    = "noEligibleScenes"
+	gapNotSelected   = "notSelected"
+	gapCatalogError  = "catalogError"
+	gapNotDiagnosed  = "notDiagnosed"
+	minGapArea       = 1e-6 // square degrees; anything smaller is a clipping artifact
+	maxDiagnosedGaps = 20
+)
+
+type gapGeometry struct {
+	geometry *geos.Geometry
+	area     float64
+}
+
+// byGapArea sorts gaps from largest to smallest.
+type byGapArea []gapGeometry
+
+func (a byGapArea) Len() int {
+	return len(a)
+}
+func (a byGapArea) Swap(i, j int) {
+	a[i], a[j] = a[j], a[i]
+}
+func (a byGapArea) Less(i, j int) bool {
+	return a[i].area > a[j].area
+}
+
+// coverageGaps breaks the uncovered part of the footprint region into
+// polygons, and explains each of them.
+func coverageGaps(uncovered *geos.Geometry, inpObj *asInpStruct) (*geojson.FeatureCollection, error) {
+	var (
+		err      error
+		gaps     []gapGeometry
+		geometry interface{}
+	)
+	if gaps, err = gapPolygons(uncovered, nil); err != nil {
+		return nil, err
+	}
+	sort.Sort(byGapArea(gaps))
+
+	policy := scoringPolicyOf(inpObj)
+	now := time.Now()
+	result := geojson.NewFeatureCollection(nil)
+	for inx, gap := range gaps {
+		reason, detail := gapNotDiagnosed, ""
+		if inx < maxDiagnosedGaps {
+			reason, detail = diagnoseGap(gap.geometry, policy, now)
+		}
+		if geometry, err = geojsongeos.GeoJSONFromGeos(gap.geometry); err != nil {
+			return nil, pzsvc.TraceErr(err)
+		}
+		result.Features = append(result.Features, geojson.NewFeature(geometry, fmt.Sprintf("gap%d", inx+1), map[string]interface{}{
+			"reason": reason,
+			"detail": detail,
+			"area":   gap.area}))
+	}
+	return result, nil
+}
+
+// gapPolygons adds each polygon of the given geometry that is large enough
+// to matter to the gaps.
+func gapPolygons(geometry *geos.Geometry, gaps []gapGeometry) ([]gapGeometry, error) {
+	var (
+		err   error
+		gt    geos.GeometryType
+		area  float64
+		count int
+		part  *geos.Geometry
+	)
+	if gt, err = geometry.Type(); err != nil {
+		return nil, pzsvc.TraceErr(err)
+	}
+	switch gt {
+	case geos.POLYGON:
+		if area, err = geometry.Area(); err != nil {
+			return nil, pzsvc.TraceErr(err)
+		}
+		if area >= minGapArea {
+			gaps = append(gaps, gapGeometry{geometry: geometry, area: area})
+		}
+	case geos.MULTIPOLYGON, geos.GEOMETRYCOLLECTION:
+		if count, err = geometry.NGeometry(); err != nil {
+			return nil, pzsvc.TraceErr(err)
+		}
+		for inx := 0; inx < count; inx++ {
+			if part, err = geometry.Geometry(inx); err != nil {
+				return nil, pzsvc.TraceErr(err)
+			}
+			if gaps, err = gapPolygons(part, gaps); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return gaps, nil
+}
+
+// diagnoseGap looks through the scenes inside the given gap to see why
+// none of them covers it.
+func diagnoseGap(gap *geos.Geometry, policy *scoringPolicy, now time.Time) (string, string) {
+	point, err := gap.PointOnSurface()
+	if err != nil {
+		return gapCatalogError, pzsvc.TraceStr(err.Error())
+	}
+	scenes, err := searchScenes(point)
+	if err != nil {
+		log.Printf("Failed to diagnose gap at %v: %v", point.String(), err.Error())
+		return gapCatalogError, err.Error()
+	}
+	eligible := 0
+	rejections := make(map[string]int)
+	for _, scene := range scenes.Features {
+		if _, _, err = policy.score(scene, now); err != nil {
+			rejections[rejectionReason(err)]++
+		} else {
+			eligible++
+		}
+	}
+	return summarizeGap(len(scenes.Features), eligible, rejections)
+}
+
+// summarizeGap gives the reason for a gap, and the details behind it,
+// from the number of scenes there, how many of them were eligible, and
+// how many of the rest were rejected for each reason.
+func summarizeGap(total, eligible int, rejections map[string]int) (string, string) {
+	if total == 0 {
+		return gapNoScenes, "The catalog has no scenes here."
+	}
+	if eligible > 0 {
+		return gapNotSelected, fmt.Sprintf("%d of %d scenes here could have been used, but none was selected.", eligible, total)
+	}
+	var reasons, counts []string
+	for reason := range rejections {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	for _, reason := range reasons {
+		counts = append(counts, fmt.Sprintf("%d %s", rejections[reason], reason))
+	}
+	detail := fmt.Sprintf("None of the %d scenes here could be used: %s.", total, strings.Join(counts, ", "))
+	if len(reasons) == 1 {
+		return reasons[0], detail
+	}
+	return gapNoEligible, detail
+}
@@ -0,0 +1,66 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bf
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSummarizeGap(t *testing.T) {
+	cases := []struct {
+		total, eligible int
+		rejections      map[string]int
+		reason, detail  string
+	}{
+		{0, 0, nil, gapNoScenes, "The catalog has no scenes here."},
+		{3, 1, map[string]int{rejectCloudCover: 2}, gapNotSelected, "1 of 3 scenes here could have been used, but none was selected."},
+		{2, 0, map[string]int{rejectCloudCover: 2}, rejectCloudCover, "None of the 2 scenes here could be used: 2 tooCloudy."},
+		{3, 0, map[string]int{rejectDateWindow: 1, rejectCloudCover: 2}, gapNoEligible, "None of the 3 scenes here could be used: 1 outsideDateWindow, 2 tooCloudy."},
+	}
+	for _, c := range cases {
+		if reason, detail := summarizeGap(c.total, c.eligible, c.rejections); reason != c.reason || detail != c.detail {
+			t.Errorf(`TestSummarizeGap: expected %s (%s), got %s (%s)`, c.reason, c.detail, reason, detail)
+		}
+	}
+}
+
+func TestRejectionReason(t *testing.T) {
+	now := time.Date(2016, 7, 1, 0, 0, 0, 0, time.UTC)
+	policy, _ := scoringPreset("clear")
+	policy.PreferredStart = "2016-03-01"
+	cases := []struct {
+		scene  string
+		reason string
+	}{
+		{"not a date", rejectInvalid},
+		{"2016-04-01T00:00:00Z", rejectCloudCover},
+	}
+	for _, c := range cases {
+		_, _, err := policy.score(scoringScene("a", c.scene, 50, "Landsat8", 1), now)
+		if reason := rejectionReason(err); err == nil || reason != c.reason {
+			t.Errorf(`TestRejectionReason: expected %s for %s, got %v`, c.reason, c.scene, err)
+		}
+	}
+
+	scene := scoringScene("a", "2016-01-01T00:00:00Z", 0, "Landsat8", 1)
+	if _, breakdown, err := policy.score(scene, now); err != nil || breakdown["dateWindow"] != -policy.DateWindowWeight {
+		t.Errorf(`TestRejectionReason: scene outside an optional window gave %v, %v`, breakdown, err)
+	}
+	policy.DateWindowRequired = true
+	if _, _, err := policy.score(scene, now); rejectionReason(err) != rejectDateWindow {
+		t.Errorf(`TestRejectionReason: scene outside a required window gave %v`, err)
+	}
+}
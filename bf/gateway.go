@@ -0,0 +1,677 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bf
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/venicegeo/pzsvc-lib"
+)
+
+// Gateway is everything bf-handle needs from Piazza.  The methods mirror
+// the pzsvc-lib calls they replace, pzAddr and authKey included, so that
+// the Piazza address can keep coming in on each request.  Each also takes
+// a context, and gives up when it is cancelled.
+type Gateway interface {
+	Ingest(ctx context.Context, fName, fType, pzAddr, sourceName, version, authKey string, ingData []byte, props map[string]string) (string, error)
+	DownloadBytes(ctx context.Context, dataID, pzAddr, authKey string) ([]byte, error)
+	// IngestStream is Ingest for data too large to hold in memory.
+	IngestStream(ctx context.Context, fName, fType, pzAddr, sourceName, version, authKey string, ingData io.Reader, props map[string]string) (string, error)
+	// DownloadStream is DownloadBytes for data too large to hold in
+	// memory.  The caller must close the result.
+	DownloadStream(ctx context.Context, dataID, pzAddr, authKey string) (io.ReadCloser, error)
+	GetFileMeta(ctx context.Context, dataID, pzAddr, authKey string) (*pzsvc.DataDesc, error)
+	UpdateFileMeta(ctx context.Context, dataID, pzAddr, authKey string, newMeta map[string]string) error
+	DeployToGeoServer(ctx context.Context, dataID, lGroupID, pzAddr, authKey string) (*pzsvc.DeplStrct, error)
+	AddGeoServerLayerGroup(ctx context.Context, pzAddr, authKey string) (string, error)
+	GetEventType(ctx context.Context, name string, mapping map[string]interface{}, pzAddr, authKey string) (pzsvc.EventType, error)
+	AddEvent(ctx context.Context, event pzsvc.Event, pzAddr, authKey string) (pzsvc.EventResponse, error)
+	// QueryText returns the dataIds of all text data items whose
+	// content matches the given string.
+	QueryText(ctx context.Context, content, pzAddr, authKey string) ([]string, error)
+	// AddTrigger creates a trigger from the given JSON and returns its ID.
+	AddTrigger(ctx context.Context, trigJSON, pzAddr, authKey string) (string, error)
+	// GetTriggers returns the known triggers, newest first.
+	GetTriggers(ctx context.Context, pzAddr, authKey string) (*pzsvc.TriggerList, error)
+}
+
+// PzGateway is the Gateway that talks to an actual Piazza instance.
+type PzGateway struct{}
+
+// The pzsvc-lib calls cannot be interrupted, so the PzGateway methods that
+// pass through to them stop waiting for them when the context is cancelled
+// (see awaitCtx), and drop whatever they would have returned.
+
+// Ingest passes through to pzsvc.Ingest
+func (PzGateway) Ingest(ctx context.Context, fName, fType, pzAddr, sourceName, version, authKey string, ingData []byte, props map[string]string) (string, error) {
+	var dataID string
+	if err := awaitCtx(ctx, func() (err error) {
+		dataID, err = pzsvc.Ingest(fName, fType, pzAddr, sourceName, version, authKey, ingData, props)
+		return
+	}); err != nil {
+		return "", err
+	}
+	return dataID, nil
+}
+
+// DownloadBytes passes through to pzsvc.DownloadBytes
+func (PzGateway) DownloadBytes(ctx context.Context, dataID, pzAddr, authKey string) ([]byte, error) {
+	var byts []byte
+	if err := awaitCtx(ctx, func() (err error) {
+		byts, err = pzsvc.DownloadBytes(dataID, pzAddr, authKey)
+		return
+	}); err != nil {
+		return nil, err
+	}
+	return byts, nil
+}
+
+// IngestStream posts the data to the Piazza /data/file endpoint as it is
+// read, and waits for the resulting ingest job through pzsvc-lib as
+// pzsvc.Ingest does.
+func (PzGateway) IngestStream(ctx context.Context, fName, fType, pzAddr, sourceName, version, authKey string, ingData io.Reader, props map[string]string) (string, error) {
+	reqObj := map[string]interface{}{
+		"data": map[string]interface{}{
+			"dataType": map[string]string{"type": fType},
+			"metadata": map[string]interface{}{
+				"name":        fName,
+				"description": sourceName,
+				"version":     version,
+				"classType":   map[string]string{"classification": "UNCLASSIFIED"},
+				"metadata":    props}},
+		"host": true}
+	reqJSON, err := json.Marshal(reqObj)
+	if err != nil {
+		return "", pzsvc.TraceErr(err)
+	}
+
+	// The multipart body is written on the fly as the request is sent
+	pipeReader, pipeWriter := io.Pipe()
+	mpWriter := multipart.NewWriter(pipeWriter)
+	go func() {
+		var part io.Writer
+		err := mpWriter.WriteField("data", string(reqJSON))
+		if err == nil {
+			if part, err = mpWriter.CreateFormFile("file", fName); err == nil {
+				if _, err = io.Copy(part, ingData); err == nil {
+					err = mpWriter.Close()
+				}
+			}
+		}
+		pipeWriter.CloseWithError(err)
+	}()
+
+	req, err := http.NewRequest("POST", pzAddr+"/data/file", pipeReader)
+	if err != nil {
+		pipeReader.Close()
+		return "", pzsvc.TraceErr(err)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", mpWriter.FormDataContentType())
+	req.Header.Set("Authorization", authKey)
+	resp, err := upstreamClient.Do(req)
+	if err != nil {
+		pipeReader.Close()
+		return "", pzsvc.TraceErr(err)
+	}
+	if resp.StatusCode >= 300 {
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return "", pzsvc.ErrWithTrace(fmt.Sprintf("Failed to ingest %v (%v): %v", fName, resp.StatusCode, string(b)))
+	}
+	jobID, err := pzsvc.GetJobID(resp)
+	resp.Body.Close()
+	if err != nil {
+		return "", pzsvc.ErrWithTrace("Ingest of " + fName + " returned no job ID: " + err.Error())
+	}
+	var result *pzsvc.DataResult
+	if err = awaitCtx(ctx, func() (err error) {
+		result, err = pzsvc.GetJobResponse(jobID, pzAddr, authKey)
+		return
+	}); err != nil {
+		return "", pzsvc.TraceErr(err)
+	}
+	if result == nil || result.DataID == "" {
+		return "", pzsvc.ErrWithTrace("Ingest job " + jobID + " for " + fName + " returned no data ID.")
+	}
+	return result.DataID, nil
+}
+
+// DownloadStream opens the Piazza /file endpoint for the given data item.
+func (PzGateway) DownloadStream(ctx context.Context, dataID, pzAddr, authKey string) (io.ReadCloser, error) {
+	req, err := http.NewRequest("GET", pzAddr+"/file/"+dataID, nil)
+	if err != nil {
+		return nil, pzsvc.TraceErr(err)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Authorization", authKey)
+	resp, err := upstreamClient.Do(req)
+	if err != nil {
+		return nil, pzsvc.TraceErr(err)
+	}
+	if resp.StatusCode >= 300 {
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, pzsvc.ErrWithTrace(fmt.Sprintf("Failed to download %v (%v): %v", dataID, resp.StatusCode, string(b)))
+	}
+	return resp.Body, nil
+}
+
+// GetFileMeta passes through to pzsvc.GetFileMeta
+func (PzGateway) GetFileMeta(ctx context.Context, dataID, pzAddr, authKey string) (*pzsvc.DataDesc, error) {
+	var desc *pzsvc.DataDesc
+	if err := awaitCtx(ctx, func() (err error) {
+		desc, err = pzsvc.GetFileMeta(dataID, pzAddr, authKey)
+		return
+	}); err != nil {
+		return nil, err
+	}
+	return desc, nil
+}
+
+// UpdateFileMeta passes through to pzsvc.UpdateFileMeta
+func (PzGateway) UpdateFileMeta(ctx context.Context, dataID, pzAddr, authKey string, newMeta map[string]string) error {
+	return awaitCtx(ctx, func() error {
+		return pzsvc.UpdateFileMeta(dataID, pzAddr, authKey, newMeta)
+	})
+}
+
+// DeployToGeoServer passes through to pzsvc.DeployToGeoServer
+func (PzGateway) DeployToGeoServer(ctx context.Context, dataID, lGroupID, pzAddr, authKey string) (*pzsvc.DeplStrct, error) {
+	var deplObj *pzsvc.DeplStrct
+	if err := awaitCtx(ctx, func() (err error) {
+		deplObj, err = pzsvc.DeployToGeoServer(dataID, lGroupID, pzAddr, authKey)
+		return
+	}); err != nil {
+		return nil, err
+	}
+	return deplObj, nil
+}
+
+// AddGeoServerLayerGroup passes through to pzsvc.AddGeoServerLayerGroup
+func (PzGateway) AddGeoServerLayerGroup(ctx context.Context, pzAddr, authKey string) (string, error) {
+	var groupID string
+	if err := awaitCtx(ctx, func() (err error) {
+		groupID, err = pzsvc.AddGeoServerLayerGroup(pzAddr, authKey)
+		return
+	}); err != nil {
+		return "", err
+	}
+	return groupID, nil
+}
+
+// GetEventType passes through to pzsvc.GetEventType
+func (PzGateway) GetEventType(ctx context.Context, name string, mapping map[string]interface{}, pzAddr, authKey string) (pzsvc.EventType, error) {
+	var eventType pzsvc.EventType
+	if err := awaitCtx(ctx, func() (err error) {
+		eventType, err = pzsvc.GetEventType(name, mapping, pzAddr, authKey)
+		return
+	}); err != nil {
+		return pzsvc.EventType{}, err
+	}
+	return eventType, nil
+}
+
+// AddEvent passes through to pzsvc.AddEvent
+func (PzGateway) AddEvent(ctx context.Context, event pzsvc.Event, pzAddr, authKey string) (pzsvc.EventResponse, error) {
+	var eventResp pzsvc.EventResponse
+	if err := awaitCtx(ctx, func() (err error) {
+		eventResp, err = pzsvc.AddEvent(event, pzAddr, authKey)
+		return
+	}); err != nil {
+		return pzsvc.EventResponse{}, err
+	}
+	return eventResp, nil
+}
+
+// QueryText runs a search against the Piazza /data/query endpoint.
+func (PzGateway) QueryText(ctx context.Context, content, pzAddr, authKey string) ([]string, error) {
+	files := pzsvc.FileDataList{}
+	queryStr := `{"query":{"bool":{"must":[{"match":{"dataResource.dataType.content":"` +
+		content +
+		`"}},{"match":{"dataResource.dataType.type":"text"}}]}}}`
+
+	if _, err := requestKnownJSONCtx(ctx, "POST", queryStr, pzAddr+"/data/query", authKey, &files); err != nil {
+		return nil, pzsvc.TraceErr(err)
+	}
+
+	outDataIds := make([]string, len(files.Data))
+	for i, val := range files.Data {
+		outDataIds[i] = val.DataID
+	}
+	return outDataIds, nil
+}
+
+// AddTrigger posts the given trigger to the Piazza /trigger endpoint.
+func (PzGateway) AddTrigger(ctx context.Context, trigJSON, pzAddr, authKey string) (string, error) {
+	var idObj struct {
+		StatusCode int `json:"statusCode"`
+		Data       struct {
+			ID string `json:"triggerId"`
+		} `json:"data"`
+	}
+	b, err := requestKnownJSONCtx(ctx, "POST", trigJSON, pzAddr+`/trigger`, authKey, &idObj)
+	if err != nil {
+		return "", pzsvc.ErrWithTrace(err.Error() + ".  http Error: " + string(b))
+	}
+	return idObj.Data.ID, nil
+}
+
+// GetTriggers retrieves the trigger list from the Piazza /trigger endpoint.
+func (PzGateway) GetTriggers(ctx context.Context, pzAddr, authKey string) (*pzsvc.TriggerList, error) {
+	var trigList pzsvc.TriggerList
+	b, err := requestKnownJSONCtx(ctx, "GET", "", pzAddr+`/trigger?perPage=1000&order=desc&sortBy=createdOn`, authKey, &trigList)
+	if err != nil {
+		return nil, pzsvc.ErrWithTrace(err.Error() + ".  http Error: " + string(b))
+	}
+	return &trigList, nil
+}
+
+// LocalGateway is a Gateway that stands in for Piazza without needing one.
+// Data items are stored as files in a directory, and everything else that
+// Piazza would keep track of (metadata, deployments, event types, events
+// and triggers) is kept in an index file alongside them.  The pzAddr and
+// authKey arguments are ignored, as is the context, since nothing here
+// waits on anyone else.
+type LocalGateway struct {
+	dir   string
+	sem   sync.Mutex
+	index localIndex
+}
+
+type localIndex struct {
+	Data        map[string]*pzsvc.DataDesc  `json:"data"`
+	Deployments map[string]*pzsvc.DeplStrct `json:"deployments"`
+	LayerGroups []string                    `json:"layerGroups"`
+	EventTypes  map[string]pzsvc.EventType  `json:"eventTypes"` // keyed by name
+	Events      []pzsvc.Event               `json:"events"`
+	Triggers    []pzsvc.Trigger             `json:"triggers"`
+}
+
+const localIndexName = "index.json"
+
+// NewLocalGateway creates a LocalGateway in the given directory, picking
+// up whatever a previous LocalGateway left there.
+func NewLocalGateway(dir string) (*LocalGateway, error) {
+	lg := LocalGateway{dir: dir}
+	if err := os.MkdirAll(filepath.Join(dir, "data"), 0755); err != nil {
+		return nil, pzsvc.TraceErr(err)
+	}
+	byts, err := ioutil.ReadFile(filepath.Join(dir, localIndexName))
+	if err == nil {
+		if err = json.Unmarshal(byts, &lg.index); err != nil {
+			return nil, pzsvc.ErrWithTrace("Could not read local gateway index: " + err.Error())
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, pzsvc.TraceErr(err)
+	}
+	if lg.index.Data == nil {
+		lg.index.Data = make(map[string]*pzsvc.DataDesc)
+	}
+	if lg.index.Deployments == nil {
+		lg.index.Deployments = make(map[string]*pzsvc.DeplStrct)
+	}
+	if lg.index.EventTypes == nil {
+		lg.index.EventTypes = make(map[string]pzsvc.EventType)
+	}
+	log.Printf("Local gateway in %v holds %d data items.", dir, len(lg.index.Data))
+	return &lg, nil
+}
+
+// Ingest stores the given bytes as a new data item.  As with Piazza, text
+// items keep their content in the item description so that it can be
+// searched with QueryText.
+func (lg *LocalGateway) Ingest(ctx context.Context, fName, fType, pzAddr, sourceName, version, authKey string, ingData []byte, props map[string]string) (string, error) {
+	return lg.IngestStream(ctx, fName, fType, pzAddr, sourceName, version, authKey, bytes.NewReader(ingData), props)
+}
+
+// localContentLimit is the most of a text item's content that is kept in
+// the index.  Longer items are searched on disk by QueryText.
+const localContentLimit = 64 * 1024
+
+// prefixWriter keeps the first limit bytes written to it, and discards
+// the rest.
+type prefixWriter struct {
+	buf   bytes.Buffer
+	limit int
+}
+
+func (pw *prefixWriter) Write(p []byte) (int, error) {
+	if room := pw.limit - pw.buf.Len(); room > 0 {
+		if room > len(p) {
+			room = len(p)
+		}
+		pw.buf.Write(p[:room])
+	}
+	return len(p), nil
+}
+
+// IngestStream stores the data read from ingData as a new data item.  The
+// data goes straight to disk; only the start of a text item is kept in
+// memory.
+func (lg *LocalGateway) IngestStream(ctx context.Context, fName, fType, pzAddr, sourceName, version, authKey string, ingData io.Reader, props map[string]string) (string, error) {
+	dataID, err := pzsvc.PsuUUID()
+	if err != nil {
+		return "", pzsvc.TraceErr(err)
+	}
+	fileName := filepath.Join(lg.dir, "data", dataID)
+	file, err := os.Create(fileName)
+	if err != nil {
+		return "", pzsvc.TraceErr(err)
+	}
+	prefix := prefixWriter{limit: localContentLimit}
+	if fType == "text" {
+		ingData = io.TeeReader(ingData, &prefix)
+	}
+	size, err := io.Copy(file, ingData)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(fileName)
+		return "", pzsvc.TraceErr(err)
+	}
+
+	desc := pzsvc.DataDesc{
+		DataID: dataID,
+		DataType: pzsvc.DataType{
+			Type:     fType,
+			MimeType: localMimeType(fType),
+			Location: &pzsvc.FileLoc{FileSize: int(size)},
+			Content:  prefix.buf.String()},
+		ResMeta: pzsvc.ResMeta{Name: fName, Metadata: make(map[string]string)}}
+	for key, val := range props {
+		desc.ResMeta.Metadata[key] = val
+	}
+	if sourceName != "" {
+		desc.ResMeta.Metadata["source"] = sourceName
+	}
+	if version != "" {
+		desc.ResMeta.Metadata["version"] = version
+	}
+
+	lg.sem.Lock()
+	defer lg.sem.Unlock()
+	lg.index.Data[dataID] = &desc
+	return dataID, lg.writeIndex()
+}
+
+// DownloadBytes returns the contents of the given data item.
+func (lg *LocalGateway) DownloadBytes(ctx context.Context, dataID, pzAddr, authKey string) ([]byte, error) {
+	stream, err := lg.DownloadStream(ctx, dataID, pzAddr, authKey)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+	byts, err := ioutil.ReadAll(stream)
+	if err != nil {
+		return nil, pzsvc.TraceErr(err)
+	}
+	return byts, nil
+}
+
+// DownloadStream opens the given data item for reading.
+func (lg *LocalGateway) DownloadStream(ctx context.Context, dataID, pzAddr, authKey string) (io.ReadCloser, error) {
+	lg.sem.Lock()
+	_, ok := lg.index.Data[dataID]
+	lg.sem.Unlock()
+	if !ok {
+		return nil, pzsvc.ErrWithTrace("Data item " + dataID + " not found in local gateway.")
+	}
+	file, err := os.Open(filepath.Join(lg.dir, "data", dataID))
+	if err != nil {
+		return nil, pzsvc.TraceErr(err)
+	}
+	return file, nil
+}
+
+// GetFileMeta returns a copy of the description of the given data item.
+func (lg *LocalGateway) GetFileMeta(ctx context.Context, dataID, pzAddr, authKey string) (*pzsvc.DataDesc, error) {
+	lg.sem.Lock()
+	defer lg.sem.Unlock()
+	desc, ok := lg.index.Data[dataID]
+	if !ok {
+		return nil, pzsvc.ErrWithTrace("Data item " + dataID + " not found in local gateway.")
+	}
+	result := *desc
+	loc := *desc.DataType.Location
+	result.DataType.Location = &loc
+	result.ResMeta.Metadata = make(map[string]string)
+	for key, val := range desc.ResMeta.Metadata {
+		result.ResMeta.Metadata[key] = val
+	}
+	return &result, nil
+}
+
+// UpdateFileMeta adds the given metadata to the given data item.
+func (lg *LocalGateway) UpdateFileMeta(ctx context.Context, dataID, pzAddr, authKey string, newMeta map[string]string) error {
+	lg.sem.Lock()
+	defer lg.sem.Unlock()
+	desc, ok := lg.index.Data[dataID]
+	if !ok {
+		return pzsvc.ErrWithTrace("Data item " + dataID + " not found in local gateway.")
+	}
+	for key, val := range newMeta {
+		desc.ResMeta.Metadata[key] = val
+	}
+	return lg.writeIndex()
+}
+
+// DeployToGeoServer records a deployment of the given data item.  Nothing
+// is actually served; the layer name is simply the dataId.
+func (lg *LocalGateway) DeployToGeoServer(ctx context.Context, dataID, lGroupID, pzAddr, authKey string) (*pzsvc.DeplStrct, error) {
+	deplID, err := pzsvc.PsuUUID()
+	if err != nil {
+		return nil, pzsvc.TraceErr(err)
+	}
+	lg.sem.Lock()
+	defer lg.sem.Unlock()
+	if _, ok := lg.index.Data[dataID]; !ok {
+		return nil, pzsvc.ErrWithTrace("Data item " + dataID + " not found in local gateway.")
+	}
+	depl := pzsvc.DeplStrct{DeplID: deplID, DataID: dataID, Layer: dataID}
+	lg.index.Deployments[deplID] = &depl
+	result := depl
+	return &result, lg.writeIndex()
+}
+
+// AddGeoServerLayerGroup records a new layer group and returns its ID.
+func (lg *LocalGateway) AddGeoServerLayerGroup(ctx context.Context, pzAddr, authKey string) (string, error) {
+	groupID, err := pzsvc.PsuUUID()
+	if err != nil {
+		return "", pzsvc.TraceErr(err)
+	}
+	lg.sem.Lock()
+	defer lg.sem.Unlock()
+	lg.index.LayerGroups = append(lg.index.LayerGroups, groupID)
+	return groupID, lg.writeIndex()
+}
+
+// GetEventType returns the event type of the given name, creating it if
+// it does not already exist.
+func (lg *LocalGateway) GetEventType(ctx context.Context, name string, mapping map[string]interface{}, pzAddr, authKey string) (pzsvc.EventType, error) {
+	lg.sem.Lock()
+	defer lg.sem.Unlock()
+	if eventType, ok := lg.index.EventTypes[name]; ok {
+		return eventType, nil
+	}
+	eventTypeID, err := pzsvc.PsuUUID()
+	if err != nil {
+		return pzsvc.EventType{}, pzsvc.TraceErr(err)
+	}
+	eventType := pzsvc.EventType{EventTypeID: eventTypeID, Name: name, Mapping: mapping}
+	lg.index.EventTypes[name] = eventType
+	return eventType, lg.writeIndex()
+}
+
+// AddEvent records the given event.
+func (lg *LocalGateway) AddEvent(ctx context.Context, event pzsvc.Event, pzAddr, authKey string) (pzsvc.EventResponse, error) {
+	var err error
+	if event.EventID, err = pzsvc.PsuUUID(); err != nil {
+		return pzsvc.EventResponse{}, pzsvc.TraceErr(err)
+	}
+	event.CreatedOn = time.Now().UTC().Format(time.RFC3339)
+
+	lg.sem.Lock()
+	defer lg.sem.Unlock()
+	known := false
+	for _, eventType := range lg.index.EventTypes {
+		if eventType.EventTypeID == event.EventTypeID {
+			known = true
+			break
+		}
+	}
+	if !known {
+		return pzsvc.EventResponse{}, pzsvc.ErrWithTrace("Event type " + event.EventTypeID + " not found in local gateway.")
+	}
+	lg.index.Events = append(lg.index.Events, event)
+	log.Printf("Local gateway recorded event %v: %#v", event.EventID, event.Data)
+	return pzsvc.EventResponse{Data: event}, lg.writeIndex()
+}
+
+// QueryText returns the dataIds of text items containing the given string,
+// sorted so that the results are stable from one call to the next.
+func (lg *LocalGateway) QueryText(ctx context.Context, content, pzAddr, authKey string) ([]string, error) {
+	var onDisk []string
+	result := make([]string, 0)
+	lg.sem.Lock()
+	for dataID, desc := range lg.index.Data {
+		switch {
+		case desc.DataType.Type != "text":
+		case strings.Contains(desc.DataType.Content, content):
+			result = append(result, dataID)
+		case desc.DataType.Location != nil && desc.DataType.Location.FileSize > len(desc.DataType.Content):
+			onDisk = append(onDisk, dataID)
+		}
+	}
+	lg.sem.Unlock()
+
+	// Items too long to keep in the index are searched a piece at a time
+	for _, dataID := range onDisk {
+		found, err := localFileContains(filepath.Join(lg.dir, "data", dataID), content)
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			result = append(result, dataID)
+		}
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+// localFileContains reports whether the given file contains the given
+// string, without reading the whole file into memory.  Each piece read
+// is searched along with the end of the one before, so that matches
+// across the boundary are found.
+func localFileContains(fileName, content string) (bool, error) {
+	if content == "" {
+		return true, nil
+	}
+	file, err := os.Open(fileName)
+	if err != nil {
+		return false, pzsvc.TraceErr(err)
+	}
+	defer file.Close()
+	var (
+		overlap = len(content) - 1
+		buf     = make([]byte, overlap+localContentLimit)
+		held    int
+	)
+	for {
+		count, err := io.ReadFull(file, buf[held:])
+		if bytes.Contains(buf[:held+count], []byte(content)) {
+			return true, nil
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return false, nil
+		} else if err != nil {
+			return false, pzsvc.TraceErr(err)
+		}
+		held = copy(buf, buf[len(buf)-overlap:])
+	}
+}
+
+// AddTrigger records the given trigger.  Triggers are kept so that they
+// can be listed, but they never fire.
+func (lg *LocalGateway) AddTrigger(ctx context.Context, trigJSON, pzAddr, authKey string) (string, error) {
+	var (
+		trigger pzsvc.Trigger
+		err     error
+	)
+	if err = json.Unmarshal([]byte(trigJSON), &trigger); err != nil {
+		return "", pzsvc.TraceErr(err)
+	}
+	if trigger.TriggerID, err = pzsvc.PsuUUID(); err != nil {
+		return "", pzsvc.TraceErr(err)
+	}
+	lg.sem.Lock()
+	defer lg.sem.Unlock()
+	lg.index.Triggers = append(lg.index.Triggers, trigger)
+	return trigger.TriggerID, lg.writeIndex()
+}
+
+// GetTriggers returns the recorded triggers, newest first.
+func (lg *LocalGateway) GetTriggers(ctx context.Context, pzAddr, authKey string) (*pzsvc.TriggerList, error) {
+	lg.sem.Lock()
+	defer lg.sem.Unlock()
+	result := pzsvc.TriggerList{Data: make([]pzsvc.Trigger, len(lg.index.Triggers))}
+	for inx, trigger := range lg.index.Triggers {
+		result.Data[len(result.Data)-1-inx] = trigger
+	}
+	return &result, nil
+}
+
+// writeIndex saves the index to disk.  It must be called with lg.sem held.
+func (lg *LocalGateway) writeIndex() error {
+	byts, err := json.MarshalIndent(lg.index, "", "  ")
+	if err != nil {
+		return pzsvc.TraceErr(err)
+	}
+	indexName := filepath.Join(lg.dir, localIndexName)
+	if err = ioutil.WriteFile(indexName+".tmp", byts, 0644); err != nil {
+		return pzsvc.TraceErr(err)
+	}
+	if err = os.Rename(indexName+".tmp", indexName); err != nil {
+		return pzsvc.TraceErr(err)
+	}
+	return nil
+}
+
+func localMimeType(fType string) string {
+	switch fType {
+	case "geojson":
+		return "application/vnd.geo+json"
+	case "raster":
+		return "image/tiff"
+	case "text":
+		return "text/plain"
+	}
+	return "application/octet-stream"
+}
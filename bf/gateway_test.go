@@ -0,0 +1,160 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bf
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/venicegeo/pzsvc-lib"
+)
+
+func TestLocalGateway(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bf-handle-gateway")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	gw, err := NewLocalGateway(dir)
+	if err != nil {
+		t.Fatal(`TestLocalGateway: failed to create gateway: ` + err.Error())
+	}
+	shoreJSON := `{"type":"FeatureCollection","features":[]}`
+	dataID, err := gw.Ingest(context.Background(), "shoreline.geojson", "geojson", "", "test", "1.0", "", []byte(shoreJSON), map[string]string{"sourceID": "landsat:a"})
+	if err != nil {
+		t.Fatal(`TestLocalGateway: failed to ingest: ` + err.Error())
+	}
+	textID, err := gw.Ingest(context.Background(), "result.txt", "text", "", "test", "", "", []byte("landsat:a"), nil)
+	if err != nil {
+		t.Fatal(`TestLocalGateway: failed to ingest text: ` + err.Error())
+	}
+
+	if err = gw.UpdateFileMeta(context.Background(), dataID, "", "", map[string]string{"algoName": "test"}); err != nil {
+		t.Error(`TestLocalGateway: failed to update metadata: ` + err.Error())
+	}
+	if _, err = gw.DeployToGeoServer(context.Background(), dataID, "", "", ""); err != nil {
+		t.Error(`TestLocalGateway: failed to deploy: ` + err.Error())
+	}
+	if _, err = gw.DeployToGeoServer(context.Background(), "no-such-id", "", "", ""); err == nil {
+		t.Error(`TestLocalGateway: deployed a data item that does not exist.`)
+	}
+	eventType, err := gw.GetEventType(context.Background(), ":test", map[string]interface{}{"shoreDataID": "string"}, "", "")
+	if err != nil {
+		t.Fatal(`TestLocalGateway: failed to get event type: ` + err.Error())
+	}
+	event := pzsvc.Event{EventTypeID: eventType.EventTypeID, Data: map[string]interface{}{"shoreDataID": dataID}}
+	if _, err = gw.AddEvent(context.Background(), event, "", ""); err != nil {
+		t.Error(`TestLocalGateway: failed to add event: ` + err.Error())
+	}
+	if _, err = gw.AddTrigger(context.Background(), `{"name":"first"}`, "", ""); err != nil {
+		t.Error(`TestLocalGateway: failed to add trigger: ` + err.Error())
+	}
+	if _, err = gw.AddTrigger(context.Background(), `{"name":"second"}`, "", ""); err != nil {
+		t.Error(`TestLocalGateway: failed to add trigger: ` + err.Error())
+	}
+
+	// everything should survive a reload from disk
+	if gw, err = NewLocalGateway(dir); err != nil {
+		t.Fatal(`TestLocalGateway: failed to reload gateway: ` + err.Error())
+	}
+	byts, err := gw.DownloadBytes(context.Background(), dataID, "", "")
+	if err != nil || string(byts) != shoreJSON {
+		t.Error(`TestLocalGateway: did not get back the ingested bytes.`)
+	}
+	streamID, err := gw.IngestStream(context.Background(), "stream.geojson", "geojson", "", "test", "", "", strings.NewReader(shoreJSON), nil)
+	if err != nil {
+		t.Fatal(`TestLocalGateway: failed to ingest a stream: ` + err.Error())
+	}
+	if stream, err := gw.DownloadStream(context.Background(), streamID, "", ""); err != nil {
+		t.Error(`TestLocalGateway: failed to download a stream: ` + err.Error())
+	} else {
+		byts, _ = ioutil.ReadAll(stream)
+		stream.Close()
+		if string(byts) != shoreJSON {
+			t.Error(`TestLocalGateway: did not get back the streamed bytes.`)
+		}
+	}
+	desc, err := gw.GetFileMeta(context.Background(), dataID, "", "")
+	if err != nil {
+		t.Fatal(`TestLocalGateway: failed to get metadata: ` + err.Error())
+	}
+	if desc.ResMeta.Metadata["sourceID"] != "landsat:a" || desc.ResMeta.Metadata["algoName"] != "test" {
+		t.Errorf(`TestLocalGateway: unexpected metadata: %#v`, desc.ResMeta.Metadata)
+	}
+	if desc.DataType.Location.FileSize != len(shoreJSON) {
+		t.Errorf(`TestLocalGateway: unexpected file size %d.`, desc.DataType.Location.FileSize)
+	}
+	if again, _ := gw.GetEventType(context.Background(), ":test", nil, "", ""); again.EventTypeID != eventType.EventTypeID {
+		t.Error(`TestLocalGateway: event type was not reused.`)
+	}
+	dataIDs, err := gw.QueryText(context.Background(), "landsat:a", "", "")
+	if err != nil || len(dataIDs) != 1 || dataIDs[0] != textID {
+		t.Errorf(`TestLocalGateway: unexpected query results: %v`, dataIDs)
+	}
+	trigList, err := gw.GetTriggers(context.Background(), "", "")
+	if err != nil || len(trigList.Data) != 2 || trigList.Data[0].Name != "second" {
+		t.Error(`TestLocalGateway: triggers did not come back newest first.`)
+	}
+}
+
+func TestLocalGatewayRemoteAlgo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bf-handle-gateway")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	gw, err := NewLocalGateway(dir)
+	if err != nil {
+		t.Fatal(`TestLocalGatewayRemoteAlgo: failed to create gateway: ` + err.Error())
+	}
+	algo, _ := getAlgorithm("pzsvc-ossim")
+	inpObj := gsInpStruct{AlgoType: "pzsvc-ossim"}
+	_, _, _, err = runAlgo(context.Background(), algo, inpObj, nil, nil, newProvenance(inpObj), gw)
+	if err == nil || !strings.Contains(err.Error(), "needs Piazza") {
+		t.Errorf(`TestLocalGatewayRemoteAlgo: remote algorithm not rejected: %v`, err)
+	}
+}
+
+func TestLocalGatewayLongText(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bf-handle-gateway")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	gw, err := NewLocalGateway(dir)
+	if err != nil {
+		t.Fatal(`TestLocalGatewayLongText: failed to create gateway: ` + err.Error())
+	}
+	// The marker straddles the boundary between the first two pieces
+	filler := strings.Repeat("x", localContentLimit+4)
+	dataID, err := gw.IngestStream(context.Background(), "long.txt", "text", "", "", "", "", strings.NewReader(filler+"landsat:b"+filler), nil)
+	if err != nil {
+		t.Fatal(`TestLocalGatewayLongText: failed to ingest: ` + err.Error())
+	}
+	desc, err := gw.GetFileMeta(context.Background(), dataID, "", "")
+	if err != nil || len(desc.DataType.Content) != localContentLimit {
+		t.Errorf(`TestLocalGatewayLongText: index kept %d bytes of content.`, len(desc.DataType.Content))
+	}
+	if dataIDs, err := gw.QueryText(context.Background(), "landsat:b", "", ""); err != nil || len(dataIDs) != 1 || dataIDs[0] != dataID {
+		t.Errorf(`TestLocalGatewayLongText: unexpected query results: %v, %v`, dataIDs, err)
+	}
+	if dataIDs, err := gw.QueryText(context.Background(), "landsat:c", "", ""); err != nil || len(dataIDs) != 0 {
+		t.Errorf(`TestLocalGatewayLongText: unexpected query results: %v, %v`, dataIDs, err)
+	}
+}
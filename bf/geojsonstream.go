@@ -0,0 +1,235 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bf
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/venicegeo/geojson-go/geojson"
+	"github.com/venicegeo/pzsvc-lib"
+)
+
+// featureScanner reads the features of a GeoJSON FeatureCollection one at
+// a time, so that the whole collection never has to be in memory at once.
+// Members of the collection other than "features" are skipped.
+type featureScanner struct {
+	decoder *json.Decoder
+	started bool
+	done    bool
+}
+
+func newFeatureScanner(reader io.Reader) *featureScanner {
+	return &featureScanner{decoder: json.NewDecoder(reader)}
+}
+
+// next returns the next feature of the collection, and io.EOF once there
+// are no more.
+func (scanner *featureScanner) next() (*geojson.Feature, error) {
+	var (
+		err   error
+		raw   json.RawMessage
+		gjIfc interface{}
+	)
+	if scanner.done {
+		return nil, io.EOF
+	}
+	if !scanner.started {
+		scanner.started = true
+		if err = scanner.start(); err != nil {
+			scanner.done = true
+			return nil, err
+		}
+	}
+	if scanner.done || !scanner.decoder.More() {
+		scanner.done = true
+		return nil, io.EOF
+	}
+	if err = scanner.decoder.Decode(&raw); err != nil {
+		scanner.done = true
+		return nil, pzsvc.TraceErr(err)
+	}
+	if gjIfc, err = geojson.Parse(raw); err != nil {
+		return nil, pzsvc.TraceErr(err)
+	}
+	if feature, ok := gjIfc.(*geojson.Feature); ok {
+		return feature, nil
+	}
+	return nil, pzsvc.ErrWithTrace(fmt.Sprintf("Was expecting a *geojson.Feature, got a %T", gjIfc))
+}
+
+// start reads up to the opening of the "features" array.  A collection
+// without one is treated as empty.
+func (scanner *featureScanner) start() error {
+	var (
+		token interface{}
+		err   error
+		key   string
+		value json.RawMessage
+	)
+	if token, err = scanner.decoder.Token(); err != nil {
+		return pzsvc.TraceErr(err)
+	}
+	if token != json.Delim('{') {
+		return pzsvc.ErrWithTrace(fmt.Sprintf("Was expecting a GeoJSON object, got %v", token))
+	}
+	for scanner.decoder.More() {
+		if token, err = scanner.decoder.Token(); err != nil {
+			return pzsvc.TraceErr(err)
+		}
+		key, _ = token.(string)
+		if key == "features" {
+			if token, err = scanner.decoder.Token(); err != nil {
+				return pzsvc.TraceErr(err)
+			}
+			if token != json.Delim('[') {
+				return pzsvc.ErrWithTrace(fmt.Sprintf("Was expecting an array of features, got %v", token))
+			}
+			return nil
+		}
+		if err = scanner.decoder.Decode(&value); err != nil {
+			return pzsvc.TraceErr(err)
+		}
+		if key == "type" && string(value) != `"FeatureCollection"` {
+			return pzsvc.ErrWithTrace("Was expecting a FeatureCollection, got a " + string(value))
+		}
+	}
+	scanner.done = true
+	return nil
+}
+
+// featureSpool collects features in a temporary file as they are
+// produced, so that a large result can be written out without being held
+// in memory.  As FeatureCollection.FillProperties does, it gives every
+// feature every property that any of them has, to work around Piazza's
+// relational restrictions.
+type featureSpool struct {
+	file       *os.File
+	writer     *bufio.Writer
+	count      int
+	properties map[string]json.RawMessage // the empty value of each property seen
+}
+
+func newFeatureSpool() (*featureSpool, error) {
+	file, err := ioutil.TempFile("", "bf-handle-spool")
+	if err != nil {
+		return nil, pzsvc.TraceErr(err)
+	}
+	return &featureSpool{file: file, writer: bufio.NewWriter(file), properties: make(map[string]json.RawMessage)}, nil
+}
+
+// add appends the feature to the spool.
+func (spool *featureSpool) add(feature *geojson.Feature) error {
+	b, err := geojson.Write(feature)
+	if err != nil {
+		return pzsvc.TraceErr(err)
+	}
+	for key, value := range feature.Properties {
+		if _, ok := spool.properties[key]; ok {
+			continue
+		}
+		switch value.(type) {
+		case string:
+			spool.properties[key] = json.RawMessage(`""`)
+		case bool:
+			spool.properties[key] = json.RawMessage(`false`)
+		case float64, float32, int, int64:
+			spool.properties[key] = json.RawMessage(`0`)
+		}
+	}
+	if _, err = spool.writer.Write(b); err == nil {
+		err = spool.writer.WriteByte('\n')
+	}
+	if err != nil {
+		return pzsvc.TraceErr(err)
+	}
+	spool.count++
+	return nil
+}
+
+// writeTo writes out everything spooled so far as a FeatureCollection.
+func (spool *featureSpool) writeTo(writer io.Writer) error {
+	var (
+		err     error
+		feature map[string]json.RawMessage
+		props   map[string]json.RawMessage
+		b       []byte
+	)
+	if err = spool.writer.Flush(); err != nil {
+		return pzsvc.TraceErr(err)
+	}
+	if _, err = spool.file.Seek(0, 0); err != nil {
+		return pzsvc.TraceErr(err)
+	}
+	defer spool.file.Seek(0, 2)
+
+	if _, err = io.WriteString(writer, `{"type":"FeatureCollection","features":[`); err != nil {
+		return pzsvc.TraceErr(err)
+	}
+	decoder := json.NewDecoder(bufio.NewReader(spool.file))
+	for inx := 0; inx < spool.count; inx++ {
+		feature, props = nil, nil
+		if err = decoder.Decode(&feature); err != nil {
+			return pzsvc.TraceErr(err)
+		}
+		if raw, ok := feature["properties"]; ok {
+			json.Unmarshal(raw, &props)
+		}
+		if props == nil {
+			props = make(map[string]json.RawMessage)
+		}
+		for key, value := range spool.properties {
+			if _, ok := props[key]; !ok {
+				props[key] = value
+			}
+		}
+		if feature["properties"], err = json.Marshal(props); err != nil {
+			return pzsvc.TraceErr(err)
+		}
+		if b, err = json.Marshal(feature); err != nil {
+			return pzsvc.TraceErr(err)
+		}
+		if inx > 0 {
+			b = append([]byte{','}, b...)
+		}
+		if _, err = writer.Write(b); err != nil {
+			return pzsvc.TraceErr(err)
+		}
+	}
+	if _, err = io.WriteString(writer, `]}`); err != nil {
+		return pzsvc.TraceErr(err)
+	}
+	return nil
+}
+
+// reader returns a reader of the spooled FeatureCollection, for passing
+// to Gateway.IngestStream.
+func (spool *featureSpool) reader() io.ReadCloser {
+	pipeReader, pipeWriter := io.Pipe()
+	go func() {
+		pipeWriter.CloseWithError(spool.writeTo(pipeWriter))
+	}()
+	return pipeReader
+}
+
+// close discards the spool.
+func (spool *featureSpool) close() {
+	spool.file.Close()
+	os.Remove(spool.file.Name())
+}
@@ -0,0 +1,86 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bf
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/venicegeo/geojson-go/geojson"
+)
+
+func TestFeatureScanner(t *testing.T) {
+	fcJSON := `{"type":"FeatureCollection","bbox":[0,0,2,2],"crs":{"type":"name","properties":{"name":"x"}},` +
+		`"features":[{"type":"Feature","id":"a","geometry":{"type":"Point","coordinates":[1,1]},"properties":{}},` +
+		`{"type":"Feature","id":"b","geometry":{"type":"Point","coordinates":[2,2]},"properties":{}}],"extra":true}`
+	scanner := newFeatureScanner(strings.NewReader(fcJSON))
+	var ids []string
+	for {
+		feature, err := scanner.next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf(`TestFeatureScanner: %v`, err.Error())
+		}
+		ids = append(ids, feature.IDStr())
+	}
+	if strings.Join(ids, ",") != "a,b" {
+		t.Errorf(`TestFeatureScanner: expected a,b, got %v`, ids)
+	}
+	if _, err := scanner.next(); err != io.EOF {
+		t.Errorf(`TestFeatureScanner: expected io.EOF after the end, got %v`, err)
+	}
+
+	if _, err := newFeatureScanner(strings.NewReader(`{"type":"FeatureCollection"}`)).next(); err != io.EOF {
+		t.Errorf(`TestFeatureScanner: expected io.EOF for a collection without features, got %v`, err)
+	}
+	if _, err := newFeatureScanner(strings.NewReader(`{"type":"Point","coordinates":[1,1]}`)).next(); err == nil || err == io.EOF {
+		t.Errorf(`TestFeatureScanner: expected an error for a Point`)
+	}
+}
+
+func TestFeatureSpool(t *testing.T) {
+	spool, err := newFeatureSpool()
+	if err != nil {
+		t.Fatalf(`TestFeatureSpool: %v`, err.Error())
+	}
+	defer spool.close()
+	point := geojson.NewPoint([]float64{1, 2})
+	spool.add(geojson.NewFeature(point, "a", map[string]interface{}{"name": "a", "score": 0.5}))
+	spool.add(geojson.NewFeature(point, "b", map[string]interface{}{"cloudy": true}))
+
+	// the spool can be written out more than once, and added to between
+	for pass := 0; pass < 2; pass++ {
+		var buffer bytes.Buffer
+		if err = spool.writeTo(&buffer); err != nil {
+			t.Fatalf(`TestFeatureSpool: %v`, err.Error())
+		}
+		fc, err := geojson.FeatureCollectionFromBytes(buffer.Bytes())
+		if err != nil {
+			t.Fatalf(`TestFeatureSpool: could not parse output: %v`, err.Error())
+		}
+		if len(fc.Features) != 2+pass {
+			t.Fatalf(`TestFeatureSpool: expected %d features, got %d`, 2+pass, len(fc.Features))
+		}
+		props, _ := json.Marshal(fc.Features[1].Properties)
+		if string(props) != `{"cloudy":true,"name":"","score":0}` {
+			t.Errorf(`TestFeatureSpool: properties were not filled: %v`, string(props))
+		}
+		spool.add(geojson.NewFeature(point, "c", nil))
+	}
+}
@@ -0,0 +1,739 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bf
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/venicegeo/pzsvc-lib"
+)
+
+/*
+This is a deliberately small GeoTIFF reader, covering what the in-process
+algorithms need: single-band images, stripped or tiled, uncompressed or
+compressed with LZW, Deflate or PackBits, with or without a horizontal
+differencing predictor.  That is enough for the Landsat and Sentinel band
+files that the image catalog points at.  Georeferencing comes from either
+a tiepoint and pixel scale or a model transformation, and projections are
+limited to geographic coordinates and UTM.
+*/
+
+// TIFF tags we care about
+const (
+	tagImageWidth      = 256
+	tagImageLength     = 257
+	tagBitsPerSample   = 258
+	tagCompression     = 259
+	tagStripOffsets    = 273
+	tagSamplesPerPixel = 277
+	tagRowsPerStrip    = 278
+	tagStripByteCounts = 279
+	tagPlanarConfig    = 284
+	tagPredictor       = 317
+	tagTileWidth       = 322
+	tagTileLength      = 323
+	tagTileOffsets     = 324
+	tagTileByteCounts  = 325
+	tagSampleFormat    = 339
+	tagPixelScale      = 33550
+	tagTiepoint        = 33922
+	tagTransformation  = 34264
+	tagGeoKeys         = 34735
+	tagGDALNoData      = 42113
+)
+
+// GeoKeys we care about
+const (
+	geoKeyModelType     = 1024
+	geoKeyRasterType    = 1025
+	geoKeyGeographic    = 2048
+	geoKeyProjectedCS   = 3072
+	rasterPixelIsPoint  = 2
+	modelTypeGeographic = 2
+)
+
+// Limits on what readGeoTIFF will take on, so that a bad header cannot
+// make it allocate without bound.  maxGeoTIFFPixels allows for scenes of
+// well over 10,000 pixels square.  maxCompressionRatio is above what
+// Deflate, LZW or PackBits can manage.
+const (
+	maxGeoTIFFPixels    = 1 << 28
+	maxCompressionRatio = 4096
+)
+
+// byte sizes of the TIFF field types, indexed by type
+var tiffTypeSize = [...]int{0, 1, 1, 2, 4, 8, 1, 1, 2, 4, 8, 4, 8}
+
+// geoRaster is a single band of a georeferenced image.  The transform is
+// in the GDAL order, so that a pixel corner (col, row) is at
+// x = t[0] + col*t[1] + row*t[2], y = t[3] + col*t[4] + row*t[5].
+type geoRaster struct {
+	width     int
+	height    int
+	data      []float32 // row major; NaN where there is no data
+	transform [6]float64
+	epsg      int
+}
+
+// at returns the value at the given pixel.
+func (gr *geoRaster) at(col, row int) float32 {
+	return gr.data[row*gr.width+col]
+}
+
+// toLonLat converts pixel coordinates (where pixel centers fall on the
+// half-integers) into longitude and latitude.
+func (gr *geoRaster) toLonLat(col, row float64) (float64, float64, error) {
+	x := gr.transform[0] + col*gr.transform[1] + row*gr.transform[2]
+	y := gr.transform[3] + col*gr.transform[4] + row*gr.transform[5]
+	if gr.epsg == 4326 || gr.epsg == 4269 {
+		return x, y, nil
+	}
+	if zone, north, ok := utmZoneFromEPSG(gr.epsg); ok {
+		lat, lon := utmToLatLon(x, y, zone, north)
+		return lon, lat, nil
+	}
+	return 0, 0, pzsvc.ErrWithTrace(fmt.Sprintf("Unsupported projection EPSG:%d.", gr.epsg))
+}
+
+// readGeoTIFFURL fetches a GeoTIFF from a URL or a local path and reads
+// it in.  Local paths may be given plain or as file:// URLs.
+func readGeoTIFFURL(ctx context.Context, imgURL string) (*geoRaster, error) {
+	var (
+		byts []byte
+		err  error
+	)
+	if strings.HasPrefix(imgURL, "http://") || strings.HasPrefix(imgURL, "https://") {
+		req, err := http.NewRequest("GET", imgURL, nil)
+		if err != nil {
+			return nil, pzsvc.TraceErr(err)
+		}
+		resp, err := upstreamClient.Do(req.WithContext(ctx))
+		if err != nil {
+			return nil, pzsvc.TraceErr(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, pzsvc.ErrWithTrace(fmt.Sprintf("Could not retrieve %v: %v", imgURL, resp.Status))
+		}
+		if byts, err = ioutil.ReadAll(resp.Body); err != nil {
+			return nil, pzsvc.TraceErr(err)
+		}
+	} else if byts, err = ioutil.ReadFile(strings.TrimPrefix(imgURL, "file://")); err != nil {
+		return nil, pzsvc.TraceErr(err)
+	}
+	result, err := readGeoTIFF(byts)
+	if err != nil {
+		return nil, pzsvc.ErrWithTrace("Could not read GeoTIFF " + imgURL + ": " + err.Error())
+	}
+	return result, nil
+}
+
+type tiffEntry struct {
+	typ   int
+	count int
+	raw   []byte
+}
+
+type tiffReader struct {
+	byts    []byte
+	order   binary.ByteOrder
+	entries map[int]tiffEntry
+}
+
+// readGeoTIFF reads the first image out of the given GeoTIFF file.
+func readGeoTIFF(byts []byte) (*geoRaster, error) {
+	tr := tiffReader{byts: byts, entries: make(map[int]tiffEntry)}
+	if len(byts) < 8 {
+		return nil, pzsvc.ErrWithTrace("File too short to be a TIFF.")
+	}
+	switch string(byts[0:2]) {
+	case "II":
+		tr.order = binary.LittleEndian
+	case "MM":
+		tr.order = binary.BigEndian
+	default:
+		return nil, pzsvc.ErrWithTrace("Not a TIFF file.")
+	}
+	if magic := tr.order.Uint16(byts[2:4]); magic != 42 {
+		return nil, pzsvc.ErrWithTrace(fmt.Sprintf("Unsupported TIFF version %d.  BigTIFF is not supported.", magic))
+	}
+	if err := tr.readIFD(int(tr.order.Uint32(byts[4:8]))); err != nil {
+		return nil, err
+	}
+	return tr.decode()
+}
+
+func (tr *tiffReader) readIFD(offset int) error {
+	if offset+2 > len(tr.byts) {
+		return pzsvc.ErrWithTrace("TIFF directory out of bounds.")
+	}
+	count := int(tr.order.Uint16(tr.byts[offset:]))
+	offset += 2
+	if offset+12*count > len(tr.byts) {
+		return pzsvc.ErrWithTrace("TIFF directory out of bounds.")
+	}
+	for inx := 0; inx < count; inx++ {
+		entry := tr.byts[offset+12*inx : offset+12*inx+12]
+		tag := int(tr.order.Uint16(entry[0:]))
+		typ := int(tr.order.Uint16(entry[2:]))
+		valCount := int(tr.order.Uint32(entry[4:]))
+		if typ <= 0 || typ >= len(tiffTypeSize) {
+			continue // unknown types are allowed, and skipped
+		}
+		size := valCount * tiffTypeSize[typ]
+		raw := entry[8:12]
+		if size > 4 {
+			valOffset := int(tr.order.Uint32(entry[8:]))
+			if valOffset+size > len(tr.byts) || valOffset < 0 {
+				return pzsvc.ErrWithTrace(fmt.Sprintf("TIFF tag %d out of bounds.", tag))
+			}
+			raw = tr.byts[valOffset : valOffset+size]
+		}
+		tr.entries[tag] = tiffEntry{typ: typ, count: valCount, raw: raw[:size]}
+	}
+	return nil
+}
+
+// values returns the numeric values of the given tag, or nil if the tag
+// is absent.
+func (tr *tiffReader) values(tag int) []float64 {
+	entry, ok := tr.entries[tag]
+	if !ok {
+		return nil
+	}
+	result := make([]float64, entry.count)
+	for inx := range result {
+		switch entry.typ {
+		case 1, 7:
+			result[inx] = float64(entry.raw[inx])
+		case 6:
+			result[inx] = float64(int8(entry.raw[inx]))
+		case 3:
+			result[inx] = float64(tr.order.Uint16(entry.raw[2*inx:]))
+		case 8:
+			result[inx] = float64(int16(tr.order.Uint16(entry.raw[2*inx:])))
+		case 4:
+			result[inx] = float64(tr.order.Uint32(entry.raw[4*inx:]))
+		case 9:
+			result[inx] = float64(int32(tr.order.Uint32(entry.raw[4*inx:])))
+		case 5:
+			result[inx] = float64(tr.order.Uint32(entry.raw[8*inx:])) / float64(tr.order.Uint32(entry.raw[8*inx+4:]))
+		case 10:
+			result[inx] = float64(int32(tr.order.Uint32(entry.raw[8*inx:]))) / float64(int32(tr.order.Uint32(entry.raw[8*inx+4:])))
+		case 11:
+			result[inx] = float64(math.Float32frombits(tr.order.Uint32(entry.raw[4*inx:])))
+		case 12:
+			result[inx] = math.Float64frombits(tr.order.Uint64(entry.raw[8*inx:]))
+		}
+	}
+	return result
+}
+
+// value returns the first value of the given tag, or the default if the
+// tag is absent.
+func (tr *tiffReader) value(tag int, dflt float64) float64 {
+	if vals := tr.values(tag); len(vals) > 0 {
+		return vals[0]
+	}
+	return dflt
+}
+
+func (tr *tiffReader) decode() (*geoRaster, error) {
+	var (
+		err       error
+		blockOffs []float64
+		blockCnts []float64
+		blockW    int
+		blockH    int
+		noData    = math.NaN()
+	)
+	result := geoRaster{
+		width:  int(tr.value(tagImageWidth, 0)),
+		height: int(tr.value(tagImageLength, 0))}
+	if result.width <= 0 || result.height <= 0 {
+		return nil, pzsvc.ErrWithTrace("TIFF has no image dimensions.")
+	}
+	if result.width > maxGeoTIFFPixels/result.height {
+		return nil, pzsvc.ErrWithTrace(fmt.Sprintf("TIFF is too large, at %dx%d pixels.", result.width, result.height))
+	}
+	if spp := tr.value(tagSamplesPerPixel, 1); spp != 1 {
+		return nil, pzsvc.ErrWithTrace(fmt.Sprintf("Only single-band images are supported.  This one has %v.", spp))
+	}
+	bits := int(tr.value(tagBitsPerSample, 1))
+	format := int(tr.value(tagSampleFormat, 1))
+	compression := int(tr.value(tagCompression, 1))
+	predictor := int(tr.value(tagPredictor, 1))
+	if predictor != 1 && predictor != 2 {
+		return nil, pzsvc.ErrWithTrace(fmt.Sprintf("Unsupported TIFF predictor %d.", predictor))
+	}
+	sampleBytes := bits / 8
+	if bits%8 != 0 || sampleBytes == 0 {
+		return nil, pzsvc.ErrWithTrace(fmt.Sprintf("Unsupported sample size of %d bits.", bits))
+	}
+	if ndStr := strings.Trim(string(tr.entries[tagGDALNoData].raw), "\x00 "); ndStr != "" {
+		if noData, err = strconv.ParseFloat(ndStr, 64); err != nil {
+			noData = math.NaN()
+		}
+	}
+
+	if _, ok := tr.entries[tagTileOffsets]; ok {
+		blockW = int(tr.value(tagTileWidth, 0))
+		blockH = int(tr.value(tagTileLength, 0))
+		blockOffs = tr.values(tagTileOffsets)
+		blockCnts = tr.values(tagTileByteCounts)
+	} else {
+		blockW = result.width
+		blockH = int(tr.value(tagRowsPerStrip, float64(result.height)))
+		blockOffs = tr.values(tagStripOffsets)
+		blockCnts = tr.values(tagStripByteCounts)
+	}
+	if blockW <= 0 || blockH <= 0 || len(blockOffs) == 0 || len(blockOffs) != len(blockCnts) {
+		return nil, pzsvc.ErrWithTrace("TIFF has no usable strip or tile layout.")
+	}
+	if blockH > result.height {
+		blockH = result.height
+	}
+	blocksAcross := (result.width + blockW - 1) / blockW
+	blocksDown := (result.height + blockH - 1) / blockH
+	if blockW > maxGeoTIFFPixels/blockH {
+		return nil, pzsvc.ErrWithTrace(fmt.Sprintf("TIFF tiles are too large, at %dx%d pixels.", blockW, blockH))
+	}
+	if len(blockOffs) < blocksAcross*blocksDown {
+		return nil, pzsvc.ErrWithTrace("TIFF is missing strips or tiles.")
+	}
+
+	// the header has to agree with how much data there is before any of
+	// the raster is allocated
+	var dataBytes float64
+	for _, cnt := range blockCnts[:blocksAcross*blocksDown] {
+		if cnt < 0 {
+			return nil, pzsvc.ErrWithTrace("TIFF has a negative strip or tile size.")
+		}
+		dataBytes += cnt
+	}
+	if compression != 1 {
+		dataBytes *= maxCompressionRatio
+	}
+	if dataBytes < float64(result.width)*float64(result.height)*float64(sampleBytes) {
+		return nil, pzsvc.ErrWithTrace(fmt.Sprintf("TIFF has too little data for a %dx%d image.", result.width, result.height))
+	}
+
+	result.data = make([]float32, result.width*result.height)
+	rowBytes := blockW * sampleBytes
+	blockBytes := rowBytes * blockH
+	for blockInx := 0; blockInx < blocksAcross*blocksDown; blockInx++ {
+		off, cnt := int(blockOffs[blockInx]), int(blockCnts[blockInx])
+		if off < 0 || off+cnt > len(tr.byts) {
+			return nil, pzsvc.ErrWithTrace(fmt.Sprintf("TIFF block %d out of bounds.", blockInx))
+		}
+		var block []byte
+		if block, err = decompressBlock(tr.byts[off:off+cnt], compression, blockBytes); err != nil {
+			return nil, err
+		}
+		x0 := (blockInx % blocksAcross) * blockW
+		y0 := (blockInx / blocksAcross) * blockH
+		for row := 0; row < blockH && y0+row < result.height; row++ {
+			if (row+1)*rowBytes > len(block) {
+				break // short final strip
+			}
+			rowByts := block[row*rowBytes : (row+1)*rowBytes]
+			if predictor == 2 {
+				undoPredictor(rowByts, sampleBytes, tr.order)
+			}
+			for col := 0; col < blockW && x0+col < result.width; col++ {
+				val := sampleValue(rowByts[col*sampleBytes:], bits, format, tr.order)
+				if val == noData {
+					val = math.NaN()
+				}
+				result.data[(y0+row)*result.width+x0+col] = float32(val)
+			}
+		}
+	}
+
+	if err = tr.georeference(&result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func (tr *tiffReader) georeference(result *geoRaster) error {
+	var (
+		rasterType = 1
+		modelType  = 0
+	)
+	if keys := tr.values(tagGeoKeys); len(keys) >= 4 {
+		for inx := 0; inx < int(keys[3]) && 4*inx+7 < len(keys); inx++ {
+			key := keys[4*inx+4 : 4*inx+8]
+			if key[1] != 0 { // only directly held values are of interest
+				continue
+			}
+			switch int(key[0]) {
+			case geoKeyModelType:
+				modelType = int(key[3])
+			case geoKeyRasterType:
+				rasterType = int(key[3])
+			case geoKeyGeographic:
+				if result.epsg == 0 {
+					result.epsg = int(key[3])
+				}
+			case geoKeyProjectedCS:
+				result.epsg = int(key[3])
+			}
+		}
+	}
+	if modelType == modelTypeGeographic && result.epsg == 0 {
+		result.epsg = 4326
+	}
+	if result.epsg == 0 {
+		return pzsvc.ErrWithTrace("GeoTIFF has no recognizable coordinate system.")
+	}
+
+	if matrix := tr.values(tagTransformation); len(matrix) >= 16 {
+		result.transform = [6]float64{matrix[3], matrix[0], matrix[1], matrix[7], matrix[4], matrix[5]}
+	} else {
+		scale := tr.values(tagPixelScale)
+		tie := tr.values(tagTiepoint)
+		if len(scale) < 2 || len(tie) < 6 {
+			return pzsvc.ErrWithTrace("GeoTIFF has no georeferencing.")
+		}
+		result.transform = [6]float64{tie[3] - tie[0]*scale[0], scale[0], 0, tie[4] + tie[1]*scale[1], 0, -scale[1]}
+	}
+	if rasterType == rasterPixelIsPoint {
+		// values refer to pixel centers rather than corners
+		result.transform[0] -= 0.5 * (result.transform[1] + result.transform[2])
+		result.transform[3] -= 0.5 * (result.transform[4] + result.transform[5])
+	}
+	return nil
+}
+
+// decompressBlock decompresses a strip or tile, stopping once it has
+// maxLen bytes, which is all that a block can hold.
+func decompressBlock(src []byte, compression, maxLen int) ([]byte, error) {
+	switch compression {
+	case 1:
+		return src, nil
+	case 5:
+		return tiffLZW(src, maxLen)
+	case 8, 32946:
+		zr, err := zlib.NewReader(bytes.NewReader(src))
+		if err != nil {
+			return nil, pzsvc.TraceErr(err)
+		}
+		defer zr.Close()
+		result, err := ioutil.ReadAll(io.LimitReader(zr, int64(maxLen)))
+		if err != nil {
+			return nil, pzsvc.TraceErr(err)
+		}
+		return result, nil
+	case 32773:
+		return packBits(src, maxLen), nil
+	}
+	return nil, pzsvc.ErrWithTrace(fmt.Sprintf("Unsupported TIFF compression %d.", compression))
+}
+
+// undoPredictor reverses horizontal differencing on a single row.
+func undoPredictor(row []byte, sampleBytes int, order binary.ByteOrder) {
+	switch sampleBytes {
+	case 1:
+		for inx := 1; inx < len(row); inx++ {
+			row[inx] += row[inx-1]
+		}
+	case 2:
+		for inx := 2; inx+1 < len(row); inx += 2 {
+			order.PutUint16(row[inx:], order.Uint16(row[inx:])+order.Uint16(row[inx-2:]))
+		}
+	case 4:
+		for inx := 4; inx+3 < len(row); inx += 4 {
+			order.PutUint32(row[inx:], order.Uint32(row[inx:])+order.Uint32(row[inx-4:]))
+		}
+	}
+}
+
+func sampleValue(byts []byte, bits, format int, order binary.ByteOrder) float64 {
+	switch {
+	case bits == 8 && format == 2:
+		return float64(int8(byts[0]))
+	case bits == 8:
+		return float64(byts[0])
+	case bits == 16 && format == 2:
+		return float64(int16(order.Uint16(byts)))
+	case bits == 16:
+		return float64(order.Uint16(byts))
+	case bits == 32 && format == 3:
+		return float64(math.Float32frombits(order.Uint32(byts)))
+	case bits == 32 && format == 2:
+		return float64(int32(order.Uint32(byts)))
+	case bits == 32:
+		return float64(order.Uint32(byts))
+	case bits == 64 && format == 3:
+		return math.Float64frombits(order.Uint64(byts))
+	}
+	return math.NaN()
+}
+
+// tiffLZW decodes TIFF-flavored LZW, which differs from compress/lzw in
+// that the code width grows one code early.  It stops after maxLen bytes.
+func tiffLZW(src []byte, maxLen int) ([]byte, error) {
+	const (
+		clearCode = 256
+		eoiCode   = 257
+	)
+	var (
+		result []byte
+		bitBuf uint32
+		bitCnt uint
+		width  uint = 9
+		prev   []byte
+		pos    int
+	)
+	table := make([][]byte, 258, 4096)
+	for inx := 0; inx < 256; inx++ {
+		table[inx] = []byte{byte(inx)}
+	}
+	for {
+		for bitCnt < width {
+			if pos >= len(src) {
+				return result, nil // some writers leave off the EOI code
+			}
+			bitBuf = bitBuf<<8 | uint32(src[pos])
+			pos++
+			bitCnt += 8
+		}
+		code := int(bitBuf>>(bitCnt-width)) & (1<<width - 1)
+		bitCnt -= width
+
+		if code == clearCode {
+			table = table[:258]
+			width = 9
+			prev = nil
+			continue
+		}
+		if code == eoiCode {
+			return result, nil
+		}
+
+		var entry []byte
+		switch {
+		case code < len(table):
+			entry = table[code]
+			if prev != nil && len(table) < 4096 {
+				table = append(table, append(append([]byte{}, prev...), entry[0]))
+			}
+		case code == len(table) && prev != nil:
+			entry = append(append([]byte{}, prev...), prev[0])
+			table = append(table, entry)
+		default:
+			return nil, pzsvc.ErrWithTrace(fmt.Sprintf("Invalid LZW code %d.", code))
+		}
+		result = append(result, entry...)
+		if len(result) >= maxLen {
+			return result[:maxLen], nil
+		}
+		prev = entry
+		if len(table) >= 1<<width-1 && width < 12 {
+			width++
+		}
+	}
+}
+
+// packBits decodes PackBits, stopping after maxLen bytes.
+func packBits(src []byte, maxLen int) []byte {
+	var result []byte
+	for inx := 0; inx < len(src) && len(result) < maxLen; {
+		n := int(int8(src[inx]))
+		inx++
+		switch {
+		case n >= 0:
+			end := inx + n + 1
+			if end > len(src) {
+				end = len(src)
+			}
+			result = append(result, src[inx:end]...)
+			inx = end
+		case n != -128 && inx < len(src):
+			for count := 0; count < 1-n; count++ {
+				result = append(result, src[inx])
+			}
+			inx++
+		}
+	}
+	if len(result) > maxLen {
+		result = result[:maxLen]
+	}
+	return result
+}
+
+type tiffOutEntry struct {
+	tag   uint16
+	typ   uint16
+	count int
+	raw   []byte
+}
+
+// writeGeoTIFF8 writes the given 8-bit bands out as a Deflate-compressed
+// GeoTIFF with the size and georeferencing of ref.  Zero is nodata.
+func writeGeoTIFF8(ref *geoRaster, bands [][]uint8) ([]byte, error) {
+	const rowsPerStrip = 64
+	var (
+		order      = binary.LittleEndian
+		out        bytes.Buffer
+		entries    []tiffOutEntry
+		stripOffs  []uint32
+		stripCnts  []uint32
+		nBands     = len(bands)
+		photometry = uint16(1)
+	)
+	if nBands == 0 {
+		return nil, pzsvc.ErrWithTrace("No bands to write.")
+	}
+	if nBands == 3 {
+		photometry = 2
+	}
+	for _, band := range bands {
+		if len(band) != ref.width*ref.height {
+			return nil, pzsvc.ErrWithTrace("Band size does not match image size.")
+		}
+	}
+
+	out.Write([]byte{'I', 'I', 42, 0, 0, 0, 0, 0}) // IFD offset filled in at the end
+	row := make([]byte, ref.width*nBands)
+	for y0 := 0; y0 < ref.height; y0 += rowsPerStrip {
+		var strip bytes.Buffer
+		zw := zlib.NewWriter(&strip)
+		for y := y0; y < y0+rowsPerStrip && y < ref.height; y++ {
+			for x := 0; x < ref.width; x++ {
+				for b := 0; b < nBands; b++ {
+					row[x*nBands+b] = bands[b][y*ref.width+x]
+				}
+			}
+			if _, err := zw.Write(row); err != nil {
+				return nil, pzsvc.TraceErr(err)
+			}
+		}
+		if err := zw.Close(); err != nil {
+			return nil, pzsvc.TraceErr(err)
+		}
+		stripOffs = append(stripOffs, uint32(out.Len()))
+		stripCnts = append(stripCnts, uint32(strip.Len()))
+		out.Write(strip.Bytes())
+	}
+
+	shorts := func(vals ...uint16) []byte {
+		result := make([]byte, 2*len(vals))
+		for inx, val := range vals {
+			order.PutUint16(result[2*inx:], val)
+		}
+		return result
+	}
+	longs := func(vals ...uint32) []byte {
+		result := make([]byte, 4*len(vals))
+		for inx, val := range vals {
+			order.PutUint32(result[4*inx:], val)
+		}
+		return result
+	}
+	doubles := func(vals ...float64) []byte {
+		result := make([]byte, 8*len(vals))
+		for inx, val := range vals {
+			order.PutUint64(result[8*inx:], math.Float64bits(val))
+		}
+		return result
+	}
+	perBand := func(val uint16) []byte {
+		vals := make([]uint16, nBands)
+		for inx := range vals {
+			vals[inx] = val
+		}
+		return shorts(vals...)
+	}
+
+	modelType, csKey := uint16(1), uint16(geoKeyProjectedCS)
+	if ref.epsg == 4326 || ref.epsg == 4269 {
+		modelType, csKey = modelTypeGeographic, geoKeyGeographic
+	}
+	geoKeys := shorts(1, 1, 0, 3,
+		geoKeyModelType, 0, 1, modelType,
+		geoKeyRasterType, 0, 1, 1,
+		csKey, 0, 1, uint16(ref.epsg))
+
+	t := ref.transform
+	entries = append(entries,
+		tiffOutEntry{tagImageWidth, 4, 1, longs(uint32(ref.width))},
+		tiffOutEntry{tagImageLength, 4, 1, longs(uint32(ref.height))},
+		tiffOutEntry{tagBitsPerSample, 3, nBands, perBand(8)},
+		tiffOutEntry{tagCompression, 3, 1, shorts(8)},
+		tiffOutEntry{262, 3, 1, shorts(photometry)},
+		tiffOutEntry{tagStripOffsets, 4, len(stripOffs), longs(stripOffs...)},
+		tiffOutEntry{tagSamplesPerPixel, 3, 1, shorts(uint16(nBands))},
+		tiffOutEntry{tagRowsPerStrip, 4, 1, longs(rowsPerStrip)},
+		tiffOutEntry{tagStripByteCounts, 4, len(stripCnts), longs(stripCnts...)},
+		tiffOutEntry{tagPlanarConfig, 3, 1, shorts(1)},
+		tiffOutEntry{tagSampleFormat, 3, nBands, perBand(1)})
+	if t[2] == 0 && t[4] == 0 {
+		entries = append(entries,
+			tiffOutEntry{tagPixelScale, 12, 3, doubles(t[1], -t[5], 0)},
+			tiffOutEntry{tagTiepoint, 12, 6, doubles(0, 0, 0, t[0], t[3], 0)})
+	} else {
+		entries = append(entries,
+			tiffOutEntry{tagTransformation, 12, 16, doubles(t[1], t[2], 0, t[0], t[4], t[5], 0, t[3], 0, 0, 0, 0, 0, 0, 0, 1)})
+	}
+	entries = append(entries,
+		tiffOutEntry{tagGeoKeys, 3, 16, geoKeys},
+		tiffOutEntry{tagGDALNoData, 2, 2, []byte{'0', 0}})
+
+	// out-of-line values go before the IFD, on word boundaries
+	valOffsets := make([]uint32, len(entries))
+	for inx, entry := range entries {
+		if len(entry.raw) > 4 {
+			if out.Len()%2 == 1 {
+				out.WriteByte(0)
+			}
+			valOffsets[inx] = uint32(out.Len())
+			out.Write(entry.raw)
+		}
+	}
+	if out.Len()%2 == 1 {
+		out.WriteByte(0)
+	}
+	ifdOffset := out.Len()
+	ifd := make([]byte, 2+12*len(entries)+4)
+	order.PutUint16(ifd, uint16(len(entries)))
+	for inx, entry := range entries {
+		slot := ifd[2+12*inx:]
+		order.PutUint16(slot[0:], entry.tag)
+		order.PutUint16(slot[2:], entry.typ)
+		order.PutUint32(slot[4:], uint32(entry.count))
+		if len(entry.raw) > 4 {
+			order.PutUint32(slot[8:], valOffsets[inx])
+		} else {
+			copy(slot[8:12], entry.raw)
+		}
+	}
+	out.Write(ifd)
+
+	result := out.Bytes()
+	order.PutUint32(result[4:], uint32(ifdOffset))
+	return result, nil
+}
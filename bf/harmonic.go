@@ -0,0 +1,288 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bf
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/venicegeo/pzsvc-lib"
+)
+
+/*
+The harmonic tide predictor works from a table of tidal stations, each with
+a set of harmonic constituents (amplitude and Greenwich phase lag).  Heights
+are predicted in the standard fashion:
+
+    h(t) = Z0 + sum( f * H * cos(V0(t) + u - G) )
+
+where V0 is the equilibrium argument of the constituent at time t, and f
+and u are the nodal corrections for the 18.6 year lunar cycle.  Astronomical
+arguments follow Meeus, and nodal corrections follow the usual Schureman
+approximations.  The table is JSON, in the following form:
+
+{"maxDistance": 100,
+ "stations":[{"name":"Somewhere", "lat":35.2, "lon":-75.6, "datum":0.0,
+   "constituents":[{"name":"M2", "amplitude":0.5, "phase":212.3}, ...]}]}
+
+maxDistance (in km) bounds how far a scene may be from its nearest station
+before we decline to predict for it.  Heights come out in whatever units
+the amplitudes and datum were given in.
+*/
+
+type tideConstituent struct {
+	Name      string  `json:"name"`
+	Amplitude float64 `json:"amplitude"`
+	Phase     float64 `json:"phase"` // Greenwich phase lag, in degrees
+}
+
+type tideStation struct {
+	Name         string            `json:"name"`
+	Lat          float64           `json:"lat"`
+	Lon          float64           `json:"lon"`
+	Datum        float64           `json:"datum"`
+	Constituents []tideConstituent `json:"constituents"`
+}
+
+type harmonicTides struct {
+	MaxDistance float64       `json:"maxDistance"`
+	Stations    []tideStation `json:"stations"`
+}
+
+// doodson holds the Doodson multipliers for tau, s, h, p, N' and p1, in
+// that order, followed by the phase offset in units of 90 degrees.
+type doodson [7]float64
+
+var constituentArgs = map[string]doodson{
+	"M2":  {2, 0, 0, 0, 0, 0, 0},
+	"S2":  {2, 2, -2, 0, 0, 0, 0},
+	"N2":  {2, -1, 0, 1, 0, 0, 0},
+	"K2":  {2, 2, 0, 0, 0, 0, 0},
+	"2N2": {2, -2, 0, 2, 0, 0, 0},
+	"MU2": {2, -2, 2, 0, 0, 0, 0},
+	"NU2": {2, -1, 2, -1, 0, 0, 0},
+	"L2":  {2, 1, 0, -1, 0, 0, 2},
+	"T2":  {2, 2, -3, 0, 0, 1, 0},
+	"K1":  {1, 1, 0, 0, 0, 0, 1},
+	"O1":  {1, -1, 0, 0, 0, 0, -1},
+	"P1":  {1, 1, -2, 0, 0, 0, -1},
+	"Q1":  {1, -2, 0, 1, 0, 0, -1},
+	"MK3": {3, 1, 0, 0, 0, 0, 1},
+	"M4":  {4, 0, 0, 0, 0, 0, 0},
+	"MS4": {4, 2, -2, 0, 0, 0, 0},
+	"MN4": {4, -1, 0, 1, 0, 0, 0},
+	"M6":  {6, 0, 0, 0, 0, 0, 0},
+	"MF":  {0, 2, 0, 0, 0, 0, 0},
+	"MM":  {0, 1, 0, -1, 0, 0, 0},
+	"SSA": {0, 0, 2, 0, 0, 0, 0},
+	"SA":  {0, 0, 1, 0, 0, 0, 0},
+}
+
+var (
+	harmonicTable     *harmonicTides
+	harmonicTablePath string
+	harmonicTableSem  sync.Mutex
+)
+
+// errTideTable is what requests see when the constituent table cannot be
+// read.  The details go to the log, as they are the server's business.
+var errTideTable = errors.New("could not read the tide constituent table")
+
+// loadHarmonicTides reads the constituent table at the given path, which
+// is always the server's own BFH_TIDE_TABLE.  The table is only read once,
+// as it does not change while we are running.
+func loadHarmonicTides(path string) (*harmonicTides, error) {
+	harmonicTableSem.Lock()
+	defer harmonicTableSem.Unlock()
+	if harmonicTable != nil && harmonicTablePath == path {
+		return harmonicTable, nil
+	}
+	byts, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Print(pzsvc.TraceStr("Could not read tide constituent table " + path + ": " + err.Error()))
+		return nil, errTideTable
+	}
+	var ht harmonicTides
+	if err = json.Unmarshal(byts, &ht); err != nil {
+		log.Print(pzsvc.TraceStr("Could not parse tide constituent table " + path + ": " + err.Error()))
+		return nil, errTideTable
+	}
+	for _, station := range ht.Stations {
+		for _, cons := range station.Constituents {
+			if _, ok := constituentArgs[strings.ToUpper(cons.Name)]; !ok {
+				return nil, pzsvc.ErrWithTrace(fmt.Sprintf("Unknown tidal constituent %s at station %s.", cons.Name, station.Name))
+			}
+		}
+	}
+	if ht.MaxDistance == 0 {
+		ht.MaxDistance = 100
+	}
+	harmonicTable, harmonicTablePath = &ht, path
+	return &ht, nil
+}
+
+func (ht *harmonicTides) tide(ctx context.Context, inp tideIn) (*tideOut, error) {
+	var (
+		station *tideStation
+		dtgTime time.Time
+		err     error
+		result  tideOut
+	)
+	if dtgTime, err = time.Parse("2006-01-02-15-04", inp.Dtg); err != nil {
+		return nil, pzsvc.TraceErr(err)
+	}
+	if station = ht.nearest(inp.Lat, inp.Lon); station == nil {
+		return nil, pzsvc.ErrWithTrace(fmt.Sprintf("No tide station within %vkm of (%v, %v).", ht.MaxDistance, inp.Lat, inp.Lon))
+	}
+
+	// Nodal corrections change over years, not hours, so they can
+	// safely be computed once for the whole day.
+	fu := nodalCorrections(dtgTime)
+
+	result.CurrTide = station.height(dtgTime, fu)
+	result.MinTide = result.CurrTide
+	result.MaxTide = result.CurrTide
+	for step := -12 * 60; step <= 12*60; step += 6 {
+		height := station.height(dtgTime.Add(time.Duration(step)*time.Minute), fu)
+		result.MinTide = math.Min(result.MinTide, height)
+		result.MaxTide = math.Max(result.MaxTide, height)
+	}
+	return &result, nil
+}
+
+// tides predicts for each location that it can.  Those it cannot, such as
+// ones with no station in range, are left out, so that one far-flung scene
+// does not cost all of the others their tides.
+func (ht *harmonicTides) tides(ctx context.Context, inp *tidesIn) (*tidesOut, error) {
+	var result tidesOut
+	for _, loc := range inp.Locations {
+		currOut, err := ht.tide(ctx, loc)
+		if err != nil {
+			log.Print(pzsvc.TraceStr("No tide prediction for " + loc.Dtg + ": " + err.Error()))
+			continue
+		}
+		result.Locations = append(result.Locations, tideWrapper{Lat: loc.Lat, Lon: loc.Lon, Dtg: loc.Dtg, Results: *currOut})
+	}
+	return &result, nil
+}
+
+// nearest returns the closest station to the given point, as long
+// as it is within MaxDistance.
+func (ht *harmonicTides) nearest(lat, lon float64) *tideStation {
+	var (
+		result   *tideStation
+		bestDist = ht.MaxDistance
+	)
+	for inx := range ht.Stations {
+		if dist := greatCircleKm(lat, lon, ht.Stations[inx].Lat, ht.Stations[inx].Lon); dist <= bestDist {
+			result = &ht.Stations[inx]
+			bestDist = dist
+		}
+	}
+	return result
+}
+
+func (station *tideStation) height(when time.Time, fu map[string][2]float64) float64 {
+	args := astroArgs(when)
+	result := station.Datum
+	for _, cons := range station.Constituents {
+		name := strings.ToUpper(cons.Name)
+		dood := constituentArgs[name]
+		v0 := dood[6] * 90
+		for inx := 0; inx < 6; inx++ {
+			v0 += dood[inx] * args[inx]
+		}
+		corr := fu[name]
+		result += corr[0] * cons.Amplitude * math.Cos((v0+corr[1]-cons.Phase)*math.Pi/180)
+	}
+	return result
+}
+
+// astroArgs returns tau, s, h, p, N' and p1, in degrees, for the given
+// time.  N' is the negative of the longitude of the lunar node.
+func astroArgs(when time.Time) [6]float64 {
+	when = when.UTC()
+	jd := float64(when.Unix())/86400.0 + 2440587.5
+	cent := (jd - 2451545.0) / 36525.0
+	hours := float64(when.Hour()) + float64(when.Minute())/60 + float64(when.Second())/3600
+
+	s := 218.3164477 + 481267.88123421*cent
+	h := 280.46646 + 36000.76983*cent
+	p := 83.3532465 + 4069.0137287*cent
+	n := 125.04452 - 1934.136261*cent
+	p1 := 282.93735 + 1.71946*cent
+	tau := 15*hours + 180 + h - s
+	return [6]float64{tau, s, h, p, -n, p1}
+}
+
+// nodalCorrections returns the nodal amplitude factor f and phase
+// correction u (in degrees) for each supported constituent.
+func nodalCorrections(when time.Time) map[string][2]float64 {
+	n := -astroArgs(when)[4] * math.Pi / 180
+	fM2 := 1.0004 - 0.0373*math.Cos(n) + 0.0002*math.Cos(2*n)
+	uM2 := -2.14 * math.Sin(n)
+	fK1 := 1.0060 + 0.1150*math.Cos(n) - 0.0088*math.Cos(2*n) + 0.0006*math.Cos(3*n)
+	uK1 := -8.86*math.Sin(n) + 0.68*math.Sin(2*n) - 0.07*math.Sin(3*n)
+	fO1 := 1.0089 + 0.1871*math.Cos(n) - 0.0147*math.Cos(2*n) + 0.0014*math.Cos(3*n)
+	uO1 := 10.80*math.Sin(n) - 1.34*math.Sin(2*n) + 0.19*math.Sin(3*n)
+	fK2 := 1.0241 + 0.2863*math.Cos(n) + 0.0083*math.Cos(2*n) - 0.0015*math.Cos(3*n)
+	uK2 := -17.74*math.Sin(n) + 0.68*math.Sin(2*n) - 0.04*math.Sin(3*n)
+	fMf := 1.043 + 0.414*math.Cos(n)
+	uMf := -23.74*math.Sin(n) + 2.68*math.Sin(2*n) - 0.38*math.Sin(3*n)
+	fMm := 1.000 - 0.130*math.Cos(n)
+
+	return map[string][2]float64{
+		"M2":  {fM2, uM2},
+		"S2":  {1, 0},
+		"N2":  {fM2, uM2},
+		"K2":  {fK2, uK2},
+		"2N2": {fM2, uM2},
+		"MU2": {fM2, uM2},
+		"NU2": {fM2, uM2},
+		"L2":  {fM2, uM2},
+		"T2":  {1, 0},
+		"K1":  {fK1, uK1},
+		"O1":  {fO1, uO1},
+		"P1":  {1, 0},
+		"Q1":  {fO1, uO1},
+		"MK3": {fM2 * fK1, uM2 + uK1},
+		"M4":  {fM2 * fM2, 2 * uM2},
+		"MS4": {fM2, uM2},
+		"MN4": {fM2 * fM2, 2 * uM2},
+		"M6":  {fM2 * fM2 * fM2, 3 * uM2},
+		"MF":  {fMf, uMf},
+		"MM":  {fMm, 0},
+		"SSA": {1, 0},
+		"SA":  {1, 0},
+	}
+}
+
+// greatCircleKm returns the distance between two points in kilometers.
+func greatCircleKm(lat1, lon1, lat2, lon2 float64) float64 {
+	rad := math.Pi / 180
+	dLat := (lat2 - lat1) * rad
+	dLon := (lon2 - lon1) * rad
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 6371.0 * 2 * math.Atan2(math.Sqrt(a), math.Sqrt(1-a))
+}
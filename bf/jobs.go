@@ -15,6 +15,7 @@
 package bf
 
 import (
+	"context"
 	"net/http"
 
 	"github.com/venicegeo/pzsvc-lib"
@@ -38,27 +39,29 @@ type sceneOutpStruct struct {
 
 // resultsBySceneID takes a sceneID (as per pzsvc-image-catalog) and the necessary information
 // for accessing Piazza, and returns a list of bf-handle results in the form of dataIds.
-func resultsBySceneID(sceneID, pzAddr, pzAuth string) ([]string, error) {
-
-	files := pzsvc.FileDataList{}
-	queryStr := `{"query":{"bool":{"must":[{"match":{"dataResource.dataType.content":"` +
-		sceneID +
-		`"}},{"match":{"dataResource.dataType.type":"text"}}]}}}`
-
-	_, err := pzsvc.RequestKnownJSON("POST", queryStr, pzAddr+"/data/query", pzAuth, &files)
+// Provenance documents mention the sceneID too, but are not results, so they
+// are left out.
+func resultsBySceneID(ctx context.Context, sceneID, pzAddr, pzAuth string, gw Gateway) ([]string, error) {
+	dataIds, err := gw.QueryText(ctx, sceneID, pzAddr, pzAuth)
 	if err != nil {
 		return nil, pzsvc.TraceErr(err)
 	}
-
-	outDataIds := make([]string, len(files.Data))
-	for i, val := range files.Data {
-		outDataIds[i] = val.DataID
+	outDataIds := make([]string, 0, len(dataIds))
+	for _, dataID := range dataIds {
+		desc, err := gw.GetFileMeta(ctx, dataID, pzAddr, pzAuth)
+		if err != nil {
+			return nil, pzsvc.TraceErr(err)
+		}
+		if desc != nil && desc.ResMeta.Metadata["bfType"] == provMetaType {
+			continue
+		}
+		outDataIds = append(outDataIds, dataID)
 	}
 	return outDataIds, nil
 }
 
 // ResultsByScene ...
-func ResultsByScene(w http.ResponseWriter, r *http.Request) {
+func ResultsByScene(w http.ResponseWriter, r *http.Request, gw Gateway) {
 	var inpObj sceneInpStruct
 	byts, err := pzsvc.ReadBodyJSON(&inpObj, r.Body)
 	if err != nil {
@@ -66,7 +69,7 @@ func ResultsByScene(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	outDataIds, err := resultsBySceneID(inpObj.SceneID, inpObj.PzAddr, inpObj.PzAuth)
+	outDataIds, err := resultsBySceneID(r.Context(), inpObj.SceneID, inpObj.PzAddr, inpObj.PzAuth, gw)
 	outObj := sceneOutpStruct{DataIDs: outDataIds}
 	if err != nil {
 		handleOut(w, "resultsByImageID error: "+err.Error(), outObj, http.StatusInternalServerError)
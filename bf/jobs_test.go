@@ -31,7 +31,7 @@ func TestResultsByScene(t *testing.T) {
 	r := http.Request{}
 	r.Method = "POST"
 	r.Body = pzsvc.GetMockReadCloser(`{"name":what?}`)
-	Execute(w, &r)
+	Execute(w, &r, PzGateway{})
 	if *outInt < 300 && *outInt >= 200 {
 		t.Error(`TestResultsByScene: passed on what should have been a json failure.`)
 	}
@@ -45,8 +45,9 @@ func TestResultsByScene(t *testing.T) {
 	cliOuts := []string{}
 
 	pzsvc.SetMockClient(cliOuts, 200)
+	defer setMockUpstream(cliOuts, 200)()
 
-	ResultsByScene(w, &r)
+	ResultsByScene(w, &r, PzGateway{})
 	if *outInt >= 300 || *outInt < 200 {
 		t.Error(`TestResultsByScene: failed on what should have been a good run.  Error: ` + *outStr)
 	}
@@ -0,0 +1,568 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bf
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+)
+
+// JobStore keeps the queue of jobs for executeAsynch, along with their
+// inputs, statuses and results.  Statuses and results are stored as the
+// JSON strings that are handed back to the client.
+type JobStore interface {
+	// AddJob queues a new job with the given input, in the lane and
+	// under the submitter given by meta
+	AddJob(jobID, inp string, meta jobMeta) error
+	// TakeJob moves the next pending job, as the lane scheduler sees it,
+	// to running, leased to the given owner until the given time, and
+	// returns its ID, its input, and which attempt at it this is.  Jobs waiting to be retried are
+	// pending once their time comes.  It returns an empty ID and no error
+	// if there are no pending jobs.
+	TakeJob(owner string, until time.Time) (string, string, int, error)
+	// Heartbeat renews the lease on a running job, or returns
+	// errLeaseLost if the job is no longer leased to the given owner.
+	// Checking and renewing the lease happen as one step.
+	Heartbeat(jobID, owner string, until time.Time) error
+	// ExpiredJobs lists the running jobs whose leases have expired
+	ExpiredJobs() ([]string, error)
+	// ReclaimJob takes a running job off the queue, and returns its input
+	// and attempts, or errJobNotFound if it is not running.  Only one
+	// caller can reclaim any given job.
+	ReclaimJob(jobID string) (string, int, error)
+	// DoneJob records the output of a job that succeeded.  The owner
+	// given to this and the other calls that end a run is the one that
+	// took the job, and the run is only ended if the job is still leased
+	// to it - otherwise they return errLeaseLost, and leave whatever run
+	// has taken the job since alone.  An empty owner stands for a job
+	// that has already been reclaimed.  Cancelled jobs stay cancelled.
+	DoneJob(jobID, owner, outp string) error
+	// ErrorJob records the error of a job that failed
+	ErrorJob(jobID, owner, errStr string) error
+	// RetryJob records the error of a running job that failed, and
+	// queues it to be run again, with the same input, at the given time
+	RetryJob(jobID, owner, inp, errStr string, at time.Time) error
+	// DeadJob records the error of a running job that failed for the last
+	// time, and adds it to the dead-letter list, keeping its input
+	DeadJob(jobID, owner, inp, errStr string) error
+	// DeadJobs lists the jobs in the dead-letter list, oldest first
+	DeadJobs() ([]string, error)
+	// RequeueJob moves a job from the dead-letter list back onto the
+	// queue, with its attempts reset, or returns errJobNotFound
+	RequeueJob(jobID string) error
+	// Status returns the status of the job, or errJobNotFound
+	Status(jobID string) (string, error)
+	// QueuePosition returns where a pending job stands in the queue, 1
+	// being next, or 0 if it is not pending
+	QueuePosition(jobID string) (int, error)
+	// Results returns the output of a job that succeeded, or
+	// errJobNotFound
+	Results(jobID string) (string, error)
+	// CancelJob takes the job off the queue, pending, running or waiting
+	// to be retried, and marks it cancelled, or returns errJobNotFound or
+	// errJobFinished.  Cancelling a cancelled job does nothing.  Stopping
+	// a running job is up to its worker.
+	CancelJob(jobID string) error
+}
+
+var (
+	errJobNotFound = errors.New("job not found")
+	errJobFinished = errors.New("job has already finished")
+)
+
+var jobStore JobStore = RedisJobStore{}
+
+// SetJobStore replaces the job store that executeAsynch uses.  It is
+// meant to be called once, on startup, before any requests come in.
+func SetJobStore(store JobStore) {
+	jobStore = store
+}
+
+// jobStatus is the status of a job as the client sees it.  Status is one
+// of Pending, Running, Success, Cancelled or Error.
+type jobStatus struct {
+	Status     string          `json:"status"`
+	Attempt    int             `json:"attempt,omitempty"`       // attempts made so far, including any running
+	Position   int             `json:"queuePosition,omitempty"` // where a pending job stands in the queue
+	Owner      string          `json:"owner,omitempty"`         // the instance and worker of bf-handle running the job
+	RetryAt    string          `json:"retryAt,omitempty"`       // when a failed job will next be tried
+	DeadLetter bool            `json:"deadLetter,omitempty"`    // whether the job is in the dead-letter list
+	Result     *jobErrorResult `json:"result,omitempty"`        // why the job (last) failed
+}
+
+type jobErrorResult struct {
+	Type    string `json:"type"`
+	Message string `json:"message"`
+	Details string `json:"details"`
+}
+
+func (status jobStatus) String() string {
+	byts, _ := json.Marshal(status)
+	return string(byts)
+}
+
+// parseJobStatus reads a stored status back.  Anything it cannot read
+// comes back with an empty Status.
+func parseJobStatus(statStr string) jobStatus {
+	var status jobStatus
+	json.Unmarshal([]byte(statStr), &status)
+	return status
+}
+
+var (
+	jobPending   = jobStatus{Status: "Pending"}.String()
+	jobCancelled = jobStatus{Status: "Cancelled"}.String()
+)
+
+// jobErrorStatus builds the status of a failed job.
+func jobErrorStatus(message, details string, attempt int) jobStatus {
+	return jobStatus{
+		Status:  "Error",
+		Attempt: attempt,
+		Result:  &jobErrorResult{Type: "error", Message: message, Details: details}}
+}
+
+// jobRetryStatus builds the status of a failed job that will be retried.
+func jobRetryStatus(errStr string, attempt int, at time.Time) string {
+	status := jobErrorStatus("process failure", errStr, attempt)
+	status.Status = "Pending"
+	status.RetryAt = at.UTC().Format(time.RFC3339)
+	return status.String()
+}
+
+// jobDeadStatus builds the status of a job in the dead-letter list.
+func jobDeadStatus(errStr string, attempt int) string {
+	status := jobErrorStatus("process failure", errStr, attempt)
+	status.DeadLetter = true
+	return status.String()
+}
+
+// RedisJobStore keeps jobs in redis, through redisCli, so that they are
+// shared between instances of bf-handle and survive restarts.
+type RedisJobStore struct{}
+
+// AddJob queues a new job in redis
+func (RedisJobStore) AddJob(jobID, inp string, meta jobMeta) error {
+	if err := redisSetMeta(jobID, meta); err != nil {
+		return err
+	}
+	return redisAddJob(jobID, inp)
+}
+
+// TakeJob takes the next pending job from redis
+func (RedisJobStore) TakeJob(owner string, until time.Time) (string, string, int, error) {
+	redisPromoteRetries()
+	jobID, inp, attempt, err := redisTakeJob(owner, until)
+	if err != nil && err.Error() == "redis: nil" {
+		err = nil
+	}
+	return jobID, inp, attempt, err
+}
+
+// Heartbeat renews a job's lease in redis
+func (RedisJobStore) Heartbeat(jobID, owner string, until time.Time) error {
+	return redisHeartbeat(jobID, owner, until)
+}
+
+// ExpiredJobs lists the running jobs in redis whose leases have expired
+func (RedisJobStore) ExpiredJobs() ([]string, error) {
+	return redisExpiredJobs()
+}
+
+// ReclaimJob takes a running job off the queue in redis
+func (RedisJobStore) ReclaimJob(jobID string) (string, int, error) {
+	return redisReclaimJob(jobID)
+}
+
+// DoneJob records a job's output in redis
+func (RedisJobStore) DoneJob(jobID, owner, outp string) error {
+	return redisDoneJob(jobID, owner, outp)
+}
+
+// ErrorJob records a job's error in redis
+func (RedisJobStore) ErrorJob(jobID, owner, errStr string) error {
+	return redisErrorJob(jobID, owner, errStr)
+}
+
+// RetryJob queues a failed job in redis to be run again
+func (RedisJobStore) RetryJob(jobID, owner, inp, errStr string, at time.Time) error {
+	return redisRetryJob(jobID, owner, inp, errStr, at)
+}
+
+// DeadJob adds a failed job to the dead-letter list in redis
+func (RedisJobStore) DeadJob(jobID, owner, inp, errStr string) error {
+	return redisDeadJob(jobID, owner, inp, errStr)
+}
+
+// DeadJobs lists the dead-letter list in redis
+func (RedisJobStore) DeadJobs() ([]string, error) {
+	return redisDeadJobs()
+}
+
+// RequeueJob moves a job from the dead-letter list in redis to the queue
+func (RedisJobStore) RequeueJob(jobID string) error {
+	return redisRequeueJob(jobID)
+}
+
+// Status reads a job's status from redis
+func (RedisJobStore) Status(jobID string) (string, error) {
+	return redisFound(redisGetStatus(jobID))
+}
+
+// QueuePosition works out where a job stands in the queue in redis
+func (RedisJobStore) QueuePosition(jobID string) (int, error) {
+	return redisQueuePosition(jobID)
+}
+
+// Results reads a job's output from redis
+func (RedisJobStore) Results(jobID string) (string, error) {
+	return redisFound(redisGetResults(jobID))
+}
+
+// CancelJob cancels a job in redis
+func (RedisJobStore) CancelJob(jobID string) error {
+	return redisCancelJob(jobID)
+}
+
+// redisFound translates a missing or cleared redis value into
+// errJobNotFound.
+func redisFound(val string, err error) (string, error) {
+	if (err != nil && err.Error() == "redis: nil") || (err == nil && val == "") {
+		return "", errJobNotFound
+	}
+	return val, err
+}
+
+// MemoryJobStore keeps jobs in memory.  It suits a single instance of
+// bf-handle with no redis, but its jobs last only as long as that
+// instance does, and finished jobs only for memoryJobTTL.
+type MemoryJobStore struct {
+	mutex    sync.Mutex
+	pending  []string
+	retries  []memoryRetry
+	running  map[string]bool
+	leases   map[string]jobLease
+	dead     []string
+	attempts map[string]int
+	inputs   map[string]string
+	meta     map[string]jobMeta
+	sched    *laneScheduler
+	status   map[string]string
+	results  map[string]string
+	finished map[string]time.Time
+}
+
+// memoryRetry is a job waiting to be retried
+type memoryRetry struct {
+	jobID string
+	at    time.Time
+}
+
+// NewMemoryJobStore returns an empty MemoryJobStore
+func NewMemoryJobStore() *MemoryJobStore {
+	return &MemoryJobStore{
+		running:  make(map[string]bool),
+		leases:   make(map[string]jobLease),
+		attempts: make(map[string]int),
+		inputs:   make(map[string]string),
+		meta:     make(map[string]jobMeta),
+		sched:    newLaneScheduler(),
+		status:   make(map[string]string),
+		results:  make(map[string]string),
+		finished: make(map[string]time.Time)}
+}
+
+// memoryJobTTL is how long a MemoryJobStore keeps the status and results
+// of a job once it has succeeded, failed or been cancelled.
+const memoryJobTTL = time.Hour
+
+// evict drops finished jobs that have outlived memoryJobTTL.  The caller
+// must hold the mutex.
+func (mjs *MemoryJobStore) evict() {
+	cutoff := time.Now().Add(-memoryJobTTL)
+	for jobID, finished := range mjs.finished {
+		if finished.Before(cutoff) {
+			delete(mjs.finished, jobID)
+			delete(mjs.status, jobID)
+			delete(mjs.results, jobID)
+			delete(mjs.attempts, jobID)
+		}
+	}
+}
+
+// AddJob queues a new job
+func (mjs *MemoryJobStore) AddJob(jobID, inp string, meta jobMeta) error {
+	mjs.mutex.Lock()
+	defer mjs.mutex.Unlock()
+	mjs.evict()
+	mjs.pending = append(mjs.pending, jobID)
+	mjs.inputs[jobID] = inp
+	mjs.meta[jobID] = meta
+	mjs.status[jobID] = jobPending
+	return nil
+}
+
+// TakeJob takes the next pending job
+func (mjs *MemoryJobStore) TakeJob(owner string, until time.Time) (string, string, int, error) {
+	mjs.mutex.Lock()
+	defer mjs.mutex.Unlock()
+	now := time.Now()
+	waiting := mjs.retries[:0]
+	for _, retry := range mjs.retries {
+		if retry.at.After(now) {
+			waiting = append(waiting, retry)
+		} else {
+			mjs.pending = append(mjs.pending, retry.jobID)
+		}
+	}
+	mjs.retries = waiting
+	pending, running := mjs.queue()
+	inx := mjs.sched.pick(pending, running)
+	if inx < 0 {
+		return "", "", 0, nil
+	}
+	jobID := mjs.pending[inx]
+	mjs.pending = append(mjs.pending[:inx], mjs.pending[inx+1:]...)
+	mjs.running[jobID] = true
+	mjs.leases[jobID] = jobLease{Owner: owner, Expires: until}
+	mjs.attempts[jobID]++
+	mjs.status[jobID] = jobStatus{Status: "Running", Attempt: mjs.attempts[jobID], Owner: owner}.String()
+	return jobID, mjs.inputs[jobID], mjs.attempts[jobID], nil
+}
+
+// queue gathers the pending jobs, oldest first, and the number of jobs
+// each submitter has running, for the scheduler
+func (mjs *MemoryJobStore) queue() ([]queuedJob, map[string]int) {
+	pending := make([]queuedJob, len(mjs.pending))
+	for inx, jobID := range mjs.pending {
+		pending[inx] = queuedJob{jobID: jobID, meta: mjs.meta[jobID]}
+	}
+	running := make(map[string]int)
+	for jobID := range mjs.running {
+		running[mjs.meta[jobID].Submitter]++
+	}
+	return pending, running
+}
+
+// Heartbeat renews a job's lease
+func (mjs *MemoryJobStore) Heartbeat(jobID, owner string, until time.Time) error {
+	mjs.mutex.Lock()
+	defer mjs.mutex.Unlock()
+	if lease, ok := mjs.leases[jobID]; !ok || lease.Owner != owner {
+		return errLeaseLost
+	}
+	mjs.leases[jobID] = jobLease{Owner: owner, Expires: until}
+	return nil
+}
+
+// ExpiredJobs lists the running jobs whose leases have expired
+func (mjs *MemoryJobStore) ExpiredJobs() ([]string, error) {
+	mjs.mutex.Lock()
+	defer mjs.mutex.Unlock()
+	var expired []string
+	now := time.Now()
+	for jobID := range mjs.running {
+		if mjs.leases[jobID].Expires.Before(now) {
+			expired = append(expired, jobID)
+		}
+	}
+	return expired, nil
+}
+
+// ReclaimJob takes a running job off the queue
+func (mjs *MemoryJobStore) ReclaimJob(jobID string) (string, int, error) {
+	mjs.mutex.Lock()
+	defer mjs.mutex.Unlock()
+	if !mjs.running[jobID] {
+		return "", 0, errJobNotFound
+	}
+	delete(mjs.running, jobID)
+	delete(mjs.leases, jobID)
+	return mjs.inputs[jobID], mjs.attempts[jobID], nil
+}
+
+// ownsRun reports whether a job is still leased to the given owner.  An
+// empty owner stands for a job that has already been reclaimed.
+func (mjs *MemoryJobStore) ownsRun(jobID, owner string) bool {
+	return owner == "" || (mjs.running[jobID] && mjs.leases[jobID].Owner == owner)
+}
+
+// endRun clears a job's running state, once it is done with for now
+func (mjs *MemoryJobStore) endRun(jobID string) {
+	delete(mjs.running, jobID)
+	delete(mjs.leases, jobID)
+	delete(mjs.inputs, jobID)
+}
+
+// DoneJob records a job's output, unless the job was cancelled
+func (mjs *MemoryJobStore) DoneJob(jobID, owner, outp string) error {
+	mjs.mutex.Lock()
+	defer mjs.mutex.Unlock()
+	if mjs.status[jobID] == jobCancelled {
+		return nil
+	}
+	if !mjs.ownsRun(jobID, owner) {
+		return errLeaseLost
+	}
+	mjs.endRun(jobID)
+	delete(mjs.meta, jobID)
+	mjs.results[jobID] = outp
+	mjs.status[jobID] = jobStatus{Status: "Success", Attempt: mjs.attempts[jobID]}.String()
+	mjs.finished[jobID] = time.Now()
+	return nil
+}
+
+// ErrorJob records a job's error, unless the job was cancelled
+func (mjs *MemoryJobStore) ErrorJob(jobID, owner, errStr string) error {
+	mjs.mutex.Lock()
+	defer mjs.mutex.Unlock()
+	if mjs.status[jobID] == jobCancelled {
+		return nil
+	}
+	if !mjs.ownsRun(jobID, owner) {
+		return errLeaseLost
+	}
+	mjs.endRun(jobID)
+	delete(mjs.meta, jobID)
+	mjs.status[jobID] = jobErrorStatus("process failure", errStr, mjs.attempts[jobID]).String()
+	mjs.finished[jobID] = time.Now()
+	return nil
+}
+
+// RetryJob queues a failed job to be run again, unless it was cancelled
+func (mjs *MemoryJobStore) RetryJob(jobID, owner, inp, errStr string, at time.Time) error {
+	mjs.mutex.Lock()
+	defer mjs.mutex.Unlock()
+	if mjs.status[jobID] == jobCancelled {
+		return nil
+	}
+	if !mjs.ownsRun(jobID, owner) {
+		return errLeaseLost
+	}
+	mjs.endRun(jobID)
+	mjs.retries = append(mjs.retries, memoryRetry{jobID: jobID, at: at})
+	mjs.inputs[jobID] = inp
+	mjs.status[jobID] = jobRetryStatus(errStr, mjs.attempts[jobID], at)
+	return nil
+}
+
+// DeadJob adds a failed job to the dead-letter list, unless it was
+// cancelled
+func (mjs *MemoryJobStore) DeadJob(jobID, owner, inp, errStr string) error {
+	mjs.mutex.Lock()
+	defer mjs.mutex.Unlock()
+	if mjs.status[jobID] == jobCancelled {
+		return nil
+	}
+	if !mjs.ownsRun(jobID, owner) {
+		return errLeaseLost
+	}
+	mjs.endRun(jobID)
+	mjs.dead = append(mjs.dead, jobID)
+	mjs.inputs[jobID] = inp
+	mjs.status[jobID] = jobDeadStatus(errStr, mjs.attempts[jobID])
+	return nil
+}
+
+// DeadJobs lists the dead-letter list
+func (mjs *MemoryJobStore) DeadJobs() ([]string, error) {
+	mjs.mutex.Lock()
+	defer mjs.mutex.Unlock()
+	return append([]string{}, mjs.dead...), nil
+}
+
+// RequeueJob moves a job from the dead-letter list to the queue
+func (mjs *MemoryJobStore) RequeueJob(jobID string) error {
+	mjs.mutex.Lock()
+	defer mjs.mutex.Unlock()
+	if !removeJobID(&mjs.dead, jobID) {
+		return errJobNotFound
+	}
+	mjs.pending = append(mjs.pending, jobID)
+	delete(mjs.attempts, jobID)
+	mjs.status[jobID] = jobPending
+	return nil
+}
+
+// Status returns a job's status
+func (mjs *MemoryJobStore) Status(jobID string) (string, error) {
+	mjs.mutex.Lock()
+	defer mjs.mutex.Unlock()
+	if status, ok := mjs.status[jobID]; ok {
+		return status, nil
+	}
+	return "", errJobNotFound
+}
+
+// QueuePosition works out where a job stands in the queue
+func (mjs *MemoryJobStore) QueuePosition(jobID string) (int, error) {
+	mjs.mutex.Lock()
+	defer mjs.mutex.Unlock()
+	pending, running := mjs.queue()
+	return mjs.sched.queuePosition(jobID, pending, running), nil
+}
+
+// Results returns a job's output
+func (mjs *MemoryJobStore) Results(jobID string) (string, error) {
+	mjs.mutex.Lock()
+	defer mjs.mutex.Unlock()
+	if outp, ok := mjs.results[jobID]; ok {
+		return outp, nil
+	}
+	return "", errJobNotFound
+}
+
+// CancelJob cancels a job that has not yet finished
+func (mjs *MemoryJobStore) CancelJob(jobID string) error {
+	mjs.mutex.Lock()
+	defer mjs.mutex.Unlock()
+	status, ok := mjs.status[jobID]
+	if !ok {
+		return errJobNotFound
+	}
+	switch parseJobStatus(status).Status {
+	case "Pending", "Running":
+	case "Cancelled":
+		return nil
+	default:
+		return errJobFinished
+	}
+	removeJobID(&mjs.pending, jobID)
+	for inx, retry := range mjs.retries {
+		if retry.jobID == jobID {
+			mjs.retries = append(mjs.retries[:inx], mjs.retries[inx+1:]...)
+			break
+		}
+	}
+	mjs.endRun(jobID)
+	delete(mjs.meta, jobID)
+	mjs.status[jobID] = jobCancelled
+	mjs.finished[jobID] = time.Now()
+	return nil
+}
+
+// removeJobID removes the first instance of jobID from the list, and
+// reports whether there was one.
+func removeJobID(jobIDs *[]string, jobID string) bool {
+	for inx, listID := range *jobIDs {
+		if listID == jobID {
+			*jobIDs = append((*jobIDs)[:inx], (*jobIDs)[inx+1:]...)
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,200 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bf
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"time"
+
+	"github.com/venicegeo/pzsvc-lib"
+)
+
+/*
+Each running asynch job is leased to the instance of bf-handle that is
+running it.  The worker renews the lease with a heartbeat for as long as it
+works on the job.  Every instance runs a reaper that looks for running jobs
+whose leases have run out, which means that whoever was running them has
+crashed or lost touch, and puts them through the job's retry policy as
+"interrupted" failures.  Jobs with live leases are left alone, so an instance
+that restarts does not disturb jobs that other instances are running.  A
+worker that finds its lease gone abandons the job, since someone else may
+already be running it again.
+
+Reaping is safe with several instances at once: only one reaper can reclaim
+any given job.
+*/
+
+var (
+	leaseDuration     = 2 * time.Minute  // how long a lease lasts without a heartbeat
+	heartbeatInterval = 30 * time.Second // how often workers renew their leases
+	reapInterval      = time.Minute      // how often the reaper looks for expired leases
+)
+
+const leaseLoc = "bf-handle:asynchLease:"
+
+var errLeaseLost = errors.New("lease lost")
+
+// redisHeartbeatScript renews a lease, so long as it still belongs to the
+// given owner, returning -1 if it does not.
+// KEYS: lease
+// ARGV: owner, new lease
+const redisHeartbeatScript = `
+local lease = redis.call("get", KEYS[1])
+if not lease or cjson.decode(lease).owner ~= ARGV[1] then return -1 end
+redis.call("set", KEYS[1], ARGV[2])
+return 1`
+
+// instanceID identifies this instance of bf-handle as the owner of the
+// jobs that it runs.
+var instanceID = newInstanceID()
+
+func newInstanceID() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "bf-handle"
+	}
+	uuid, _ := pzsvc.PsuUUID()
+	if len(uuid) > 8 {
+		uuid = uuid[:8]
+	}
+	return host + "-" + uuid
+}
+
+// jobLease records who is running a job, and until when they are
+// assumed to be.
+type jobLease struct {
+	Owner   string    `json:"owner"`
+	Expires time.Time `json:"expires"`
+}
+
+func (lease jobLease) String() string {
+	byts, _ := json.Marshal(lease)
+	return string(byts)
+}
+
+// runReaper reaps jobs with expired leases every reapInterval, for as long
+// as bf-handle runs.
+func runReaper() {
+	for {
+		reapJobs()
+		time.Sleep(reapInterval)
+	}
+}
+
+// reapJobs reclaims every running job whose lease has expired, and retries
+// or fails it according to its retry policy.
+func reapJobs() {
+	jobIDs, err := jobStore.ExpiredJobs()
+	if err != nil {
+		log.Print(pzsvc.TraceStr("Could not check job leases: " + err.Error()))
+		return
+	}
+	for _, jobID := range jobIDs {
+		inpStr, attempt, err := jobStore.ReclaimJob(jobID)
+		if err == errJobNotFound {
+			continue // finished, or reclaimed by some other reaper
+		}
+		if err != nil {
+			log.Print(pzsvc.TraceStr("Could not reclaim job " + jobID + ": " + err.Error()))
+			continue
+		}
+		errStr := "bf-handle stopped renewing its lease on the job, and may have crashed."
+		log.Printf("Reaping job %v after attempt %v", jobID, attempt)
+		policy, err := jobRetryPolicy(inpStr)
+		if err != nil {
+			if err = jobStore.ErrorJob(jobID, "", errStr); err != nil {
+				log.Print(pzsvc.TraceStr("Could not fail job " + jobID + ": " + err.Error()))
+			}
+			continue
+		}
+		failAsynchJob(jobID, "", inpStr, attempt, policy, failInterrupted, errStr)
+	}
+}
+
+// redisLease reads a job's lease, returning nil if there is none.
+func redisLease(jobID string) (*jobLease, error) {
+	leaseObj := redisCli.Get(leaseLoc + jobID)
+	if leaseObj.Err() != nil {
+		if leaseObj.Err().Error() == "redis: nil" {
+			return nil, nil
+		}
+		return nil, leaseObj.Err()
+	}
+	if leaseObj.Val() == "" {
+		return nil, nil
+	}
+	var lease jobLease
+	if err := json.Unmarshal([]byte(leaseObj.Val()), &lease); err != nil {
+		return nil, err
+	}
+	return &lease, nil
+}
+
+// redisHeartbeat renews a lease, so long as it still belongs to the
+// given owner.
+func redisHeartbeat(jobID, owner string, until time.Time) error {
+	lease := jobLease{Owner: owner, Expires: until}.String()
+	return redisLeaseResult(redisCli.Eval(redisHeartbeatScript, []string{leaseLoc + jobID}, []string{owner, lease}).Result())
+}
+
+// redisLeaseResult reads the reply of a script that checks a lease, which
+// is -1 if the lease has been lost.
+func redisLeaseResult(res interface{}, err error) error {
+	if err == nil && res == int64(-1) {
+		return errLeaseLost
+	}
+	return err
+}
+
+// redisExpiredJobs lists the running jobs whose leases have expired.  Jobs
+// are leased as they are taken, so a running job with no lease at all can
+// only be one left over from before leases, and counts as expired.
+func redisExpiredJobs() ([]string, error) {
+	runningObj := redisCli.LRange(runningLoc, 0, -1)
+	if runningObj.Err() != nil {
+		return nil, runningObj.Err()
+	}
+	var expired []string
+	now := time.Now()
+	for _, jobID := range runningObj.Val() {
+		lease, err := redisLease(jobID)
+		if err != nil {
+			return nil, err
+		}
+		if lease == nil || lease.Expires.Before(now) {
+			expired = append(expired, jobID)
+		}
+	}
+	return expired, nil
+}
+
+// redisReclaimJob takes a running job off the running queue, along with
+// its lease, and returns its input and attempts.  Removal from the queue
+// is atomic, so only one caller can reclaim any given job.
+func redisReclaimJob(jobID string) (string, int, error) {
+	remObj := redisCli.LRem(runningLoc, 0, jobID)
+	if remObj.Err() != nil {
+		return "", 0, remObj.Err()
+	}
+	if remObj.Val() == 0 {
+		return "", 0, errJobNotFound
+	}
+	redisCli.Del(leaseLoc + jobID)
+	inpObj := redisCli.Get(inpLoc + jobID)
+	return inpObj.Val(), redisAttempts(jobID), inpObj.Err()
+}
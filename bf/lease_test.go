@@ -0,0 +1,112 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bf
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReapJobs(t *testing.T) {
+	defer SetJobStore(jobStore)
+	store := NewMemoryJobStore()
+	SetJobStore(store)
+
+	// a is running on a live peer, b on one that has gone quiet
+	store.AddJob("a", `{"algoType":"ndwi"}`, jobMeta{})
+	store.AddJob("b", `{"algoType":"ndwi","retry":{"backoff":0.01}}`, jobMeta{})
+	store.AddJob("c", `{"algoType":"ndwi","retry":{"maxAttempts":1}}`, jobMeta{})
+	store.TakeJob("peer", time.Now().Add(time.Minute))
+	store.TakeJob("gone", time.Now().Add(-time.Second))
+	store.TakeJob("gone", time.Now().Add(-time.Second))
+
+	expired, _ := store.ExpiredJobs()
+	if len(expired) != 2 {
+		t.Errorf(`TestReapJobs: unexpected expired jobs %v.`, expired)
+	}
+	reapJobs()
+	status, _ := store.Status("a")
+	if parsed := parseJobStatus(status); parsed.Status != "Running" || parsed.Owner != "peer" {
+		t.Errorf(`TestReapJobs: reaped a job with a live lease: %s.`, status)
+	}
+	status, _ = store.Status("b")
+	if parsed := parseJobStatus(status); parsed.Status != "Pending" || parsed.RetryAt == "" {
+		t.Errorf(`TestReapJobs: expired job was not requeued: %s.`, status)
+	}
+	status, _ = store.Status("c")
+	if parsed := parseJobStatus(status); parsed.Status != "Error" || !parsed.DeadLetter {
+		t.Errorf(`TestReapJobs: expired job on its last attempt was not failed: %s.`, status)
+	}
+	if _, _, err := store.ReclaimJob("b"); err != errJobNotFound {
+		t.Error(`TestReapJobs: reclaimed a job twice.`)
+	}
+
+	// the quiet instance wakes up, and finds out that it lost the job
+	if err := store.Heartbeat("b", "gone", time.Now().Add(time.Minute)); err != errLeaseLost {
+		t.Error(`TestReapJobs: renewed a lease that was lost.`)
+	}
+	if err := store.Heartbeat("a", "gone", time.Now().Add(time.Minute)); err != errLeaseLost {
+		t.Error(`TestReapJobs: renewed someone else's lease.`)
+	}
+	if err := store.Heartbeat("a", "peer", time.Now().Add(time.Minute)); err != nil {
+		t.Error(`TestReapJobs: failed to renew a live lease.`)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	jobID, inp, attempt, _ := store.TakeJob("peer", time.Now().Add(time.Minute))
+	if jobID != "b" || inp != `{"algoType":"ndwi","retry":{"backoff":0.01}}` || attempt != 2 {
+		t.Errorf(`TestReapJobs: took %s/%s/%d rather than the reaped job.`, jobID, inp, attempt)
+	}
+
+	// the old run cannot finish or fail the job out from under the new one
+	if err := store.DoneJob("b", "gone", "outB"); err != errLeaseLost {
+		t.Errorf(`TestReapJobs: a run that lost its lease finished the job: %v.`, err)
+	}
+	if err := store.RetryJob("b", "gone", "inpB", "oops", time.Now()); err != errLeaseLost {
+		t.Errorf(`TestReapJobs: a run that lost its lease retried the job: %v.`, err)
+	}
+	status, _ = store.Status("b")
+	if parsed := parseJobStatus(status); parsed.Status != "Running" || parsed.Owner != "peer" {
+		t.Errorf(`TestReapJobs: the new run was disturbed: %s.`, status)
+	}
+	if err := store.DoneJob("b", "peer", "outB"); err != nil {
+		t.Errorf(`TestReapJobs: the new run could not finish: %v.`, err)
+	}
+}
+
+func TestStartJobHeartbeat(t *testing.T) {
+	defer SetJobStore(jobStore)
+	defer func(interval time.Duration) { heartbeatInterval = interval }(heartbeatInterval)
+	store := NewMemoryJobStore()
+	SetJobStore(store)
+	heartbeatInterval = time.Millisecond
+
+	store.AddJob("a", "inpA", jobMeta{})
+	store.TakeJob(instanceID, time.Now().Add(5*time.Millisecond))
+	ctx, endJob := startJob("a", instanceID)
+	defer endJob()
+	time.Sleep(20 * time.Millisecond)
+	if expired, _ := store.ExpiredJobs(); len(expired) != 0 || ctx.Err() != nil {
+		t.Error(`TestStartJobHeartbeat: lease was not kept alive.`)
+	}
+
+	// a reaper elsewhere decides that the job is dead
+	store.ReclaimJob("a")
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Error(`TestStartJobHeartbeat: job was not abandoned when its lease was lost.`)
+	}
+}
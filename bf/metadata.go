@@ -15,6 +15,7 @@
 package bf
 
 import (
+	"context"
 	"encoding/json"
 	"strconv"
 
@@ -26,11 +27,11 @@ import (
 // call, the output from a call to the tide service, and one of the geojson
 // features from the harvester.  It builds a map[string]string out of whichever of these
 // is available and returns the result.
-func getMeta(dataID, pzAddr, pzAuth string, inpTide *tideOut, feature *CatFeature) (map[string]string, error) {
+func getMeta(ctx context.Context, dataID, pzAddr, pzAuth string, inpTide *tideOut, feature *CatFeature, gw Gateway) (map[string]string, error) {
 	attMap := make(map[string]string)
 
 	if dataID != "" {
-		dataRes, err := pzsvc.GetFileMeta(dataID, pzAddr, pzAuth)
+		dataRes, err := gw.GetFileMeta(ctx, dataID, pzAddr, pzAuth)
 		if err != nil {
 			return nil, err
 		}
@@ -66,8 +67,8 @@ func getMeta(dataID, pzAddr, pzAuth string, inpTide *tideOut, feature *CatFeatur
 // dataId both to download the geojson file in question from S3  It then iterates through
 // all fo the features in the file and adds the given properties to each, before uploading
 // the file that results and returning the dataId from that upload.
-func addGeoFeatureMeta(dataID, pzAddr, pzAuth string, props map[string]string) (string, error) {
-	b, err := pzsvc.DownloadBytes(dataID, pzAddr, pzAuth)
+func addGeoFeatureMeta(ctx context.Context, dataID, pzAddr, pzAuth string, props map[string]string, gw Gateway) (string, error) {
+	b, err := gw.DownloadBytes(ctx, dataID, pzAddr, pzAuth)
 	var obj geojson.FeatureCollection
 	err = json.Unmarshal(b, &obj)
 	if err != nil {
@@ -89,7 +90,7 @@ func addGeoFeatureMeta(dataID, pzAddr, pzAuth string, props map[string]string) (
 	source := props["algoName"]
 	version := props["version"]
 
-	dataID, err = pzsvc.Ingest(fName, "geojson", pzAddr, source, version, pzAuth, b2, props)
+	dataID, err = gw.Ingest(ctx, fName, "geojson", pzAddr, source, version, pzAuth, b2, props)
 
 	return dataID, pzsvc.TraceErr(err)
 }
@@ -0,0 +1,310 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bf
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/venicegeo/geojson-go/geojson"
+	"github.com/venicegeo/pzsvc-lib"
+)
+
+/*
+The NDWI detector runs inside bf-handle.  It takes two bands - by default
+green and near infrared - and computes the normalized difference water index
+
+    ndwi = (b1 - b2) / (b1 + b2)
+
+for each pixel.  Water comes out high and land comes out low.  The index
+is thresholded, either at a fixed value or at the one that Otsu's method
+picks from its histogram, and the boundary between the two is traced
+with marching squares and returned as LineStrings.  Pixels that are zero
+or nodata in either band are left out, so image borders do not produce
+spurious shorelines.
+
+Parameters, given as algoParams on the request:
+- threshold: a number in [-1, 1], or "otsu" (the default)
+- minVertices: lines with fewer vertices than this are dropped as noise
+  (default 10)
+*/
+
+const ndwiDefaultMinVertices = 10
+
+// ndwiAlgo is the in-process NDWI shoreline detector.
+type ndwiAlgo struct{}
+
+func (ndwiAlgo) Bands() []string {
+	return []string{"green", "nir"}
+}
+
+// Command is empty, as ndwiAlgo is never run through pzsvc-exec.
+func (ndwiAlgo) Command(imgNames []string, attMap map[string]string) string {
+	return ""
+}
+
+func (ndwiAlgo) Outputs() []string {
+	return []string{`shoreline.geojson`}
+}
+
+// FeatureMeta is false so that the output goes through the same metadata
+// handling as that of pzsvc-ossim.
+func (ndwiAlgo) FeatureMeta() bool {
+	return false
+}
+
+func (ndwiAlgo) detect(images []*geoRaster, params map[string]string) (*geojson.FeatureCollection, error) {
+	var (
+		err         error
+		threshold   float64
+		minVertices = ndwiDefaultMinVertices
+	)
+	if len(images) != 2 {
+		return nil, pzsvc.ErrWithTrace(fmt.Sprintf("NDWI requires 2 images.  Received %d.", len(images)))
+	}
+	if images[0].width != images[1].width || images[0].height != images[1].height {
+		return nil, pzsvc.ErrWithTrace(fmt.Sprintf("NDWI bands differ in size: %dx%d and %dx%d.",
+			images[0].width, images[0].height, images[1].width, images[1].height))
+	}
+	if str := params["minVertices"]; str != "" {
+		if minVertices, err = strconv.Atoi(str); err != nil {
+			return nil, pzsvc.ErrWithTrace("Invalid minVertices: " + str)
+		}
+	}
+
+	index := ndwiIndex(images[0], images[1])
+	if str := params["threshold"]; str == "" || str == "otsu" {
+		threshold = otsuThreshold(index.data)
+	} else if threshold, err = strconv.ParseFloat(str, 64); err != nil || threshold < -1 || threshold > 1 {
+		return nil, pzsvc.ErrWithTrace("Threshold must be a number between -1 and 1, or \"otsu\".  Received " + str + ".")
+	}
+
+	result := geojson.NewFeatureCollection(nil)
+	for _, line := range traceContours(index, float32(threshold)) {
+		if len(line) < minVertices {
+			continue
+		}
+		coords := make([][]float64, len(line))
+		for inx, pt := range line {
+			lon, lat, err := index.toLonLat(pt[0], pt[1])
+			if err != nil {
+				return nil, err
+			}
+			coords[inx] = []float64{lon, lat}
+		}
+		props := map[string]interface{}{"ndwiThreshold": threshold}
+		result.Features = append(result.Features, geojson.NewFeature(geojson.NewLineString(coords), nil, props))
+	}
+	return result, nil
+}
+
+// ndwiIndex computes the normalized difference of the two bands, in a
+// raster of its own with the georeferencing of the first.
+func ndwiIndex(band1, band2 *geoRaster) *geoRaster {
+	result := *band1
+	result.data = make([]float32, len(band1.data))
+	nan := float32(math.NaN())
+	for inx := range result.data {
+		b1, b2 := band1.data[inx], band2.data[inx]
+		if b1 != b1 || b2 != b2 || b1 == 0 || b2 == 0 || b1+b2 == 0 {
+			result.data[inx] = nan
+			continue
+		}
+		result.data[inx] = (b1 - b2) / (b1 + b2)
+	}
+	return &result
+}
+
+// otsuThreshold picks the threshold that best separates the values in
+// [-1, 1] into two classes, by maximizing the between-class variance.
+func otsuThreshold(data []float32) float64 {
+	const bins = 256
+	var (
+		hist  [bins]float64
+		total float64
+		sum   float64
+	)
+	for _, val := range data {
+		if val != val {
+			continue
+		}
+		bin := int((float64(val) + 1) / 2 * bins)
+		if bin < 0 {
+			bin = 0
+		} else if bin >= bins {
+			bin = bins - 1
+		}
+		hist[bin]++
+		total++
+	}
+	if total == 0 {
+		return 0
+	}
+	for inx := 0; inx < bins; inx++ {
+		sum += float64(inx) * hist[inx]
+	}
+
+	var (
+		weightB, sumB, bestVar float64
+		bestInx                = bins / 2
+	)
+	for inx := 0; inx < bins; inx++ {
+		weightB += hist[inx]
+		if weightB == 0 {
+			continue
+		}
+		weightF := total - weightB
+		if weightF == 0 {
+			break
+		}
+		sumB += float64(inx) * hist[inx]
+		meanB := sumB / weightB
+		meanF := (sum - sumB) / weightF
+		if between := weightB * weightF * (meanB - meanF) * (meanB - meanF); between > bestVar {
+			bestVar = between
+			bestInx = inx
+		}
+	}
+	// the threshold sits at the upper edge of the best background bin
+	return float64(bestInx+1)/bins*2 - 1
+}
+
+// marchingSegments lists the edge pairs crossed in each marching squares
+// case, with edges numbered top, right, bottom, left.  The corner bits
+// are top-left 8, top-right 4, bottom-right 2 and bottom-left 1.  The
+// saddles (5 and 10) are given here for a center below the threshold,
+// and flipped when it is above.
+var marchingSegments = [16][][2]int{
+	{}, {{3, 2}}, {{2, 1}}, {{3, 1}},
+	{{0, 1}}, {{0, 1}, {3, 2}}, {{0, 2}}, {{3, 0}},
+	{{3, 0}}, {{0, 2}}, {{3, 0}, {2, 1}}, {{0, 1}},
+	{{3, 1}}, {{2, 1}}, {{3, 2}}, {},
+}
+
+// traceContours traces the lines along which the raster crosses the given
+// level, and returns them in pixel coordinates.  Lines that close on
+// themselves come back with the same first and last point.
+func traceContours(gr *geoRaster, level float32) [][][2]float64 {
+	var (
+		width = gr.width
+		segs  [][2]int
+	)
+	// Crossing points are identified by the pixel edge they lie on: the
+	// edge running right from pixel (col, row) is 2*(row*width+col), and
+	// the edge running down from it is one more than that.
+	hEdge := func(col, row int) int { return 2 * (row*width + col) }
+	vEdge := func(col, row int) int { return 2*(row*width+col) + 1 }
+
+	for row := 0; row+1 < gr.height; row++ {
+		for col := 0; col+1 < width; col++ {
+			tl, tr := gr.at(col, row), gr.at(col+1, row)
+			br, bl := gr.at(col+1, row+1), gr.at(col, row+1)
+			if tl != tl || tr != tr || br != br || bl != bl {
+				continue
+			}
+			cellCase := 0
+			if tl > level {
+				cellCase |= 8
+			}
+			if tr > level {
+				cellCase |= 4
+			}
+			if br > level {
+				cellCase |= 2
+			}
+			if bl > level {
+				cellCase |= 1
+			}
+			pairs := marchingSegments[cellCase]
+			if (cellCase == 5 || cellCase == 10) && (tl+tr+br+bl)/4 > level {
+				pairs = marchingSegments[15-cellCase]
+			}
+			edges := [4]int{hEdge(col, row), vEdge(col+1, row), hEdge(col, row+1), vEdge(col, row)}
+			for _, pair := range pairs {
+				segs = append(segs, [2]int{edges[pair[0]], edges[pair[1]]})
+			}
+		}
+	}
+
+	// edgePoint interpolates where along its edge the crossing lies
+	edgePoint := func(edge int) [2]float64 {
+		col, row := (edge/2)%width, (edge/2)/width
+		v0 := gr.at(col, row)
+		var v1 float32
+		if edge%2 == 0 {
+			v1 = gr.at(col+1, row)
+		} else {
+			v1 = gr.at(col, row+1)
+		}
+		frac := 0.5
+		if v1 != v0 {
+			frac = float64((level - v0) / (v1 - v0))
+		}
+		if edge%2 == 0 {
+			return [2]float64{float64(col) + frac + 0.5, float64(row) + 0.5}
+		}
+		return [2]float64{float64(col) + 0.5, float64(row) + frac + 0.5}
+	}
+
+	// join the segments up into lines
+	ends := make(map[int][]int, 2*len(segs))
+	for inx, seg := range segs {
+		ends[seg[0]] = append(ends[seg[0]], inx)
+		ends[seg[1]] = append(ends[seg[1]], inx)
+	}
+	used := make([]bool, len(segs))
+	extend := func(line []int) []int {
+		for {
+			last := line[len(line)-1]
+			next := -1
+			for _, segInx := range ends[last] {
+				if !used[segInx] {
+					next = segInx
+					break
+				}
+			}
+			if next < 0 {
+				return line
+			}
+			used[next] = true
+			if segs[next][0] == last {
+				line = append(line, segs[next][1])
+			} else {
+				line = append(line, segs[next][0])
+			}
+		}
+	}
+
+	var result [][][2]float64
+	for inx, seg := range segs {
+		if used[inx] {
+			continue
+		}
+		used[inx] = true
+		line := extend([]int{seg[0], seg[1]})
+		for left, right := 0, len(line)-1; left < right; left, right = left+1, right-1 {
+			line[left], line[right] = line[right], line[left]
+		}
+		line = extend(line)
+
+		points := make([][2]float64, len(line))
+		for ptInx, edge := range line {
+			points[ptInx] = edgePoint(edge)
+		}
+		result = append(result, points)
+	}
+	return result
+}
@@ -0,0 +1,255 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bf
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"math"
+	"testing"
+
+	"github.com/venicegeo/geojson-go/geojson"
+)
+
+// buildTestTIFF writes a little-endian, single-strip, 16-bit GeoTIFF in
+// UTM zone 18N, 30m pixels, with its top left corner at (600000, 4000000).
+func buildTestTIFF(width, height int, vals []uint16, deflate bool) []byte {
+	raw := new(bytes.Buffer)
+	for row := 0; row < height; row++ {
+		// horizontal differencing, so that the predictor gets exercised
+		for col := 0; col < width; col++ {
+			val := vals[row*width+col]
+			if deflate && col > 0 {
+				val -= vals[row*width+col-1]
+			}
+			binary.Write(raw, binary.LittleEndian, val)
+		}
+	}
+	strip := raw.Bytes()
+	compression, predictor := uint32(1), uint32(1)
+	if deflate {
+		zbuf := new(bytes.Buffer)
+		zw := zlib.NewWriter(zbuf)
+		zw.Write(strip)
+		zw.Close()
+		strip = zbuf.Bytes()
+		compression, predictor = 8, 2
+	}
+
+	type entry struct {
+		tag, typ uint16
+		vals     interface{}
+	}
+	geoKeys := []uint16{1, 1, 0, 2, 1024, 0, 1, 1, 3072, 0, 1, 32618}
+	entries := []entry{
+		{256, 4, []uint32{uint32(width)}},
+		{257, 4, []uint32{uint32(height)}},
+		{258, 3, []uint16{16}},
+		{259, 3, []uint16{uint16(compression)}},
+		{273, 4, []uint32{0}}, // patched below
+		{277, 3, []uint16{1}},
+		{278, 4, []uint32{uint32(height)}},
+		{279, 4, []uint32{uint32(len(strip))}},
+		{317, 3, []uint16{uint16(predictor)}},
+		{33550, 12, []float64{30, 30, 0}},
+		{33922, 12, []float64{0, 0, 0, 600000, 4000000, 0}},
+		{34735, 3, geoKeys},
+	}
+
+	// layout: header, IFD, out-of-line values, strip
+	ifdSize := 2 + 12*len(entries) + 4
+	extra := new(bytes.Buffer)
+	ifd := new(bytes.Buffer)
+	binary.Write(ifd, binary.LittleEndian, uint16(len(entries)))
+	var stripOffsetPos int
+	for _, ent := range entries {
+		valBuf := new(bytes.Buffer)
+		binary.Write(valBuf, binary.LittleEndian, ent.vals)
+		count := valBuf.Len() / []int{0, 1, 1, 2, 4, 8, 1, 1, 2, 4, 8, 4, 8}[ent.typ]
+		binary.Write(ifd, binary.LittleEndian, ent.tag)
+		binary.Write(ifd, binary.LittleEndian, ent.typ)
+		binary.Write(ifd, binary.LittleEndian, uint32(count))
+		if ent.tag == 273 {
+			stripOffsetPos = ifd.Len()
+		}
+		if valBuf.Len() <= 4 {
+			val := make([]byte, 4)
+			copy(val, valBuf.Bytes())
+			ifd.Write(val)
+		} else {
+			binary.Write(ifd, binary.LittleEndian, uint32(8+ifdSize+extra.Len()))
+			extra.Write(valBuf.Bytes())
+		}
+	}
+	binary.Write(ifd, binary.LittleEndian, uint32(0))
+	ifdByts := ifd.Bytes()
+	binary.LittleEndian.PutUint32(ifdByts[stripOffsetPos:], uint32(8+ifdSize+extra.Len()))
+
+	out := new(bytes.Buffer)
+	out.WriteString("II")
+	binary.Write(out, binary.LittleEndian, uint16(42))
+	binary.Write(out, binary.LittleEndian, uint32(8))
+	out.Write(ifdByts)
+	out.Write(extra.Bytes())
+	out.Write(strip)
+	return out.Bytes()
+}
+
+func TestReadGeoTIFF(t *testing.T) {
+	vals := []uint16{1, 2, 3, 4, 500, 600, 700, 65535}
+	for _, deflate := range []bool{false, true} {
+		gr, err := readGeoTIFF(buildTestTIFF(4, 2, vals, deflate))
+		if err != nil {
+			t.Fatal(`TestReadGeoTIFF: failed to read: ` + err.Error())
+		}
+		if gr.width != 4 || gr.height != 2 || gr.epsg != 32618 {
+			t.Errorf(`TestReadGeoTIFF: unexpected header values %d %d %d.`, gr.width, gr.height, gr.epsg)
+		}
+		for inx, val := range vals {
+			if gr.data[inx] != float32(val) {
+				t.Errorf(`TestReadGeoTIFF: pixel %d is %v, not %v (deflate %v).`, inx, gr.data[inx], val, deflate)
+			}
+		}
+		if gr.transform[0] != 600000 || gr.transform[3] != 4000000 || gr.transform[1] != 30 || gr.transform[5] != -30 {
+			t.Errorf(`TestReadGeoTIFF: unexpected transform %v.`, gr.transform)
+		}
+	}
+	if _, err := readGeoTIFF([]byte("not a tiff at all")); err == nil {
+		t.Error(`TestReadGeoTIFF: read something that was not a TIFF.`)
+	}
+
+	// headers that claim more than there is, patching the width, length
+	// and rows per strip of the first three entries
+	for _, dims := range [][2]uint32{{100000, 100000}, {4000, 4000}} {
+		for _, deflate := range []bool{false, true} {
+			byts := buildTestTIFF(4, 2, vals, deflate)
+			binary.LittleEndian.PutUint32(byts[18:], dims[0])
+			binary.LittleEndian.PutUint32(byts[30:], dims[1])
+			binary.LittleEndian.PutUint32(byts[90:], dims[1])
+			if _, err := readGeoTIFF(byts); err == nil {
+				t.Errorf(`TestReadGeoTIFF: read a %dx%d TIFF from %d bytes (deflate %v).`, dims[0], dims[1], len(byts), deflate)
+			}
+		}
+	}
+}
+
+func TestTiffLZW(t *testing.T) {
+	// "ABABABA" as 9-bit codes: A B 258(AB) 260(ABA) EOI
+	codes := []int{256, 65, 66, 258, 260, 257}
+	var (
+		buf    []byte
+		bitBuf uint64
+		bitCnt uint
+	)
+	for _, code := range codes {
+		bitBuf = bitBuf<<9 | uint64(code)
+		bitCnt += 9
+		for bitCnt >= 8 {
+			buf = append(buf, byte(bitBuf>>(bitCnt-8)))
+			bitCnt -= 8
+		}
+	}
+	if bitCnt > 0 {
+		buf = append(buf, byte(bitBuf<<(8-bitCnt)))
+	}
+	out, err := tiffLZW(buf, 100)
+	if err != nil || string(out) != "ABABABA" {
+		t.Errorf(`TestTiffLZW: got %q, %v.`, out, err)
+	}
+}
+
+func TestUTMToLatLon(t *testing.T) {
+	tests := []struct {
+		easting, northing float64
+		zone              int
+		north             bool
+		lat, lon          float64
+	}{
+		{500000, 4427757.219, 18, true, 40, -75},
+		{663256.399, 3929982.914, 18, true, 35.5, -73.2},
+		{333568.941, 6247473.337, 56, false, -33.9, 151.2},
+	}
+	for _, test := range tests {
+		lat, lon := utmToLatLon(test.easting, test.northing, test.zone, test.north)
+		if math.Abs(lat-test.lat) > 1e-6 || math.Abs(lon-test.lon) > 1e-6 {
+			t.Errorf(`TestUTMToLatLon: expected (%v, %v), got (%v, %v).`, test.lat, test.lon, lat, lon)
+		}
+	}
+}
+
+func TestNDWIDetect(t *testing.T) {
+	const width, height = 20, 10
+	green := make([]uint16, width*height)
+	nir := make([]uint16, width*height)
+	for row := 0; row < height; row++ {
+		for col := 0; col < width; col++ {
+			if col < width/2 { // water
+				green[row*width+col], nir[row*width+col] = 1000, 200
+			} else {
+				green[row*width+col], nir[row*width+col] = 300, 900
+			}
+		}
+	}
+	greenImg, err := readGeoTIFF(buildTestTIFF(width, height, green, true))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	nirImg, err := readGeoTIFF(buildTestTIFF(width, height, nir, false))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	for _, params := range []map[string]string{nil, {"threshold": "0"}} {
+		fc, err := ndwiAlgo{}.detect([]*geoRaster{greenImg, nirImg}, params)
+		if err != nil {
+			t.Fatal(`TestNDWIDetect: failed to detect: ` + err.Error())
+		}
+		if len(fc.Features) != 1 {
+			t.Fatalf(`TestNDWIDetect: expected one shoreline, got %d.`, len(fc.Features))
+		}
+		// the boundary runs down the middle of the image, between the
+		// pixel centers at eastings of 600285 and 600315.  Allow another
+		// pixel either side for grid convergence.
+		_, minLon := utmToLatLon(600255, 4000000-30*5, 18, true)
+		_, maxLon := utmToLatLon(600345, 4000000-30*5, 18, true)
+		line, ok := fc.Features[0].Geometry.(*geojson.LineString)
+		if !ok {
+			t.Fatalf(`TestNDWIDetect: expected a LineString, got a %T.`, fc.Features[0].Geometry)
+		}
+		if len(line.Coordinates) != height {
+			t.Errorf(`TestNDWIDetect: expected %d vertices, got %d.`, height, len(line.Coordinates))
+		}
+		for _, coord := range line.Coordinates {
+			if coord[0] < minLon || coord[0] > maxLon {
+				t.Errorf(`TestNDWIDetect: vertex %v is off the boundary (%v to %v).`, coord, minLon, maxLon)
+			}
+		}
+	}
+
+	if _, err = (ndwiAlgo{}).detect([]*geoRaster{greenImg}, nil); err == nil {
+		t.Error(`TestNDWIDetect: passed with only one band.`)
+	}
+	if _, err = (ndwiAlgo{}).detect([]*geoRaster{greenImg, nirImg}, map[string]string{"threshold": "2"}); err == nil {
+		t.Error(`TestNDWIDetect: passed with an out of range threshold.`)
+	}
+}
+
+func TestOtsuThreshold(t *testing.T) {
+	data := []float32{-0.6, -0.55, -0.5, 0.5, 0.55, 0.6, float32(math.NaN())}
+	if threshold := otsuThreshold(data); threshold < -0.5 || threshold >= 0.5 {
+		t.Errorf(`TestOtsuThreshold: threshold %v does not separate the classes.`, threshold)
+	}
+}
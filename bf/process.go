@@ -15,12 +15,15 @@
 package bf
 
 import (
+	"context"
 	"encoding/json"
-	//"errors"
 	"fmt"
+	"log"
 	"net/http"
 	"os"
+	"runtime/debug"
 	"strconv"
+	"strings"
 
 	"github.com/venicegeo/geojson-go/geojson"
 	"github.com/venicegeo/pzsvc-exec/pzse"
@@ -34,40 +37,44 @@ Various TODOs:
 */
 
 type gsInpStruct struct {
-	AlgoType   string           `json:"algoType"`                // API for the shoreline algorithm
-	AlgoURL    string           `json:"svcURL"`                  // URL for the shoreline algorithm
-	BndMrgType string           `json:"bandMergeType,omitempty"` // API for the bandmerge/rgb service (optional)
-	BndMrgURL  string           `json:"bandMergeURL,omitempty"`  // URL for the bandmerge/rgb service (optional)
-	TideURL    string           `json:"tideURL,omitempty"`       // URL for the tide service (optional)
-	MetaJSON   *CatFeature      `json:"metaDataJSON,omitempty"`  // JSON block from Image Catalog
-	MetaURL    string           `json:"metaDataURL,omitempty"`   // URL to call to get JSON block
-	metaFeat   *geojson.Feature ``                               // in place to maintain support with bulk-builds
-	Bands      []string         `json:"bands"`                   // names of bands to feed into the shoreline algorithm
-	PzAuth     string           `json:"pzAuthToken,omitempty"`   // Auth string for this Pz instance
-	PzAddr     string           `json:"pzAddr"`                  // gateway URL for this Pz instance
-	DbAuth     string           `json:"dbAuthToken,omitempty"`   // Auth string for the initial image database
-	LGroupID   string           `json:"lGroupId"`                // UUID string for the target geoserver layer group
-	JobName    string           `json:"jobName"`                 // Arbitrary user-defined string to aid in later reference
+	AlgoType   string            `json:"algoType"`                // API for the shoreline algorithm
+	AlgoURL    string            `json:"svcURL"`                  // URL for the shoreline algorithm
+	BndMrgType string            `json:"bandMergeType,omitempty"` // API for the bandmerge/rgb service (optional)
+	BndMrgURL  string            `json:"bandMergeURL,omitempty"`  // URL for the bandmerge/rgb service (optional)
+	TideURL    string            `json:"tideURL,omitempty"`       // URL for the tide service (optional)
+	MetaJSON   *CatFeature       `json:"metaDataJSON,omitempty"`  // JSON block from Image Catalog
+	MetaURL    string            `json:"metaDataURL,omitempty"`   // URL to call to get JSON block
+	metaFeat   *geojson.Feature  ``                               // in place to maintain support with bulk-builds
+	Bands      []string          `json:"bands"`                   // names of bands to feed into the shoreline algorithm
+	PzAuth     string            `json:"pzAuthToken,omitempty"`   // Auth string for this Pz instance
+	PzAddr     string            `json:"pzAddr"`                  // gateway URL for this Pz instance
+	DbAuth     string            `json:"dbAuthToken,omitempty"`   // Auth string for the initial image database
+	LGroupID   string            `json:"lGroupId"`                // UUID string for the target geoserver layer group
+	JobName    string            `json:"jobName"`                 // Arbitrary user-defined string to aid in later reference
+	AlgoParams map[string]string `json:"algoParams,omitempty"`    // Tuning parameters for in-process algorithms (optional)
 }
 
 type gsOutpStruct struct {
-	ShoreDataID   string      `json:"shoreDataID"`
-	ShoreDeplID   string      `json:"shoreDeplID"`
-	RGBloc        string      `json:"rgbLoc"`
-	Geometry      interface{} `json:"geometry"`
-	AlgoType      string      `json:"algoType"`
-	SceneCapDate  string      `json:"sceneCaptureDate"`
-	SceneID       string      `json:"sceneId"`
-	JobName       string      `json:"resultName"`
-	SensorName    string      `json:"sensorName"`
-	AlgoURL       string      `json:"svcURL"`
-	ShoreFileSize string      `json:"shoreFileSize"`
-	Error         string      `json:"error"`
+	ShoreDataID   string             `json:"shoreDataID"`
+	ShoreDeplID   string             `json:"shoreDeplID"`
+	RGBloc        string             `json:"rgbLoc"`
+	Geometry      interface{}        `json:"geometry"`
+	AlgoType      string             `json:"algoType"`
+	SceneCapDate  string             `json:"sceneCaptureDate"`
+	SceneID       string             `json:"sceneId"`
+	JobName       string             `json:"resultName"`
+	SensorName    string             `json:"sensorName"`
+	AlgoURL       string             `json:"svcURL"`
+	ShoreFileSize string             `json:"shoreFileSize"`
+	ProvDataID    string             `json:"provDataID,omitempty"`  // Piazza ID of the PROV-JSON provenance record
+	Timings       map[string]float64 `json:"timings,omitempty"`     // Seconds taken by each stage of processing
+	FailedStage   string             `json:"failedStage,omitempty"` // The stage of processing that failed, if any
+	Error         string             `json:"error"`
 }
 
 // Execute executes a single shoreline detection
 // based on the metadata in a gsInpStruct
-func Execute(w http.ResponseWriter, r *http.Request) {
+func Execute(w http.ResponseWriter, r *http.Request, gw Gateway) {
 	var (
 		byts       []byte
 		err        error
@@ -95,12 +102,14 @@ func Execute(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	outpObj, httpStatus = processScene(&inpObj)
+	outpObj, httpStatus = processScene(context.Background(), &inpObj, gw)
 	handleOut(httpStatus)
 
 }
 
-func processScene(inpObj *gsInpStruct) (*gsOutpStruct, int) {
+// processScene checks and fills in the input, then runs genShoreline on it.
+// Cancelling the context abandons processing at the next upstream call.
+func processScene(ctx context.Context, inpObj *gsInpStruct, gw Gateway) (*gsOutpStruct, int) {
 	var (
 		err         error
 		outpFeature *genShoreOut
@@ -113,9 +122,12 @@ func processScene(inpObj *gsInpStruct) (*gsOutpStruct, int) {
 	}
 
 	if inpObj.MetaURL != "" {
-		inpObj.MetaJSON = new(CatFeature)
-		if _, err = pzsvc.RequestKnownJSON("GET", "", inpObj.MetaURL, inpObj.PzAuth, inpObj.MetaJSON); err != nil {
-			outpObj.Error = "Error: pzsvc.RequestKnownJSON: possible flaw in metaDataURL (" + inpObj.MetaURL + "): " + err.Error()
+		metaJSON := new(CatFeature)
+		if _, err = requestKnownJSONCtx(ctx, "GET", "", inpObj.MetaURL, inpObj.PzAuth, metaJSON); err == nil {
+			inpObj.MetaJSON = metaJSON
+		} else {
+			outpObj.FailedStage = failSceneMetadata
+			outpObj.Error = "Error: requestKnownJSONCtx: possible flaw in metaDataURL (" + inpObj.MetaURL + "): " + err.Error()
 			return &outpObj, http.StatusBadRequest
 		}
 	}
@@ -128,7 +140,11 @@ func processScene(inpObj *gsInpStruct) (*gsOutpStruct, int) {
 		inpObj.DbAuth = os.Getenv("BFH_DB_AUTH")
 	}
 
-	if outpFeature, err = genShoreline(*inpObj); err != nil {
+	outpFeature, err = genShoreline(ctx, *inpObj, gw)
+	outpObj.ProvDataID = outpFeature.provDataID
+	outpObj.Timings = outpFeature.timings
+	if err != nil {
+		outpObj.FailedStage = outpFeature.failedStage
 		outpObj.Error = "Error: genShoreline: " + err.Error()
 		return &outpObj, http.StatusInternalServerError
 	}
@@ -149,18 +165,21 @@ func processScene(inpObj *gsInpStruct) (*gsOutpStruct, int) {
 }
 
 type genShoreOut struct {
-	minTide  float64
-	maxTide  float64
-	currTide float64
-	dataID   string
-	deplID   string
-	rgbLoc   string
-	fileSize string
+	minTide     float64
+	maxTide     float64
+	currTide    float64
+	dataID      string
+	deplID      string
+	rgbLoc      string
+	fileSize    string
+	provDataID  string
+	timings     map[string]float64
+	failedStage string
 }
 
 // popShoreline functions serves as an in to genShoreline for
 // those who want to get a geojson.Feature out.
-func popShoreline(inpObj gsInpStruct, inFeat *geojson.Feature) (*geojson.Feature, error) {
+func popShoreline(ctx context.Context, inpObj gsInpStruct, inFeat *geojson.Feature, gw Gateway) (*geojson.Feature, error) {
 	var (
 		byts     []byte
 		err      error
@@ -179,7 +198,7 @@ func popShoreline(inpObj gsInpStruct, inFeat *geojson.Feature) (*geojson.Feature
 		return nil, pzsvc.TraceErr(err)
 	}
 
-	shoreOut, err = genShoreline(inpObj)
+	shoreOut, err = genShoreline(ctx, inpObj, gw)
 	if err != nil {
 		return nil, pzsvc.TraceErr(err)
 	}
@@ -189,6 +208,12 @@ func popShoreline(inpObj gsInpStruct, inFeat *geojson.Feature) (*geojson.Feature
 	inFeat.Properties["currentTide"] = strconv.FormatFloat(shoreOut.currTide, 'f', -1, 64)
 	inFeat.Properties["shoreDataID"] = shoreOut.dataID
 	inFeat.Properties["shoreDeplID"] = shoreOut.deplID
+	if shoreOut.provDataID != "" {
+		inFeat.Properties["provDataID"] = shoreOut.provDataID
+	}
+	if shoreOut.rgbLoc != "" {
+		inFeat.Properties["rgbLoc"] = shoreOut.rgbLoc
+	}
 
 	return inFeat, nil
 
@@ -196,31 +221,96 @@ func popShoreline(inpObj gsInpStruct, inFeat *geojson.Feature) (*geojson.Feature
 
 // genShoreline serves as main function for this file, and is the
 // primary workhorse function of bf-handle as a whole.  It
-// processes raster images into geojson.
-func genShoreline(inpObj gsInpStruct) (*genShoreOut, error) {
+// processes raster images into geojson, and records the provenance
+// of the result (see provenance.go), whether or not it succeeds,
+// unless it is cancelled.  The result is never nil.
+func genShoreline(ctx context.Context, inpObj gsInpStruct, gw Gateway) (*genShoreOut, error) {
+	var sceneID string
+	if inpObj.MetaJSON != nil {
+		sceneID = inpObj.MetaJSON.ID
+	}
+	prov := newProvenance(inpObj)
+	stage := prov.start(stageProcessScene)
+	result, err := detectScene(ctx, inpObj, prov, gw)
+	if result == nil {
+		result = new(genShoreOut)
+	}
+	stage.end(err, map[string]interface{}{"bf:jobName": inpObj.JobName})
+	result.timings = prov.timings
+	result.failedStage = prov.failed
+	if ctx.Err() != nil {
+		return result, err
+	}
+	if provDataID, provErr := prov.ingest(ctx, sceneID, result.dataID, inpObj, gw); provErr == nil {
+		result.provDataID = provDataID
+	} else {
+		log.Print(pzsvc.TraceStr("Could not ingest provenance for " + sceneID + ": " + provErr.Error()))
+	}
+	return result, err
+}
+
+// detectScene does the work of genShoreline.
+func detectScene(ctx context.Context, inpObj gsInpStruct, prov *provenance, gw Gateway) (*genShoreOut, error) {
 	var (
-		result genShoreOut
-		//		rgbChan     chan string
+		result      genShoreOut
+		rgbChan     chan string
 		err         error
 		urls        []string
+		bands       []string
+		algo        Algorithm
 		shoreDataID string
 		deplObj     *pzsvc.DeplStrct
 		inTideObj   *tideIn
+		tides       tideProvider
+		currTideObj *tideOut
 		outTideObj  = new(tideOut)
 	)
 
-	// rgbGen is no longer in use, and its usage is likely to change if/when it returns.
-	/*
-		if inpObj.BndMrgType != "" && inpObj.BndMrgURL != "" {
-			rgbChan = make(chan string)
-			go rgbGen(inpObj, rgbChan)
-		}*/
+	stage := prov.start(stageResolveImages)
+	if algo, err = getAlgorithm(inpObj.AlgoType); err == nil {
+		if bands, err = algoBands(algo, inpObj.Bands); err == nil {
+			if urls, err = findImgURLs(inpObj, bands); err != nil {
+				err = pzsvc.TraceErr(err)
+			}
+		}
+	}
+	stage.end(err, nil)
+	if err != nil {
+		return &result, err
+	}
+	if inpObj.MetaJSON != nil {
+		prov.used(stageResolveImages, "bf:scene")
+	}
+	for inx, band := range bands {
+		bandID := "bf:band." + band
+		prov.entity(bandID, map[string]interface{}{"prov:type": "bf:Band", "bf:band": band, "prov:location": urls[inx]})
+		prov.generated(bandID, stageResolveImages)
+		prov.used(stageRunAlgorithm, bandID)
+	}
+
+	// the RGB composite is a nice-to-have, so it runs alongside the
+	// shoreline detection and its failure does not fail the scene.
+	if inpObj.BndMrgType != "" {
+		rgbChan = make(chan string, 1)
+		go rgbGen(ctx, inpObj, rgbChan, gw)
+	}
 
 	if inpObj.TideURL != "" {
+		if err = ctx.Err(); err != nil {
+			return &result, err
+		}
+		stage = prov.start(stageTideLookup)
 		if inTideObj = findTide(inpObj.MetaJSON.BBox, inpObj.MetaJSON.Properties.AcqDate); inTideObj == nil {
-			return nil, pzsvc.TraceErr(
+			err = pzsvc.TraceErr(
 				fmt.Errorf(`Could not get tide information from feature %v because 
 					required elements did not exist.`, inpObj.MetaJSON.ID))
+			stage.end(err, nil)
+			return nil, err
+		}
+
+		if tides, err = getTideProvider(inpObj.TideURL); err != nil {
+			stage.end(err, nil)
+			return nil, pzsvc.TraceErr(err)
 		}
 
 		// currently, the tide prediction service can generate
@@ -228,34 +318,46 @@ func genShoreline(inpObj gsInpStruct) (*genShoreOut, error) {
 		// example, if the scene is in the middle of the ocean).
 		// Thus, if we get an error from this, we simply continue
 		// without the tide data.
-		if _, err = pzsvc.ReqByObjJSON("POST", inpObj.TideURL, "", inTideObj, outTideObj); err == nil {
+		prov.used(stageTideLookup, "bf:scene")
+		currTideObj, err = tides.tide(ctx, *inTideObj)
+		if err == nil {
+			outTideObj = currTideObj
 			result.minTide = outTideObj.MinTide
 			result.maxTide = outTideObj.MaxTide
 			result.currTide = outTideObj.CurrTide
+			prov.entity("bf:tide", map[string]interface{}{
+				"prov:type":      "bf:Tide",
+				"prov:location":  inpObj.TideURL,
+				"bf:currentTide": result.currTide,
+				"bf:24hrMinTide": result.minTide,
+				"bf:24hrMaxTide": result.maxTide})
+			prov.generated("bf:tide", stageTideLookup)
+			prov.used(stageRunAlgorithm, "bf:tide")
+			stage.end(nil, nil)
+		} else if ctx.Err() != nil {
+			stage.end(err, nil)
+			return &result, err
 		} else {
+			stage.end(err, nil)
 			fmt.Printf(pzsvc.TraceStr("Skipping tide information for" + inpObj.MetaJSON.ID + ":" + err.Error()))
 		}
 	}
 
-	if urls, err = findImgURLs(inpObj); err != nil {
-		return &result, pzsvc.TraceErr(err)
-	}
-
 	fmt.Println("bf-handle: running Algo")
-	if shoreDataID, deplObj, result.fileSize, err = runAlgo(inpObj, outTideObj, urls); err != nil {
+	if shoreDataID, deplObj, result.fileSize, err = runAlgo(ctx, algo, inpObj, outTideObj, urls, prov, gw); err != nil {
 		return &result, pzsvc.TraceErr(err)
 	}
 	result.dataID = shoreDataID
 	result.deplID = deplObj.DeplID
-	/*
-		if rgbChan != nil {
-			fmt.Println("waiting for rgb")
-			rgbLoc := <-rgbChan // returns the Geoserver Layer
-			if len(rgbLoc) > 7 && rgbLoc[0:6] == "Error:" {
-				return &result, errors.New(rgbLoc)
-			}
+	if rgbChan != nil {
+		fmt.Println("waiting for rgb")
+		rgbLoc := <-rgbChan // returns the Geoserver Layer
+		if strings.HasPrefix(rgbLoc, "Error:") {
+			fmt.Println(pzsvc.TraceStr("Skipping RGB for " + inpObj.MetaJSON.ID + ": " + rgbLoc))
+		} else {
 			result.rgbLoc = rgbLoc
-		}*/
+		}
+	}
 
 	return &result, nil
 }
@@ -298,100 +400,184 @@ func provision(inpObj gsInpStruct, bands []string) ([]string, error) {
 	return dataIDs, nil
 }*/
 
-func findImgURLs(inpObj gsInpStruct) ([]string, error) {
-	outURLs := make([]string, len(inpObj.Bands))
-	for i, band := range inpObj.Bands {
-		outURLs[i] = inpObj.MetaJSON.Properties.Bands[band]
+func findImgURLs(inpObj gsInpStruct, bands []string) ([]string, error) {
+	outURLs := make([]string, len(bands))
+	for i, band := range bands {
+		if outURLs[i] = inpObj.MetaJSON.Properties.Bands[band]; outURLs[i] == "" {
+			return nil, pzsvc.ErrWithTrace(`Scene ` + inpObj.MetaJSON.ID + ` has no "` + band + `" band.`)
+		}
 	}
 	return outURLs, nil
 }
 
 // runAlgo does whatever it takes to run the algorithm it is given on
-// the dataIDs it is told to target.  It returns the dataId of the result
-// file.  Right now, it doesn't have any algorithms to handle other than
-// pzsvc-ossim, but as that changes the case statement is going to get
-// bigger and uglier.
-func runAlgo(inpObj gsInpStruct, inpTide *tideOut, inpURLs []string) (string, *pzsvc.DeplStrct, string, error) {
+// the images it is told to target.  It returns the dataId of the result
+// file.  The details of each algorithm live with its entry in the
+// algorithm registry (see algorithms.go), so adding a new one should not
+// require any changes here.
+func runAlgo(ctx context.Context, algo Algorithm, inpObj gsInpStruct, inpTide *tideOut, inpURLs []string, prov *provenance, gw Gateway) (string, *pzsvc.DeplStrct, string, error) {
 	var (
-		dataID      string
-		attMap      map[string]string
-		deplObj     *pzsvc.DeplStrct
-		err         error
-		hasFeatMeta = false
+		dataID  string
+		rawID   string
+		command string
+		attMap  map[string]string
+		deplObj *pzsvc.DeplStrct
+		err     error
 	)
-	switch inpObj.AlgoType {
-	case "pzsvc-ossim":
-		attMap, err = getMeta("", "", "", inpTide, inpObj.MetaJSON)
-		if err != nil {
-			return "", nil, "", pzsvc.TraceErr(err)
+	// pzsvc-exec ingests its output into Piazza itself, where a
+	// LocalGateway cannot see it.
+	if _, local := algo.(localAlgorithm); !local {
+		if _, ok := gw.(*LocalGateway); ok {
+			return "", nil, "", pzsvc.ErrWithTrace(`Algorithm "` + inpObj.AlgoType + `" runs through pzsvc-exec, which needs Piazza.  Only local algorithms can run without it.`)
 		}
-		dataID, err = runOssim(inpObj.AlgoURL, inpURLs[0], inpURLs[1], inpObj.PzAddr, inpObj.PzAuth, attMap)
-		if err != nil {
-			return "", nil, "", pzsvc.TraceErr(err)
-		}
-		//		hasFeatMeta = true
-		// the version of OSSIM we are currently capable of using does not have feature-level
-		// metadata.  Until/unless that's fixed, we need to treat them the same way we do
-		// everyone else.
-	default:
-		return "", nil, "", pzsvc.ErrWithTrace(`bf-handle error: algorithm type "` + inpObj.AlgoType + `" not defined`)
 	}
-
-	attMap, err = getMeta(dataID, inpObj.PzAddr, inpObj.PzAuth, inpTide, inpObj.MetaJSON)
+	attMap, err = getMeta(ctx, "", "", "", inpTide, inpObj.MetaJSON, gw)
+	if err != nil {
+		return "", nil, "", pzsvc.TraceErr(err)
+	}
+	if err = ctx.Err(); err != nil {
+		return "", nil, "", err
+	}
+	stage := prov.start(stageRunAlgorithm)
+	if local, ok := algo.(localAlgorithm); ok {
+		dataID, err = runLocal(ctx, local, inpObj, inpURLs, gw)
+	} else {
+		dataID, command, err = runExec(ctx, algo, inpObj.AlgoURL, inpURLs, inpObj.PzAddr, inpObj.PzAuth, attMap)
+	}
+	attrs := make(map[string]interface{})
+	if command != "" {
+		attrs["bf:command"] = command
+	}
+	stage.end(err, attrs)
 	if err != nil {
 		return "", nil, "", pzsvc.TraceErr(err)
 	}
+	rawID = "pz:" + dataID
+	prov.entity(rawID, map[string]interface{}{"prov:type": "bf:RawShoreline"})
+	prov.generated(rawID, stageRunAlgorithm)
+
+	stage = prov.start(stageIngestMeta)
+	if attMap, err = getMeta(ctx, dataID, inpObj.PzAddr, inpObj.PzAuth, inpTide, inpObj.MetaJSON, gw); err != nil {
+		stage.end(err, nil)
+		return "", nil, "", pzsvc.TraceErr(err)
+	}
 	fileSize := attMap["fileSize"]
 	delete(attMap, "fileSize")
+	if attMap["version"] != "" {
+		prov.doc.Agent["bf:algorithm"]["bf:version"] = attMap["version"]
+	}
 
-	if hasFeatMeta {
-		err = pzsvc.UpdateFileMeta(dataID, inpObj.PzAddr, inpObj.PzAuth, attMap)
-		if err != nil {
-			return "", nil, "", pzsvc.TraceErr(err)
-		}
+	metaDataID := dataID
+	if algo.FeatureMeta() {
+		err = gw.UpdateFileMeta(ctx, metaDataID, inpObj.PzAddr, inpObj.PzAuth, attMap)
 	} else {
-		dataID, err = addGeoFeatureMeta(dataID, inpObj.PzAddr, inpObj.PzAuth, attMap)
-		if err != nil {
-			return "", nil, "", pzsvc.TraceErr(err)
-		}
+		metaDataID, err = addGeoFeatureMeta(ctx, metaDataID, inpObj.PzAddr, inpObj.PzAuth, attMap, gw)
+	}
+	stage.end(err, nil)
+	if err != nil {
+		return "", nil, "", pzsvc.TraceErr(err)
+	}
+	dataID = metaDataID
+	prov.used(stageIngestMeta, rawID)
+	prov.entity("pz:"+dataID, map[string]interface{}{"prov:type": "bf:Shoreline", "bf:fileSize": fileSize})
+	prov.generated("pz:"+dataID, stageIngestMeta)
+	if "pz:"+dataID != rawID {
+		prov.derived("pz:"+dataID, rawID)
 	}
 
-	deplObj, err = pzsvc.DeployToGeoServer(dataID, inpObj.LGroupID, inpObj.PzAddr, inpObj.PzAuth)
+	stage = prov.start(stageDeploy)
+	deplObj, err = gw.DeployToGeoServer(ctx, dataID, inpObj.LGroupID, inpObj.PzAddr, inpObj.PzAuth)
+	stage.end(err, nil)
 	if err != nil {
 		return "", nil, "", pzsvc.TraceErr(err)
 	}
+	prov.used(stageDeploy, "pz:"+dataID)
+	prov.entity("bf:deployment", map[string]interface{}{"prov:type": "bf:Deployment", "bf:deplId": deplObj.DeplID, "bf:layer": deplObj.Layer})
+	prov.generated("bf:deployment", stageDeploy)
 
 	fmt.Printf("Completed algorithm %v; %v : %v\n", inpObj.MetaJSON.ID, dataID, deplObj.DeplID)
 
 	return dataID, deplObj, fileSize, nil
 }
 
-// runOssim does all of the things necessary to process the given images
-// through pzsvc-ossim.  It constructs and executes the request, reads
-// the response, and extracts the dataID of the output from it.
-func runOssim(algoURL, imgURL1, imgURL2, pzAddr, authKey string, attMap map[string]string) (string, error) {
-	geoJName := `shoreline.geojson`
+// callPzsvcExec is pzse.CallPzsvcExec, except that the call is dropped
+// when the context is cancelled.
+func callPzsvcExec(ctx context.Context, inpObj *pzse.InpStruct, algoURL string) (*pzse.OutStruct, error) {
+	var outStruct pzse.OutStruct
+	byts, err := json.Marshal(inpObj)
+	if err != nil {
+		return nil, pzsvc.TraceErr(err)
+	}
+	if byts, err = requestKnownJSONCtx(ctx, "POST", string(byts), algoURL, "", &outStruct); err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, pzsvc.ErrWithTrace(err.Error() + "  Response: " + string(byts))
+	}
+	return &outStruct, nil
+}
 
-	funcStr := `shoreline --image img1.TIF,img2.TIF --projection geo-scaled `
-	for key, val := range attMap {
-		fmt.Println("adding props to shoreline call: key: " + key + "value: " + val)
-		funcStr = funcStr + fmt.Sprintf(`--prop %s:%s `, key, val)
+// runExec does all of the things necessary to process the given images
+// through a pzsvc-exec based algorithm.  It constructs and executes the
+// request, reads the response, and extracts the dataID of the output from
+// it.  It also returns the command that it ran.
+func runExec(ctx context.Context, algo Algorithm, algoURL string, imgURLs []string, pzAddr, authKey string, attMap map[string]string) (string, string, error) {
+	imgNames := make([]string, len(imgURLs))
+	for i := range imgURLs {
+		imgNames[i] = fmt.Sprintf("img%d.TIF", i+1)
 	}
-	funcStr = funcStr + geoJName
+	outNames := algo.Outputs()
+
+	funcStr := algo.Command(imgNames, attMap)
 	fmt.Println("final funcStr: " + funcStr)
 
 	inpObj := pzse.InpStruct{Command: funcStr,
-		InExtFiles: []string{0: imgURL1, 1: imgURL2},
-		InExtNames: []string{0: "img1.TIF", 1: "img2.TIF"},
-		OutGeoJs:   []string{0: geoJName},
+		InExtFiles: imgURLs,
+		InExtNames: imgNames,
+		OutGeoJs:   outNames,
 		OutTiffs:   nil,
 		OutTxts:    nil,
 		PzAuth:     authKey,
 		PzAddr:     pzAddr}
 
-	outStruct, err := pzse.CallPzsvcExec(&inpObj, algoURL)
+	outStruct, err := callPzsvcExec(ctx, &inpObj, algoURL)
+	if err != nil {
+		return "", funcStr, pzsvc.TraceErr(err)
+	}
+	if outStruct.OutFiles[outNames[0]] == "" {
+		return "", funcStr, pzsvc.ErrWithTrace(`No output file "` + outNames[0] + `" in response from ` + algoURL)
+	}
+	return outStruct.OutFiles[outNames[0]], funcStr, nil
+}
+
+// runLocal runs an in-process algorithm on the given images, and ingests
+// the result so that it can be handled in the same way as the output of
+// a pzsvc-exec based algorithm.
+func runLocal(ctx context.Context, algo localAlgorithm, inpObj gsInpStruct, imgURLs []string, gw Gateway) (string, error) {
+	var (
+		err    error
+		byts   []byte
+		fc     *geojson.FeatureCollection
+		images = make([]*geoRaster, len(imgURLs))
+	)
+	for i, imgURL := range imgURLs {
+		fmt.Println("bf-handle: reading " + imgURL)
+		if images[i], err = readGeoTIFFURL(ctx, imgURL); err != nil {
+			return "", pzsvc.TraceErr(err)
+		}
+	}
+	if fc, err = algo.detect(images, inpObj.AlgoParams); err != nil {
+		return "", pzsvc.TraceErr(err)
+	}
+	images = nil
+	debug.FreeOSMemory()
+
+	if byts, err = geojson.Write(fc); err != nil {
+		return "", pzsvc.TraceErr(err)
+	}
+	dataID, err := gw.Ingest(ctx, algo.Outputs()[0], "geojson", inpObj.PzAddr, inpObj.AlgoType, "", inpObj.PzAuth, byts, nil)
 	if err != nil {
 		return "", pzsvc.TraceErr(err)
 	}
-	return outStruct.OutFiles[geoJName], nil
+	return dataID, nil
 }
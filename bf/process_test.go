@@ -31,7 +31,7 @@ func TestExecute(t *testing.T) {
 	r := http.Request{}
 	r.Method = "POST"
 	r.Body = pzsvc.GetMockReadCloser(`{"name":what?}`)
-	Execute(w, &r)
+	Execute(w, &r, PzGateway{})
 	if *outInt < 300 && *outInt >= 200 {
 		t.Error(`TestExecute: passed on what should have been a json failure.`)
 	}
@@ -71,7 +71,7 @@ func TestExecute(t *testing.T) {
 
 	pzsvc.SetMockClient(cliOuts, 200)
 
-	Execute(w, &r)
+	Execute(w, &r, PzGateway{})
 	if *outInt >= 300 || *outInt < 200 {
 		t.Error(`TestExecute: failed on what should have been a good run.  Error: ` + *outStr)
 	}
@@ -131,24 +131,15 @@ func buildTriggerRequestJSON(trigData trigUIStruct, layerGID string) (string, er
 }
 
 // NewProductLine ....
-func NewProductLine(w http.ResponseWriter, r *http.Request) {
+func NewProductLine(w http.ResponseWriter, r *http.Request, gw Gateway) {
 
 	type outpType struct {
 		TriggerID    string `json:"triggerId"`
 		LayerGroupID string `json:"layerGroupId"`
 	}
 
-	type newTrigData struct {
-		ID string `json:"triggerId"`
-	}
-	type newTrigOut struct {
-		StatusCode int         `json:"statusCode"`
-		Data       newTrigData `json:"data"`
-	}
-
 	inpObj := trigUIStruct{MinX: math.NaN(), MinY: math.NaN(), MaxX: math.NaN(), MaxY: math.NaN(), CloudCover: math.NaN()}
 	outpObj := outpType{}
-	idObj := newTrigOut{}
 
 	_, err := pzsvc.ReadBodyJSON(&inpObj, r.Body)
 	if err != nil {
@@ -178,7 +169,7 @@ func NewProductLine(w http.ResponseWriter, r *http.Request) {
 		bfInpObj.DbAuth = os.Getenv("BFH_DB_AUTH")
 	}
 
-	layerGID, err := pzsvc.AddGeoServerLayerGroup(bfInpObj.PzAddr, bfInpObj.PzAuth)
+	layerGID, err := gw.AddGeoServerLayerGroup(r.Context(), bfInpObj.PzAddr, bfInpObj.PzAuth)
 	if err != nil {
 		handleOut(w, pzsvc.TraceStr(err.Error()), outpObj, http.StatusBadRequest)
 		return
@@ -193,14 +184,12 @@ func NewProductLine(w http.ResponseWriter, r *http.Request) {
 
 	// TODO: once we can make a few test-runs and get a better idea of the shape of the
 	// response object, we may want to do something with them.
-	b, err := pzsvc.RequestKnownJSON("POST", outJSON, bfInpObj.PzAddr+`/trigger`, bfInpObj.PzAuth, &idObj)
+	outpObj.TriggerID, err = gw.AddTrigger(r.Context(), outJSON, bfInpObj.PzAddr, bfInpObj.PzAuth)
 	if err != nil {
-		handleOut(w, pzsvc.TraceStr(err.Error())+".  http Error: "+string(b), outpObj, http.StatusInternalServerError)
+		handleOut(w, pzsvc.TraceStr(err.Error()), outpObj, http.StatusInternalServerError)
 		return
 	}
-
-	outpObj.TriggerID = idObj.Data.ID
-	fmt.Println("idObj.ID: " + idObj.Data.ID)
+	fmt.Println("idObj.ID: " + outpObj.TriggerID)
 
 	outpObj.LayerGroupID = layerGID
 
@@ -319,7 +308,7 @@ func toFloat(input interface{}) (float64, error) {
 
 // GetProductLines responds to a properly formed network request
 // by sending out a list of triggers in JSON format.
-func GetProductLines(w http.ResponseWriter, r *http.Request) {
+func GetProductLines(w http.ResponseWriter, r *http.Request, gw Gateway) {
 
 	var inpObj struct {
 		EventTypeID string `json:"eventTypeId"`
@@ -348,11 +337,9 @@ func GetProductLines(w http.ResponseWriter, r *http.Request) {
 
 	//getJSON := `{"perPage":1000,"order":"desc","sortBy":"createdOn"}`
 
-	var inTrigList pzsvc.TriggerList
-
-	b, err := pzsvc.RequestKnownJSON("GET", "", inpObj.PzAddr+`/trigger?perPage=1000&order=desc&sortBy=createdOn`, inpObj.PzAuth, &inTrigList)
+	inTrigList, err := gw.GetTriggers(r.Context(), inpObj.PzAddr, inpObj.PzAuth)
 	if err != nil {
-		handleOut(w, "Error: pzsvc.RequestKnownJSON: "+err.Error()+".  http Error: "+string(b), outpObj, http.StatusInternalServerError)
+		handleOut(w, "Error: GetTriggers: "+err.Error(), outpObj, http.StatusInternalServerError)
 		return
 	}
 
@@ -390,7 +377,7 @@ AddTriggerLoop:
 		outpObj.TrigList = append(outpObj.TrigList, *newTrig)
 	}
 
-	b, err = json.Marshal(outpObj)
+	b, err := json.Marshal(outpObj)
 	if err != nil {
 		handleOut(w, "Marshalling error: "+err.Error()+".", outpObj, http.StatusInternalServerError)
 		return
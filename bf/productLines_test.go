@@ -35,7 +35,7 @@ func TestNewProductLine(t *testing.T) {
 	r.Method = "POST"
 	testBodyStr := `{"name":what?}`
 	r.Body = pzsvc.GetMockReadCloser(testBodyStr)
-	NewProductLine(w, &r)
+	NewProductLine(w, &r, PzGateway{})
 	if *outInt < 300 && *outInt >= 200 {
 		t.Error(`TestExecute: passed on what should have been a json failure.`)
 	}
@@ -47,8 +47,9 @@ func TestNewProductLine(t *testing.T) {
 	cliOuts := []string{}
 
 	pzsvc.SetMockClient(cliOuts, 200)
+	defer setMockUpstream(cliOuts, 200)()
 
-	NewProductLine(w, &r)
+	NewProductLine(w, &r, PzGateway{})
 	if *outInt >= 300 || *outInt < 200 {
 		t.Error(`TestNewProductLine: failed on what should have been a good run.  Error: ` + *outStr)
 	}
@@ -63,7 +64,7 @@ func TestGetProductLines(t *testing.T) {
 	r.Method = "POST"
 	testBodyStr := `{"name":what?}`
 	r.Body = pzsvc.GetMockReadCloser(testBodyStr)
-	GetProductLines(w, &r)
+	GetProductLines(w, &r, PzGateway{})
 	if *outInt < 300 && *outInt >= 200 {
 		t.Error(`TestExecute: passed on what should have been a json failure.`)
 	}
@@ -76,7 +77,8 @@ func TestGetProductLines(t *testing.T) {
 	cliOuts := []string{}
 
 	pzsvc.SetMockClient(cliOuts, 200)
-	GetProductLines(w, &r)
+	defer setMockUpstream(cliOuts, 200)()
+	GetProductLines(w, &r, PzGateway{})
 	if *outInt >= 300 || *outInt < 200 {
 		t.Error(`TestGetProductLines: failed on what should have been a good run.  Error: ` + *outStr)
 	}
@@ -87,7 +89,7 @@ func TestGetProductLines(t *testing.T) {
 	cliOuts = []string{}
 
 	pzsvc.SetMockClient(cliOuts, 200)
-	GetProductLines(w, &r)
+	GetProductLines(w, &r, PzGateway{})
 
 }
 
@@ -0,0 +1,286 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bf
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/paulsmith/gogeos/geos"
+	"github.com/venicegeo/geojson-geos-go/geojsongeos"
+	"github.com/venicegeo/geojson-go/geojson"
+	"github.com/venicegeo/pzsvc-lib"
+)
+
+// coordTransform maps an x, y (longitude, latitude) pair into another
+// coordinate system.
+type coordTransform func(x, y float64) (float64, float64)
+
+// toUTM projects longitude and latitude into the given UTM zone.
+func toUTM(zone int, north bool) coordTransform {
+	return func(x, y float64) (float64, float64) {
+		return latLonToUTM(y, x, zone, north)
+	}
+}
+
+// fromUTM unprojects the given UTM zone into longitude and latitude.
+func fromUTM(zone int, north bool) coordTransform {
+	return func(x, y float64) (float64, float64) {
+		lat, lon := utmToLatLon(x, y, zone, north)
+		return lon, lat
+	}
+}
+
+// utmFor returns the UTM zone and hemisphere in which to work with the
+// given geometry: those of its centroid.  It also returns the longitude of
+// the centroid.
+func utmFor(geometry *geos.Geometry) (int, bool, float64, error) {
+	var (
+		err      error
+		centroid *geos.Geometry
+		lon, lat float64
+	)
+	if centroid, err = geometry.Centroid(); err != nil {
+		return 0, false, 0, pzsvc.TraceErr(err)
+	}
+	if lon, err = centroid.X(); err != nil {
+		return 0, false, 0, pzsvc.TraceErr(err)
+	}
+	if lat, err = centroid.Y(); err != nil {
+		return 0, false, 0, pzsvc.TraceErr(err)
+	}
+	return utmZoneOf(lon), lat >= 0, lon, nil
+}
+
+// transformGeos applies the transform to every coordinate of the given
+// geometry.
+func transformGeos(geometry *geos.Geometry, transform coordTransform) (*geos.Geometry, error) {
+	gjGeometry, err := geojsongeos.GeoJSONFromGeos(geometry)
+	if err != nil {
+		return nil, pzsvc.TraceErr(err)
+	}
+	if gjGeometry, err = transformGeoJSON(gjGeometry, transform); err != nil {
+		return nil, err
+	}
+	if geometry, err = geojsongeos.GeosFromGeoJSON(gjGeometry); err != nil {
+		return nil, pzsvc.TraceErr(err)
+	}
+	return geometry, nil
+}
+
+// transformGeoJSON returns a copy of the given GeoJSON geometry with the
+// transform applied to every coordinate.
+func transformGeoJSON(input interface{}, transform coordTransform) (interface{}, error) {
+	point := func(coords []float64) []float64 {
+		result := append([]float64(nil), coords...)
+		if len(result) >= 2 {
+			result[0], result[1] = transform(coords[0], coords[1])
+		}
+		return result
+	}
+	line := func(coords [][]float64) [][]float64 {
+		result := make([][]float64, len(coords))
+		for inx, coord := range coords {
+			result[inx] = point(coord)
+		}
+		return result
+	}
+	polygon := func(coords [][][]float64) [][][]float64 {
+		result := make([][][]float64, len(coords))
+		for inx, ring := range coords {
+			result[inx] = line(ring)
+		}
+		return result
+	}
+	switch it := input.(type) {
+	case *geojson.Point:
+		return geojson.NewPoint(point(it.Coordinates)), nil
+	case *geojson.LineString:
+		return geojson.NewLineString(line(it.Coordinates)), nil
+	case *geojson.Polygon:
+		return geojson.NewPolygon(polygon(it.Coordinates)), nil
+	case *geojson.MultiPoint:
+		return geojson.NewMultiPoint(line(it.Coordinates)), nil
+	case *geojson.MultiLineString:
+		return geojson.NewMultiLineString(polygon(it.Coordinates)), nil
+	case *geojson.MultiPolygon:
+		coords := make([][][][]float64, len(it.Coordinates))
+		for inx, poly := range it.Coordinates {
+			coords[inx] = polygon(poly)
+		}
+		return geojson.NewMultiPolygon(coords), nil
+	case *geojson.GeometryCollection:
+		geometries := make([]interface{}, len(it.Geometries))
+		for inx, geometry := range it.Geometries {
+			var err error
+			if geometries[inx], err = transformGeoJSON(geometry, transform); err != nil {
+				return nil, err
+			}
+		}
+		return geojson.NewGeometryCollection(geometries), nil
+	}
+	return nil, pzsvc.ErrWithTrace(fmt.Sprintf("Cannot transform geometry of type %T.", input))
+}
+
+// bufferMeters buffers the given geometry by the given distance in meters.
+// A geometry that spans more than one UTM zone is cut along the zone
+// boundaries, and each piece is buffered in its own zone before the pieces
+// are merged, so that no part of it is measured far from the meridian of
+// its zone.  Any part of a buffered piece with less area than minArea, in
+// square meters, is replaced by its bounding box, so that small features
+// do not turn into a great many points later on.
+func bufferMeters(geometry *geos.Geometry, meters, minArea float64) (*geos.Geometry, error) {
+	var (
+		err        error
+		gjGeometry interface{}
+		strip,
+		piece,
+		collection *geos.Geometry
+		pieces []*geos.Geometry
+		empty  bool
+	)
+	if gjGeometry, err = geojsongeos.GeoJSONFromGeos(geometry); err != nil {
+		return nil, pzsvc.TraceErr(err)
+	}
+	minLon, maxLon := math.Inf(1), math.Inf(-1)
+	eachLon(gjGeometry, func(lon float64) {
+		minLon = math.Min(minLon, lon)
+		maxLon = math.Max(maxLon, lon)
+	})
+	wests := utmStrips(minLon, maxLon)
+	if len(wests) < 2 {
+		return bufferInZone(geometry, meters, minArea)
+	}
+
+	for _, west := range wests {
+		east := west + utmZoneSize
+		if strip, err = geos.NewPolygon([]geos.Coord{
+			geos.NewCoord(west, -90), geos.NewCoord(east, -90), geos.NewCoord(east, 90),
+			geos.NewCoord(west, 90), geos.NewCoord(west, -90)}); err != nil {
+			return nil, pzsvc.TraceErr(err)
+		}
+		if piece, err = geometry.Intersection(strip); err != nil {
+			return nil, pzsvc.TraceErr(err)
+		}
+		if empty, err = piece.IsEmpty(); err != nil {
+			return nil, pzsvc.TraceErr(err)
+		}
+		if empty {
+			continue
+		}
+		if piece, err = bufferInZone(piece, meters, minArea); err != nil {
+			return nil, err
+		}
+		pieces = append(pieces, piece)
+	}
+	if collection, err = geos.NewCollection(geos.GEOMETRYCOLLECTION, pieces...); err != nil {
+		return nil, pzsvc.TraceErr(err)
+	}
+	if geometry, err = collection.Buffer(0); err != nil {
+		return nil, pzsvc.TraceErr(err)
+	}
+	return geometry, nil
+}
+
+// utmStrips returns the western edges of the UTM zones that the given
+// range of longitudes touches.  Zone boundaries fall every utmZoneSize
+// degrees from -180, in whatever frame the longitudes are in.
+func utmStrips(minLon, maxLon float64) []float64 {
+	var result []float64
+	if minLon > maxLon {
+		return nil
+	}
+	west := math.Floor((minLon+180)/utmZoneSize)*utmZoneSize - 180
+	for ; west < maxLon || len(result) == 0; west += utmZoneSize {
+		result = append(result, west)
+	}
+	return result
+}
+
+// bufferInZone buffers the given geometry by the given distance in meters,
+// by way of the UTM zone of its centroid.
+func bufferInZone(geometry *geos.Geometry, meters, minArea float64) (*geos.Geometry, error) {
+	zone, north, lon, err := utmFor(geometry)
+	if err != nil {
+		return nil, err
+	}
+	// Unprojected longitudes come back near the zone's central meridian,
+	// and need to go back near the original geometry's
+	unproject := fromUTM(zone, north)
+	toFrame := func(x, y float64) (float64, float64) {
+		x, y = unproject(x, y)
+		return nearLon(x, lon), y
+	}
+	if geometry, err = transformGeos(geometry, toUTM(zone, north)); err != nil {
+		return nil, err
+	}
+	if geometry, err = geometry.Buffer(meters); err != nil {
+		return nil, pzsvc.TraceErr(err)
+	}
+	if geometry, err = envelopeSmallParts(geometry, minArea); err != nil {
+		return nil, err
+	}
+	return transformGeos(geometry, toFrame)
+}
+
+// envelopeSmallParts replaces each polygon of the given geometry that has
+// less area than minArea with its bounding box.
+func envelopeSmallParts(geometry *geos.Geometry, minArea float64) (*geos.Geometry, error) {
+	var (
+		err   error
+		gt    geos.GeometryType
+		area  float64
+		count int
+		part  *geos.Geometry
+		parts []*geos.Geometry
+	)
+	if gt, err = geometry.Type(); err != nil {
+		return nil, pzsvc.TraceErr(err)
+	}
+	switch gt {
+	case geos.POLYGON:
+		if area, err = geometry.Area(); err != nil {
+			return nil, pzsvc.TraceErr(err)
+		}
+		if area < minArea {
+			if geometry, err = geometry.Envelope(); err != nil {
+				return nil, pzsvc.TraceErr(err)
+			}
+		}
+		return geometry, nil
+	case geos.MULTIPOLYGON:
+		if count, err = geometry.NGeometry(); err != nil {
+			return nil, pzsvc.TraceErr(err)
+		}
+		for inx := 0; inx < count; inx++ {
+			if part, err = geometry.Geometry(inx); err != nil {
+				return nil, pzsvc.TraceErr(err)
+			}
+			if part, err = envelopeSmallParts(part, minArea); err != nil {
+				return nil, err
+			}
+			parts = append(parts, part)
+		}
+		// bounding boxes may now overlap, so merge them
+		if geometry, err = geos.NewCollection(geos.MULTIPOLYGON, parts...); err != nil {
+			return nil, pzsvc.TraceErr(err)
+		}
+		if geometry, err = geometry.Buffer(0); err != nil {
+			return nil, pzsvc.TraceErr(err)
+		}
+		return geometry, nil
+	}
+	return nil, pzsvc.TraceErr(fmt.Errorf("Unexpected geometry type: %v", gt))
+}
@@ -0,0 +1,109 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bf
+
+import (
+	"math"
+	"testing"
+
+	"github.com/venicegeo/geojson-go/geojson"
+)
+
+func TestTransformGeoJSON(t *testing.T) {
+	input := geojson.NewGeometryCollection([]interface{}{
+		geojson.NewPoint([]float64{-75, 40, 12}),
+		geojson.NewPolygon([][][]float64{{{-75, 40}, {-74, 40}, {-74, 41}, {-75, 40}}})})
+	projected, err := transformGeoJSON(input, toUTM(18, true))
+	if err != nil {
+		t.Fatal(`TestTransformGeoJSON: ` + err.Error())
+	}
+	point := projected.(*geojson.GeometryCollection).Geometries[0].(*geojson.Point)
+	if math.Abs(point.Coordinates[0]-500000) > 1e-3 || math.Abs(point.Coordinates[1]-4427757.219) > 1e-3 || point.Coordinates[2] != 12 {
+		t.Errorf(`TestTransformGeoJSON: unexpected projected point %v`, point.Coordinates)
+	}
+	if input.Geometries[0].(*geojson.Point).Coordinates[0] != -75 {
+		t.Error(`TestTransformGeoJSON: the input was modified.`)
+	}
+
+	unprojected, err := transformGeoJSON(projected, fromUTM(18, true))
+	if err != nil {
+		t.Fatal(`TestTransformGeoJSON: ` + err.Error())
+	}
+	ring := unprojected.(*geojson.GeometryCollection).Geometries[1].(*geojson.Polygon).Coordinates[0]
+	for inx, coord := range input.Geometries[1].(*geojson.Polygon).Coordinates[0] {
+		if math.Abs(ring[inx][0]-coord[0]) > 1e-6 || math.Abs(ring[inx][1]-coord[1]) > 1e-6 {
+			t.Errorf(`TestTransformGeoJSON: %v came back as %v`, coord, ring[inx])
+		}
+	}
+
+	if _, err = transformGeoJSON("nonsense", toUTM(18, true)); err == nil {
+		t.Error(`TestTransformGeoJSON: transformed a string.`)
+	}
+}
+
+func TestLatLonToUTM(t *testing.T) {
+	tests := []struct {
+		lat, lon float64
+		zone     int
+		north    bool
+	}{
+		{40, -75, 18, true},
+		{35.5, -73.2, 18, true},
+		{-33.9, 151.2, 56, false},
+		{71.3, -156.8, 4, true},
+	}
+	for _, test := range tests {
+		if zone := utmZoneOf(test.lon); zone != test.zone {
+			t.Errorf(`TestLatLonToUTM: expected zone %d for %v, got %d.`, test.zone, test.lon, zone)
+		}
+		easting, northing := latLonToUTM(test.lat, test.lon, test.zone, test.north)
+		lat, lon := utmToLatLon(easting, northing, test.zone, test.north)
+		if math.Abs(lat-test.lat) > 1e-6 || math.Abs(lon-test.lon) > 1e-6 {
+			t.Errorf(`TestLatLonToUTM: (%v, %v) came back as (%v, %v).`, test.lat, test.lon, lat, lon)
+		}
+	}
+	if easting, northing := latLonToUTM(40, -75, 18, true); math.Abs(easting-500000) > 1e-3 || math.Abs(northing-4427757.219) > 1e-3 {
+		t.Errorf(`TestLatLonToUTM: expected (500000, 4427757.219), got (%v, %v).`, easting, northing)
+	}
+}
+
+func TestUTMStrips(t *testing.T) {
+	tests := []struct {
+		minLon, maxLon float64
+		wests          []float64
+	}{
+		{-75, -74, []float64{-78}},
+		{-78, -72, []float64{-78}},
+		{-79, -71, []float64{-84, -78, -72}},
+		{178, 182, []float64{174, 180}},
+		{5, 5, []float64{0}},
+	}
+	for _, test := range tests {
+		wests := utmStrips(test.minLon, test.maxLon)
+		if len(wests) != len(test.wests) {
+			t.Errorf(`TestUTMStrips: expected %v for (%v, %v), got %v.`, test.wests, test.minLon, test.maxLon, wests)
+			continue
+		}
+		for inx := range wests {
+			if wests[inx] != test.wests[inx] {
+				t.Errorf(`TestUTMStrips: expected %v for (%v, %v), got %v.`, test.wests, test.minLon, test.maxLon, wests)
+				break
+			}
+		}
+	}
+	if wests := utmStrips(1, 0); len(wests) != 0 {
+		t.Errorf(`TestUTMStrips: got %v for an empty range.`, wests)
+	}
+}
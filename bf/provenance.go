@@ -0,0 +1,199 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bf
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/venicegeo/pzsvc-lib"
+)
+
+// Version is the version of bf-handle, as recorded in provenance.  Builds
+// can set it with -ldflags "-X github.com/venicegeo/bf-handle/bf.Version=...".
+var Version = "dev"
+
+// Stages of processing a scene, as named in provenance and timings
+const (
+	stageProcessScene  = "processScene"
+	stageResolveImages = "resolveImages"
+	stageTideLookup    = "tideLookup"
+	stageRunAlgorithm  = "runAlgorithm"
+	stageIngestMeta    = "ingestMetadata"
+	stageDeploy        = "deploy"
+)
+
+// provDoc is a W3C PROV-JSON document (https://www.w3.org/Submission/prov-json/).
+// Each member maps identifiers to their attributes; relations have blank
+// node identifiers.
+type provDoc struct {
+	Prefix            map[string]string                 `json:"prefix"`
+	Entity            map[string]map[string]interface{} `json:"entity"`
+	Activity          map[string]map[string]interface{} `json:"activity"`
+	Agent             map[string]map[string]interface{} `json:"agent"`
+	Used              map[string]map[string]interface{} `json:"used,omitempty"`
+	WasGeneratedBy    map[string]map[string]interface{} `json:"wasGeneratedBy,omitempty"`
+	WasAssociatedWith map[string]map[string]interface{} `json:"wasAssociatedWith,omitempty"`
+	WasInformedBy     map[string]map[string]interface{} `json:"wasInformedBy,omitempty"`
+	WasDerivedFrom    map[string]map[string]interface{} `json:"wasDerivedFrom,omitempty"`
+}
+
+// provenance records what happens to a scene as it is processed: what went
+// in, which algorithm ran and how, how long each stage took, and what came
+// out.  It is not safe for concurrent use.
+type provenance struct {
+	doc       provDoc
+	relations int
+	timings   map[string]float64 // seconds taken by each stage
+	failed    string             // the last stage to fail, if any
+}
+
+// provStage is a stage of processing that has started and not yet ended.
+type provStage struct {
+	prov  *provenance
+	name  string
+	start time.Time
+}
+
+func newProvenance(inpObj gsInpStruct) *provenance {
+	prov := provenance{
+		doc: provDoc{
+			Prefix: map[string]string{
+				"bf": "https://github.com/venicegeo/bf-handle#",
+				"pz": inpObj.PzAddr + "/file/"},
+			Entity:   make(map[string]map[string]interface{}),
+			Activity: make(map[string]map[string]interface{}),
+			Agent:    make(map[string]map[string]interface{})},
+		timings: make(map[string]float64)}
+	prov.agent("bf:bf-handle", map[string]interface{}{"bf:version": Version})
+	algoAttrs := map[string]interface{}{"bf:algoType": inpObj.AlgoType}
+	if inpObj.AlgoURL != "" {
+		algoAttrs["prov:location"] = inpObj.AlgoURL
+	}
+	prov.agent("bf:algorithm", algoAttrs)
+	if inpObj.MetaJSON != nil {
+		prov.entity("bf:scene", map[string]interface{}{
+			"prov:type":       "bf:Scene",
+			"bf:sceneId":      inpObj.MetaJSON.ID,
+			"bf:acquiredDate": inpObj.MetaJSON.Properties.AcqDate,
+			"bf:sensorName":   inpObj.MetaJSON.Properties.SensorName})
+	}
+	return &prov
+}
+
+func (prov *provenance) entity(id string, attrs map[string]interface{}) {
+	if existing, ok := prov.doc.Entity[id]; ok {
+		for key, value := range attrs {
+			existing[key] = value
+		}
+		return
+	}
+	prov.doc.Entity[id] = attrs
+}
+
+func (prov *provenance) agent(id string, attrs map[string]interface{}) {
+	attrs["prov:type"] = "prov:SoftwareAgent"
+	prov.doc.Agent[id] = attrs
+}
+
+// relation adds a relation of the given kind.
+func (prov *provenance) relation(kind *map[string]map[string]interface{}, attrs map[string]interface{}) {
+	if *kind == nil {
+		*kind = make(map[string]map[string]interface{})
+	}
+	prov.relations++
+	(*kind)["_:r"+strconv.Itoa(prov.relations)] = attrs
+}
+
+// used records that the stage used the entity.
+func (prov *provenance) used(stage, entity string) {
+	prov.relation(&prov.doc.Used, map[string]interface{}{"prov:activity": "bf:" + stage, "prov:entity": entity})
+}
+
+// generated records that the stage generated the entity.
+func (prov *provenance) generated(entity, stage string) {
+	prov.relation(&prov.doc.WasGeneratedBy, map[string]interface{}{"prov:entity": entity, "prov:activity": "bf:" + stage})
+}
+
+// derived records that one entity was derived from another.
+func (prov *provenance) derived(entity, from string) {
+	prov.relation(&prov.doc.WasDerivedFrom, map[string]interface{}{"prov:generatedEntity": entity, "prov:usedEntity": from})
+}
+
+// start begins timing a stage.
+func (prov *provenance) start(name string) *provStage {
+	return &provStage{prov: prov, name: name, start: time.Now()}
+}
+
+// end records the stage as an activity, with the error that ended it if
+// there was one.  Every stage but the whole is part of processing the
+// scene, and stages other than the algorithm run are bf-handle's own.
+func (stage *provStage) end(err error, attrs map[string]interface{}) {
+	prov := stage.prov
+	end := time.Now()
+	if attrs == nil {
+		attrs = make(map[string]interface{})
+	}
+	attrs["prov:startTime"] = stage.start.UTC().Format(time.RFC3339Nano)
+	attrs["prov:endTime"] = end.UTC().Format(time.RFC3339Nano)
+	if err != nil {
+		attrs["bf:error"] = err.Error()
+		if stage.name != stageProcessScene {
+			prov.failed = stage.name
+		}
+	}
+	id := "bf:" + stage.name
+	prov.doc.Activity[id] = attrs
+	prov.timings[stage.name] = end.Sub(stage.start).Seconds()
+
+	agent := "bf:bf-handle"
+	if stage.name == stageRunAlgorithm {
+		agent = "bf:algorithm"
+	}
+	prov.relation(&prov.doc.WasAssociatedWith, map[string]interface{}{"prov:activity": id, "prov:agent": agent})
+	if stage.name != stageProcessScene {
+		prov.relation(&prov.doc.WasInformedBy, map[string]interface{}{"prov:informed": "bf:" + stageProcessScene, "prov:informant": id})
+	}
+}
+
+// provMetaType marks provenance documents in their metadata, so that
+// searches for results can tell them apart from the results themselves.
+const provMetaType = "provenance"
+
+// ingest stores the provenance document in Piazza as text, and notes its
+// dataId on the shoreline if there is one.
+func (prov *provenance) ingest(ctx context.Context, sceneID, shoreDataID string, inpObj gsInpStruct, gw Gateway) (string, error) {
+	byts, err := json.Marshal(prov.doc)
+	if err != nil {
+		return "", pzsvc.TraceErr(err)
+	}
+	props := map[string]string{"sceneID": sceneID, "bfType": provMetaType}
+	if shoreDataID != "" {
+		props["shoreDataID"] = shoreDataID
+	}
+	provDataID, err := gw.Ingest(ctx, sceneID+".prov.json", "text", inpObj.PzAddr, "bf-handle provenance", Version, inpObj.PzAuth, byts, props)
+	if err != nil {
+		return "", pzsvc.TraceErr(err)
+	}
+	if shoreDataID != "" {
+		if err = gw.UpdateFileMeta(ctx, shoreDataID, inpObj.PzAddr, inpObj.PzAuth, map[string]string{"provDataID": provDataID}); err != nil {
+			log.Print(pzsvc.TraceStr("Could not note provenance " + provDataID + " on shoreline " + shoreDataID + ": " + err.Error()))
+		}
+	}
+	return provDataID, nil
+}
@@ -0,0 +1,145 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bf
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestProvenance(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bf-handle-provenance")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	gw, err := NewLocalGateway(dir)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	shoreID, err := gw.Ingest(context.Background(), "shoreline.geojson", "geojson", "", "test", "", "", []byte(`{"type":"FeatureCollection","features":[]}`), nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	inpObj := gsInpStruct{AlgoType: "shoreline", MetaJSON: &CatFeature{ID: "landsat:a"}}
+	prov := newProvenance(inpObj)
+	whole := prov.start(stageProcessScene)
+	stage := prov.start(stageRunAlgorithm)
+	stage.end(nil, map[string]interface{}{"bf:command": "shoreline img1.TIF"})
+	prov.used(stageRunAlgorithm, "bf:scene")
+	prov.entity("pz:"+shoreID, map[string]interface{}{"prov:type": "bf:Shoreline"})
+	prov.generated("pz:"+shoreID, stageRunAlgorithm)
+	stage = prov.start(stageDeploy)
+	stage.end(errors.New("no GeoServer"), nil)
+	whole.end(nil, nil)
+
+	if len(prov.timings) != 3 {
+		t.Errorf(`TestProvenance: expected 3 stage timings, got %v.`, prov.timings)
+	}
+	provID, err := prov.ingest(context.Background(), "landsat:a", shoreID, inpObj, gw)
+	if err != nil {
+		t.Fatal(`TestProvenance: failed to ingest: ` + err.Error())
+	}
+	desc, err := gw.GetFileMeta(context.Background(), shoreID, "", "")
+	if err != nil || desc.ResMeta.Metadata["provDataID"] != provID {
+		t.Error(`TestProvenance: provenance was not noted on the shoreline.`)
+	}
+
+	byts, err := gw.DownloadBytes(context.Background(), provID, "", "")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	var doc provDoc
+	if err = json.Unmarshal(byts, &doc); err != nil {
+		t.Fatal(`TestProvenance: could not read document: ` + err.Error())
+	}
+	if doc.Activity["bf:"+stageRunAlgorithm]["bf:command"] != "shoreline img1.TIF" {
+		t.Errorf(`TestProvenance: unexpected algorithm activity %v.`, doc.Activity["bf:"+stageRunAlgorithm])
+	}
+	if doc.Activity["bf:"+stageDeploy]["bf:error"] != "no GeoServer" {
+		t.Error(`TestProvenance: deploy error was not recorded.`)
+	}
+	if _, ok := doc.Activity["bf:"+stageProcessScene]["prov:endTime"]; !ok {
+		t.Error(`TestProvenance: scene activity has no end time.`)
+	}
+	if doc.Entity["bf:scene"]["bf:sceneId"] != "landsat:a" {
+		t.Errorf(`TestProvenance: unexpected scene entity %v.`, doc.Entity["bf:scene"])
+	}
+	if len(doc.Used) != 1 || len(doc.WasGeneratedBy) != 1 || len(doc.WasAssociatedWith) != 3 || len(doc.WasInformedBy) != 2 {
+		t.Errorf(`TestProvenance: unexpected relations %d/%d/%d/%d.`,
+			len(doc.Used), len(doc.WasGeneratedBy), len(doc.WasAssociatedWith), len(doc.WasInformedBy))
+	}
+	for _, assoc := range doc.WasAssociatedWith {
+		if assoc["prov:activity"] == "bf:"+stageRunAlgorithm && assoc["prov:agent"] != "bf:algorithm" {
+			t.Error(`TestProvenance: algorithm run was not associated with the algorithm.`)
+		}
+	}
+}
+
+func TestGenShorelineProvenance(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bf-handle-provenance")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	gw, err := NewLocalGateway(dir)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// a failed scene still gets a provenance record saying where it failed
+	inpObj := gsInpStruct{AlgoType: "no-such-algorithm", MetaJSON: &CatFeature{ID: "landsat:b"}}
+	result, err := genShoreline(context.Background(), inpObj, gw)
+	if err == nil {
+		t.Fatal(`TestGenShorelineProvenance: expected an error for an unknown algorithm.`)
+	}
+	if result == nil || result.provDataID == "" {
+		t.Fatal(`TestGenShorelineProvenance: no provenance was recorded.`)
+	}
+	if result.failedStage != stageResolveImages {
+		t.Errorf(`TestGenShorelineProvenance: failed stage was %s.`, result.failedStage)
+	}
+	if _, ok := result.timings[stageResolveImages]; !ok {
+		t.Errorf(`TestGenShorelineProvenance: unexpected timings %v.`, result.timings)
+	}
+	byts, err := gw.DownloadBytes(context.Background(), result.provDataID, "", "")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	var doc provDoc
+	if err = json.Unmarshal(byts, &doc); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, ok := doc.Activity["bf:"+stageResolveImages]["bf:error"]; !ok {
+		t.Error(`TestGenShorelineProvenance: the failing stage was not recorded.`)
+	}
+	if _, ok := doc.Activity["bf:"+stageRunAlgorithm]; ok {
+		t.Error(`TestGenShorelineProvenance: recorded a stage that never ran.`)
+	}
+
+	// the provenance mentions the scene, but is not a result for it
+	textID, err := gw.Ingest(context.Background(), "landsat:b.txt", "text", "", "", "", "", []byte("landsat:b"), nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if dataIDs, err := resultsBySceneID(context.Background(), "landsat:b", "", "", gw); err != nil || len(dataIDs) != 1 || dataIDs[0] != textID {
+		t.Errorf(`TestGenShorelineProvenance: unexpected results for the scene: %v, %v`, dataIDs, err)
+	}
+}
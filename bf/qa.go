@@ -0,0 +1,514 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bf
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/venicegeo/geojson-go/geojson"
+	"github.com/venicegeo/pzsvc-lib"
+)
+
+const (
+	qaSampleSpacing    = 30 // meters between the points measured along each line, about a Landsat pixel
+	defaultQATolerance = 90 // how close a shoreline must come to the baseline to recover it, in meters
+	qaAreaMargin       = 1  // degrees around the scene within which the baseline is projected
+)
+
+// qaDownloadTimeout bounds the download of each shoreline for QA.
+const qaDownloadTimeout = 5 * time.Minute
+
+// qaReport describes how closely a detected shoreline follows the
+// baseline.  Offsets are the distances in meters from points along the
+// shoreline to the nearest baseline, and the Hausdorff distance is the
+// greatest distance from either line to the other.  Recovered is the
+// fraction of the baseline in the scene that is within the tolerance of
+// a shoreline.
+type qaReport struct {
+	Scenes         int     `json:"scenes,omitempty"` // for batch summaries
+	Samples        int     `json:"samples"`
+	MeanOffset     float64 `json:"meanOffset"`
+	MedianOffset   float64 `json:"medianOffset"`
+	P95Offset      float64 `json:"p95Offset"`
+	Hausdorff      float64 `json:"hausdorff"`
+	BaselineLength float64 `json:"baselineLength"`
+	Recovered      float64 `json:"recovered"`
+}
+
+// qaMeasure is the raw material of a qaReport, kept so that the measures
+// of several scenes can be pooled into one.
+type qaMeasure struct {
+	scenes          int
+	offsets         []float64
+	hausdorff       float64
+	baselineLength  float64
+	recoveredLength float64
+}
+
+type qaInpStruct struct {
+	PzAddr      string                 `json:"pzAddr"`                // gateway URL for this Pz instance
+	PzAuth      string                 `json:"pzAuthToken,omitempty"` // Auth string for this Pz instance
+	Baseline    map[string]interface{} `json:"baseline"`              // Baseline shoreline, as GeoJSON
+	ShoreDataID string                 `json:"shoreDataID,omitempty"` // Piazza ID of the shorelines to evaluate
+	Shorelines  map[string]interface{} `json:"shorelines,omitempty"`  // Shorelines as GeoJSON, instead of shoreDataID
+	Footprint   map[string]interface{} `json:"footprint,omitempty"`   // Area that the shorelines cover, as GeoJSON (optional)
+	QATolerance float64                `json:"qaTolerance,omitempty"` // How close counts as recovered, in meters (optional)
+}
+
+// ShorelineQA measures how closely a set of shorelines follows the
+// baseline, and returns a qaReport.
+func ShorelineQA(w http.ResponseWriter, r *http.Request, gw Gateway) {
+	var (
+		b          []byte
+		err        error
+		inpObj     qaInpStruct
+		shorelines []*geojson.Feature
+		tolerance  float64
+		area       interface{}
+	)
+
+	// clients to this function expect a JSON response
+	// containing the error message
+	handleError := func(errmsg string, status int) {
+		log.Print(errmsg)
+		outpErr := pzsvc.Error{Message: errmsg}
+		b, err = json.Marshal(outpErr)
+		if err != nil {
+			b = []byte(`{"error":"json.Marshal error: ` + err.Error() + `", "baseError":"` + errmsg + `"}`)
+		}
+		http.Error(w, string(b), status)
+	}
+
+	if b, err = pzsvc.ReadBodyJSON(&inpObj, r.Body); err != nil {
+		handleError(pzsvc.TraceStr("Error: pzsvc.ReadBodyJSON: "+err.Error()+".\nInput String: "+string(b)), http.StatusBadRequest)
+		return
+	}
+	if inpObj.PzAuth == "" {
+		inpObj.PzAuth = os.Getenv("BFH_PZ_AUTH")
+	}
+	if inpObj.Baseline == nil {
+		handleError(pzsvc.TraceStr("Input must contain a baseline."), http.StatusBadRequest)
+		return
+	}
+	if tolerance, err = qaTolerance(inpObj.QATolerance); err != nil {
+		handleError(err.Error(), http.StatusBadRequest)
+		return
+	}
+	scInpObj := scInpStruct{PzAddr: inpObj.PzAddr, PzAuth: inpObj.PzAuth}
+	if shorelines, err = changeShorelines(r.Context(), inpObj.ShoreDataID, inpObj.Shorelines, scInpObj, gw); err != nil {
+		handleError(pzsvc.TraceStr("Could not read the shorelines: "+err.Error()), http.StatusBadRequest)
+		return
+	}
+	if inpObj.Footprint != nil {
+		area = geojson.FromMap(inpObj.Footprint)
+	}
+
+	frame := frameFor(inpObj.Baseline)
+	measure, err := measureFeatures(inpObj.Baseline, shorelines, area, frame, tolerance)
+	if err != nil {
+		handleError(err.Error(), http.StatusBadRequest)
+		return
+	}
+	if b, err = json.Marshal(measure.report()); err != nil {
+		handleError(pzsvc.TraceStr("Failed to write QA report: "+err.Error()), http.StatusInternalServerError)
+		return
+	}
+	w.Write(b)
+}
+
+// qaTolerance returns the tolerance to use for recovering the baseline,
+// given the requested one.
+func qaTolerance(requested float64) (float64, error) {
+	switch {
+	case requested < 0:
+		return 0, pzsvc.ErrWithTrace(fmt.Sprintf("qaTolerance must not be negative, not %v.", requested))
+	case requested == 0:
+		return defaultQATolerance, nil
+	}
+	return requested, nil
+}
+
+// qaFootprints measures the shoreline of each of the given detection
+// results against the baseline.  Each result gets its report as "qa."
+// properties, which assembly passes on to its shorelines, and the batch
+// job gets a summary of them all.  Each download is bounded by
+// qaDownloadTimeout, and the pass stops early if ctx is cancelled.
+func qaFootprints(ctx context.Context, job *batchJob, inpObj asInpStruct, results []*geojson.Feature, gw Gateway) {
+	var (
+		total      qaMeasure
+		shorelines []*geojson.Feature
+		stream     io.ReadCloser
+		feature    *geojson.Feature
+		err        error
+	)
+	tolerance, _ := qaTolerance(inpObj.QATolerance)
+	frame := frameFor(inpObj.Baseline)
+	for inx, result := range results {
+		if result == nil {
+			continue
+		}
+		if ctx.Err() != nil {
+			log.Print(pzsvc.TraceStr("QA stopped: " + ctx.Err().Error()))
+			break
+		}
+		shoreDataID := result.PropertyString("shoreDataID")
+		dlCtx, cancel := context.WithTimeout(ctx, qaDownloadTimeout)
+		if stream, err = gw.DownloadStream(dlCtx, shoreDataID, inpObj.PzAddr, inpObj.PzAuth); err != nil {
+			cancel()
+			log.Print(pzsvc.TraceStr("QA could not download shoreline " + shoreDataID + ": " + err.Error()))
+			continue
+		}
+		shorelines = nil
+		scanner := newFeatureScanner(stream)
+		for {
+			if feature, err = scanner.next(); err != nil {
+				break
+			}
+			shorelines = append(shorelines, feature)
+		}
+		stream.Close()
+		cancel()
+		if err != io.EOF {
+			log.Print(pzsvc.TraceStr("QA could not read shoreline " + shoreDataID + ": " + err.Error()))
+			continue
+		}
+
+		measure, err := measureFeatures(inpObj.Baseline, shorelines, result.Geometry, frame, tolerance)
+		if err != nil {
+			log.Print(pzsvc.TraceStr("QA failed for " + shoreDataID + ": " + err.Error()))
+			continue
+		}
+		report := measure.report()
+		report.setProperties(result.Properties)
+		job.setFootprintQA(inx, report)
+		total.add(measure)
+		log.Printf("QA for %v: mean offset %.1f m, %.0f%% of baseline recovered.", result.ID, report.MeanOffset, report.Recovered*100)
+	}
+	if total.scenes > 0 {
+		job.setQA(total.report())
+	}
+}
+
+// setProperties records the report in the given feature properties.
+func (report *qaReport) setProperties(props map[string]interface{}) {
+	props["qa.meanOffset"] = report.MeanOffset
+	props["qa.medianOffset"] = report.MedianOffset
+	props["qa.p95Offset"] = report.P95Offset
+	props["qa.hausdorff"] = report.Hausdorff
+	props["qa.recovered"] = report.Recovered
+}
+
+// qaProperties copies the "qa." properties from one feature's properties
+// to another's.
+func qaProperties(from, to map[string]interface{}) {
+	for _, key := range []string{"qa.meanOffset", "qa.medianOffset", "qa.p95Offset", "qa.hausdorff", "qa.recovered"} {
+		if value, ok := from[key]; ok {
+			to[key] = value
+		}
+	}
+}
+
+// measureFeatures measures the given shoreline features against the
+// baseline, within the given area if there is one.
+func measureFeatures(baseline interface{}, shorelines []*geojson.Feature, area interface{}, frame lonFrame, tolerance float64) (qaMeasure, error) {
+	var (
+		gjIfc interface{}
+		err   error
+		lines [][][]float64
+	)
+	if gjIfc, err = frame.normalize(baseline); err != nil {
+		return qaMeasure{}, err
+	}
+	baseLines := geoJSONLines(gjIfc)
+	for _, shoreline := range shorelines {
+		if shoreline.Geometry == nil {
+			continue
+		}
+		if gjIfc, err = frame.normalize(shoreline.Geometry); err != nil {
+			return qaMeasure{}, err
+		}
+		lines = append(lines, featureLines(gjIfc)...)
+	}
+	if area != nil {
+		if area, err = frame.normalize(area); err != nil {
+			return qaMeasure{}, err
+		}
+	}
+	return measureShoreline(baseLines, lines, area, tolerance), nil
+}
+
+// measureShoreline measures the shoreline lines against the baseline
+// lines, all in longitude and latitude.  Only the baseline within the
+// area counts toward recovery and the Hausdorff distance; without an area,
+// the bounding box of the shoreline stands in for it.  Everything is
+// worked in the UTM zone of the middle of the area.
+func measureShoreline(baseline, shoreline [][][]float64, area interface{}, tolerance float64) qaMeasure {
+	var (
+		areaEnv envelope
+		ok      bool
+		inArea  func(point []float64) bool
+	)
+	measure := qaMeasure{scenes: 1}
+	if area != nil {
+		areaEnv, ok = envelopeOf(area)
+		inArea = func(point []float64) bool { return pointInGeoJSON(point, area) }
+	}
+	if !ok {
+		if areaEnv, ok = envelopeOf(geojson.NewMultiLineString(shoreline)); !ok {
+			return measure
+		}
+		inArea = func(point []float64) bool {
+			return areaEnv.intersects(envelope{point[0], point[1], point[0], point[1]})
+		}
+	}
+	centerLon := areaEnv.centerX()
+	zone, north := utmZoneOf(centerLon), areaEnv.centerY() >= 0
+	project := toUTM(zone, north)
+	unproject := fromUTM(zone, north)
+
+	// Only the baseline near the area is projected; far from its zone,
+	// UTM would make nonsense of it
+	near := envelope{areaEnv[0] - qaAreaMargin, areaEnv[1] - qaAreaMargin, areaEnv[2] + qaAreaMargin, areaEnv[3] + qaAreaMargin}
+	projectLines := func(lines [][][]float64, keep func(a, b []float64) bool) [][][]float64 {
+		var result [][][]float64
+		for _, line := range lines {
+			var run [][]float64
+			for inx := 0; inx+1 < len(line); inx++ {
+				if !keep(line[inx], line[inx+1]) {
+					if len(run) > 0 {
+						result = append(result, run)
+						run = nil
+					}
+					continue
+				}
+				if len(run) == 0 {
+					run = append(run, projectPoint(line[inx], project))
+				}
+				run = append(run, projectPoint(line[inx+1], project))
+			}
+			if len(run) > 0 {
+				result = append(result, run)
+			}
+		}
+		return result
+	}
+	baseUTM := projectLines(baseline, func(a, b []float64) bool {
+		return near.intersects(envelope{math.Min(a[0], b[0]), math.Min(a[1], b[1]), math.Max(a[0], b[0]), math.Max(a[1], b[1])})
+	})
+	shoreUTM := projectLines(shoreline, func(a, b []float64) bool { return true })
+	baseIndex := newSegmentIndex(baseUTM)
+	shoreIndex := newSegmentIndex(shoreUTM)
+
+	for _, line := range shoreUTM {
+		for _, sample := range densify(line, qaSampleSpacing) {
+			if offset := baseIndex.distance(sample.point); !math.IsInf(offset, 1) {
+				measure.offsets = append(measure.offsets, offset)
+				measure.hausdorff = math.Max(measure.hausdorff, offset)
+			}
+		}
+	}
+	for _, line := range baseUTM {
+		for _, sample := range densify(line, qaSampleSpacing) {
+			lon, lat := unproject(sample.point[0], sample.point[1])
+			if !inArea([]float64{nearLon(lon, centerLon), lat}) {
+				continue
+			}
+			measure.baselineLength += sample.length
+			gap := shoreIndex.distance(sample.point)
+			if gap <= tolerance {
+				measure.recoveredLength += sample.length
+			}
+			if !math.IsInf(gap, 1) {
+				measure.hausdorff = math.Max(measure.hausdorff, gap)
+			}
+		}
+	}
+	return measure
+}
+
+func projectPoint(point []float64, transform coordTransform) []float64 {
+	x, y := transform(point[0], point[1])
+	return []float64{x, y}
+}
+
+// add pools another measure into this one.
+func (measure *qaMeasure) add(other qaMeasure) {
+	measure.scenes += other.scenes
+	measure.offsets = append(measure.offsets, other.offsets...)
+	measure.hausdorff = math.Max(measure.hausdorff, other.hausdorff)
+	measure.baselineLength += other.baselineLength
+	measure.recoveredLength += other.recoveredLength
+}
+
+func (measure qaMeasure) report() *qaReport {
+	result := qaReport{Samples: len(measure.offsets), Hausdorff: measure.hausdorff, BaselineLength: measure.baselineLength}
+	if measure.scenes > 1 {
+		result.Scenes = measure.scenes
+	}
+	if measure.baselineLength > 0 {
+		result.Recovered = measure.recoveredLength / measure.baselineLength
+	}
+	if len(measure.offsets) == 0 {
+		return &result
+	}
+	offsets := append([]float64(nil), measure.offsets...)
+	sort.Float64s(offsets)
+	sum := 0.0
+	for _, offset := range offsets {
+		sum += offset
+	}
+	result.MeanOffset = sum / float64(len(offsets))
+	result.MedianOffset = percentile(offsets, 0.5)
+	result.P95Offset = percentile(offsets, 0.95)
+	return &result
+}
+
+// percentile interpolates the given fraction of the way through the
+// sorted values.
+func percentile(sorted []float64, fraction float64) float64 {
+	pos := fraction * float64(len(sorted)-1)
+	lower := int(math.Floor(pos))
+	if lower+1 >= len(sorted) {
+		return sorted[len(sorted)-1]
+	}
+	return sorted[lower] + (sorted[lower+1]-sorted[lower])*(pos-float64(lower))
+}
+
+// qaSample is a point along a line, standing for length meters of it.
+type qaSample struct {
+	point  []float64
+	length float64
+}
+
+// densify returns samples along the line at no more than spacing apart,
+// each in the middle of the stretch it stands for.
+func densify(line [][]float64, spacing float64) []qaSample {
+	var result []qaSample
+	for inx := 0; inx+1 < len(line); inx++ {
+		from, to := line[inx], line[inx+1]
+		dx, dy := to[0]-from[0], to[1]-from[1]
+		length := math.Hypot(dx, dy)
+		if length == 0 {
+			continue
+		}
+		count := math.Ceil(length / spacing)
+		for step := 0.0; step < count; step++ {
+			frac := (step + 0.5) / count
+			result = append(result, qaSample{point: []float64{from[0] + dx*frac, from[1] + dy*frac}, length: length / count})
+		}
+	}
+	return result
+}
+
+// segmentIndex holds the segments of some lines in an STR tree, for
+// finding the distance from a point to the nearest of them.
+type segmentIndex struct {
+	segments [][2][]float64
+	tree     *strTree
+}
+
+func newSegmentIndex(lines [][][]float64) *segmentIndex {
+	var (
+		result segmentIndex
+		envs   []envelope
+	)
+	for _, line := range lines {
+		for inx := 0; inx+1 < len(line); inx++ {
+			a, b := line[inx], line[inx+1]
+			result.segments = append(result.segments, [2][]float64{a, b})
+			envs = append(envs, envelope{math.Min(a[0], b[0]), math.Min(a[1], b[1]), math.Max(a[0], b[0]), math.Max(a[1], b[1])})
+		}
+	}
+	result.tree = newSTRTree(envs)
+	return &result
+}
+
+// distance returns the distance from the point to the nearest segment, or
+// +Inf if there are none.  The search window doubles until it finds a
+// segment within its radius, or takes in everything.
+func (index *segmentIndex) distance(point []float64) float64 {
+	bounds, ok := index.tree.bounds()
+	if !ok {
+		return math.Inf(1)
+	}
+	for radius := qaSampleSpacing * 2.0; ; radius *= 2 {
+		window := envelope{point[0] - radius, point[1] - radius, point[0] + radius, point[1] + radius}
+		best := math.Inf(1)
+		for _, item := range index.tree.query(window) {
+			segment := index.segments[item]
+			best = math.Min(best, segmentDistance(point, segment[0], segment[1]))
+		}
+		if best <= radius || (window[0] <= bounds[0] && window[1] <= bounds[1] && window[2] >= bounds[2] && window[3] >= bounds[3]) {
+			return best
+		}
+	}
+}
+
+// segmentDistance returns the distance from p to the segment from a to b.
+func segmentDistance(p, a, b []float64) float64 {
+	dx, dy := b[0]-a[0], b[1]-a[1]
+	frac := 0.0
+	if lengthSq := dx*dx + dy*dy; lengthSq > 0 {
+		frac = math.Max(0, math.Min(1, ((p[0]-a[0])*dx+(p[1]-a[1])*dy)/lengthSq))
+	}
+	return math.Hypot(p[0]-(a[0]+dx*frac), p[1]-(a[1]+dy*frac))
+}
+
+// pointInGeoJSON reports whether the point is inside the given polygonal
+// GeoJSON.
+func pointInGeoJSON(point []float64, input interface{}) bool {
+	inPolygon := func(rings [][][]float64) bool {
+		inside := false
+		for _, ring := range rings {
+			// every ring crossed toggles, so holes take care of themselves
+			for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+				a, b := ring[i], ring[j]
+				if (a[1] > point[1]) != (b[1] > point[1]) &&
+					point[0] < (b[0]-a[0])*(point[1]-a[1])/(b[1]-a[1])+a[0] {
+					inside = !inside
+				}
+			}
+		}
+		return inside
+	}
+	switch it := input.(type) {
+	case *geojson.Feature:
+		return pointInGeoJSON(point, it.Geometry)
+	case *geojson.Polygon:
+		return inPolygon(it.Coordinates)
+	case *geojson.MultiPolygon:
+		for _, polygon := range it.Coordinates {
+			if inPolygon(polygon) {
+				return true
+			}
+		}
+	case *geojson.GeometryCollection:
+		for _, geometry := range it.Geometries {
+			if pointInGeoJSON(point, geometry) {
+				return true
+			}
+		}
+	}
+	return false
+}
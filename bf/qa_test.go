@@ -0,0 +1,104 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bf
+
+import (
+	"math"
+	"testing"
+
+	"github.com/venicegeo/geojson-go/geojson"
+)
+
+func TestMeasureShoreline(t *testing.T) {
+	// a baseline 0.1 degrees long, and a shoreline about 100 m north of
+	// its western half
+	baseline := [][][]float64{{{10, 0.5}, {10.1, 0.5}}}
+	shoreline := [][][]float64{{{10, 0.5009}, {10.05, 0.5009}}}
+	area := geojson.NewPolygon([][][]float64{{{10, 0.4}, {10.1, 0.4}, {10.1, 0.6}, {10, 0.6}, {10, 0.4}}})
+
+	report := measureShoreline(baseline, shoreline, area, 120).report()
+	if math.Abs(report.MeanOffset-99.5) > 1 || math.Abs(report.MedianOffset-99.5) > 1 || math.Abs(report.P95Offset-99.5) > 1 {
+		t.Errorf(`TestMeasureShoreline: expected offsets of about 99.5 m, got %#v`, report)
+	}
+	if math.Abs(report.Recovered-0.5) > 0.01 {
+		t.Errorf(`TestMeasureShoreline: expected half the baseline recovered, got %v`, report.Recovered)
+	}
+	if math.Abs(report.BaselineLength-11132) > 20 {
+		t.Errorf(`TestMeasureShoreline: expected about 11132 m of baseline, got %v`, report.BaselineLength)
+	}
+	// the far end of the baseline is about 5.5 km from the shoreline
+	if report.Hausdorff < 5500 || report.Hausdorff > 5600 {
+		t.Errorf(`TestMeasureShoreline: expected a Hausdorff distance of about 5.5 km, got %v`, report.Hausdorff)
+	}
+	if report = measureShoreline(baseline, shoreline, area, 90).report(); report.Recovered != 0 {
+		t.Errorf(`TestMeasureShoreline: expected nothing recovered within 90 m, got %v`, report.Recovered)
+	}
+
+	// without an area, only the baseline alongside the shoreline counts
+	if report = measureShoreline(baseline, [][][]float64{{{10, 0.4}, {10.05, 0.6}}}, nil, 120).report(); math.Abs(report.BaselineLength-5566) > 20 {
+		t.Errorf(`TestMeasureShoreline: expected about 5566 m of baseline, got %v`, report.BaselineLength)
+	}
+
+	var total qaMeasure
+	total.add(measureShoreline(baseline, shoreline, area, 120))
+	total.add(measureShoreline(baseline, nil, area, 120))
+	if report = total.report(); report.Scenes != 2 || math.Abs(report.Recovered-0.25) > 0.01 {
+		t.Errorf(`TestMeasureShoreline: unexpected pooled report %#v`, report)
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	sorted := []float64{1, 2, 3, 4, 5}
+	if actual := percentile(sorted, 0.5); actual != 3 {
+		t.Errorf(`TestPercentile: expected a median of 3, got %v`, actual)
+	}
+	if actual := percentile(sorted, 0.95); math.Abs(actual-4.8) > 1e-9 {
+		t.Errorf(`TestPercentile: expected 4.8, got %v`, actual)
+	}
+	if actual := percentile([]float64{7}, 0.95); actual != 7 {
+		t.Errorf(`TestPercentile: expected 7, got %v`, actual)
+	}
+}
+
+func TestSegmentIndex(t *testing.T) {
+	index := newSegmentIndex([][][]float64{{{0, 0}, {100, 0}}, {{5000, 5000}, {5000, 6000}}})
+	cases := []struct {
+		point    []float64
+		expected float64
+	}{{[]float64{50, 10}, 10}, {[]float64{-30, 40}, 50}, {[]float64{4000, 5500}, 1000}, {[]float64{2000, 0}, 1900}}
+	for _, c := range cases {
+		if actual := index.distance(c.point); math.Abs(actual-c.expected) > 1e-9 {
+			t.Errorf(`TestSegmentIndex: expected %v from %v, got %v`, c.expected, c.point, actual)
+		}
+	}
+	if actual := newSegmentIndex(nil).distance([]float64{0, 0}); !math.IsInf(actual, 1) {
+		t.Errorf(`TestSegmentIndex: expected +Inf with no segments, got %v`, actual)
+	}
+}
+
+func TestPointInGeoJSON(t *testing.T) {
+	donut := geojson.NewPolygon([][][]float64{
+		{{0, 0}, {10, 0}, {10, 10}, {0, 10}, {0, 0}},
+		{{4, 4}, {6, 4}, {6, 6}, {4, 6}, {4, 4}}})
+	cases := []struct {
+		point    []float64
+		expected bool
+	}{{[]float64{2, 2}, true}, {[]float64{5, 5}, false}, {[]float64{12, 5}, false}}
+	for _, c := range cases {
+		if actual := pointInGeoJSON(c.point, geojson.NewFeature(donut, nil, nil)); actual != c.expected {
+			t.Errorf(`TestPointInGeoJSON: expected %v for %v`, c.expected, c.point)
+		}
+	}
+}
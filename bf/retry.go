@@ -0,0 +1,143 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bf
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"time"
+)
+
+/*
+Asynch jobs that fail are retried when the failure looks like it might not
+happen again: an algorithm service, Piazza or GeoServer that was briefly
+unavailable, for example.  Each job can carry its own retry policy, under
+"retry" in its input; otherwise it gets the default one.  Failures are
+classed by the stage of processing that they happened in (see
+provenance.go), along with "sceneMetadata" for fetching metaDataURL,
+"interrupted" for jobs whose instance of bf-handle stopped running them
+(see lease.go), and "input" for anything wrong with the request itself.  Jobs that fail in a
+class that is not retried are marked as errors at once.  Jobs that are
+still failing after their last attempt go to the dead-letter list, from
+which they can be requeued.
+*/
+
+const (
+	defaultMaxAttempts = 3
+	defaultBackoff     = 30  // seconds before the first retry
+	defaultMaxBackoff  = 600 // seconds
+	maxRetryAttempts   = 20
+)
+
+// error classes other than the stages of processing
+const (
+	failSceneMetadata = "sceneMetadata"
+	failInterrupted   = "interrupted"
+	failInput         = "input"
+	failUnknown       = "unknown"
+)
+
+var defaultRetryOn = []string{failSceneMetadata, failInterrupted, stageRunAlgorithm, stageIngestMeta, stageDeploy}
+
+var errorClasses = map[string]bool{
+	failSceneMetadata:  true,
+	failInterrupted:    true,
+	failInput:          true,
+	failUnknown:        true,
+	stageResolveImages: true,
+	stageTideLookup:    true,
+	stageRunAlgorithm:  true,
+	stageIngestMeta:    true,
+	stageDeploy:        true}
+
+// retryPolicy says how often, how soon, and for which classes of error a
+// failed job is retried.  Zero values take the defaults.
+type retryPolicy struct {
+	MaxAttempts int      `json:"maxAttempts"` // attempts in all, including the first
+	Backoff     float64  `json:"backoff"`     // seconds before the first retry, doubling each time
+	MaxBackoff  float64  `json:"maxBackoff"`  // most seconds between attempts
+	RetryOn     []string `json:"retryOn"`     // classes of error to retry
+}
+
+// asynchOptions are the parts of an asynch job's input that are about the
+// job, rather than the scene.
+type asynchOptions struct {
+	Retry *retryPolicy `json:"retry,omitempty"`
+}
+
+// jobRetryPolicy reads the retry policy out of a job's input, filling in
+// the defaults, and checks it.
+func jobRetryPolicy(inpStr string) (retryPolicy, error) {
+	var options asynchOptions
+	if err := json.Unmarshal([]byte(inpStr), &options); err != nil {
+		return retryPolicy{}, err
+	}
+	var policy retryPolicy
+	if options.Retry != nil {
+		policy = *options.Retry
+	}
+	if policy.MaxAttempts == 0 {
+		policy.MaxAttempts = defaultMaxAttempts
+	}
+	if policy.Backoff == 0 {
+		policy.Backoff = defaultBackoff
+	}
+	if policy.MaxBackoff == 0 {
+		policy.MaxBackoff = math.Max(defaultMaxBackoff, policy.Backoff)
+	}
+	if policy.RetryOn == nil {
+		policy.RetryOn = defaultRetryOn
+	}
+	if policy.MaxAttempts < 1 || policy.MaxAttempts > maxRetryAttempts {
+		return policy, errors.New("retry.maxAttempts must be between 1 and 20")
+	}
+	if policy.Backoff < 0 || policy.MaxBackoff < policy.Backoff {
+		return policy, errors.New("retry.backoff must not be negative, nor more than retry.maxBackoff")
+	}
+	for _, class := range policy.RetryOn {
+		if !errorClasses[class] {
+			return policy, errors.New(`retry.retryOn: unknown error class "` + class + `"`)
+		}
+	}
+	return policy, nil
+}
+
+// retries reports whether the policy retries the given class of error
+func (policy retryPolicy) retries(class string) bool {
+	for _, retryClass := range policy.RetryOn {
+		if retryClass == class {
+			return true
+		}
+	}
+	return false
+}
+
+// delay is how long to wait after the given attempt before the next one
+func (policy retryPolicy) delay(attempt int) time.Duration {
+	seconds := math.Min(policy.Backoff*math.Pow(2, float64(attempt-1)), policy.MaxBackoff)
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// errorClass works out the class of a processScene failure
+func errorClass(outpObj *gsOutpStruct, httpStatus int) string {
+	switch {
+	case outpObj.FailedStage != "":
+		return outpObj.FailedStage
+	case httpStatus < 500:
+		return failInput
+	}
+	return failUnknown
+}
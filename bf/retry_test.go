@@ -0,0 +1,132 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bf
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/venicegeo/pzsvc-lib"
+)
+
+func TestJobRetryPolicy(t *testing.T) {
+	policy, err := jobRetryPolicy(`{"algoType":"ndwi"}`)
+	if err != nil || policy.MaxAttempts != defaultMaxAttempts || !policy.retries(stageDeploy) || policy.retries(failInput) {
+		t.Errorf(`TestJobRetryPolicy: unexpected default policy %#v.`, policy)
+	}
+	policy, err = jobRetryPolicy(`{"retry":{"maxAttempts":5,"backoff":10,"maxBackoff":60,"retryOn":["tideLookup"]}}`)
+	if err != nil || policy.MaxAttempts != 5 || !policy.retries(stageTideLookup) || policy.retries(stageDeploy) {
+		t.Errorf(`TestJobRetryPolicy: unexpected policy %#v.`, policy)
+	}
+	for inx, delay := range []time.Duration{10 * time.Second, 20 * time.Second, 40 * time.Second, time.Minute, time.Minute} {
+		if policy.delay(inx+1) != delay {
+			t.Errorf(`TestJobRetryPolicy: delay after attempt %d was %v, not %v.`, inx+1, policy.delay(inx+1), delay)
+		}
+	}
+	for _, inpStr := range []string{
+		`{"retry":{"maxAttempts":-1}}`,
+		`{"retry":{"maxAttempts":100}}`,
+		`{"retry":{"backoff":100,"maxBackoff":10}}`,
+		`{"retry":{"retryOn":["cosmicRays"]}}`,
+		`{"retry":"often"}`} {
+		if _, err = jobRetryPolicy(inpStr); err == nil {
+			t.Errorf(`TestJobRetryPolicy: accepted %s.`, inpStr)
+		}
+	}
+}
+
+func TestErrorClass(t *testing.T) {
+	if class := errorClass(&gsOutpStruct{FailedStage: stageDeploy}, http.StatusInternalServerError); class != stageDeploy {
+		t.Errorf(`TestErrorClass: got %s rather than the failed stage.`, class)
+	}
+	if class := errorClass(&gsOutpStruct{}, http.StatusBadRequest); class != failInput {
+		t.Errorf(`TestErrorClass: got %s for a bad request.`, class)
+	}
+	if class := errorClass(&gsOutpStruct{}, http.StatusInternalServerError); class != failUnknown {
+		t.Errorf(`TestErrorClass: got %s for an unknown failure.`, class)
+	}
+}
+
+func TestFailAsynchJob(t *testing.T) {
+	defer SetJobStore(jobStore)
+	store := NewMemoryJobStore()
+	SetJobStore(store)
+	policy, _ := jobRetryPolicy(`{"retry":{"maxAttempts":2,"backoff":0.01}}`)
+
+	// a transient failure is retried once its backoff is up
+	store.AddJob("a", "inpA", jobMeta{})
+	_, _, attempt, _ := store.TakeJob(instanceID, time.Now().Add(leaseDuration))
+	failAsynchJob("a", instanceID, "inpA", attempt, policy, stageDeploy, "GeoServer is down")
+	status, _ := store.Status("a")
+	if parsed := parseJobStatus(status); parsed.Status != "Pending" || parsed.Attempt != 1 || parsed.RetryAt == "" || parsed.Result == nil {
+		t.Errorf(`TestFailAsynchJob: unexpected retry status %s.`, status)
+	}
+	if jobID, _, _, _ := store.TakeJob(instanceID, time.Now().Add(leaseDuration)); jobID != "" {
+		t.Error(`TestFailAsynchJob: retried a job before its backoff was up.`)
+	}
+	time.Sleep(20 * time.Millisecond)
+	jobID, inp, attempt, _ := store.TakeJob(instanceID, time.Now().Add(leaseDuration))
+	if jobID != "a" || inp != "inpA" || attempt != 2 {
+		t.Errorf(`TestFailAsynchJob: took %s/%s/%d rather than the retry.`, jobID, inp, attempt)
+	}
+
+	// the last attempt sends it to the dead-letter list
+	failAsynchJob("a", instanceID, "inpA", attempt, policy, stageDeploy, "GeoServer is still down")
+	status, _ = store.Status("a")
+	if parsed := parseJobStatus(status); parsed.Status != "Error" || !parsed.DeadLetter || parsed.Attempt != 2 {
+		t.Errorf(`TestFailAsynchJob: unexpected dead status %s.`, status)
+	}
+
+	// errors that are not retried fail at once
+	store.AddJob("b", "inpB", jobMeta{})
+	_, _, attempt, _ = store.TakeJob(instanceID, time.Now().Add(leaseDuration))
+	failAsynchJob("b", instanceID, "inpB", attempt, policy, failInput, "no such band")
+	status, _ = store.Status("b")
+	if parsed := parseJobStatus(status); parsed.Status != "Error" || parsed.DeadLetter {
+		t.Errorf(`TestFailAsynchJob: unexpected error status %s.`, status)
+	}
+
+	w, outStr, outInt := pzsvc.GetMockResponseWriter()
+	getDeadLetters(w)
+	var deadObj struct {
+		DeadLetters []struct {
+			JobID  string    `json:"jobId"`
+			Status jobStatus `json:"status"`
+		} `json:"deadLetters"`
+	}
+	if err := json.Unmarshal([]byte(*outStr), &deadObj); err != nil || *outInt != http.StatusOK ||
+		len(deadObj.DeadLetters) != 1 || deadObj.DeadLetters[0].JobID != "a" || !deadObj.DeadLetters[0].Status.DeadLetter {
+		t.Errorf(`TestFailAsynchJob: unexpected dead letters %s.`, *outStr)
+	}
+
+	w, _, outInt = pzsvc.GetMockResponseWriter()
+	requeueAsynchJob(w, "b")
+	if *outInt != http.StatusBadRequest {
+		t.Error(`TestFailAsynchJob: requeued a job that was not dead.`)
+	}
+	w, _, outInt = pzsvc.GetMockResponseWriter()
+	requeueAsynchJob(w, "a")
+	if *outInt != http.StatusOK {
+		t.Error(`TestFailAsynchJob: failed to requeue a dead job.`)
+	}
+	if jobIDs, _ := store.DeadJobs(); len(jobIDs) != 0 {
+		t.Error(`TestFailAsynchJob: requeued job is still in the dead-letter list.`)
+	}
+	if jobID, inp, attempt, _ = store.TakeJob(instanceID, time.Now().Add(leaseDuration)); jobID != "a" || inp != "inpA" || attempt != 1 {
+		t.Errorf(`TestFailAsynchJob: took %s/%s/%d rather than the requeued job.`, jobID, inp, attempt)
+	}
+}
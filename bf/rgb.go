@@ -14,63 +14,159 @@
 
 package bf
 
-/*
 import (
+	"context"
 	"fmt"
+	"math"
+	"sort"
 
 	"github.com/venicegeo/pzsvc-exec/pzse"
 	"github.com/venicegeo/pzsvc-lib"
 )
 
+// the fraction of pixels clipped off each end by the local stretch
+const rgbClipFraction = 0.02
+
 // rgbGen is designed to work as a subthread function.  It takes in
 // a basic input object, provisions appropriate files out of the band
-// information, and applies some manner of bandmerge to them (currently
-// only pzsvc-ossim is available).  The results get pushed back through
-// the given channel.
-func rgbGen(inpObj gsInpStruct, rgbChan chan string) {
+// information, and applies some manner of bandmerge to them: either
+// pzsvc-ossim, or "local" for the one built into bf-handle.  The
+// resulting Geoserver layer, or an error string beginning with "Error:",
+// gets pushed back through the given channel.
+func rgbGen(ctx context.Context, inpObj gsInpStruct, rgbChan chan string, gw Gateway) {
 	var (
-		err       error
-		fileID    string
-		outStruct *pzse.OutStruct
+		err     error
+		fileID  string
+		deplObj *pzsvc.DeplStrct
 	)
 
+	bands := inpObj.MetaJSON.Properties.Bands
+	bandURLs := []string{bands["red"], bands["green"], bands["blue"]}
+	for inx, name := range []string{"red", "green", "blue"} {
+		if bandURLs[inx] == "" {
+			rgbChan <- `Error: Scene ` + inpObj.MetaJSON.ID + ` has no "` + name + `" band.`
+			return
+		}
+	}
+
 	switch inpObj.BndMrgType {
 	case "pzsvc-ossim":
-
-		outFName := "rgb.TIF"
-		bands := inpObj.MetaJSON.Properties.Bands
-		funcStr := fmt.Sprintf(`bandmerge --output-radiometry U8 --red red.TIF --green green.TIF --blue blue.TIF %s`,
-			outFName)
-
-		execObj := pzse.InpStruct{Command: funcStr,
-			InExtFiles: []string{0: bands["red"], 1: bands["green"], 2: bands["blue"]},
-			InExtNames: []string{0: "red.TIF", 1: "green.TIF", 2: "blue.TIF"},
-			OutTiffs:   []string{0: outFName},
-			OutTxts:    nil,
-			PzAuth:     inpObj.PzAuth}
-
-		outStruct, err = pzse.CallPzsvcExec(&execObj, inpObj.BndMrgURL)
-		if err != nil {
-			rgbChan <- fmt.Sprintf(`Error: CallPzsvcExec: %s`, err.Error())
+		if fileID, err = rgbOssim(ctx, inpObj, bandURLs); err != nil {
+			rgbChan <- `Error: ` + err.Error()
 			return
 		}
-		fileID = outStruct.OutFiles[outFName]
-		if fileID == "" {
-			rgbChan <- fmt.Sprintf(`Error: CallPzsvcExec: No Outfile.  Pzsvc-exec errors: %s`, err.Error())
+	case "local":
+		if fileID, err = rgbLocal(ctx, inpObj, bandURLs, gw); err != nil {
+			rgbChan <- `Error: ` + err.Error()
 			return
 		}
-		fmt.Println("RGB fileId: " + fileID)
-
 	default:
-		rgbChan <- ("Error: Unknown bandmerge algorithm")
+		rgbChan <- `Error: Unknown bandmerge algorithm "` + inpObj.BndMrgType + `"`
+		return
+	}
+	fmt.Println("RGB fileId: " + fileID)
+
+	if deplObj, err = gw.DeployToGeoServer(ctx, fileID, "", inpObj.PzAddr, inpObj.PzAuth); err != nil {
+		rgbChan <- `Error: DeployToGeoServer: ` + err.Error()
 		return
 	}
+	fmt.Println("RGB geoserver ID: " + deplObj.Layer)
+
+	rgbChan <- deplObj.Layer
+}
+
+// rgbOssim runs the bandmerge command of pzsvc-ossim, and returns the
+// dataId of the result.
+func rgbOssim(ctx context.Context, inpObj gsInpStruct, bandURLs []string) (string, error) {
+	if inpObj.BndMrgURL == "" {
+		return "", pzsvc.ErrWithTrace("bandMergeURL is required for pzsvc-ossim bandmerge.")
+	}
+	outFName := "rgb.TIF"
+	funcStr := fmt.Sprintf(`bandmerge --output-radiometry U8 --red red.TIF --green green.TIF --blue blue.TIF %s`,
+		outFName)
+
+	execObj := pzse.InpStruct{Command: funcStr,
+		InExtFiles: bandURLs,
+		InExtNames: []string{0: "red.TIF", 1: "green.TIF", 2: "blue.TIF"},
+		OutTiffs:   []string{0: outFName},
+		OutTxts:    nil,
+		PzAuth:     inpObj.PzAuth,
+		PzAddr:     inpObj.PzAddr}
+
+	outStruct, err := callPzsvcExec(ctx, &execObj, inpObj.BndMrgURL)
+	if err != nil {
+		return "", pzsvc.ErrWithTrace(`CallPzsvcExec: ` + err.Error())
+	}
+	if outStruct.OutFiles[outFName] == "" {
+		return "", pzsvc.ErrWithTrace(fmt.Sprintf(`CallPzsvcExec: No Outfile.  Pzsvc-exec errors: %v`, outStruct.Errors))
+	}
+	return outStruct.OutFiles[outFName], nil
+}
+
+// rgbLocal builds an 8-bit true color GeoTIFF out of the given bands
+// inside bf-handle, and ingests it.  Each band is stretched linearly
+// between its 2nd and 98th percentiles, which is usually enough to give
+// a reasonable picture without any further tuning.
+func rgbLocal(ctx context.Context, inpObj gsInpStruct, bandURLs []string, gw Gateway) (string, error) {
+	var (
+		err    error
+		byts   []byte
+		images = make([]*geoRaster, len(bandURLs))
+		merged [][]uint8
+	)
+	for inx, bandURL := range bandURLs {
+		if images[inx], err = readGeoTIFFURL(ctx, bandURL); err != nil {
+			return "", err
+		}
+		if images[inx].width != images[0].width || images[inx].height != images[0].height {
+			return "", pzsvc.ErrWithTrace("RGB bands differ in size.")
+		}
+	}
+	for _, image := range images {
+		merged = append(merged, stretchBand(image.data))
+	}
 
-	outpObj, err := pzsvc.DeployToGeoServer(fileID, "", inpObj.PzAddr, inpObj.PzAuth)
+	// anything missing from any band is missing from all of them
+	for pix := range merged[0] {
+		if merged[0][pix] == 0 || merged[1][pix] == 0 || merged[2][pix] == 0 {
+			merged[0][pix], merged[1][pix], merged[2][pix] = 0, 0, 0
+		}
+	}
 
-	fmt.Println("RGB geoserver ID: " + outpObj.Layer)
+	if byts, err = writeGeoTIFF8(images[0], merged); err != nil {
+		return "", err
+	}
+	return gw.Ingest(ctx, "rgb.TIF", "raster", inpObj.PzAddr, "bf-handle rgb", "", inpObj.PzAuth, byts, nil)
+}
+
+// stretchBand scales the band linearly into 1-255, leaving 0 for nodata.
+func stretchBand(data []float32) []uint8 {
+	var sample []float64
 
-	rgbChan <- outpObj.Layer
-	return
+	// a sorted sample of a million or so is plenty to find percentiles
+	step := len(data)/1000000 + 1
+	for inx := 0; inx < len(data); inx += step {
+		if val := data[inx]; val == val && val != 0 {
+			sample = append(sample, float64(val))
+		}
+	}
+	result := make([]uint8, len(data))
+	if len(sample) == 0 {
+		return result
+	}
+	sort.Float64s(sample)
+	low := sample[int(float64(len(sample)-1)*rgbClipFraction)]
+	high := sample[int(float64(len(sample)-1)*(1-rgbClipFraction))]
+	if high <= low {
+		high = low + 1
+	}
+
+	for inx, val := range data {
+		if val != val || val == 0 {
+			continue
+		}
+		scaled := 1 + 254*(float64(val)-low)/(high-low)
+		result[inx] = uint8(math.Max(1, math.Min(255, scaled)))
+	}
+	return result
 }
-*/
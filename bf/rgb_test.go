@@ -0,0 +1,92 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bf
+
+import (
+	"encoding/binary"
+	"math"
+	"testing"
+)
+
+func TestStretchBand(t *testing.T) {
+	data := make([]float32, 102)
+	for inx := range data {
+		data[inx] = float32(inx * 10)
+	}
+	data[101] = float32(math.NaN())
+	result := stretchBand(data)
+	if result[0] != 0 || result[101] != 0 {
+		t.Errorf(`TestStretchBand: nodata came out as %d and %d.`, result[0], result[101])
+	}
+	if result[1] != 1 || result[100] != 255 {
+		t.Errorf(`TestStretchBand: ends came out as %d and %d, not clipped to 1 and 255.`, result[1], result[100])
+	}
+	for inx := 2; inx < 101; inx++ {
+		if result[inx] < result[inx-1] {
+			t.Errorf(`TestStretchBand: stretch is not monotonic at %d.`, inx)
+		}
+	}
+}
+
+func TestWriteGeoTIFF8(t *testing.T) {
+	ref := &geoRaster{width: 3, height: 70, epsg: 32618,
+		transform: [6]float64{600000, 30, 0, 4000000, 0, -30}}
+	band := make([]uint8, ref.width*ref.height)
+	for inx := range band {
+		band[inx] = uint8(inx)
+	}
+
+	// single band files can be read straight back in
+	byts, err := writeGeoTIFF8(ref, [][]uint8{band})
+	if err != nil {
+		t.Fatal(`TestWriteGeoTIFF8: failed to write: ` + err.Error())
+	}
+	gr, err := readGeoTIFF(byts)
+	if err != nil {
+		t.Fatal(`TestWriteGeoTIFF8: failed to read back: ` + err.Error())
+	}
+	if gr.width != ref.width || gr.height != ref.height || gr.epsg != ref.epsg || gr.transform != ref.transform {
+		t.Errorf(`TestWriteGeoTIFF8: header came back as %d %d %d %v.`, gr.width, gr.height, gr.epsg, gr.transform)
+	}
+	for inx, val := range band {
+		if want := float32(val); val == 0 {
+			if gr.data[inx] == gr.data[inx] {
+				t.Errorf(`TestWriteGeoTIFF8: pixel %d should be nodata, got %v.`, inx, gr.data[inx])
+			}
+		} else if gr.data[inx] != want {
+			t.Errorf(`TestWriteGeoTIFF8: pixel %d is %v, not %v.`, inx, gr.data[inx], want)
+		}
+	}
+
+	// RGB files are checked for their structure
+	byts, err = writeGeoTIFF8(ref, [][]uint8{band, band, band})
+	if err != nil {
+		t.Fatal(`TestWriteGeoTIFF8: failed to write RGB: ` + err.Error())
+	}
+	tr := tiffReader{byts: byts, order: binary.LittleEndian, entries: make(map[int]tiffEntry)}
+	if err = tr.readIFD(int(binary.LittleEndian.Uint32(byts[4:8]))); err != nil {
+		t.Fatal(`TestWriteGeoTIFF8: failed to read RGB directory: ` + err.Error())
+	}
+	if spp, photo := tr.value(tagSamplesPerPixel, 1), tr.value(262, 0); spp != 3 || photo != 2 {
+		t.Errorf(`TestWriteGeoTIFF8: RGB has %v samples and photometric %v.`, spp, photo)
+	}
+	if strips := tr.values(tagStripOffsets); len(strips) != 2 {
+		t.Errorf(`TestWriteGeoTIFF8: expected 2 strips, got %d.`, len(strips))
+	}
+
+	if _, err = writeGeoTIFF8(ref, [][]uint8{band[1:]}); err == nil {
+		t.Error(`TestWriteGeoTIFF8: wrote a band of the wrong size.`)
+	}
+}
@@ -0,0 +1,319 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bf
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+
+	"github.com/paulsmith/gogeos/geos"
+	"github.com/venicegeo/geojson-geos-go/geojsongeos"
+	"github.com/venicegeo/geojson-go/geojson"
+	"github.com/venicegeo/pzsvc-image-catalog/catalog"
+	"github.com/venicegeo/pzsvc-lib"
+)
+
+// SceneCatalog is the source of the scene metadata that bf-handle works
+// from.  By default, this is pzsvc-image-catalog, but anything that can
+// search for scenes and keep track of their properties will do.
+type SceneCatalog interface {
+	// GetScenes returns the scenes that intersect the given feature
+	GetScenes(feature *geojson.Feature, options catalog.SearchOptions) (*geojson.FeatureCollection, error)
+	// GetSceneMetadata returns the scene with the given ID
+	GetSceneMetadata(sceneID string) (*geojson.Feature, error)
+	// StoreFeature adds the given scene, or replaces it if it already exists
+	StoreFeature(feature *geojson.Feature) error
+	// SaveFeatureProperties sets the given properties on an existing scene
+	SaveFeatureProperties(sceneID string, properties map[string]interface{}) error
+}
+
+var sceneCatalog SceneCatalog = imageCatalog{}
+
+// SetSceneCatalog replaces the scene catalog that bf-handle uses.  It is
+// meant to be called once, on startup, before any requests come in.
+func SetSceneCatalog(scenes SceneCatalog) {
+	sceneCatalog = scenes
+}
+
+// imageCatalog passes everything through to pzsvc-image-catalog
+type imageCatalog struct{}
+
+func (imageCatalog) GetScenes(feature *geojson.Feature, options catalog.SearchOptions) (*geojson.FeatureCollection, error) {
+	sceneDescriptors, _, err := catalog.GetScenes(feature, options)
+	if err != nil {
+		return nil, err
+	}
+	if sceneDescriptors.Scenes == nil {
+		return geojson.NewFeatureCollection(nil), nil
+	}
+	return sceneDescriptors.Scenes, nil
+}
+
+func (imageCatalog) GetSceneMetadata(sceneID string) (*geojson.Feature, error) {
+	return catalog.GetSceneMetadata(sceneID)
+}
+
+func (imageCatalog) StoreFeature(feature *geojson.Feature) error {
+	_, err := catalog.StoreFeature(feature, true)
+	return err
+}
+
+func (imageCatalog) SaveFeatureProperties(sceneID string, properties map[string]interface{}) error {
+	return catalog.SaveFeatureProperties(sceneID, properties)
+}
+
+// LocalCatalog is a SceneCatalog backed by a directory of GeoJSON files.
+// Each file holds either a single scene Feature or a FeatureCollection of
+// them, in the same format that pzsvc-image-catalog produces.  Changes
+// are written back to the file the scene came from.  New scenes are
+// written to a file of their own.
+type LocalCatalog struct {
+	dir    string
+	sem    sync.Mutex
+	scenes map[string]*geojson.Feature
+	files  map[string]string   // sceneID -> file it lives in
+	groups map[string][]string // file -> sceneIDs it holds, in order
+}
+
+// NewLocalCatalog reads in all of the .geojson and .json files in the
+// given directory, and builds a LocalCatalog out of them.
+func NewLocalCatalog(dir string) (*LocalCatalog, error) {
+	var (
+		err       error
+		fileNames []string
+		gjIfc     interface{}
+		byts      []byte
+	)
+	lc := LocalCatalog{
+		dir:    dir,
+		scenes: make(map[string]*geojson.Feature),
+		files:  make(map[string]string),
+		groups: make(map[string][]string)}
+
+	if fileNames, err = filepath.Glob(filepath.Join(dir, "*")); err != nil {
+		return nil, pzsvc.TraceErr(err)
+	}
+	sort.Strings(fileNames)
+	for _, fileName := range fileNames {
+		if ext := filepath.Ext(fileName); ext != ".geojson" && ext != ".json" {
+			continue
+		}
+		if byts, err = ioutil.ReadFile(fileName); err != nil {
+			return nil, pzsvc.TraceErr(err)
+		}
+		if gjIfc, err = geojson.Parse(byts); err != nil {
+			return nil, pzsvc.ErrWithTrace("Could not parse scene file " + fileName + ": " + err.Error())
+		}
+		switch it := gjIfc.(type) {
+		case *geojson.Feature:
+			lc.add(it, fileName)
+		case *geojson.FeatureCollection:
+			for _, feature := range it.Features {
+				lc.add(feature, fileName)
+			}
+		default:
+			log.Printf("Skipping %v: expected a Feature or FeatureCollection, got a %T.", fileName, gjIfc)
+		}
+	}
+	log.Printf("Loaded %d scenes from %v.", len(lc.scenes), dir)
+	return &lc, nil
+}
+
+func (lc *LocalCatalog) add(feature *geojson.Feature, fileName string) {
+	sceneID := feature.IDStr()
+	if sceneID == "" {
+		log.Printf("Skipping a scene with no ID in %v.", fileName)
+		return
+	}
+	if feature.Properties == nil {
+		feature.Properties = make(map[string]interface{})
+	}
+	if _, ok := lc.files[sceneID]; !ok {
+		lc.groups[fileName] = append(lc.groups[fileName], sceneID)
+		lc.files[sceneID] = fileName
+	}
+	lc.scenes[sceneID] = feature
+}
+
+// GetScenes returns copies of all of the scenes whose bounding boxes
+// overlap that of the given feature.  If options.Rigorous is set, the
+// scene geometries must actually intersect the feature geometry as well.
+func (lc *LocalCatalog) GetScenes(feature *geojson.Feature, options catalog.SearchOptions) (*geojson.FeatureCollection, error) {
+	var (
+		err        error
+		searchGeom *geos.Geometry
+		sceneGeom  *geos.Geometry
+		intersects bool
+		copyFeat   *geojson.Feature
+		sceneIDs   []string
+	)
+	result := geojson.NewFeatureCollection(nil)
+	searchBbox := feature.ForceBbox()
+	if len(searchBbox) < 4 {
+		return nil, pzsvc.ErrWithTrace("Search feature has no usable bounding box.")
+	}
+	if options.Rigorous {
+		if searchGeom, err = geojsongeos.GeosFromGeoJSON(feature.Geometry); err != nil {
+			return nil, pzsvc.TraceErr(err)
+		}
+	}
+
+	lc.sem.Lock()
+	defer lc.sem.Unlock()
+
+	for sceneID := range lc.scenes {
+		sceneIDs = append(sceneIDs, sceneID)
+	}
+	sort.Strings(sceneIDs)
+	for _, sceneID := range sceneIDs {
+		scene := lc.scenes[sceneID]
+		if !bboxOverlap(searchBbox, scene.ForceBbox()) {
+			continue
+		}
+		if searchGeom != nil {
+			if sceneGeom, err = geojsongeos.GeosFromGeoJSON(scene.Geometry); err != nil {
+				log.Printf("Could not convert geometry of scene %v: %v", sceneID, err.Error())
+				continue
+			}
+			if intersects, err = sceneGeom.Intersects(searchGeom); err != nil || !intersects {
+				continue
+			}
+		}
+		if copyFeat, err = copyFeature(scene); err != nil {
+			return nil, err
+		}
+		result.Features = append(result.Features, copyFeat)
+	}
+	return result, nil
+}
+
+// GetSceneMetadata returns a copy of the scene with the given ID
+func (lc *LocalCatalog) GetSceneMetadata(sceneID string) (*geojson.Feature, error) {
+	lc.sem.Lock()
+	defer lc.sem.Unlock()
+	scene, ok := lc.scenes[sceneID]
+	if !ok {
+		return nil, pzsvc.ErrWithTrace("Scene " + sceneID + " not found in local catalog.")
+	}
+	return copyFeature(scene)
+}
+
+// StoreFeature adds or replaces the given scene, and writes it to disk.
+func (lc *LocalCatalog) StoreFeature(feature *geojson.Feature) error {
+	copyFeat, err := copyFeature(feature)
+	if err != nil {
+		return err
+	}
+	lc.sem.Lock()
+	defer lc.sem.Unlock()
+
+	sceneID := copyFeat.IDStr()
+	if sceneID == "" {
+		return pzsvc.ErrWithTrace("Cannot store a scene with no ID.")
+	}
+	fileName, ok := lc.files[sceneID]
+	if !ok {
+		fileName = filepath.Join(lc.dir, safeFileName(sceneID)+".geojson")
+	}
+	lc.add(copyFeat, fileName)
+	return lc.writeFile(fileName)
+}
+
+// SaveFeatureProperties adds the given properties to an existing
+// scene, and writes it to disk.
+func (lc *LocalCatalog) SaveFeatureProperties(sceneID string, properties map[string]interface{}) error {
+	lc.sem.Lock()
+	defer lc.sem.Unlock()
+	scene, ok := lc.scenes[sceneID]
+	if !ok {
+		return pzsvc.ErrWithTrace("Scene " + sceneID + " not found in local catalog.")
+	}
+	for key, val := range properties {
+		scene.Properties[key] = val
+	}
+	return lc.writeFile(lc.files[sceneID])
+}
+
+// writeFile rewrites the given file from the scenes it holds.  It
+// must be called with lc.sem held.
+func (lc *LocalCatalog) writeFile(fileName string) error {
+	var (
+		byts []byte
+		err  error
+	)
+	sceneIDs := lc.groups[fileName]
+	if len(sceneIDs) == 1 {
+		byts, err = geojson.Write(lc.scenes[sceneIDs[0]])
+	} else {
+		fc := geojson.NewFeatureCollection(nil)
+		for _, sceneID := range sceneIDs {
+			fc.Features = append(fc.Features, lc.scenes[sceneID])
+		}
+		byts, err = geojson.Write(fc)
+	}
+	if err != nil {
+		return pzsvc.TraceErr(err)
+	}
+
+	// write and rename, so that a crash partway through cannot
+	// leave us with a corrupted scene file
+	tmpName := fileName + ".tmp"
+	if err = ioutil.WriteFile(tmpName, byts, 0644); err != nil {
+		return pzsvc.TraceErr(err)
+	}
+	if err = os.Rename(tmpName, fileName); err != nil {
+		return pzsvc.TraceErr(err)
+	}
+	return nil
+}
+
+// copyFeature makes a deep copy of a feature, so that callers can modify
+// what we hand them without it leaking back into the catalog.
+func copyFeature(feature *geojson.Feature) (*geojson.Feature, error) {
+	byts, err := geojson.Write(feature)
+	if err != nil {
+		return nil, pzsvc.TraceErr(err)
+	}
+	gjIfc, err := geojson.Parse(byts)
+	if err != nil {
+		return nil, pzsvc.TraceErr(err)
+	}
+	result, ok := gjIfc.(*geojson.Feature)
+	if !ok {
+		return nil, pzsvc.ErrWithTrace(fmt.Sprintf("Feature copy came back as a %T.", gjIfc))
+	}
+	return result, nil
+}
+
+func bboxOverlap(a, b geojson.BoundingBox) bool {
+	if len(a) < 4 || len(b) < 4 {
+		return false
+	}
+	// bounding boxes with elevation run minx,miny,minz,maxx,maxy,maxz
+	ad, bd := len(a)/2, len(b)/2
+	return a[0] <= b[bd] && b[0] <= a[ad] && a[1] <= b[bd+1] && b[1] <= a[ad+1]
+}
+
+var unsafeChars = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+func safeFileName(name string) string {
+	return unsafeChars.ReplaceAllString(name, "_")
+}
@@ -0,0 +1,101 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bf
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/venicegeo/geojson-go/geojson"
+)
+
+const testSceneFC = `{"type":"FeatureCollection","features":[
+{"type":"Feature","id":"landsat:LC80090472014280LGN00","geometry":{"type":"Polygon","coordinates":[[[-75,35],[-74,35],[-74,36],[-75,36],[-75,35]]]},"properties":{"cloudCover":10,"sensorName":"Landsat8"}},
+{"type":"Feature","id":"landsat:LC80100472014280LGN00","geometry":{"type":"Polygon","coordinates":[[[10,10],[11,10],[11,11],[10,11],[10,10]]]},"properties":{"cloudCover":50,"sensorName":"Landsat8"}}]}`
+
+func TestLocalCatalog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bf-handle-scenes")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	if err = ioutil.WriteFile(filepath.Join(dir, "scenes.geojson"), []byte(testSceneFC), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err = ioutil.WriteFile(filepath.Join(dir, "readme.txt"), []byte("not a scene"), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	lc, err := NewLocalCatalog(dir)
+	if err != nil {
+		t.Fatal(`TestLocalCatalog: failed to load catalog: ` + err.Error())
+	}
+	if _, err = lc.GetSceneMetadata("landsat:nope"); err == nil {
+		t.Error(`TestLocalCatalog: found a scene that should not exist.`)
+	}
+	scene, err := lc.GetSceneMetadata("landsat:LC80090472014280LGN00")
+	if err != nil {
+		t.Fatal(`TestLocalCatalog: failed to find scene: ` + err.Error())
+	}
+
+	// changes to what we get back must not leak into the catalog
+	scene.Properties["cloudCover"] = 99.0
+	scene, _ = lc.GetSceneMetadata("landsat:LC80090472014280LGN00")
+	if scene.PropertyFloat("cloudCover") != 10 {
+		t.Error(`TestLocalCatalog: caller modification leaked into catalog.`)
+	}
+
+	err = lc.SaveFeatureProperties("landsat:LC80090472014280LGN00", map[string]interface{}{"CurrentTide": 0.5})
+	if err != nil {
+		t.Error(`TestLocalCatalog: failed to save properties: ` + err.Error())
+	}
+	newScene := geojson.NewFeature(nil, "landsat:new", map[string]interface{}{"cloudCover": 5.0})
+	if err = lc.StoreFeature(newScene); err != nil {
+		t.Error(`TestLocalCatalog: failed to store feature: ` + err.Error())
+	}
+
+	// everything should survive a reload from disk
+	lc, err = NewLocalCatalog(dir)
+	if err != nil {
+		t.Fatal(`TestLocalCatalog: failed to reload catalog: ` + err.Error())
+	}
+	if scene, err = lc.GetSceneMetadata("landsat:LC80090472014280LGN00"); err != nil || scene.PropertyFloat("CurrentTide") != 0.5 {
+		t.Error(`TestLocalCatalog: saved properties did not persist.`)
+	}
+	if _, err = lc.GetSceneMetadata("landsat:LC80100472014280LGN00"); err != nil {
+		t.Error(`TestLocalCatalog: lost the second scene in the collection.`)
+	}
+	if _, err = lc.GetSceneMetadata("landsat:new"); err != nil {
+		t.Error(`TestLocalCatalog: stored feature did not persist.`)
+	}
+}
+
+func TestBboxOverlap(t *testing.T) {
+	a := geojson.BoundingBox{0, 0, 2, 2}
+	if !bboxOverlap(a, geojson.BoundingBox{1, 1, 3, 3}) {
+		t.Error(`TestBboxOverlap: missed an overlap.`)
+	}
+	if bboxOverlap(a, geojson.BoundingBox{3, 3, 4, 4}) {
+		t.Error(`TestBboxOverlap: found a nonexistent overlap.`)
+	}
+	if !bboxOverlap(a, geojson.BoundingBox{1, 1, 0, 3, 3, 10}) {
+		t.Error(`TestBboxOverlap: missed an overlap with elevation.`)
+	}
+	if bboxOverlap(a, nil) {
+		t.Error(`TestBboxOverlap: found an overlap with an empty box.`)
+	}
+}
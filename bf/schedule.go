@@ -0,0 +1,255 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bf
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+)
+
+/*
+Pending asynch jobs are drawn from three priority lanes: "high", "normal"
+and "low".  The lanes share the workers by weight, using stride
+scheduling, so that a busy high lane slows the others down without
+stopping them.  Within a lane, the next job goes to whichever submitter
+has the fewest jobs running for their weight, and is that submitter's
+oldest job in the lane.  So one submitter with hundreds of jobs queued
+does not hold up another who has only a few.
+
+Submitters are told apart by their Piazza auth tokens, not by anything
+that they say about themselves, so nobody can take another's share.  A
+submitter may name whoever a job is for, and these names share out the
+submitter's own jobs in the same way, but they do not add to its share.
+
+With redis, lane state is kept alongside the queue and moves on in the
+same script that takes a job, so instances sharing a queue share out the
+lanes as one.  A MemoryJobStore keeps its own.
+*/
+
+// laneWeights are the shares of the workers that each lane gets while
+// all are busy, highest priority first.
+var laneWeights = []struct {
+	name   string
+	weight float64
+}{{"high", 4}, {"normal", 2}, {"low", 1}}
+
+var (
+	submitterWeights      = make(map[string]float64)
+	submitterWeightsMutex sync.RWMutex
+)
+
+// SetSubmitterWeights sets the shares of the workers that submitters get
+// when competing for them.  Submitters not given have a weight of 1.  It
+// is meant to be called once, on startup, before any requests come in.
+func SetSubmitterWeights(weights map[string]float64) {
+	submitterWeightsMutex.Lock()
+	defer submitterWeightsMutex.Unlock()
+	submitterWeights = weights
+}
+
+func submitterWeight(submitter string) float64 {
+	submitterWeightsMutex.RLock()
+	defer submitterWeightsMutex.RUnlock()
+	if weight, ok := submitterWeights[submitter]; ok && weight > 0 {
+		return weight
+	}
+	return 1
+}
+
+// jobMeta is what the scheduler needs to know about a job
+type jobMeta struct {
+	Priority  string `json:"priority,omitempty"`
+	Submitter string `json:"submitter,omitempty"`
+}
+
+// queuedJob is a pending job, for scheduling
+type queuedJob struct {
+	jobID string
+	meta  jobMeta
+}
+
+// jobMetaFor reads the priority and submitter out of a job's input.  The
+// submitter is derived from the Piazza auth token, or is "anonymous"
+// without one.  A "submitter" given in the input is only a sub-key under
+// that, as in "pz-1a2b3c4d5e6f/alice", since anyone can claim any name.
+func jobMetaFor(inpStr string) (jobMeta, error) {
+	var options struct {
+		Priority  string `json:"priority"`
+		Submitter string `json:"submitter"`
+		PzAuth    string `json:"pzAuthToken"`
+	}
+	if err := json.Unmarshal([]byte(inpStr), &options); err != nil {
+		return jobMeta{}, err
+	}
+	meta := jobMeta{Priority: strings.ToLower(options.Priority), Submitter: "anonymous"}
+	if meta.Priority == "" {
+		meta.Priority = "normal"
+	}
+	if laneIndex(meta.Priority) < 0 {
+		return meta, errors.New(`priority must be "high", "normal" or "low"`)
+	}
+	if options.PzAuth != "" {
+		hash := sha256.Sum256([]byte(options.PzAuth))
+		meta.Submitter = "pz-" + hex.EncodeToString(hash[:6])
+	}
+	if options.Submitter != "" {
+		meta.Submitter += "/" + options.Submitter
+	}
+	return meta, nil
+}
+
+// submitterIdentity returns the identity that a submitter belongs to,
+// without any sub-key.
+func submitterIdentity(submitter string) string {
+	if inx := strings.Index(submitter, "/"); inx >= 0 {
+		return submitter[:inx]
+	}
+	return submitter
+}
+
+// laneIndex returns the lane for a priority, treating no priority as
+// normal, or -1 if there is no such lane.
+func laneIndex(priority string) int {
+	if priority == "" {
+		priority = "normal"
+	}
+	for inx, lane := range laneWeights {
+		if lane.name == priority {
+			return inx
+		}
+	}
+	return -1
+}
+
+// laneScheduler picks pending jobs.  pass holds the virtual time of each
+// lane, which advances by the inverse of the lane's weight each time it is
+// drawn from.  now is the virtual time of the last draw.  A lane that has
+// sat empty is brought up to now when it fills again, so that it cannot
+// make up for lost time at the others' expense.
+type laneScheduler struct {
+	pass []float64
+	now  float64
+}
+
+func newLaneScheduler() *laneScheduler {
+	return &laneScheduler{pass: make([]float64, len(laneWeights))}
+}
+
+func (sched *laneScheduler) copy() *laneScheduler {
+	return &laneScheduler{pass: append([]float64{}, sched.pass...), now: sched.now}
+}
+
+// laneState is the form in which a laneScheduler is stored
+type laneState struct {
+	Pass []float64 `json:"pass"`
+	Now  float64   `json:"now"`
+}
+
+func (sched *laneScheduler) String() string {
+	byts, _ := json.Marshal(laneState{Pass: sched.pass, Now: sched.now})
+	return string(byts)
+}
+
+// parseLaneScheduler reads back a stored laneScheduler.  Anything that
+// cannot be read, or that was stored with other lanes, starts afresh.
+func parseLaneScheduler(stateStr string) *laneScheduler {
+	var state laneState
+	if json.Unmarshal([]byte(stateStr), &state) != nil || len(state.Pass) != len(laneWeights) {
+		return newLaneScheduler()
+	}
+	return &laneScheduler{pass: state.Pass, now: state.Now}
+}
+
+// pick returns the index in pending (oldest first) of the job to run
+// next, given how many jobs each submitter has running, or -1 if there are
+// none.  It advances the scheduler as though the job was taken.  Shares
+// and weights go by submitter identity, and within an identity, the
+// sub-key with the fewest jobs running goes first.
+func (sched *laneScheduler) pick(pending []queuedJob, running map[string]int) int {
+	filled := make([]bool, len(laneWeights))
+	for _, job := range pending {
+		if lane := laneIndex(job.meta.Priority); lane >= 0 {
+			filled[lane] = true
+		}
+	}
+	lane := -1
+	for inx := range laneWeights {
+		if !filled[inx] {
+			continue
+		}
+		if sched.pass[inx] < sched.now {
+			sched.pass[inx] = sched.now
+		}
+		if lane < 0 || sched.pass[inx] < sched.pass[lane] {
+			lane = inx
+		}
+	}
+	if lane < 0 {
+		return -1
+	}
+	sched.now = sched.pass[lane]
+	sched.pass[lane] += 1 / laneWeights[lane].weight
+
+	identities := make(map[string]int)
+	for submitter, count := range running {
+		identities[submitterIdentity(submitter)] += count
+	}
+	best, bestShare := -1, 0.0
+	seen := make(map[string]bool)
+	for inx, job := range pending {
+		submitter := job.meta.Submitter
+		if laneIndex(job.meta.Priority) != lane || seen[submitter] {
+			continue
+		}
+		seen[submitter] = true
+		identity := submitterIdentity(submitter)
+		share := float64(identities[identity]) / submitterWeight(identity)
+		if best < 0 || share < bestShare {
+			best, bestShare = inx, share
+		} else if share == bestShare && identity == submitterIdentity(pending[best].meta.Submitter) && running[submitter] < running[pending[best].meta.Submitter] {
+			best = inx
+		}
+	}
+	return best
+}
+
+// queuePosition works out where the given job stands in the queue, 1
+// being next, by running the scheduler forward over a copy of its state,
+// as though nothing finished or was added in the meantime.  It returns 0
+// if the job is not pending.
+func (sched *laneScheduler) queuePosition(jobID string, pending []queuedJob, running map[string]int) int {
+	sched = sched.copy()
+	pending = append([]queuedJob{}, pending...)
+	counts := make(map[string]int)
+	for submitter, count := range running {
+		counts[submitter] = count
+	}
+	for position := 1; len(pending) > 0; position++ {
+		inx := sched.pick(pending, counts)
+		if inx < 0 {
+			break
+		}
+		if pending[inx].jobID == jobID {
+			return position
+		}
+		counts[pending[inx].meta.Submitter]++
+		pending = append(pending[:inx], pending[inx+1:]...)
+	}
+	return 0
+}
@@ -0,0 +1,180 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bf
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/venicegeo/pzsvc-lib"
+)
+
+func TestJobMetaFor(t *testing.T) {
+	meta, err := jobMetaFor(`{"algoType":"ndwi"}`)
+	if err != nil || meta.Priority != "normal" || meta.Submitter != "anonymous" {
+		t.Errorf(`TestJobMetaFor: unexpected defaults %v, %v.`, meta, err)
+	}
+	meta, err = jobMetaFor(`{"priority":"HIGH","submitter":"alice"}`)
+	if err != nil || meta.Priority != "high" || meta.Submitter != "anonymous/alice" {
+		t.Errorf(`TestJobMetaFor: unexpected meta %v, %v.`, meta, err)
+	}
+	meta, _ = jobMetaFor(`{"pzAuthToken":"secret"}`)
+	other, _ := jobMetaFor(`{"pzAuthToken":"other"}`)
+	if len(meta.Submitter) != 15 || meta.Submitter[:3] != "pz-" || meta.Submitter == other.Submitter {
+		t.Errorf(`TestJobMetaFor: bad submitters from auth tokens: %s, %s.`, meta.Submitter, other.Submitter)
+	}
+
+	// a declared submitter cannot stand in for the auth token
+	named, _ := jobMetaFor(`{"pzAuthToken":"secret","submitter":"` + other.Submitter + `"}`)
+	if named.Submitter != meta.Submitter+"/"+other.Submitter || submitterIdentity(named.Submitter) != meta.Submitter {
+		t.Errorf(`TestJobMetaFor: declared submitter overrode the auth token: %s.`, named.Submitter)
+	}
+	if _, err = jobMetaFor(`{"priority":"urgent"}`); err == nil {
+		t.Error(`TestJobMetaFor: accepted an unknown priority.`)
+	}
+}
+
+func TestLaneScheduler(t *testing.T) {
+	var pending []queuedJob
+	for inx := 0; inx < 10; inx++ {
+		for _, lane := range laneWeights {
+			pending = append(pending, queuedJob{jobID: lane.name + strconv.Itoa(inx), meta: jobMeta{Priority: lane.name}})
+		}
+	}
+	sched := newLaneScheduler()
+	counts := make(map[string]int)
+	for pick := 0; pick < 7; pick++ {
+		inx := sched.pick(pending, nil)
+		counts[pending[inx].meta.Priority]++
+		pending = append(pending[:inx], pending[inx+1:]...)
+	}
+	if counts["high"] != 4 || counts["normal"] != 2 || counts["low"] != 1 {
+		t.Errorf(`TestLaneScheduler: lanes not shared by weight: %v.`, counts)
+	}
+
+	// a lane that sat empty does not get to make up for it
+	sched = newLaneScheduler()
+	normal := []queuedJob{{jobID: "n", meta: jobMeta{Priority: "normal"}}}
+	for pick := 0; pick < 20; pick++ {
+		sched.pick(normal, nil)
+	}
+	pending = nil
+	for inx := 0; inx < 5; inx++ {
+		pending = append(pending, queuedJob{jobID: "n" + strconv.Itoa(inx), meta: jobMeta{Priority: "normal"}},
+			queuedJob{jobID: "l" + strconv.Itoa(inx), meta: jobMeta{Priority: "low"}})
+	}
+	counts = make(map[string]int)
+	for pick := 0; pick < 3; pick++ {
+		inx := sched.pick(pending, nil)
+		counts[pending[inx].meta.Priority]++
+		pending = append(pending[:inx], pending[inx+1:]...)
+	}
+	if counts["normal"] != 2 || counts["low"] != 1 {
+		t.Errorf(`TestLaneScheduler: refilled lane made up for lost time: %v.`, counts)
+	}
+
+	// within a lane, submitters share by weight
+	defer SetSubmitterWeights(nil)
+	SetSubmitterWeights(map[string]float64{"alice": 2})
+	pending = []queuedJob{{jobID: "a", meta: jobMeta{Submitter: "alice"}}, {jobID: "b", meta: jobMeta{Submitter: "bob"}}}
+	if inx := newLaneScheduler().pick(pending, map[string]int{"alice": 1, "bob": 1}); inx != 0 {
+		t.Errorf(`TestLaneScheduler: weighted submitter not favoured.`)
+	}
+	if inx := newLaneScheduler().pick(pending, map[string]int{"alice": 3, "bob": 1}); inx != 1 {
+		t.Errorf(`TestLaneScheduler: weighted submitter took more than its share.`)
+	}
+
+	// sub-keys share out their submitter's jobs, without adding to its share
+	pending = []queuedJob{{jobID: "a", meta: jobMeta{Submitter: "bob/x"}}, {jobID: "b", meta: jobMeta{Submitter: "bob/y"}},
+		{jobID: "c", meta: jobMeta{Submitter: "carol"}}}
+	if inx := newLaneScheduler().pick(pending, map[string]int{"bob/x": 1}); inx != 2 {
+		t.Errorf(`TestLaneScheduler: sub-key added to its submitter's share.`)
+	}
+	if inx := newLaneScheduler().pick(pending, map[string]int{"bob/x": 1, "carol": 2}); inx != 1 {
+		t.Errorf(`TestLaneScheduler: sub-keys not shared out within their submitter.`)
+	}
+}
+
+func TestLaneSchedulerState(t *testing.T) {
+	sched := newLaneScheduler()
+	sched.pick([]queuedJob{{jobID: "a", meta: jobMeta{Priority: "low"}}}, nil)
+	stored := parseLaneScheduler(sched.String())
+	if stored.now != sched.now || len(stored.pass) != len(sched.pass) || stored.pass[2] != sched.pass[2] {
+		t.Errorf(`TestLaneSchedulerState: stored %s, read back %s.`, sched, stored)
+	}
+	for _, stateStr := range []string{"", "garbage", `{"pass":[1],"now":1}`} {
+		if fresh := parseLaneScheduler(stateStr); fresh.now != 0 || len(fresh.pass) != len(laneWeights) {
+			t.Errorf(`TestLaneSchedulerState: did not start afresh from %q.`, stateStr)
+		}
+	}
+}
+
+func TestMemoryFairShare(t *testing.T) {
+	store := NewMemoryJobStore()
+	for inx := 0; inx < 300; inx++ {
+		store.AddJob("alice"+strconv.Itoa(inx), "inp", jobMeta{Priority: "normal", Submitter: "alice"})
+	}
+	store.AddJob("bob", "inp", jobMeta{Priority: "normal", Submitter: "bob"})
+	if pos, _ := store.QueuePosition("bob"); pos != 2 {
+		t.Errorf(`TestMemoryFairShare: bob stuck behind alice, at position %d.`, pos)
+	}
+	if jobID, _, _, _ := store.TakeJob(instanceID, time.Now().Add(leaseDuration)); jobID != "alice0" {
+		t.Errorf(`TestMemoryFairShare: took %s first, not the oldest job.`, jobID)
+	}
+	if pos, _ := store.QueuePosition("bob"); pos != 1 {
+		t.Errorf(`TestMemoryFairShare: bob not next, at position %d.`, pos)
+	}
+	if jobID, _, _, _ := store.TakeJob(instanceID, time.Now().Add(leaseDuration)); jobID != "bob" {
+		t.Errorf(`TestMemoryFairShare: took %s, not bob's job.`, jobID)
+	}
+	if pos, _ := store.QueuePosition("bob"); pos != 0 {
+		t.Errorf(`TestMemoryFairShare: running job given position %d.`, pos)
+	}
+}
+
+func TestAsynchPriority(t *testing.T) {
+	defer SetJobStore(jobStore)
+	store := NewMemoryJobStore()
+	SetJobStore(store)
+	taskChan = make(chan string)
+
+	store.AddJob("a", "inp", jobMeta{Priority: "normal", Submitter: "alice"})
+	store.AddJob("b", "inp", jobMeta{Priority: "normal", Submitter: "alice"})
+	w, outStr, outInt := pzsvc.GetMockResponseWriter()
+	r := http.Request{Method: "POST", Body: pzsvc.GetMockReadCloser(`{"algoType":"ndwi","priority":"high","submitter":"bob"}`)}
+	addAsynchJob(w, &r)
+	if *outInt != http.StatusOK {
+		t.Fatalf(`TestAsynchPriority: could not add job: %s`, *outStr)
+	}
+	jobID, _, _, _ := store.TakeJob(instanceID, time.Now().Add(leaseDuration))
+	if pos, _ := store.QueuePosition(jobID); jobID == "a" || jobID == "b" || pos != 0 {
+		t.Errorf(`TestAsynchPriority: high priority job not taken first.`)
+	}
+
+	w, outStr, _ = pzsvc.GetMockResponseWriter()
+	getAsynchStatus(w, "b")
+	if parsed := parseJobStatus(*outStr); parsed.Status != "Pending" || parsed.Position != 2 {
+		t.Errorf(`TestAsynchPriority: unexpected status %s.`, *outStr)
+	}
+
+	w, outStr, outInt = pzsvc.GetMockResponseWriter()
+	r = http.Request{Method: "POST", Body: pzsvc.GetMockReadCloser(`{"algoType":"ndwi","priority":"urgent"}`)}
+	addAsynchJob(w, &r)
+	if *outInt != http.StatusBadRequest {
+		t.Errorf(`TestAsynchPriority: accepted an unknown priority: %s.`, *outStr)
+	}
+}
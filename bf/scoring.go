@@ -0,0 +1,302 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bf
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/venicegeo/geojson-go/geojson"
+	"github.com/venicegeo/pzsvc-lib"
+)
+
+/*
+A scoring policy decides how candidate scenes are ranked when footprints are
+chosen.  Every scene starts at 1 and loses points for each way in which it
+falls short:
+
+- cloudCover: cloudWeight * sqrt(cloud cover / 100)
+- age: ageWeight per year since acquisition
+- pre2015: pre2015Penalty, if acquired before 2015.  Older Landsat scenes
+  are unlikely to be in the S3 archive.
+- tide: tideWeight times how far the tide at acquisition was from the
+  preferred tideStage ("low", "mid" or "high"), as a fraction of the day's
+  range.  Scenes without tide information lose the full tideWeight.
+- dateWindow: dateWindowWeight, if acquired outside of preferredStart to
+  preferredEnd (when either is given)
+- sensor: sensorWeight, if the sensor is not among preferredSensors (when
+  any are given)
+
+Scenes with more than maxCloudCover are not considered at all, nor, if
+dateWindowRequired is set, are scenes outside of the preferred dates.  Policies
+start from a named preset (see scoringPresets), and any fields given along
+with the preset override it.
+*/
+
+// scoringPolicy holds the weights and preferences for scoring scenes.
+type scoringPolicy struct {
+	Preset             string   `json:"preset"`
+	CloudWeight        float64  `json:"cloudWeight"`
+	MaxCloudCover      float64  `json:"maxCloudCover"`
+	AgeWeight          float64  `json:"ageWeight"`
+	Pre2015Penalty     float64  `json:"pre2015Penalty"`
+	TideWeight         float64  `json:"tideWeight"`
+	TideStage          string   `json:"tideStage"`
+	PreferredStart     string   `json:"preferredStart,omitempty"`
+	PreferredEnd       string   `json:"preferredEnd,omitempty"`
+	DateWindowWeight   float64  `json:"dateWindowWeight"`
+	DateWindowRequired bool     `json:"dateWindowRequired,omitempty"`
+	PreferredSensors   []string `json:"preferredSensors,omitempty"`
+	SensorWeight       float64  `json:"sensorWeight"`
+}
+
+const defaultScoringPreset = "default"
+
+// scoringPresets are the named starting points for scoring policies.
+var scoringPresets = map[string]scoringPolicy{
+	// balances everything, with a preference for high tide
+	"default": {CloudWeight: 1, MaxCloudCover: 100, AgeWeight: 0.1, Pre2015Penalty: 0.5,
+		TideWeight: math.Sqrt(0.1), TideStage: "high", DateWindowWeight: 1, SensorWeight: 0.5},
+	// strongly prefers cloud-free scenes, and will not take very cloudy ones
+	"clear": {CloudWeight: 2, MaxCloudCover: 30, AgeWeight: 0.05, Pre2015Penalty: 0.5,
+		TideWeight: math.Sqrt(0.1), TideStage: "high", DateWindowWeight: 1, SensorWeight: 0.5},
+	// strongly prefers the newest scenes
+	"recent": {CloudWeight: 1, MaxCloudCover: 100, AgeWeight: 0.5, Pre2015Penalty: 1,
+		TideWeight: math.Sqrt(0.1), TideStage: "high", DateWindowWeight: 1, SensorWeight: 0.5},
+	// for mapping the low water line
+	"lowTide": {CloudWeight: 1, MaxCloudCover: 100, AgeWeight: 0.1, Pre2015Penalty: 0.5,
+		TideWeight: 1, TideStage: "low", DateWindowWeight: 1, SensorWeight: 0.5},
+	// for mapping the high water line
+	"highTide": {CloudWeight: 1, MaxCloudCover: 100, AgeWeight: 0.1, Pre2015Penalty: 0.5,
+		TideWeight: 1, TideStage: "high", DateWindowWeight: 1, SensorWeight: 0.5},
+}
+
+// UnmarshalJSON starts from the named preset, and overrides it with
+// whichever fields are given.
+func (policy *scoringPolicy) UnmarshalJSON(byts []byte) error {
+	type plainPolicy scoringPolicy
+	var named struct {
+		Preset string `json:"preset"`
+	}
+	if err := json.Unmarshal(byts, &named); err != nil {
+		return err
+	}
+	base, err := scoringPreset(named.Preset)
+	if err != nil {
+		return err
+	}
+	result := plainPolicy(*base)
+	if err = json.Unmarshal(byts, &result); err != nil {
+		return err
+	}
+	*policy = scoringPolicy(result)
+	return policy.validate()
+}
+
+// scoringPreset returns a copy of the named preset.  An empty name gives
+// the default.
+func scoringPreset(name string) (*scoringPolicy, error) {
+	if name == "" {
+		name = defaultScoringPreset
+	}
+	preset, ok := scoringPresets[name]
+	if !ok {
+		var names []string
+		for key := range scoringPresets {
+			names = append(names, key)
+		}
+		sort.Strings(names)
+		return nil, pzsvc.ErrWithTrace(fmt.Sprintf(`Unknown scoring preset "%s".  Presets are: %s.`, name, strings.Join(names, ", ")))
+	}
+	preset.Preset = name
+	return &preset, nil
+}
+
+// scoringPolicyOrDefault returns the given policy, or the default preset
+// if there is none.
+func scoringPolicyOrDefault(policy *scoringPolicy) *scoringPolicy {
+	if policy == nil {
+		policy, _ = scoringPreset(defaultScoringPreset)
+	}
+	return policy
+}
+
+func (policy *scoringPolicy) validate() error {
+	switch policy.TideStage {
+	case "low", "mid", "high":
+	default:
+		return pzsvc.ErrWithTrace(`tideStage must be "low", "mid" or "high".  Received "` + policy.TideStage + `".`)
+	}
+	for _, dateStr := range []string{policy.PreferredStart, policy.PreferredEnd} {
+		if _, err := parseScoringDate(dateStr); dateStr != "" && err != nil {
+			return pzsvc.ErrWithTrace("Invalid preferred date " + dateStr + ".  Use RFC 3339 or YYYY-MM-DD.")
+		}
+	}
+	return nil
+}
+
+func parseScoringDate(dateStr string) (time.Time, error) {
+	if result, err := time.Parse(time.RFC3339, dateStr); err == nil {
+		return result, nil
+	}
+	return time.Parse("2006-01-02", dateStr)
+}
+
+var date2015 = time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// Reasons that a policy will not consider a scene
+const (
+	rejectInvalid    = "invalidMetadata"
+	rejectCloudCover = "tooCloudy"
+	rejectDateWindow = "outsideDateWindow"
+)
+
+// sceneRejection is the error for a scene that a policy will not consider
+// at all.  The reason is one of the reject constants.
+type sceneRejection struct {
+	reason string
+	err    error
+}
+
+func (rejection sceneRejection) Error() string {
+	return rejection.err.Error()
+}
+
+// rejectionReason returns the reason for the given scoring error.
+func rejectionReason(err error) string {
+	if rejection, ok := err.(sceneRejection); ok {
+		return rejection.reason
+	}
+	return rejectInvalid
+}
+
+// score computes the score of the given scene under this policy, along
+// with the amount that each factor contributed to it.  It returns an error
+// if the scene is not eligible at all.
+func (policy *scoringPolicy) score(scene *geojson.Feature, now time.Time) (float64, map[string]float64, error) {
+	breakdown := map[string]float64{"base": 1}
+
+	acquiredDateString := scene.PropertyString("acquiredDate")
+	acquiredDate, err := time.Parse(time.RFC3339, acquiredDateString)
+	if err != nil {
+		return 0, nil, sceneRejection{rejectInvalid, pzsvc.ErrWithTrace("Received invalid date of " + acquiredDateString)}
+	}
+
+	cloudCover := scene.PropertyFloat("cloudCover")
+	if math.IsNaN(cloudCover) {
+		cloudCover = 100 // unknown cloud cover is assumed to be the worst
+	}
+	if cloudCover > policy.MaxCloudCover {
+		return 0, nil, sceneRejection{rejectCloudCover, pzsvc.ErrWithTrace(fmt.Sprintf("Cloud cover of %v exceeds the maximum of %v.", cloudCover, policy.MaxCloudCover))}
+	}
+	breakdown["cloudCover"] = -policy.CloudWeight * math.Sqrt(math.Max(cloudCover, 0)/100.0)
+
+	ageYears := math.Max(now.Sub(acquiredDate).Hours()/(24*365), 0)
+	breakdown["age"] = -policy.AgeWeight * ageYears
+	if acquiredDate.Before(date2015) {
+		breakdown["pre2015"] = -policy.Pre2015Penalty
+	}
+
+	// how far the tide was from the preferred stage, from 0 to 1
+	tideMiss := 1.0
+	currTide := scene.PropertyFloat("CurrentTide")
+	minTide := scene.PropertyFloat("24hrMinTide")
+	maxTide := scene.PropertyFloat("24hrMaxTide")
+	if stage := (currTide - minTide) / (maxTide - minTide); !math.IsNaN(stage) && !math.IsInf(stage, 0) {
+		stage = math.Max(0, math.Min(1, stage))
+		switch policy.TideStage {
+		case "low":
+			tideMiss = stage
+		case "mid":
+			tideMiss = math.Abs(2*stage - 1)
+		default:
+			tideMiss = 1 - stage
+		}
+	}
+	breakdown["tide"] = -policy.TideWeight * tideMiss
+
+	if policy.PreferredStart != "" || policy.PreferredEnd != "" {
+		outside := false
+		if start, err := parseScoringDate(policy.PreferredStart); err == nil && acquiredDate.Before(start) {
+			outside = true
+		}
+		if end, err := parseScoringDate(policy.PreferredEnd); err == nil && acquiredDate.After(end) {
+			outside = true
+		}
+		if outside && policy.DateWindowRequired {
+			return 0, nil, sceneRejection{rejectDateWindow, pzsvc.ErrWithTrace("Acquired date of " + acquiredDateString + " is outside of the preferred dates.")}
+		}
+		breakdown["dateWindow"] = 0
+		if outside {
+			breakdown["dateWindow"] = -policy.DateWindowWeight
+		}
+	}
+
+	if len(policy.PreferredSensors) > 0 {
+		breakdown["sensor"] = -policy.SensorWeight
+		sensorName := scene.PropertyString("sensorName")
+		for _, preferred := range policy.PreferredSensors {
+			if strings.EqualFold(preferred, sensorName) {
+				breakdown["sensor"] = 0
+			}
+		}
+	}
+
+	result := 0.0
+	for _, val := range breakdown {
+		result += val
+	}
+	return result, breakdown, nil
+}
+
+// setScore records the score of the scene, and how it was reached, in
+// its properties.  The breakdown is kept in flat "score.*" properties so
+// that it survives ingestion into Piazza.
+func setScore(scene *geojson.Feature, policy *scoringPolicy, score float64, breakdown map[string]float64) {
+	scene.Properties["score"] = score
+	scene.Properties["score.policy"] = policy.Preset
+	for key, val := range breakdown {
+		scene.Properties["score."+key] = val
+	}
+}
+
+// ByScore allows for sorting of features by their scores under a policy.
+// Scenes that the policy rejects sort first.
+type ByScore struct {
+	Features []*geojson.Feature
+	policy   *scoringPolicy
+	now      time.Time
+}
+
+func (a ByScore) Len() int {
+	return len(a.Features)
+}
+func (a ByScore) Swap(i, j int) {
+	a.Features[i], a.Features[j] = a.Features[j], a.Features[i]
+}
+func (a ByScore) Less(i, j int) bool {
+	return a.scoreOf(a.Features[i]) < a.scoreOf(a.Features[j])
+}
+func (a ByScore) scoreOf(scene *geojson.Feature) float64 {
+	score, _, err := a.policy.score(scene, a.now)
+	if err != nil {
+		return math.Inf(-1)
+	}
+	return score
+}
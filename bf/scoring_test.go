@@ -0,0 +1,115 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bf
+
+import (
+	"encoding/json"
+	"math"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/venicegeo/geojson-go/geojson"
+)
+
+func scoringScene(id, acquired string, cloudCover float64, sensor string, tide float64) *geojson.Feature {
+	return geojson.NewFeature(nil, id, map[string]interface{}{
+		"acquiredDate": acquired,
+		"cloudCover":   cloudCover,
+		"sensorName":   sensor,
+		"CurrentTide":  tide,
+		"24hrMinTide":  0.0,
+		"24hrMaxTide":  1.0})
+}
+
+func TestScoringPolicyJSON(t *testing.T) {
+	var inpObj asInpStruct
+	if err := json.Unmarshal([]byte(`{"scoring":{"preset":"clear","maxCloudCover":20}}`), &inpObj); err != nil {
+		t.Fatal(`TestScoringPolicyJSON: ` + err.Error())
+	}
+	policy := inpObj.Scoring
+	if policy.Preset != "clear" || policy.MaxCloudCover != 20 || policy.CloudWeight != 2 || policy.TideStage != "high" {
+		t.Errorf(`TestScoringPolicyJSON: unexpected policy %#v`, policy)
+	}
+	if err := json.Unmarshal([]byte(`{"tideStage":"mid"}`), policy); err != nil || policy.Preset != defaultScoringPreset || policy.TideStage != "mid" {
+		t.Errorf(`TestScoringPolicyJSON: override of default gave %#v, %v`, policy, err)
+	}
+	for _, bad := range []string{`{"preset":"nonesuch"}`, `{"tideStage":"ebb"}`, `{"preferredStart":"last week"}`} {
+		if err := json.Unmarshal([]byte(bad), new(scoringPolicy)); err == nil {
+			t.Errorf(`TestScoringPolicyJSON: accepted %s`, bad)
+		}
+	}
+}
+
+func TestScoringPolicyScore(t *testing.T) {
+	now := time.Date(2016, 7, 1, 0, 0, 0, 0, time.UTC)
+	policy, _ := scoringPreset("highTide")
+	scene := scoringScene("a", "2016-01-01T00:00:00Z", 25, "Landsat8", 0.75)
+
+	score, breakdown, err := policy.score(scene, now)
+	if err != nil {
+		t.Fatal(`TestScoringPolicyScore: ` + err.Error())
+	}
+	sum := 0.0
+	for _, val := range breakdown {
+		sum += val
+	}
+	if math.Abs(sum-score) > 1e-9 {
+		t.Errorf(`TestScoringPolicyScore: breakdown %v does not sum to %v`, breakdown, score)
+	}
+	if math.Abs(breakdown["cloudCover"]+0.5) > 1e-9 || math.Abs(breakdown["tide"]+0.25) > 1e-9 {
+		t.Errorf(`TestScoringPolicyScore: unexpected breakdown %v`, breakdown)
+	}
+	if _, ok := breakdown["pre2015"]; ok {
+		t.Errorf(`TestScoringPolicyScore: 2016 scene was penalized as pre-2015.`)
+	}
+
+	policy.TideStage = "low"
+	if _, breakdown, _ = policy.score(scene, now); math.Abs(breakdown["tide"]+0.75) > 1e-9 {
+		t.Errorf(`TestScoringPolicyScore: low tide stage gave %v`, breakdown["tide"])
+	}
+	policy.TideStage = "mid"
+	if _, breakdown, _ = policy.score(scene, now); math.Abs(breakdown["tide"]+0.5) > 1e-9 {
+		t.Errorf(`TestScoringPolicyScore: mid tide stage gave %v`, breakdown["tide"])
+	}
+
+	policy.PreferredStart = "2016-02-01"
+	policy.PreferredSensors = []string{"Sentinel-2"}
+	if _, breakdown, _ = policy.score(scene, now); breakdown["dateWindow"] != -policy.DateWindowWeight || breakdown["sensor"] != -policy.SensorWeight {
+		t.Errorf(`TestScoringPolicyScore: preferences gave %v`, breakdown)
+	}
+
+	policy.MaxCloudCover = 10
+	if _, _, err = policy.score(scene, now); err == nil {
+		t.Errorf(`TestScoringPolicyScore: scene over maxCloudCover was scored.`)
+	}
+}
+
+func TestByScore(t *testing.T) {
+	now := time.Date(2016, 7, 1, 0, 0, 0, 0, time.UTC)
+	features := []*geojson.Feature{
+		scoringScene("cloudy", "2016-06-01T00:00:00Z", 80, "Landsat8", 1),
+		scoringScene("old", "2013-06-01T00:00:00Z", 0, "Landsat8", 1),
+		scoringScene("best", "2016-06-01T00:00:00Z", 0, "Landsat8", 1),
+		scoringScene("bad", "not a date", 0, "Landsat8", 1)}
+	sort.Sort(ByScore{Features: features, policy: scoringPolicyOrDefault(nil), now: now})
+	order := ""
+	for _, feature := range features {
+		order += feature.IDStr() + " "
+	}
+	if order != "bad cloudy old best " {
+		t.Errorf(`TestByScore: unexpected order %s`, order)
+	}
+}
@@ -0,0 +1,255 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bf
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/venicegeo/geojson-go/geojson"
+	"github.com/venicegeo/pzsvc-lib"
+)
+
+/*
+Stitching joins the pieces of shoreline that assembly cuts apart at
+footprint boundaries.  Wherever the ends of two lines are within the
+tolerance of one another, the closest such pairs first, the lines are
+joined end to end, meeting at the point halfway between the two ends.  A
+line whose two ends meet is closed into a ring.  Each resulting line
+records the scenes that it was made from in its "sceneIds" property, as a
+comma-separated list so that it survives ingestion into Piazza.
+
+Ends are found through a grid of cells at least the tolerance across, so
+that stitching takes time in proportion to the number of lines.
+*/
+
+// defaultStitchTolerance is how close, in meters, line ends must be to be
+// stitched if the input does not say: two Landsat pixels.
+const defaultStitchTolerance = 60
+
+// meters per degree of latitude, and of longitude at the equator
+const (
+	metersPerDegLat = 110574
+	metersPerDegLon = 111320
+)
+
+// stitchTolerance returns the stitching tolerance of the given input, in
+// meters, or an error if it is negative.
+func stitchTolerance(inpObj *asInpStruct) (float64, error) {
+	if inpObj.StitchTolerance == 0 {
+		return defaultStitchTolerance, nil
+	}
+	if inpObj.StitchTolerance < 0 {
+		return 0, pzsvc.ErrWithTrace(fmt.Sprintf("stitchTolerance must not be negative.  Received %v.", inpObj.StitchTolerance))
+	}
+	return inpObj.StitchTolerance, nil
+}
+
+// stitchChain is a line being built up from pieces.  Its ends are the
+// indexes of the piece ends (see stitchEnd) at its first and last points.
+type stitchChain struct {
+	coords     [][]float64
+	sceneIDs   map[string]bool
+	feature    *geojson.Feature // the first feature the line came from
+	start, end int
+	closed     bool
+}
+
+// stitchEnd is one end of one of the original pieces.
+type stitchEnd struct {
+	chain int
+	coord []float64
+	used  bool
+}
+
+type stitchPair struct {
+	a, b     int
+	distance float64
+}
+
+// byStitchDistance sorts pairs of ends from closest to farthest.
+type byStitchDistance []stitchPair
+
+func (a byStitchDistance) Len() int {
+	return len(a)
+}
+func (a byStitchDistance) Swap(i, j int) {
+	a[i], a[j] = a[j], a[i]
+}
+func (a byStitchDistance) Less(i, j int) bool {
+	return a[i].distance < a[j].distance
+}
+
+// stitchShorelines joins the given shoreline features wherever their ends
+// are within the tolerance, in meters, of one another.  sceneIDs gives the
+// scene that each feature came from.  The result has one LineString
+// feature for each joined line.
+func stitchShorelines(features []*geojson.Feature, sceneIDs []string, tolerance float64) []*geojson.Feature {
+	var (
+		chains []*stitchChain
+		ends   []stitchEnd
+		pairs  []stitchPair
+	)
+
+	// Break everything down into separate lines
+	for inx, feature := range features {
+		for _, line := range featureLines(feature.Geometry) {
+			if len(line) < 2 {
+				continue
+			}
+			chains = append(chains, &stitchChain{
+				coords:   line,
+				sceneIDs: map[string]bool{sceneIDs[inx]: true},
+				feature:  feature,
+				start:    len(ends),
+				end:      len(ends) + 1})
+			ends = append(ends,
+				stitchEnd{chain: len(chains) - 1, coord: line[0]},
+				stitchEnd{chain: len(chains) - 1, coord: line[len(line)-1]})
+		}
+	}
+
+	// Find every pair of ends that are close enough to join.  Cells are
+	// the tolerance tall, and at least the tolerance wide at every
+	// latitude we have, so close ends are always in neighboring cells.
+	maxLat := 0.0
+	for _, end := range ends {
+		maxLat = math.Max(maxLat, math.Abs(end.coord[1]))
+	}
+	cellLat := tolerance / metersPerDegLat
+	cellLon := tolerance / (metersPerDegLon * math.Max(math.Cos(maxLat*math.Pi/180), 0.01))
+	cell := func(coord []float64) [2]int {
+		return [2]int{int(math.Floor(coord[0] / cellLon)), int(math.Floor(coord[1] / cellLat))}
+	}
+	grid := make(map[[2]int][]int)
+	for inx, end := range ends {
+		key := cell(end.coord)
+		grid[key] = append(grid[key], inx)
+	}
+	for inx, end := range ends {
+		key := cell(end.coord)
+		for dx := -1; dx <= 1; dx++ {
+			for dy := -1; dy <= 1; dy++ {
+				for _, other := range grid[[2]int{key[0] + dx, key[1] + dy}] {
+					if other <= inx || other == inx^1 && len(chains[end.chain].coords) < 3 {
+						continue
+					}
+					if distance := groundDistance(end.coord, ends[other].coord); distance <= tolerance {
+						pairs = append(pairs, stitchPair{inx, other, distance})
+					}
+				}
+			}
+		}
+	}
+	sort.Stable(byStitchDistance(pairs))
+
+	// Join them, closest first.  Chains that are joined into others are
+	// left nil, and the ends that they had are pointed at the survivor.
+	for _, pair := range pairs {
+		if ends[pair.a].used || ends[pair.b].used {
+			continue
+		}
+		chainA, chainB := chains[ends[pair.a].chain], chains[ends[pair.b].chain]
+		mid := midpoint(ends[pair.a].coord, ends[pair.b].coord)
+		ends[pair.a].used, ends[pair.b].used = true, true
+		if chainA == chainB {
+			chainA.coords[0] = mid
+			chainA.coords[len(chainA.coords)-1] = mid
+			chainA.closed = true
+			continue
+		}
+		// Line A up to end at a, and B to start at b
+		if chainA.start == pair.a {
+			chainA.reverse()
+		}
+		if chainB.end == pair.b {
+			chainB.reverse()
+		}
+		chainA.coords[len(chainA.coords)-1] = mid
+		chainA.coords = append(chainA.coords, chainB.coords[1:]...)
+		chainA.end = chainB.end
+		for sceneID := range chainB.sceneIDs {
+			chainA.sceneIDs[sceneID] = true
+		}
+		survivor := ends[pair.a].chain
+		ends[chainB.end].chain = survivor
+		chains[ends[pair.b].chain] = nil
+	}
+
+	result := make([]*geojson.Feature, 0, len(chains))
+	for _, chain := range chains {
+		if chain == nil {
+			continue
+		}
+		var ids []string
+		for sceneID := range chain.sceneIDs {
+			ids = append(ids, sceneID)
+		}
+		sort.Strings(ids)
+		properties := make(map[string]interface{})
+		for key, val := range chain.feature.Properties {
+			properties[key] = val
+		}
+		properties["sceneIds"] = strings.Join(ids, ",")
+		result = append(result, geojson.NewFeature(geojson.NewLineString(chain.coords), chain.feature.ID, properties))
+	}
+	return result
+}
+
+func (chain *stitchChain) reverse() {
+	for i, j := 0, len(chain.coords)-1; i < j; i, j = i+1, j-1 {
+		chain.coords[i], chain.coords[j] = chain.coords[j], chain.coords[i]
+	}
+	chain.start, chain.end = chain.end, chain.start
+}
+
+// featureLines returns copies of the lines in the given GeoJSON geometry.
+func featureLines(input interface{}) [][][]float64 {
+	var result [][][]float64
+	copyLine := func(line [][]float64) [][]float64 {
+		return append([][]float64(nil), line...)
+	}
+	switch it := input.(type) {
+	case *geojson.LineString:
+		result = append(result, copyLine(it.Coordinates))
+	case *geojson.MultiLineString:
+		for _, line := range it.Coordinates {
+			result = append(result, copyLine(line))
+		}
+	case *geojson.GeometryCollection:
+		for _, geometry := range it.Geometries {
+			result = append(result, featureLines(geometry)...)
+		}
+	}
+	return result
+}
+
+// groundDistance is the approximate distance between two nearby points,
+// in meters.
+func groundDistance(a, b []float64) float64 {
+	cosLat := math.Cos((a[1] + b[1]) / 2 * math.Pi / 180)
+	dx := (a[0] - b[0]) * metersPerDegLon * cosLat
+	dy := (a[1] - b[1]) * metersPerDegLat
+	return math.Hypot(dx, dy)
+}
+
+func midpoint(a, b []float64) []float64 {
+	result := append([]float64(nil), a...)
+	result[0] = (a[0] + b[0]) / 2
+	result[1] = (a[1] + b[1]) / 2
+	return result
+}
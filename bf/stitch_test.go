@@ -0,0 +1,73 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bf
+
+import (
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/venicegeo/geojson-go/geojson"
+)
+
+func TestStitchShorelines(t *testing.T) {
+	line := func(id string, coords ...[]float64) *geojson.Feature {
+		return geojson.NewFeature(geojson.NewLineString(coords), id, map[string]interface{}{"name": id})
+	}
+	// a is cut at a footprint boundary into a1 and a2, which is written
+	// backward; b is far away; c is a ring broken open.
+	features := []*geojson.Feature{
+		line("a1", []float64{0, 0}, []float64{0.001, 0}, []float64{0.002, 0}),
+		line("b", []float64{1, 1}, []float64{1.001, 1}),
+		line("a2", []float64{0.004, 0}, []float64{0.003, 0}, []float64{0.0022, 0}),
+		line("c", []float64{2, 2}, []float64{2.001, 2}, []float64{2.001, 2.001}, []float64{2.0001, 2})}
+	sceneIDs := []string{"landsat:A", "landsat:A", "landsat:B", "landsat:C"}
+
+	result := stitchShorelines(features, sceneIDs, 60)
+	if len(result) != 3 {
+		t.Fatalf(`TestStitchShorelines: expected 3 lines, got %d`, len(result))
+	}
+	stitched := result[0].Geometry.(*geojson.LineString).Coordinates
+	expected := [][]float64{{0, 0}, {0.001, 0}, {0.0021, 0}, {0.003, 0}, {0.004, 0}}
+	if len(stitched) != len(expected) {
+		t.Fatalf(`TestStitchShorelines: expected %v, got %v`, expected, stitched)
+	}
+	for inx, coord := range expected {
+		if math.Abs(stitched[inx][0]-coord[0]) > 1e-12 || stitched[inx][1] != coord[1] {
+			t.Errorf(`TestStitchShorelines: expected %v, got %v`, expected, stitched)
+		}
+	}
+	if ids := result[0].PropertyString("sceneIds"); ids != "landsat:A,landsat:B" {
+		t.Errorf(`TestStitchShorelines: expected sceneIds of landsat:A,landsat:B, got %s`, ids)
+	}
+	if result[0].PropertyString("name") != "a1" || result[1].PropertyString("sceneIds") != "landsat:A" {
+		t.Errorf(`TestStitchShorelines: unexpected properties %v, %v`, result[0].Properties, result[1].Properties)
+	}
+	ring := result[2].Geometry.(*geojson.LineString).Coordinates
+	if !reflect.DeepEqual(ring[0], ring[len(ring)-1]) {
+		t.Errorf(`TestStitchShorelines: expected a closed ring, got %v`, ring)
+	}
+	if features[0].Geometry.(*geojson.LineString).Coordinates[2][0] != 0.002 {
+		t.Error(`TestStitchShorelines: the input was modified.`)
+	}
+
+	// Nothing is within a meter
+	if result = stitchShorelines(features, sceneIDs, 1); len(result) != 4 {
+		t.Errorf(`TestStitchShorelines: expected nothing to be stitched, got %d lines`, len(result))
+	}
+	if _, err := stitchTolerance(&asInpStruct{StitchTolerance: -5}); err == nil {
+		t.Error(`TestStitchShorelines: accepted a negative tolerance.`)
+	}
+}
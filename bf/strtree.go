@@ -0,0 +1,176 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bf
+
+import (
+	"math"
+	"sort"
+
+	"github.com/venicegeo/geojson-go/geojson"
+)
+
+// strNodeCapacity is the most children that a node of an STR tree has.
+const strNodeCapacity = 10
+
+// envelope is a bounding box: minx, miny, maxx, maxy.
+type envelope [4]float64
+
+func (env envelope) intersects(other envelope) bool {
+	return env[0] <= other[2] && other[0] <= env[2] && env[1] <= other[3] && other[1] <= env[3]
+}
+
+func (env envelope) union(other envelope) envelope {
+	return envelope{math.Min(env[0], other[0]), math.Min(env[1], other[1]), math.Max(env[2], other[2]), math.Max(env[3], other[3])}
+}
+
+func (env envelope) centerX() float64 {
+	return (env[0] + env[2]) / 2
+}
+
+func (env envelope) centerY() float64 {
+	return (env[1] + env[3]) / 2
+}
+
+// envelopeOf returns the envelope of the given GeoJSON geometry, and false
+// if it has no coordinates.
+func envelopeOf(geometry interface{}) (envelope, bool) {
+	bbox := geojson.NewFeature(geometry, "", nil).ForceBbox()
+	if len(bbox) < 4 {
+		return envelope{}, false
+	}
+	// bounding boxes with elevation run minx,miny,minz,maxx,maxy,maxz
+	half := len(bbox) / 2
+	return envelope{bbox[0], bbox[1], bbox[half], bbox[half+1]}, true
+}
+
+// strTree is a read-only R-tree, bulk loaded by Sort-Tile-Recursive:
+// items are sorted into vertical slices by x, and then into nodes by y
+// within each slice, level by level up to the root.  Searching it takes
+// time in proportion to the log of the number of items, plus the number
+// found.
+type strTree struct {
+	root *strNode
+}
+
+type strNode struct {
+	env      envelope
+	children []*strNode
+	item     int // index of the item, for leaves
+}
+
+// newSTRTree builds a tree over the given envelopes.  Items are known by
+// their indexes in envs.
+func newSTRTree(envs []envelope) *strTree {
+	if len(envs) == 0 {
+		return &strTree{}
+	}
+	level := make([]*strNode, len(envs))
+	for inx, env := range envs {
+		level[inx] = &strNode{env: env, item: inx}
+	}
+	for len(level) > 1 {
+		level = strPack(level)
+	}
+	return &strTree{root: level[0]}
+}
+
+// strPack groups one level of nodes into the next level up.
+func strPack(nodes []*strNode) []*strNode {
+	var result []*strNode
+	parentCount := int(math.Ceil(float64(len(nodes)) / strNodeCapacity))
+	sliceCount := int(math.Ceil(math.Sqrt(float64(parentCount))))
+	sliceSize := sliceCount * strNodeCapacity
+
+	sort.Sort(strNodesByX(nodes))
+	for start := 0; start < len(nodes); start += sliceSize {
+		slice := nodes[start:minInt(start+sliceSize, len(nodes))]
+		sort.Sort(strNodesByY(slice))
+		for nstart := 0; nstart < len(slice); nstart += strNodeCapacity {
+			children := slice[nstart:minInt(nstart+strNodeCapacity, len(slice))]
+			parent := &strNode{env: children[0].env, children: append([]*strNode(nil), children...), item: -1}
+			for _, child := range children[1:] {
+				parent.env = parent.env.union(child.env)
+			}
+			result = append(result, parent)
+		}
+	}
+	return result
+}
+
+// bounds returns the envelope of everything in the tree, and false if it
+// is empty.
+func (tree *strTree) bounds() (envelope, bool) {
+	if tree.root == nil {
+		return envelope{}, false
+	}
+	return tree.root.env, true
+}
+
+// query returns the indexes of the items whose envelopes intersect the
+// given one, in ascending order.
+func (tree *strTree) query(env envelope) []int {
+	var (
+		result []int
+		search func(node *strNode)
+	)
+	search = func(node *strNode) {
+		if !node.env.intersects(env) {
+			return
+		}
+		if node.children == nil {
+			result = append(result, node.item)
+			return
+		}
+		for _, child := range node.children {
+			search(child)
+		}
+	}
+	if tree.root != nil {
+		search(tree.root)
+	}
+	sort.Ints(result)
+	return result
+}
+
+type strNodesByX []*strNode
+
+func (a strNodesByX) Len() int {
+	return len(a)
+}
+func (a strNodesByX) Swap(i, j int) {
+	a[i], a[j] = a[j], a[i]
+}
+func (a strNodesByX) Less(i, j int) bool {
+	return a[i].env.centerX() < a[j].env.centerX()
+}
+
+type strNodesByY []*strNode
+
+func (a strNodesByY) Len() int {
+	return len(a)
+}
+func (a strNodesByY) Swap(i, j int) {
+	a[i], a[j] = a[j], a[i]
+}
+func (a strNodesByY) Less(i, j int) bool {
+	return a[i].env.centerY() < a[j].env.centerY()
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,61 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bf
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+
+	"github.com/venicegeo/geojson-go/geojson"
+)
+
+func TestSTRTree(t *testing.T) {
+	if found := newSTRTree(nil).query(envelope{-180, -90, 180, 90}); len(found) != 0 {
+		t.Errorf(`TestSTRTree: empty tree found %v`, found)
+	}
+	random := rand.New(rand.NewSource(1))
+	for _, count := range []int{1, 9, 10, 11, 101, 1000} {
+		envs := make([]envelope, count)
+		for inx := range envs {
+			x, y := random.Float64()*100, random.Float64()*100
+			envs[inx] = envelope{x, y, x + random.Float64()*5, y + random.Float64()*5}
+		}
+		tree := newSTRTree(envs)
+		for query := 0; query < 50; query++ {
+			x, y := random.Float64()*100, random.Float64()*100
+			env := envelope{x, y, x + random.Float64()*20, y + random.Float64()*20}
+			var expected []int
+			for inx, curr := range envs {
+				if curr.intersects(env) {
+					expected = append(expected, inx)
+				}
+			}
+			if found := tree.query(env); !reflect.DeepEqual(found, expected) {
+				t.Errorf(`TestSTRTree: %d items, query %v: expected %v, got %v`, count, env, expected, found)
+			}
+		}
+	}
+}
+
+func TestEnvelopeOf(t *testing.T) {
+	line := geojson.NewLineString([][]float64{{1, 5, 10}, {3, 2, 20}, {2, 4, 30}})
+	if env, ok := envelopeOf(line); !ok || env != (envelope{1, 2, 3, 5}) {
+		t.Errorf(`TestEnvelopeOf: expected [1 2 3 5], got %v %v`, env, ok)
+	}
+	if _, ok := envelopeOf(geojson.NewLineString(nil)); ok {
+		t.Errorf(`TestEnvelopeOf: expected no envelope for an empty line`)
+	}
+}
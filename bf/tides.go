@@ -15,12 +15,15 @@
 package bf
 
 import (
+	"context"
+	"encoding/json"
 	"log"
 	"math"
+	"os"
+	"strings"
 	"time"
 
 	"github.com/venicegeo/geojson-go/geojson"
-	"github.com/venicegeo/pzsvc-image-catalog/catalog"
 	"github.com/venicegeo/pzsvc-lib"
 )
 
@@ -51,6 +54,111 @@ type tidesOut struct {
 	Locations []tideWrapper `json:"locations"`
 }
 
+// tideProvider is anything that can give us tide predictions.  tide
+// handles a single location, and tides handles several at once.  Either
+// way, the outputs should be the same regardless of which provider
+// produced them.
+type tideProvider interface {
+	tide(ctx context.Context, inp tideIn) (*tideOut, error)
+	tides(ctx context.Context, inp *tidesIn) (*tidesOut, error)
+}
+
+// remoteTides calls out to a tide prediction service in the
+// format of github.com/venicegeo/bf_TidePrediction
+type remoteTides struct {
+	url string
+}
+
+func (rt remoteTides) tide(ctx context.Context, inp tideIn) (*tideOut, error) {
+	var result tideOut
+	if err := rt.request(ctx, inp, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func (rt remoteTides) tides(ctx context.Context, inp *tidesIn) (*tidesOut, error) {
+	var result tidesOut
+	if err := rt.request(ctx, inp, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// request posts the given input to the tide service, and reads its
+// response into outpObj.
+func (rt remoteTides) request(ctx context.Context, inpObj, outpObj interface{}) error {
+	byts, err := json.Marshal(inpObj)
+	if err != nil {
+		return pzsvc.TraceErr(err)
+	}
+	if _, err = requestKnownJSONCtx(ctx, "POST", string(byts), rt.url, "", outpObj); err != nil {
+		return pzsvc.TraceErr(err)
+	}
+	return nil
+}
+
+// fallbackTides uses its primary provider where it can, and drops
+// back to the secondary one when the primary fails.
+type fallbackTides struct {
+	primary, secondary tideProvider
+}
+
+func (ft fallbackTides) tide(ctx context.Context, inp tideIn) (*tideOut, error) {
+	result, err := ft.primary.tide(ctx, inp)
+	if err != nil && ctx.Err() == nil {
+		log.Print(pzsvc.TraceStr("Primary tide provider failed.  Falling back.  Error: " + err.Error()))
+		return ft.secondary.tide(ctx, inp)
+	}
+	return result, err
+}
+
+func (ft fallbackTides) tides(ctx context.Context, inp *tidesIn) (*tidesOut, error) {
+	result, err := ft.primary.tides(ctx, inp)
+	if err != nil && ctx.Err() == nil {
+		log.Print(pzsvc.TraceStr("Primary tide provider failed.  Falling back.  Error: " + err.Error()))
+		return ft.secondary.tides(ctx, inp)
+	}
+	return result, err
+}
+
+// getTideProvider works out what provider to use from the tide address
+// given in a request.  "harmonic" uses the local harmonic predictor, with
+// the constituent table at BFH_TIDE_TABLE.  Requests cannot name a table
+// of their own, as that would let them open whatever file they liked.
+// Anything else is taken as the URL of a tide service.  In that case, if
+// there is a table at BFH_TIDE_TABLE, we fall back on it when the service
+// fails.  An empty address means no tides at all, and returns nil.
+func getTideProvider(tideAddr string) (tideProvider, error) {
+	var (
+		ht  *harmonicTides
+		err error
+	)
+	tablePath := os.Getenv("BFH_TIDE_TABLE")
+	switch {
+	case tideAddr == "":
+		return nil, nil
+	case strings.HasPrefix(tideAddr, "harmonic:"):
+		return nil, pzsvc.ErrWithTrace(`Tide address must be "harmonic" or a URL.  Constituent tables are set on the server, through BFH_TIDE_TABLE.`)
+	case tideAddr == "harmonic":
+		if tablePath == "" {
+			return nil, pzsvc.ErrWithTrace("Harmonic tides requested, but no constituent table given.  Set BFH_TIDE_TABLE.")
+		}
+		if ht, err = loadHarmonicTides(tablePath); err != nil {
+			return nil, err
+		}
+		return ht, nil
+	case tablePath != "":
+		if ht, err = loadHarmonicTides(tablePath); err != nil {
+			log.Print(pzsvc.TraceStr("Could not load fallback tide table: " + err.Error()))
+			return remoteTides{url: tideAddr}, nil
+		}
+		return fallbackTides{primary: remoteTides{url: tideAddr}, secondary: ht}, nil
+	default:
+		return remoteTides{url: tideAddr}, nil
+	}
+}
+
 func findTide(bbox geojson.BoundingBox, timeStr string) *tideIn {
 	var (
 		center  *geojson.Point
@@ -96,7 +204,7 @@ func updateSceneTide(scene *geojson.Feature, inpObj tideOut) {
 	properties["24hrMinTide"] = inpObj.MinTide
 	properties["24hrMaxTide"] = inpObj.MaxTide
 
-	if err := catalog.SaveFeatureProperties(scene.IDStr(), properties); err != nil {
+	if err := sceneCatalog.SaveFeatureProperties(scene.IDStr(), properties); err != nil {
 		log.Print(pzsvc.TraceStr("Failed to update feature " + scene.IDStr() + " with tide information: " + err.Error()))
 	}
 }
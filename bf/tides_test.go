@@ -0,0 +1,98 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bf
+
+import (
+	"context"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testTideTable = `{"maxDistance":50, "stations":[
+	{"name":"Test Station", "lat":35.2, "lon":-75.6, "datum":0.5,
+	 "constituents":[{"name":"M2", "amplitude":1.0, "phase":0.0}]}]}`
+
+func writeTestTideTable(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "bf-tides")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	path := filepath.Join(dir, "tides.json")
+	if err = ioutil.WriteFile(path, []byte(testTideTable), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	return path
+}
+
+func TestHarmonicTides(t *testing.T) {
+	path := writeTestTideTable(t)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	defer os.Setenv("BFH_TIDE_TABLE", os.Getenv("BFH_TIDE_TABLE"))
+	os.Setenv("BFH_TIDE_TABLE", path)
+	tides, err := getTideProvider("harmonic")
+	if err != nil {
+		t.Fatal(`TestHarmonicTides: could not load table: ` + err.Error())
+	}
+	out, err := tides.tide(context.Background(), tideIn{Lat: 35.21, Lon: -75.61, Dtg: "2016-10-17-23-52"})
+	if err != nil {
+		t.Fatal(`TestHarmonicTides: failed on what should have been a good run: ` + err.Error())
+	}
+	// A single M2 constituent swings through its full range within 24 hours
+	if math.Abs(out.MinTide+0.5) > 0.1 || math.Abs(out.MaxTide-1.5) > 0.1 {
+		t.Errorf(`TestHarmonicTides: unexpected range %v to %v`, out.MinTide, out.MaxTide)
+	}
+	if out.CurrTide < out.MinTide || out.CurrTide > out.MaxTide {
+		t.Errorf(`TestHarmonicTides: current tide %v outside of range`, out.CurrTide)
+	}
+
+	outs, err := tides.tides(context.Background(), &tidesIn{Locations: []tideIn{{Lat: 35.21, Lon: -75.61, Dtg: "2016-10-17-23-52"}}})
+	if err != nil || len(outs.Locations) != 1 || outs.Locations[0].Results != *out {
+		t.Error(`TestHarmonicTides: batch prediction did not match single prediction.`)
+	}
+
+	if _, err = tides.tide(context.Background(), tideIn{Lat: 0, Lon: 0, Dtg: "2016-10-17-23-52"}); err == nil {
+		t.Error(`TestHarmonicTides: passed on what should have been an out-of-range failure.`)
+	}
+
+	// a location out of range is left out, rather than failing the rest
+	outs, err = tides.tides(context.Background(), &tidesIn{Locations: []tideIn{
+		{Lat: 0, Lon: 0, Dtg: "2016-10-17-23-50"}, {Lat: 35.21, Lon: -75.61, Dtg: "2016-10-17-23-52"}}})
+	if err != nil || len(outs.Locations) != 1 || outs.Locations[0].Dtg != "2016-10-17-23-52" {
+		t.Errorf(`TestHarmonicTides: unexpected batch prediction with a location out of range: %v, %v.`, outs, err)
+	}
+}
+
+func TestGetTideProvider(t *testing.T) {
+	if tides, err := getTideProvider(""); tides != nil || err != nil {
+		t.Error(`TestGetTideProvider: expected no provider for an empty address.`)
+	}
+	if tides, _ := getTideProvider("https://tideprediction.io/"); tides == nil {
+		t.Error(`TestGetTideProvider: expected a remote provider.`)
+	}
+	path := writeTestTideTable(t)
+	defer os.RemoveAll(filepath.Dir(path))
+	if _, err := getTideProvider("harmonic:" + path); err == nil {
+		t.Error(`TestGetTideProvider: loaded a constituent table named in the request.`)
+	}
+	defer os.Setenv("BFH_TIDE_TABLE", os.Getenv("BFH_TIDE_TABLE"))
+	os.Setenv("BFH_TIDE_TABLE", "/no/such/table.json")
+	if _, err := getTideProvider("harmonic"); err != errTideTable {
+		t.Errorf(`TestGetTideProvider: unexpected error for a missing table: %v.`, err)
+	}
+}
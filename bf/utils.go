@@ -15,9 +15,15 @@
 package bf
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/venicegeo/pzsvc-lib"
 )
@@ -44,4 +50,80 @@ func jsonEscString(modString string) string {
 	modString = strings.Replace(modString, `\`, `\\`, -1)
 	modString = strings.Replace(modString, `"`, `\"`, -1)
 	return modString
-}
\ No newline at end of file
+}
+
+// awaitCtx makes the given call, but stops waiting for it if the context
+// is cancelled first.  Many upstream calls go through pzsvc-lib, which
+// cannot be interrupted, so an abandoned call carries on in the background
+// and its results are dropped; the caller must not touch anything the call
+// writes to once it has been abandoned.  awaitCtx returns ctx.Err() if and
+// only if it abandoned the call.
+func awaitCtx(ctx context.Context, call func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() { done <- call() }()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// upstreamClient is the client for the upstream calls that bf-handle makes
+// itself rather than through pzsvc-lib, so that they can be cancelled
+// through their request contexts.  There is no overall timeout, since a
+// large file may legitimately take a long time to move, but connecting and
+// waiting for a response are bounded.
+var upstreamClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		Dial: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second}).Dial,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 5 * time.Minute,
+		ExpectContinueTimeout: time.Second}}
+
+// requestKnownJSONCtx is pzsvc.RequestKnownJSON, except that the request
+// is dropped when the context is cancelled.  It sends bodyStr, if any, as
+// JSON, reads the JSON response into outpObj, and returns the response
+// body.
+func requestKnownJSONCtx(ctx context.Context, method, bodyStr, url, authKey string, outpObj interface{}) ([]byte, error) {
+	var body io.Reader
+	if bodyStr != "" {
+		body = strings.NewReader(bodyStr)
+	}
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, pzsvc.TraceErr(err)
+	}
+	req = req.WithContext(ctx)
+	if bodyStr != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if authKey != "" {
+		req.Header.Set("Authorization", authKey)
+	}
+	resp, err := upstreamClient.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, pzsvc.TraceErr(err)
+	}
+	defer resp.Body.Close()
+	byts, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, pzsvc.TraceErr(err)
+	}
+	if resp.StatusCode >= 300 {
+		return byts, pzsvc.ErrWithTrace(fmt.Sprintf("%v %v returned status %v.", method, url, resp.StatusCode))
+	}
+	if err = json.Unmarshal(byts, outpObj); err != nil {
+		return byts, pzsvc.TraceErr(err)
+	}
+	return byts, nil
+}
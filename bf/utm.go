@@ -0,0 +1,129 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bf
+
+import "math"
+
+// WGS84 ellipsoid and UTM constants
+const (
+	wgs84A      = 6378137.0
+	wgs84F      = 1 / 298.257223563
+	utmK0       = 0.9996
+	utmFalseE   = 500000.0
+	utmFalseNS  = 10000000.0
+	utmZoneSize = 6.0
+)
+
+// utmZoneFromEPSG picks the UTM zone and hemisphere out of an EPSG code.
+// WGS84 (326xx and 327xx) and NAD83 (269xx) UTM codes are recognized; the
+// difference between the NAD83 and WGS84 datums is well under a pixel
+// for our purposes.
+func utmZoneFromEPSG(epsg int) (zone int, north bool, ok bool) {
+	switch {
+	case epsg >= 32601 && epsg <= 32660:
+		return epsg - 32600, true, true
+	case epsg >= 32701 && epsg <= 32760:
+		return epsg - 32700, false, true
+	case epsg >= 26901 && epsg <= 26923:
+		return epsg - 26900, true, true
+	}
+	return 0, false, false
+}
+
+// utmToLatLon converts a UTM easting and northing, in meters, into a
+// latitude and longitude in degrees.  It follows Snyder's series
+// expansion, which is good to well under a meter within the zone.
+func utmToLatLon(easting, northing float64, zone int, north bool) (float64, float64) {
+	e2 := wgs84F * (2 - wgs84F)
+	ep2 := e2 / (1 - e2)
+	e1 := (1 - math.Sqrt(1-e2)) / (1 + math.Sqrt(1-e2))
+
+	x := easting - utmFalseE
+	y := northing
+	if !north {
+		y -= utmFalseNS
+	}
+	lon0 := float64(zone-1)*utmZoneSize - 180 + utmZoneSize/2
+
+	m := y / utmK0
+	mu := m / (wgs84A * (1 - e2/4 - 3*e2*e2/64 - 5*e2*e2*e2/256))
+	phi1 := mu +
+		(3*e1/2-27*math.Pow(e1, 3)/32)*math.Sin(2*mu) +
+		(21*e1*e1/16-55*math.Pow(e1, 4)/32)*math.Sin(4*mu) +
+		(151*math.Pow(e1, 3)/96)*math.Sin(6*mu) +
+		(1097*math.Pow(e1, 4)/512)*math.Sin(8*mu)
+
+	sinPhi, cosPhi, tanPhi := math.Sin(phi1), math.Cos(phi1), math.Tan(phi1)
+	n1 := wgs84A / math.Sqrt(1-e2*sinPhi*sinPhi)
+	t1 := tanPhi * tanPhi
+	c1 := ep2 * cosPhi * cosPhi
+	r1 := wgs84A * (1 - e2) / math.Pow(1-e2*sinPhi*sinPhi, 1.5)
+	d := x / (n1 * utmK0)
+
+	lat := phi1 - (n1*tanPhi/r1)*(d*d/2-
+		(5+3*t1+10*c1-4*c1*c1-9*ep2)*math.Pow(d, 4)/24+
+		(61+90*t1+298*c1+45*t1*t1-252*ep2-3*c1*c1)*math.Pow(d, 6)/720)
+	lon := (d -
+		(1+2*t1+c1)*math.Pow(d, 3)/6 +
+		(5-2*c1+28*t1-3*c1*c1+8*ep2+24*t1*t1)*math.Pow(d, 5)/120) / cosPhi
+
+	return lat * 180 / math.Pi, lon0 + lon*180/math.Pi
+}
+
+// utmZoneOf returns the UTM zone containing the given longitude, which
+// may be outside of -180 to 180.
+func utmZoneOf(lon float64) int {
+	zone := int(math.Floor((standardFrame.wrap(lon)+180)/utmZoneSize)) + 1
+	switch {
+	case zone < 1:
+		return 1
+	case zone > 60:
+		return 60
+	}
+	return zone
+}
+
+// latLonToUTM converts a latitude and longitude, in degrees, into a UTM
+// easting and northing in meters, the inverse of utmToLatLon.  Longitudes
+// may be given in any frame (see antimeridian.go).  Points on
+// the far side of the equator from the given hemisphere come out with
+// northings beyond its usual range, rather than being wrapped.
+func latLonToUTM(lat, lon float64, zone int, north bool) (float64, float64) {
+	e2 := wgs84F * (2 - wgs84F)
+	ep2 := e2 / (1 - e2)
+	lon0 := float64(zone-1)*utmZoneSize - 180 + utmZoneSize/2
+
+	phi := lat * math.Pi / 180
+	sinPhi, cosPhi, tanPhi := math.Sin(phi), math.Cos(phi), math.Tan(phi)
+	n := wgs84A / math.Sqrt(1-e2*sinPhi*sinPhi)
+	t := tanPhi * tanPhi
+	c := ep2 * cosPhi * cosPhi
+	a := cosPhi * (nearLon(lon, lon0) - lon0) * math.Pi / 180
+	m := wgs84A * ((1-e2/4-3*e2*e2/64-5*e2*e2*e2/256)*phi -
+		(3*e2/8+3*e2*e2/32+45*e2*e2*e2/1024)*math.Sin(2*phi) +
+		(15*e2*e2/256+45*e2*e2*e2/1024)*math.Sin(4*phi) -
+		(35*e2*e2*e2/3072)*math.Sin(6*phi))
+
+	easting := utmFalseE + utmK0*n*(a+
+		(1-t+c)*math.Pow(a, 3)/6+
+		(5-18*t+t*t+72*c-58*ep2)*math.Pow(a, 5)/120)
+	northing := utmK0 * (m + n*tanPhi*(a*a/2+
+		(5-t+9*c+4*c*c)*math.Pow(a, 4)/24+
+		(61-58*t+t*t+600*c-330*ep2)*math.Pow(a, 6)/720))
+	if !north {
+		northing += utmFalseNS
+	}
+	return easting, northing
+}
@@ -19,6 +19,7 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 
 	"github.com/venicegeo/bf-handle/bf"
@@ -30,6 +31,54 @@ func main() {
 
 	catalog.SetImageCatalogPrefix("pzsvc-image-catalog")
 
+	// For air-gapped use, scenes can come from a directory of
+	// GeoJSON files rather than from pzsvc-image-catalog.
+	if catalogDir := os.Getenv("BFH_LOCAL_CATALOG"); catalogDir != "" {
+		localCatalog, err := bf.NewLocalCatalog(catalogDir)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		bf.SetSceneCatalog(localCatalog)
+	}
+
+	// Likewise, results can be kept in a local directory rather
+	// than in Piazza.
+	var gateway bf.Gateway = bf.PzGateway{}
+	if gatewayDir := os.Getenv("BFH_LOCAL_GATEWAY"); gatewayDir != "" {
+		localGateway, err := bf.NewLocalGateway(gatewayDir)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		gateway = localGateway
+	}
+
+	// Asynch jobs can be kept in memory rather than in redis, for
+	// single-instance deployments.
+	if os.Getenv("BFH_JOB_STORE") == "memory" {
+		bf.SetJobStore(bf.NewMemoryJobStore())
+	}
+
+	// Submitters can be given a bigger or smaller share of the asynch
+	// workers, as "submitter=weight,submitter=weight", where a submitter is
+	// "anonymous" or the "pz-" hash of an auth token, without any sub-key.
+	if weightStr := os.Getenv("BFH_SUBMITTER_WEIGHTS"); weightStr != "" {
+		weights := make(map[string]float64)
+		for _, entry := range strings.Split(weightStr, ",") {
+			parts := strings.SplitN(entry, "=", 2)
+			if len(parts) != 2 {
+				log.Print(pzsvc.TraceStr("bad submitter weight: " + entry))
+				continue
+			}
+			weight, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+			if err != nil || weight <= 0 {
+				log.Print(pzsvc.TraceStr("bad submitter weight: " + entry))
+				continue
+			}
+			weights[strings.TrimSpace(parts[0])] = weight
+		}
+		bf.SetSubmitterWeights(weights)
+	}
+
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 
 		// sets up the CORS stuff and stops if it's a Preflighted OPTIONS request
@@ -48,17 +97,23 @@ func main() {
 
 		switch pathStrs[1] {
 		case "execute":
-			bf.Execute(w, r)
+			bf.Execute(w, r, gateway)
 		case "executeAsynch":
-			bf.HandleAsynch(w, r)
+			bf.HandleAsynch(w, r, gateway)
 		case "executeBatch":
-			bf.ExecuteBatch(w, r)
+			bf.HandleBatch(w, r, gateway)
 		case "prepareFootprints":
 			bf.PrepareFootprints(w, r)
 		case "assembleShorelines":
-			bf.AssembleShorelines(w, r)
+			bf.AssembleShorelines(w, r, gateway)
+		case "shorelineChange":
+			bf.ShorelineChange(w, r, gateway)
+		case "shorelineQA":
+			bf.ShorelineQA(w, r, gateway)
 		case "resultsByScene":
-			bf.ResultsByScene(w, r)
+			bf.ResultsByScene(w, r, gateway)
+		case "algorithms":
+			bf.Algorithms(w, r)
 
 		default:
 			pzsvc.HTTPOut(w, `{"Errors": "Command undefined.  Try help?",  "Given Path":"`+r.URL.Path+`"}`, http.StatusBadRequest)